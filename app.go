@@ -3,33 +3,78 @@ package main
 import (
 	"common/logging"
 	"common/models"
-	"common/utils"
+	"context"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"hash/fnv"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+	"transaction_service/applog"
+	"transaction_service/auth"
+	"transaction_service/clock"
 	"transaction_service/queries/transdb"
 	"transaction_service/queries/utils"
+	"transaction_service/ratelimit"
+	"transaction_service/sequencer"
+	"transaction_service/tracing"
 
 	"github.com/go-redis/redis"
 	"github.com/gorilla/mux"
-	"github.com/jackc/pgx"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Env struct {
+	log        *slog.Logger
 	logger     logging.Logger
 	tdb        transdb.TransactionDataStore
 	quoteCache *redis.Client
+	quotes     dbutils.QuoteProvider
 	databases  (map[int]transdb.TransactionDataStore)
 	logDB 	  	logging.LogDB
+	auth       *auth.Authenticator
+	limiter    ratelimit.Limiter
+	limits     map[ratelimit.Class]ratelimit.ClassLimits
+	clock      clock.Clock
+	// costBasis is how the databases match sales to lots.
+	costBasis transdb.CostBasis
+	// seq runs each user's commands in transaction order. nil disables it.
+	seq *sequencer.Sequencer
+
+	// requestTimeout bounds how long a single command may spend on
+	// database queries and quote server calls.
+	requestTimeout time.Duration
+	// scheduleInterval is how often main runs due recurring buys. 0
+	// turns the scheduler off.
+	scheduleInterval time.Duration
+	// triggerInterval is how often main runs the trigger engine, which
+	// executes triggers and orders and expires DAY orders. 0 turns it off.
+	triggerInterval time.Duration
+	// allowClearUsers lets clearUsers empty the databases. It is set by
+	// ALLOW_CLEAR_USERS and must stay off in production.
+	allowClearUsers bool
 }
 
+const defaultRequestTimeout = 5 * time.Second
+
+// reservationTimeout is how many seconds a buy or sell has to be committed.
+const reservationTimeout = 60
+
+// default sequencer options, see USER_QUEUE_* in the README
+var defaultSequencerOptions = sequencer.Options{Shards: 64, QueueSize: 100, Hold: 5 * time.Millisecond}
+
 type extendedHandlerFunc func(http.ResponseWriter, *http.Request, logging.Command)
 
 func hash(s string) int {
@@ -38,9 +83,13 @@ func hash(s string) int {
 	return int(h.Sum32())
 }
 
-func (env *Env) respondWithError(w http.ResponseWriter, code int, err error, message string, command logging.Command, vars map[string]string) {
+func (env *Env) respondWithError(ctx context.Context, w http.ResponseWriter, code int, err error, message string, command logging.Command, vars map[string]string) {
+	if dbutils.IsTimeout(err) {
+		code = http.StatusGatewayTimeout
+		err = dbutils.ErrTimeout
+	}
 	env.logger.LogErrorEvent(command, vars, message)
-	utils.LogErrSkip(err, message, 2) // skip 2 stack frames to get actual caller
+	applog.LogErrSkip(ctx, err, message, 1) // skip 1 stack frame to get actual caller
 	env.respondWithJSON(w, code, map[string]string{"error": err.Error(), "message": message})
 }
 
@@ -55,72 +104,179 @@ func (env *Env) respondWithJSON(w http.ResponseWriter, code int, payload interfa
 //TODO: refactor  + test
 func (env *Env) getQuoute(w http.ResponseWriter, r *http.Request, command logging.Command) {
 	vars := mux.Vars(r)
-	price, err := dbutils.QueryQuotePrice(env.quoteCache, env.logger, vars["username"], vars["symbol"], vars["trans"])
+	ctx := r.Context()
+	tdb := env.databases[hash(vars["username"])%len(env.databases)]
+	price, err := env.quotes.QueryQuotePrice(ctx, vars["username"], vars["symbol"], vars["trans"])
 	if err != nil {
 		errMsg := fmt.Sprintf("Error getting quote for %s and %s", vars["username"], vars["symbol"])
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
-	env.respondWithJSON(w, http.StatusOK, map[string]string{"price": strconv.Itoa(price), "symbol": vars["symbol"]})
+	currency, err := tdb.QuerySymbolCurrency(ctx, nil, vars["symbol"])
+	if err != nil {
+		errMsg := fmt.Sprintf("Error getting currency of %s", vars["symbol"])
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+	env.respondWithJSON(w, http.StatusOK, map[string]string{"price": strconv.Itoa(price), "symbol": vars["symbol"], "currency": currency})
+}
+
+// clearResult is what clearUsers counted on one database, and whether it
+// was emptied.
+type clearResult struct {
+	Database int            `json:"database"`
+	Rows     map[string]int `json:"rows"`
+	Cleared  bool           `json:"cleared"`
 }
 
 //TODO: refactor
+// clearUsers empties the user tables of every database. The rows of all of
+// them are counted first, so a database that can't be reached stops it
+// before anything is removed; with dryRun=true only the counts are
+// returned. Each database is then emptied in a transaction of its own and
+// the commits only start once every one has been emptied, so a failure
+// while emptying rolls all of them back. The commits still run one after
+// another, so this is not all or nothing: if a later commit fails, the
+// databases before it stay cleared and the error names the one that
+// failed. It is refused unless ALLOW_CLEAR_USERS is set, and anything but
+// a dry run must be a POST.
 func (env *Env) clearUsers(w http.ResponseWriter, r *http.Request, command logging.Command) {
 	vars := mux.Vars(r)
-	err := env.tdb.ClearUsers()
-	if err != nil {
-		errMsg := "Failed to clear users"
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+	ctx := r.Context()
+	if !env.allowClearUsers {
+		errMsg := "Clearing users is disabled, set ALLOW_CLEAR_USERS=true outside production to enable it."
+		env.respondWithError(ctx, w, http.StatusForbidden, errors.New(errMsg), errMsg, command, vars)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Cleared users succesfully."))
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+	if !dryRun && r.Method != http.MethodPost {
+		errMsg := "Clearing users must be a POST request."
+		env.respondWithError(ctx, w, http.StatusMethodNotAllowed, errors.New(errMsg), errMsg, command, vars)
+		return
+	}
+
+	results := make([]clearResult, len(env.databases))
+	for i := range results {
+		rows, err := env.databases[i].CountUserRows(ctx)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to count rows on database %d, nothing was cleared.", i)
+			env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+			return
+		}
+		results[i] = clearResult{Database: i, Rows: rows}
+	}
+
+	if !dryRun {
+		txs := make([]transdb.Tx, 0, len(results))
+		rollback := func() {
+			for _, tx := range txs {
+				tx.Rollback(ctx)
+			}
+		}
+		for i := range results {
+			tx, err := env.databases[i].Begin(ctx)
+			if err == nil {
+				txs = append(txs, tx)
+				err = env.databases[i].ClearUsers(ctx, tx)
+			}
+			if err != nil {
+				rollback()
+				errMsg := fmt.Sprintf("Failed to clear database %d, nothing was cleared.", i)
+				env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+				return
+			}
+		}
+		// every database is emptied, so only a commit itself can fail now
+		for i, tx := range txs {
+			if err := tx.Commit(ctx); err != nil {
+				txs = txs[i:]
+				rollback()
+				errMsg := fmt.Sprintf("Failed to commit clearing database %d, only the databases before it were cleared.", i)
+				env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+				return
+			}
+			results[i].Cleared = true
+			applog.FromContext(ctx).Warn("Cleared users", "database", i, "rows", results[i].Rows)
+		}
+	}
+
+	env.respondWithJSON(w, http.StatusOK, map[string]interface{}{"dryRun": dryRun, "databases": results})
 }
 
 func (env *Env) addUser(w http.ResponseWriter, r *http.Request, command logging.Command) {
 	vars := mux.Vars(r)
+	ctx := r.Context()
 	username := vars["username"]
 	moneyStr := vars["money"]
 	errMsg := fmt.Sprintf("Failed to add user %s", username)
 
 	money, err := strconv.Atoi(moneyStr)
 	if err != nil {
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
+	// money in another currency goes to the user's balance in it
+	currency := transdb.BaseCurrency
+	if str := r.URL.Query().Get("currency"); str != "" {
+		if currency, err = transdb.ParseCurrency(str); err != nil {
+			env.respondWithError(ctx, w, http.StatusBadRequest, err, err.Error(), command, vars)
+			return
+		}
+	}
+	baseMoney := money
+	if currency != transdb.BaseCurrency {
+		baseMoney = 0
+	}
+
 	tdb := env.databases[hash(username)%len(env.databases)]
 
-	user, err := tdb.QueryUser(username)
+	user, err := tdb.QueryUser(ctx, username)
 
-	if err != nil && err == pgx.ErrNoRows {
+	if err != nil && err == transdb.ErrNoRows {
 		//user no exist
-		newUser := models.User{Username: username, Money: money}
-		_, err := tdb.InsertUser(newUser)
+		newUser := models.User{Username: username, Money: baseMoney}
+		err := tdb.InsertUser(ctx, newUser)
 		if err != nil {
-			env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+			env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 			return
 		}
 
 	} else if err != nil {
 		// error
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 
 	} else {
 		// user exists
-		user.Money += money
-		_, err = tdb.UpdateUser(user)
+		if status, err := tdb.QueryUserStatus(ctx, nil, username); err != nil {
+			env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+			return
+		} else if status == transdb.UserClosing || status == transdb.UserClosed {
+			errMsg = fmt.Sprintf("The account of %s is %s.", username, status)
+			env.respondWithError(ctx, w, http.StatusConflict, status.Err(), errMsg, command, vars)
+			return
+		}
+		user.Money += baseMoney
+		err = tdb.UpdateUser(ctx, user)
 
 		if err != nil {
-			env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+			env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 			return
 		}
 	}
 
-	user, err = tdb.QueryUser(username)
+	if currency != transdb.BaseCurrency {
+		err = tdb.UpdateUserBalance(ctx, nil, username, currency, money, models.SELL)
+		if err != nil {
+			env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+			return
+		}
+	}
+
+	user, err = tdb.QueryUser(ctx, username)
 	if err != nil {
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
@@ -129,25 +285,26 @@ func (env *Env) addUser(w http.ResponseWriter, r *http.Request, command logging.
 
 func (env *Env) availableBalance(w http.ResponseWriter, r *http.Request, command logging.Command) {
 	vars := mux.Vars(r)
+	ctx := r.Context()
 	username := vars["username"]
 
 	tdb := env.databases[hash(username)%len(env.databases)]
 
-	_, err := tdb.QueryUser(username)
-	if err != nil && err == pgx.ErrNoRows {
+	_, err := tdb.QueryUser(ctx, username)
+	if err != nil && err == transdb.ErrNoRows {
 		errMsg := fmt.Sprintf("No such user %s exists.", username)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	} else if err != nil {
 		errMsg := fmt.Sprintf("Error retrieving user %s.", username)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	balance, err := tdb.QueryUserAvailableBalance(username)
+	balance, err := tdb.QueryUserAvailableBalance(ctx, username)
 	if err != nil {
 		errMsg := fmt.Sprintf("Error getting user available balance for %s.", username)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 	var m map[string]int
@@ -159,26 +316,27 @@ func (env *Env) availableBalance(w http.ResponseWriter, r *http.Request, command
 
 func (env *Env) availableShares(w http.ResponseWriter, r *http.Request, command logging.Command) {
 	vars := mux.Vars(r)
+	ctx := r.Context()
 	username := vars["username"]
 	symbol := vars["symbol"]
 
 	tdb := env.databases[hash(username)%len(env.databases)]
 
-	_, err := tdb.QueryUser(username)
-	if err != nil && err == pgx.ErrNoRows {
+	_, err := tdb.QueryUser(ctx, username)
+	if err != nil && err == transdb.ErrNoRows {
 		errMsg := fmt.Sprintf("No such user %s exists.", username)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	} else if err != nil {
 		errMsg := fmt.Sprintf("Error retrieving user %s.", username)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	balance, err := tdb.QueryUserAvailableShares(username, symbol)
+	balance, err := tdb.QueryUserAvailableShares(ctx, username, symbol)
 	if err != nil {
 		errMsg := fmt.Sprintf("Error getting user available shares for %s: %s.", username, symbol)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 	var m map[string]int
@@ -190,217 +348,201 @@ func (env *Env) availableShares(w http.ResponseWriter, r *http.Request, command
 
 func (env *Env) buyOrder(w http.ResponseWriter, r *http.Request, command logging.Command) {
 	vars := mux.Vars(r)
-	username := vars["username"]
-	symbol := vars["symbol"]
-	trans := vars["trans"]
-	tdb := env.databases[hash(username)%len(env.databases)]
+	ctx := r.Context()
 
 	buyAmount, err := strconv.Atoi(vars["amount"])
 	if err != nil {
 		errMsg := fmt.Sprintf("Invalid amount %s.", vars["amount"])
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	balance, err := tdb.QueryUserAvailableBalance(username)
+	env.reserveOrder(w, r, command, models.BUY, transdb.Quantity{Amount: buyAmount})
+}
 
-	// check that user exists and has enough money
-	if err != nil {
-		if err == pgx.ErrNoRows {
-			errMsg := fmt.Sprintf("Failed to find user %s.", username)
-			env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
-			return
-		}
+func (env *Env) sellOrder(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
 
-		errMsg := fmt.Sprintf("Error getting user data for %s.", username)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+	sellAmount, err := strconv.Atoi(vars["amount"])
+	if err != nil {
+		errMsg := fmt.Sprintf("Invalid amount %s.", vars["amount"])
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	if balance < buyAmount {
-		errMsg := fmt.Sprintf("User does not have enough money to complete order %d < %d.", balance, buyAmount)
-		err = errors.New("Error not enough money.")
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
-		return
-	}
+	env.reserveOrder(w, r, command, models.SELL, transdb.Quantity{Amount: sellAmount})
+}
 
-	quote, err := dbutils.QueryQuotePrice(env.quoteCache, env.logger, username, symbol, trans)
-	if err != nil {
-		errMsg := fmt.Sprintf("Error getting quote from quote server for %s: %s.", username, symbol)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
-		return
-	}
+func (env *Env) buyShares(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	env.reserveShares(w, r, command, models.BUY)
+}
 
-	reservation := models.Reservation{Username: username, Symbol: symbol, Order: models.BUY}
-	reservation.Shares = buyAmount / quote
-	reservation.Amount = reservation.Shares * quote
-	reservation.Time = time.Now().Unix()
+func (env *Env) sellShares(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	env.reserveShares(w, r, command, models.SELL)
+}
 
-	if reservation.Shares == 0 {
-		errMsg := fmt.Sprintf("Cannot buy %d amount of shares", reservation.Shares)
-		err = errors.New(errMsg)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
-		return
-	}
+// reserveShares reserves a buy or sell of the {shares} path parameter,
+// which may be a decimal when shares are fractional.
+func (env *Env) reserveShares(w http.ResponseWriter, r *http.Request, command logging.Command, orderType models.OrderType) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	tdb := env.databases[hash(vars["username"])%len(env.databases)]
 
-	rid, err := tdb.AddReservation(nil, reservation)
+	shares, err := tdb.ShareScale().Parse(vars["shares"])
 	if err != nil {
-		errMsg := "Error setting buy order."
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusBadRequest, err, err.Error(), command, vars)
 		return
 	}
 
-	reserv, err := tdb.QueryReservation(rid)
-	if err != nil {
-		errMsg := "Error reservation not found after insert."
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
-		return
-	}
+	env.reserveOrder(w, r, command, orderType, transdb.Quantity{Shares: shares})
+}
 
-	env.respondWithJSON(w, http.StatusOK, reserv)
+// sellAll reserves a sale of every share of the symbol the user has
+// available.
+func (env *Env) sellAll(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	env.reserveOrder(w, r, command, models.SELL, transdb.Quantity{All: true})
+}
 
-	// remove reservation if not bought within 60 seconds
-	go tdb.RemoveOrder(rid, 60)
+// orderReservation is a buy or sell waiting to be committed. Shares and
+// Amount are the quantity and notional the commit will trade, priced at
+// Price. Net is the cash the commit moves once Fees are paid.
+type orderReservation struct {
+	models.Reservation
+	Price     int   `json:"price"`
+	Fees      int   `json:"fees"`
+	Net       int   `json:"net"`
+	ExpiresAt int64 `json:"expiresAt"`
 }
 
-func (env *Env) sellOrder(w http.ResponseWriter, r *http.Request, command logging.Command) {
+// reserveOrder prices q at the current quote and reserves it for the user
+// to commit within reservationTimeout seconds.
+func (env *Env) reserveOrder(w http.ResponseWriter, r *http.Request, command logging.Command, orderType models.OrderType, q transdb.Quantity) {
 	vars := mux.Vars(r)
+	ctx := r.Context()
 	username := vars["username"]
 	symbol := vars["symbol"]
 	trans := vars["trans"]
 	tdb := env.databases[hash(username)%len(env.databases)]
 
-	sellAmount, err := strconv.Atoi(vars["amount"])
-	if err != nil {
-		errMsg := fmt.Sprintf("Invalid amount %s.", vars["amount"])
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
-		return
-	}
-
-	quote, err := dbutils.QueryQuotePrice(env.quoteCache, env.logger, username, symbol, trans)
+	quote, err := transdb.BaseQuotes(tdb, env.quotes).QueryQuotePrice(ctx, username, symbol, trans)
 	if err != nil {
 		errMsg := fmt.Sprintf("Error getting quote from quote server for %s: %s.", username, symbol)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
-		return
-	}
-
-	sharesToSell := sellAmount / quote
-
-	availableShares, err := tdb.QueryUserAvailableShares(username, symbol)
-	if err != nil {
-		errMsg := fmt.Sprintf("Error querying available shares for %s: %s.", username, symbol)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
-		return
-	}
-
-	if availableShares < sharesToSell {
-		errMsg := fmt.Sprintf("User does not have enough shares to complete order %d < %d", availableShares, sharesToSell)
-		err = errors.New("Error not enough shares.")
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
-		return
-	}
-
-	reservation := models.Reservation{Username: username, Symbol: symbol, Order: models.SELL}
-	reservation.Shares = sharesToSell
-	reservation.Amount = reservation.Shares * quote
-	reservation.Time = time.Now().Unix()
-
-	if sharesToSell == 0 {
-		errMsg := fmt.Sprintf("Cannot sell %d amount of shares", sharesToSell)
-		err = errors.New(errMsg)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	rid, err := tdb.AddReservation(nil, reservation)
+	reservation, err := tdb.ReserveOrder(ctx, username, symbol, orderType, q, quote)
 	if err != nil {
-		errMsg := "Error setting sell order."
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		var errMsg string
+		switch err {
+		case transdb.ErrNoRows:
+			errMsg = fmt.Sprintf("Failed to find user %s.", username)
+		case transdb.ErrNoShares:
+			errMsg = fmt.Sprintf("Cannot %s %d amount of shares", orderType, reservation.Shares)
+		case transdb.ErrInsufficientFunds:
+			errMsg = fmt.Sprintf("User does not have enough money to complete order for %d.", reservation.Amount)
+		case transdb.ErrInsufficientShares:
+			errMsg = fmt.Sprintf("User does not have enough shares to complete order for %d.", reservation.Shares)
+		default:
+			errMsg = fmt.Sprintf("Error setting %s order.", orderType)
+		}
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	reserv, err := tdb.QueryReservation(rid)
+	reserv, err := tdb.QueryReservation(ctx, reservation.ID)
 	if err != nil {
 		errMsg := "Error reservation not found after insert."
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	env.respondWithJSON(w, http.StatusOK, reserv)
+	resp := orderReservation{Reservation: reserv, Price: quote, ExpiresAt: reserv.Time + reservationTimeout}
+	resp.Fees = tdb.Fees().Fee(reserv.Symbol, reserv.Order, reserv.Amount)
+	resp.Net = reserv.Amount - resp.Fees
+	if reserv.Order == models.BUY {
+		resp.Net = reserv.Amount + resp.Fees
+	}
+	env.respondWithJSON(w, http.StatusOK, resp)
 
 	// remove reservation if not bought within 60 seconds
-	go tdb.RemoveOrder(rid, 60)
+	go tdb.RemoveOrder(context.WithoutCancel(ctx), reserv.ID, reservationTimeout)
 }
 
 func (env *Env) commitOrder(w http.ResponseWriter, r *http.Request, orderType models.OrderType, command logging.Command) {
 	var vars = mux.Vars(r)
+	ctx := r.Context()
 	username := vars["username"]
 	trans := vars["trans"]
 	tdb := env.databases[hash(username)%len(env.databases)]
 
-	res, err := tdb.QueryLastReservation(username, orderType)
-	if err != nil && err == pgx.ErrNoRows {
+	res, err := tdb.QueryLastReservation(ctx, username, orderType)
+	if err != nil && err == transdb.ErrNoRows {
 		errMsg := fmt.Sprintf("No reserved %s order to commit.", orderType)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	} else if err != nil {
 		errMsg := fmt.Sprintf("Error finding last %s reservation.", orderType)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
 	var balance int
 	var amount int
+	var fee int
 
 	if orderType == models.BUY {
-		balance, err = tdb.QueryUserAvailableBalance(username)
+		balance, err = tdb.QueryUserAvailableBalance(ctx, username)
 		amount = res.Amount
+		// the commission is paid on top of a buy's amount
+		fee = tdb.Fees().Fee(res.Symbol, models.BUY, res.Amount)
 
 	} else {
-		balance, err = tdb.QueryUserAvailableShares(username, res.Symbol)
+		balance, err = tdb.QueryUserAvailableShares(ctx, username, res.Symbol)
 		amount = res.Shares
 	}
 
 	// check that user exists and has enough resources
 	if err != nil {
-		if err == pgx.ErrNoRows {
+		if err == transdb.ErrNoRows {
 			errMsg := fmt.Sprintf("Failed to find user %s.", username)
-			env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+			env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 			return
 		}
 
 		errMsg := fmt.Sprintf("Error getting user data for %s.", username)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
 	if amount == 0 {
 		errMsg := fmt.Sprintf("User cannot complete order for %d amount.", amount)
 		err = errors.New(errMsg)
-		tdb.RemoveReservation(nil, res.ID) //TODO: test
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		tdb.RemoveReservation(ctx, nil, res.ID) //TODO: test
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	if balance < amount {
-		errMsg := fmt.Sprintf("User does not have enough resources to complete order %d < %d.", balance, amount)
+	if balance < amount+fee {
+		errMsg := fmt.Sprintf("User does not have enough resources to complete order %d < %d.", balance, amount+fee)
 		err = errors.New("Error not enough resources.")
-		tdb.RemoveReservation(nil, res.ID) // TODO: test
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		tdb.RemoveReservation(ctx, nil, res.ID) // TODO: test
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	err = tdb.CommitBuySellTransaction(res, trans)
+	err = tdb.CommitBuySellTransaction(ctx, res, trans)
 	if err != nil {
 		errMsg := fmt.Sprintf("Error commiting %s order.", orderType)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	stock, err := tdb.QueryUserStock(res.Username, res.Symbol)
+	stock, err := tdb.QueryUserStock(ctx, res.Username, res.Symbol)
 	if err != nil {
 		errMsg := "Error could not find updated stock."
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 	}
 
 	env.respondWithJSON(w, http.StatusOK, stock)
@@ -417,13 +559,14 @@ func (env *Env) commitSell(w http.ResponseWriter, r *http.Request, command loggi
 
 func (env *Env) cancelOrder(w http.ResponseWriter, r *http.Request, orderType models.OrderType, command logging.Command) {
 	vars := mux.Vars(r)
+	ctx := r.Context()
 	username := vars["username"]
 	tdb := env.databases[hash(username)%len(env.databases)]
 
-	res, err := tdb.RemoveLastOrderTypeReservation(username, orderType)
+	res, err := tdb.RemoveLastOrderTypeReservation(ctx, username, orderType)
 	if err != nil {
 		errMsg := fmt.Sprintf("Error deleting last %s reservation.", orderType)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 	env.respondWithJSON(w, http.StatusOK, res)
@@ -440,6 +583,7 @@ func (env *Env) cancelBuy(w http.ResponseWriter, r *http.Request, command loggin
 
 func (env *Env) setBuyAmount(w http.ResponseWriter, r *http.Request, command logging.Command) {
 	vars := mux.Vars(r)
+	ctx := r.Context()
 	username := vars["username"]
 	symbol := vars["symbol"]
 	trans := vars["trans"]
@@ -448,62 +592,62 @@ func (env *Env) setBuyAmount(w http.ResponseWriter, r *http.Request, command log
 	buyAmount, err := strconv.Atoi(vars["amount"])
 	if err != nil {
 		errMsg := fmt.Sprintf("Invalid amount %s.", vars["amount"])
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	trig, err := tdb.QueryUserTrigger(username, symbol, models.BUY)
-	if err != nil && err != pgx.ErrNoRows {
+	trig, err := tdb.QueryUserTrigger(ctx, username, symbol, models.BUY)
+	if err != nil && err != transdb.ErrNoRows {
 		errMsg := fmt.Sprintf("Error querying %s triggers for %s", models.BUY, username)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
-	if err != pgx.ErrNoRows {
+	if err != transdb.ErrNoRows {
 		errMsg := fmt.Sprintf("Error a %s amount already exists for %s and %s. Please cancel before proceeding.", models.BUY, username, symbol)
 		err = errors.New(fmt.Sprintf("Error duplicate %s amount for %s and %s.", models.BUY, username, symbol))
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	balance, err := tdb.QueryUserAvailableBalance(username)
+	balance, err := tdb.QueryUserAvailableBalance(ctx, username)
 	// check that user exists and has enough money
 	if err != nil {
-		if err == pgx.ErrNoRows {
+		if err == transdb.ErrNoRows {
 			errMsg := fmt.Sprintf("Failed to find user %s.", username)
-			env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+			env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 			return
 		}
 
 		errMsg := fmt.Sprintf("Error getting user data for %s.", username)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
 	if buyAmount == 0  {
 		errMsg := fmt.Sprintf("User cannot complete order for %d amount.", buyAmount)
 		err = errors.New(errMsg)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
 	if balance < buyAmount {
 		errMsg := fmt.Sprintf("User does not have enough money to complete trigger %d < %d.", balance, buyAmount)
 		err = errors.New("Error not enough money.")
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	tid, err := tdb.CommitSetOrderTransaction(username, symbol, models.BUY, buyAmount, trans)
+	tid, err := tdb.CommitSetOrderTransaction(ctx, username, symbol, models.BUY, buyAmount, trans)
 	if err != nil {
 		errMsg := fmt.Sprintf("Error setting buy amount for %s: %s", username, symbol)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	trig, err = tdb.QueryStockTrigger(tid)
+	trig, err = tdb.QueryStockTrigger(ctx, tid)
 	if err != nil {
 		errMsg := fmt.Sprintf("Error trigger %d not found after insert.", tid)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
@@ -512,6 +656,7 @@ func (env *Env) setBuyAmount(w http.ResponseWriter, r *http.Request, command log
 
 func (env *Env) setSellAmount(w http.ResponseWriter, r *http.Request, command logging.Command) {
 	vars := mux.Vars(r)
+	ctx := r.Context()
 	username := vars["username"]
 	symbol := vars["symbol"]
 	trans := vars["trans"]
@@ -520,64 +665,64 @@ func (env *Env) setSellAmount(w http.ResponseWriter, r *http.Request, command lo
 	sellAmount, err := strconv.Atoi(vars["amount"])
 	if err != nil {
 		errMsg := fmt.Sprintf("Invalid amount %s.", vars["amount"])
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	availableShares, err := tdb.QueryUserAvailableShares(username, symbol)
+	availableShares, err := tdb.QueryUserAvailableShares(ctx, username, symbol)
 	if err != nil {
 		errMsg := fmt.Sprintf("Error getting user available shares for %s: %s.", username, symbol)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	trig, err := tdb.QueryUserTrigger(username, symbol, models.SELL)
-	if err != nil && err != pgx.ErrNoRows {
+	trig, err := tdb.QueryUserTrigger(ctx, username, symbol, models.SELL)
+	if err != nil && err != transdb.ErrNoRows {
 		errMsg := fmt.Sprintf("Error querying %s triggers for %s", models.BUY, username)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
-	if err != pgx.ErrNoRows {
+	if err != transdb.ErrNoRows {
 		errMsg := fmt.Sprintf("Error a %s amount already exists for %s and %s. Please cancel before proceeding.", models.SELL, username, symbol)
 		err = errors.New(fmt.Sprintf("Error duplicate %s amount for %s and %s.", models.SELL, username, symbol))
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	quote, err := dbutils.QueryQuotePrice(env.quoteCache, env.logger, username, symbol, trans)
+	quote, err := transdb.BaseQuotes(tdb, env.quotes).QueryQuotePrice(ctx, username, symbol, trans)
 	if err != nil {
 		errMsg := fmt.Sprintf("Error getting quote from quote server for %s: %s.", username, symbol)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	sellShares := sellAmount / quote
+	sellShares := tdb.ShareScale().Buy(sellAmount, quote)
 
 	if sellShares == 0  {
 		errMsg := fmt.Sprintf("User cannot complete order for %d amount.", sellShares)
 		err = errors.New(errMsg)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
 	if availableShares < sellShares {
 		errMsg := fmt.Sprintf("User does not have enough stock to complete trigger %d < %d.", availableShares, sellShares)
 		err = errors.New("Error not enough stock.")
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	tid, err := tdb.CommitSetOrderTransaction(username, symbol, models.SELL, sellShares, trans)
+	tid, err := tdb.CommitSetOrderTransaction(ctx, username, symbol, models.SELL, sellShares, trans)
 	if err != nil {
 		errMsg := fmt.Sprintf("Error setting %s amount for %s: %s", models.SELL, username, symbol)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	trig, err = tdb.QueryStockTrigger(tid)
+	trig, err = tdb.QueryStockTrigger(ctx, tid)
 	if err != nil {
 		errMsg := fmt.Sprintf("Error trigger %d not found after insert.", tid)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
@@ -586,6 +731,7 @@ func (env *Env) setSellAmount(w http.ResponseWriter, r *http.Request, command lo
 
 func (env *Env) setOrderTrigger(w http.ResponseWriter, r *http.Request, orderType models.OrderType, command logging.Command) {
 	vars := mux.Vars(r)
+	ctx := r.Context()
 	username := vars["username"]
 	symbol := vars["symbol"]
 	triggerPrice, err := strconv.Atoi(vars["triggerPrice"])
@@ -593,38 +739,38 @@ func (env *Env) setOrderTrigger(w http.ResponseWriter, r *http.Request, orderTyp
 
 	if err != nil {
 		errMsg := fmt.Sprintf("Invalid amount %s.", vars["triggerPrice"])
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	trig, err := tdb.QueryUserTrigger(username, symbol, orderType)
-	if err != nil && err != pgx.ErrNoRows {
+	trig, err := tdb.QueryUserTrigger(ctx, username, symbol, orderType)
+	if err != nil && err != transdb.ErrNoRows {
 		errMsg := fmt.Sprintf("Error querying %s triggers for %s", orderType, username)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	if err != nil && err != pgx.ErrNoRows && trig.Executable {
+	if err != nil && err != transdb.ErrNoRows && trig.Executable {
 		errMsg := fmt.Sprintf("Error a %s trigger already exists for %s and %s. Please cancel before proceeding.", orderType, username, symbol)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
 	trig.TriggerPrice = triggerPrice
 	trig.Executable = true
 
-	err = tdb.UpdateTrigger(trig)
+	err = transdb.SetTrigger(ctx, tdb, trig)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to update %s trigger for %s and %s", orderType, username, symbol)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
 	//For err checking consider removing
-	trig, err = tdb.QueryStockTrigger(trig.ID)
+	trig, err = tdb.QueryStockTrigger(ctx, trig.ID)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to query updated %s trigger for %s and %s", orderType, username, symbol)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
@@ -639,16 +785,96 @@ func (env *Env) setSellTrigger(w http.ResponseWriter, r *http.Request, command l
 	env.setOrderTrigger(w, r, models.SELL, command)
 }
 
+// setSellTrailingStop turns the user's sell trigger for symbol into a
+// trailing stop, trailing the quote by the trailAmount query parameter in
+// cents or by trailPercent percent. The stop starts below the current quote
+// and rises with it.
+func (env *Env) setSellTrailingStop(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	symbol := vars["symbol"]
+	trans := vars["trans"]
+	tdb := env.databases[hash(username)%len(env.databases)]
+
+	ts := transdb.TrailingStop{Username: username, Symbol: symbol}
+	q := r.URL.Query()
+	var err error
+	switch {
+	case q.Get("trailAmount") != "" && q.Get("trailPercent") == "":
+		ts.TrailAmount, err = strconv.Atoi(q.Get("trailAmount"))
+		if err == nil && ts.TrailAmount <= 0 {
+			err = errors.New("Invalid trailAmount")
+		}
+	case q.Get("trailPercent") != "" && q.Get("trailAmount") == "":
+		var pct float64
+		pct, err = strconv.ParseFloat(q.Get("trailPercent"), 64)
+		ts.TrailBasisPoints = int(math.Round(pct * 100))
+		if err == nil && (ts.TrailBasisPoints <= 0 || ts.TrailBasisPoints >= 10000) {
+			err = errors.New("Invalid trailPercent")
+		}
+	default:
+		err = errors.New("Exactly one of trailAmount or trailPercent is required")
+	}
+	if err != nil {
+		env.respondWithError(ctx, w, http.StatusBadRequest, err, err.Error(), command, vars)
+		return
+	}
+
+	trig, err := tdb.QueryUserTrigger(ctx, username, symbol, models.SELL)
+	if err != nil {
+		errMsg := fmt.Sprintf("Error no sell amount is set for %s and %s.", username, symbol)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+	if trig.Executable {
+		errMsg := fmt.Sprintf("Error a sell trigger already exists for %s and %s. Please cancel before proceeding.", username, symbol)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, errors.New(errMsg), errMsg, command, vars)
+		return
+	}
+
+	quote, err := transdb.BaseQuotes(tdb, env.quotes).QueryQuotePrice(ctx, username, symbol, trans)
+	if err != nil {
+		errMsg := fmt.Sprintf("Error getting quote from quote server for %s: %s.", username, symbol)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+	ts.TID = trig.ID
+	ts.HighWater = quote
+	if ts.Stop() <= 0 {
+		errMsg := fmt.Sprintf("Trail is larger than the %s quote of %d.", symbol, quote)
+		env.respondWithError(ctx, w, http.StatusBadRequest, errors.New(errMsg), errMsg, command, vars)
+		return
+	}
+
+	err = tdb.SetTrailingStop(ctx, nil, ts)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to set trailing stop for %s and %s.", username, symbol)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+
+	trig, err = tdb.QueryStockTrigger(ctx, trig.ID)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to query updated sell trigger for %s and %s", username, symbol)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+
+	env.respondWithJSON(w, http.StatusOK, summaryTrigger{Trigger: trig, State: "active", Trailing: &ts})
+}
+
 func (env *Env) executeTriggerTest(w http.ResponseWriter, r *http.Request, command logging.Command) {
 	vars := mux.Vars(r)
+	ctx := r.Context()
 	username := vars["username"]
 	trans := vars["trans"]
 	tdb := env.databases[hash(username)%len(env.databases)]
 
-	rTrigs, err := tdb.QueryAndExecuteCurrentTriggers(env.quoteCache, trans)
+	rTrigs, err := tdb.QueryAndExecuteCurrentTriggers(ctx, env.quotes, trans)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to execute triggers for %s.", username)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
@@ -657,27 +883,28 @@ func (env *Env) executeTriggerTest(w http.ResponseWriter, r *http.Request, comma
 
 func (env *Env) cancelTrigger(w http.ResponseWriter, r *http.Request, orderType models.OrderType, command logging.Command) {
 	vars := mux.Vars(r)
+	ctx := r.Context()
 	username := vars["username"]
 	symbol := vars["symbol"]
 	trans := vars["trans"]
 	tdb := env.databases[hash(username)%len(env.databases)]
 
-	trig, err := tdb.QueryUserTrigger(username, symbol, orderType)
+	trig, err := tdb.QueryUserTrigger(ctx, username, symbol, orderType)
 	if err != nil {
-		if err == pgx.ErrNoRows {
+		if err == transdb.ErrNoRows {
 			errMsg := fmt.Sprintf("Error no %s trigger exists for %s and %s.", orderType, username, symbol)
-			env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+			env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 			return
 		}
-		errMsg := fmt.Sprintf("Error querying %s triggers for %s", orderType, username, command, vars)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		errMsg := fmt.Sprintf("Error querying %s triggers for %s", orderType, username)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	trig, err = tdb.CancelOrderTransaction(trig, trans)
+	trig, err = tdb.CancelOrderTransaction(ctx, trig, trans)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to cancel %s trigger for %s and %s", orderType, username, symbol)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
@@ -713,194 +940,1887 @@ func (env *Env) dumplogUser(w http.ResponseWriter, r *http.Request, command logg
 	env.respondWithJSON(w, http.StatusOK, m)
 }
 
+// page sizes for the summary command history and execution history
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+type summaryStock struct {
+	models.Stock
+	// Price and MarketValue are set when valuing a summary with a cached quote.
+	Price       *int `json:"price,omitempty"`
+	MarketValue *int `json:"marketValue,omitempty"`
+}
+
+type summaryReservation struct {
+	models.Reservation
+	// Fees is the commission committing the reservation will charge.
+	Fees      int   `json:"fees"`
+	ExpiresAt int64 `json:"expiresAt"`
+}
+
+type summaryTrigger struct {
+	models.Trigger
+	// State is "pending" until a trigger price is set, then "active".
+	State string `json:"state"`
+	// Trailing is set for trailing stops, whose trigger price is the
+	// current effective stop.
+	Trailing *transdb.TrailingStop `json:"trailing,omitempty"`
+}
+
+type summaryValuation struct {
+	StocksValue int      `json:"stocksValue"`
+	TotalValue  int      `json:"totalValue"`
+	Unpriced    []string `json:"unpriced,omitempty"`
+}
+
+// queryInt parses the query parameter name as a non-negative integer,
+// returning def if it is absent.
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	str := r.URL.Query().Get(name)
+	if str == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(str)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid %s %s", name, str)
+	}
+	return n, nil
+}
+
+// displaySummary reports a user's balance, holdings, open reservations,
+// triggers, open orders and a page of their command history. The page is chosen with
+// the offset and limit query parameters. With value=true holdings are
+// valued at cached quotes; symbols without one are listed as unpriced
+// rather than fetched from the quote server.
 func (env *Env) displaySummary(w http.ResponseWriter, r *http.Request, command logging.Command) {
 	vars := mux.Vars(r)
+	ctx := r.Context()
 	username := vars["username"]
+	tdb := env.databases[hash(username)%len(env.databases)]
 	type payload struct {
-		UserCommands [] logging.UserCommandType `json:"userCommands"`
-		Balance		 int						`json:"balance"`
-		Triggers	 []	models.Trigger			`json:"triggers"`
+		UserCommands   []logging.UserCommandType `json:"userCommands"`
+		CommandsTotal  int                       `json:"commandsTotal"`
+		CommandsOffset int                       `json:"commandsOffset"`
+		CommandsLimit  int                       `json:"commandsLimit"`
+		Balance        int                       `json:"balance"`
+		Balances       map[string]int            `json:"balances"`
+		ReservedFunds  int                       `json:"reservedFunds"`
+		ReservedShares map[string]int            `json:"reservedShares"`
+		Stocks         []summaryStock            `json:"stocks"`
+		Reservations   []summaryReservation      `json:"reservations"`
+		Triggers       []summaryTrigger          `json:"triggers"`
+		Orders         []transdb.Order           `json:"orders"`
+		FeesPaid       int                       `json:"feesPaid"`
+		FeeSchedule    transdb.FeeSchedule       `json:"feeSchedule"`
+		Valuation      *summaryValuation         `json:"valuation,omitempty"`
+	}
+
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		env.respondWithError(ctx, w, http.StatusBadRequest, err, err.Error(), command, vars)
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultPageLimit)
+	if err != nil {
+		env.respondWithError(ctx, w, http.StatusBadRequest, err, err.Error(), command, vars)
+		return
 	}
+	if limit == 0 || limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	valued := r.URL.Query().Get("value") == "true"
 
-	p := payload{}
+	p := payload{CommandsOffset: offset, CommandsLimit: limit, ReservedShares: map[string]int{}}
 	userCommands, err := env.logDB.GetSingleUserCommands(username)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to execute display summary.")
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
+	p.CommandsTotal = len(userCommands)
+	if offset > len(userCommands) {
+		offset = len(userCommands)
+	}
+	userCommands = userCommands[offset:]
+	if len(userCommands) > limit {
+		userCommands = userCommands[:limit]
+	}
+	p.UserCommands = userCommands
 
-	balance, err := env.tdb.QueryUserAvailableBalance(username)
+	p.Balance, err = tdb.QueryUserAvailableBalance(ctx, username)
 	if err != nil {
 		errMsg := fmt.Sprintf("Error getting user available balance for %s.", username)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
-
-	triggers, err := env.tdb.QueryAllUserTriggers(username)
+	p.Balances, err = tdb.QueryUserBalances(ctx, username)
 	if err != nil {
-		errMsg := fmt.Sprintf("Failed to get trigger records for %s.", username)
-		env.respondWithError(w, http.StatusInternalServerError, err, errMsg, command, vars)
+		errMsg := fmt.Sprintf("Error getting balances for %s.", username)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
 		return
 	}
 
-	p.UserCommands = userCommands
-	p.Balance = balance
-	p.Triggers = triggers
-
-	env.respondWithJSON(w, http.StatusOK, p)
-	return
-}
-
-func validateURLParams(r *http.Request) (err error) {
-	vars := mux.Vars(r)
+	stocks, err := tdb.QueryAllUserStocks(ctx, username)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to get stock records for %s.", username)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+	p.Stocks = make([]summaryStock, 0, len(stocks))
+	for _, stock := range stocks {
+		p.Stocks = append(p.Stocks, summaryStock{Stock: stock})
+	}
 
-	username, ok := vars["username"]
-	if ok != false {
-		if len(username) <= 0 {
-			return errors.New("Invalid username\n")
+	reservations, err := tdb.QueryAllUserReservations(ctx, username)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to get reservation records for %s.", username)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+	now := env.clock.Now().Unix()
+	p.Reservations = []summaryReservation{}
+	for _, res := range reservations {
+		// skip reservations whose removal is still pending
+		if expires := res.Time + reservationTimeout; expires > now {
+			fees := tdb.Fees().Fee(res.Symbol, res.Order, res.Amount)
+			p.Reservations = append(p.Reservations, summaryReservation{Reservation: res, Fees: fees, ExpiresAt: expires})
 		}
 	}
 
-	stock, ok := vars["stock"]
-	if ok != false {
-		// v, err := strconv.Atoi(stock)
-		if len(stock) <= 0 || len(stock) > 3 {
-			return errors.New("Invalid stock\n")
-		}
-		// allows stocks to be numbers
-		// could add check for stocks not being number values
+	triggers, err := tdb.QueryAllUserTriggers(ctx, username)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to get trigger records for %s.", username)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+	stops, err := tdb.QueryTrailingStops(ctx, username)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to get trailing stops for %s.", username)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+	trailing := make(map[int64]transdb.TrailingStop, len(stops))
+	for _, ts := range stops {
+		trailing[ts.TID] = ts
 	}
+	p.Triggers = make([]summaryTrigger, 0, len(triggers))
+	for _, trig := range triggers {
+		st := summaryTrigger{Trigger: trig, State: "pending"}
+		if trig.Executable {
+			st.State = "active"
+		}
+		if ts, ok := trailing[trig.ID]; ok {
+			st.Trailing = &ts
+		}
+		p.Triggers = append(p.Triggers, st)
 
-	amount, ok := vars["amount"]
-	if ok != false {
-		floatAmount, err := strconv.ParseFloat(amount, 64)
-		if floatAmount <= 0 || err != nil {
-			return errors.New("Invalid amount\n")
+		// setting a trigger amount sets aside the buy funds or sell shares
+		if trig.Order == models.BUY {
+			p.ReservedFunds += trig.Amount
+		} else {
+			p.ReservedShares[trig.Symbol] += trig.Amount
 		}
 	}
 
-	money, ok := vars["money"]
-	if ok != false {
-		floatMoney, err := strconv.ParseFloat(money, 64)
-		if floatMoney <= 0 || err != nil {
-			return errors.New("Invalid money\n")
+	p.Orders, err = tdb.QueryUserOrders(ctx, username, true)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to get open orders for %s.", username)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+	if p.Orders == nil {
+		p.Orders = []transdb.Order{}
+	}
+	for _, o := range p.Orders {
+		if o.Side() == models.BUY {
+			p.ReservedFunds += o.Held
+		} else {
+			p.ReservedShares[o.Symbol] += o.Held
 		}
 	}
 
-	triggerPrice, ok := vars["triggerPrice"]
-	if ok != false {
-		floatTriggerPrice, err := strconv.ParseFloat(triggerPrice, 64)
-		if floatTriggerPrice <= 0 || err != nil {
-			return errors.New("Invalid trigger price\n")
+	p.FeeSchedule = tdb.Fees()
+	p.FeesPaid, err = tdb.QueryUserFees(ctx, username)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to get fees paid by %s.", username)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+
+	if valued {
+		p.Valuation = env.valueSummary(ctx, tdb, p.Stocks, p.ReservedShares)
+		p.Valuation.TotalValue += p.Balance + p.ReservedFunds
+		currencies := make([]string, 0, len(p.Balances))
+		for currency := range p.Balances {
+			currencies = append(currencies, currency)
+		}
+		sort.Strings(currencies)
+		for _, currency := range currencies {
+			r, err := transdb.ExchangeRate(ctx, tdb, currency, transdb.BaseCurrency)
+			if err != nil {
+				applog.FromContext(ctx).Warn("Failed to get exchange rate", "currency", currency, "error", err)
+				p.Valuation.Unpriced = append(p.Valuation.Unpriced, currency)
+				continue
+			}
+			p.Valuation.TotalValue += r.Convert(p.Balances[currency])
 		}
 	}
 
-	shares, ok := vars["shares"]
-	if ok != false {
-		intShares, err := strconv.Atoi(shares)
-		if intShares <= 0 || err != nil {
-			return errors.New("Invalid number of shares\n")
+	env.respondWithJSON(w, http.StatusOK, p)
+	return
+}
+
+// valueSummary prices stocks and reserved shares at cached quotes in the
+// base currency, filling in each stock's price and market value.
+func (env *Env) valueSummary(ctx context.Context, tdb transdb.TransactionDataStore, stocks []summaryStock, reservedShares map[string]int) *summaryValuation {
+	scale := tdb.ShareScale()
+	v := &summaryValuation{}
+	cached, _ := env.quotes.(dbutils.CachedQuoter)
+	prices := make(map[string]int)
+	missed := make(map[string]bool)
+	price := func(symbol string) (int, bool) {
+		if quote, ok := prices[symbol]; ok {
+			return quote, true
+		}
+		if missed[symbol] {
+			return 0, false
 		}
+		quote, ok := 0, false
+		if cached != nil {
+			var err error
+			quote, ok, err = cached.CachedQuote(ctx, symbol)
+			if err != nil {
+				applog.FromContext(ctx).Warn("Failed to read cached quote", "symbol", symbol, "error", err)
+			}
+			if ok {
+				if quote, err = transdb.ToBase(ctx, tdb, symbol, quote); err != nil {
+					applog.FromContext(ctx).Warn("Failed to convert cached quote", "symbol", symbol, "error", err)
+					ok = false
+				}
+			}
+		}
+		if !ok {
+			missed[symbol] = true
+			v.Unpriced = append(v.Unpriced, symbol)
+			return 0, false
+		}
+		prices[symbol] = quote
+		return quote, true
 	}
 
-	orderType, ok := vars["orderType"]
-	if ok != false {
-		if len(orderType) <= 0 {
-			return errors.New("Invalid order type\n")
+	for i := range stocks {
+		quote, ok := price(stocks[i].Symbol)
+		if !ok {
+			continue
 		}
+		value := scale.Value(stocks[i].Shares, quote)
+		stocks[i].Price = &quote
+		stocks[i].MarketValue = &value
+		v.StocksValue += value
 	}
 
-	totalValue, ok := vars["totalValue"]
-	if ok != false {
-		floatTotalValue, err := strconv.ParseFloat(totalValue, 64)
-		if floatTotalValue <= 0 || err != nil {
-			return errors.New("Invalid totalValue\n")
+	symbols := make([]string, 0, len(reservedShares))
+	for symbol := range reservedShares {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	for _, symbol := range symbols {
+		if quote, ok := price(symbol); ok {
+			v.StocksValue += scale.Value(reservedShares[symbol], quote)
 		}
 	}
 
-	err = nil
-	return err
+	v.TotalValue = v.StocksValue
+	return v
 }
 
-func (env *Env) logHandler(fn extendedHandlerFunc, command logging.Command) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		env.logger.LogCommand(command, mux.Vars(r))
-		l := fmt.Sprintf("%s - %s%s", r.Method, r.Host, r.URL)
-		err := validateURLParams(r)
-		if err != nil {
-			utils.LogErr(err, "Url params invalid.")
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			env.logger.LogErrorEvent(command, mux.Vars(r), "URL param validation failed.")
-			return
-		}
+type position struct {
+	Symbol string `json:"symbol"`
+	Shares int    `json:"shares"`
+	// Cost is the cost basis of the shares held, AverageCost per share.
+	Cost        int     `json:"cost"`
+	AverageCost float64 `json:"averageCost"`
+	Price       int     `json:"price"`
+	MarketValue int     `json:"marketValue"`
+	// UnrealizedGain and UnrealizedReturn compare the market value with
+	// the cost basis, RealizedGain totals past sales.
+	UnrealizedGain   int           `json:"unrealizedGain"`
+	UnrealizedReturn float64       `json:"unrealizedReturn"`
+	RealizedGain     int           `json:"realizedGain"`
+	Lots             []transdb.Lot `json:"lots"`
+}
 
-		log.Println(l)
-		w.Header().Set("Connection", "close")
-		fn(w, r, command)
-		vars := mux.Vars(r)
-		if val, exist := vars["trans"]; exist {
-			env.logger.LogSystemEvent(command, "ROOT_LOG", "1", "2", val)
-		}
+// ratio returns n/d, or 0 when d is 0.
+func ratio(n int, d int) float64 {
+	if d == 0 {
+		return 0
 	}
+	return float64(n) / float64(d)
 }
 
-func main() {
+// portfolio reports each position's cost basis from its lots, its value
+// at the current quote, and the profit or loss realized and unrealized.
+// Symbols the user has sold out of are listed with no shares so their
+// realized gain is still reported.
+func (env *Env) portfolio(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	trans := vars["trans"]
+	tdb := env.databases[hash(username)%len(env.databases)]
+	type payload struct {
+		CostBasis        transdb.CostBasis `json:"costBasis"`
+		Positions        []*position       `json:"positions"`
+		Cost             int               `json:"cost"`
+		MarketValue      int               `json:"marketValue"`
+		UnrealizedGain   int               `json:"unrealizedGain"`
+		UnrealizedReturn float64           `json:"unrealizedReturn"`
+		RealizedGain     int               `json:"realizedGain"`
+	}
+
+	lots, err := tdb.QueryUserLots(ctx, nil, username, "")
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to get lots for %s.", username)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+	realizations, err := tdb.QueryUserRealizations(ctx, username)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to get realized gains for %s.", username)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+
+	positions := make(map[string]*position)
+	get := func(symbol string) *position {
+		if positions[symbol] == nil {
+			positions[symbol] = &position{Symbol: symbol, Lots: []transdb.Lot{}}
+		}
+		return positions[symbol]
+	}
+	for _, lot := range lots {
+		pos := get(lot.Symbol)
+		pos.Shares += lot.Shares
+		pos.Cost += lot.Cost
+		pos.Lots = append(pos.Lots, lot)
+	}
+	for _, rz := range realizations {
+		get(rz.Symbol).RealizedGain += rz.Gain()
+	}
+
+	p := payload{CostBasis: env.costBasis, Positions: make([]*position, 0, len(positions))}
+	for _, pos := range positions {
+		p.Positions = append(p.Positions, pos)
+	}
+	sort.Slice(p.Positions, func(i, j int) bool { return p.Positions[i].Symbol < p.Positions[j].Symbol })
+
+	for _, pos := range p.Positions {
+		if pos.Shares > 0 {
+			pos.Price, err = transdb.BaseQuotes(tdb, env.quotes).QueryQuotePrice(ctx, username, pos.Symbol, trans)
+			if err != nil {
+				errMsg := fmt.Sprintf("Error getting quote from quote server for %s: %s.", username, pos.Symbol)
+				env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+				return
+			}
+		}
+		pos.AverageCost = ratio(pos.Cost, pos.Shares) * float64(tdb.ShareScale().Units())
+		pos.MarketValue = tdb.ShareScale().Value(pos.Shares, pos.Price)
+		pos.UnrealizedGain = pos.MarketValue - pos.Cost
+		pos.UnrealizedReturn = ratio(pos.UnrealizedGain, pos.Cost)
+
+		p.Cost += pos.Cost
+		p.MarketValue += pos.MarketValue
+		p.UnrealizedGain += pos.UnrealizedGain
+		p.RealizedGain += pos.RealizedGain
+	}
+	p.UnrealizedReturn = ratio(p.UnrealizedGain, p.Cost)
+
+	env.respondWithJSON(w, http.StatusOK, p)
+}
+
+// queryTime parses the query parameter name as unix seconds or an RFC 3339
+// time, returning 0 if it is absent.
+func queryTime(r *http.Request, name string) (int64, error) {
+	str := r.URL.Query().Get(name)
+	if str == "" {
+		return 0, nil
+	}
+	if n, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return n, nil
+	}
+	t, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s %s", name, str)
+	}
+	return t.Unix(), nil
+}
+
+// executionFilter reads the history query parameters. CSV exports return
+// every match unless a limit is given.
+func executionFilter(r *http.Request, export bool) (f transdb.ExecutionFilter, err error) {
+	q := r.URL.Query()
+	if f.From, err = queryTime(r, "from"); err != nil {
+		return
+	}
+	if f.To, err = queryTime(r, "to"); err != nil {
+		return
+	}
+	f.Symbol = q.Get("symbol")
+	switch side := q.Get("side"); side {
+	case "":
+	case string(models.BUY), string(models.SELL):
+		f.Side = models.OrderType(side)
+	default:
+		return f, fmt.Errorf("Invalid side %s", side)
+	}
+
+	if f.Offset, err = queryInt(r, "offset", 0); err != nil {
+		return
+	}
+	def := defaultPageLimit
+	if export {
+		def = 0
+	}
+	if f.Limit, err = queryInt(r, "limit", def); err != nil {
+		return
+	}
+	if (!export && f.Limit == 0) || f.Limit > maxPageLimit {
+		f.Limit = maxPageLimit
+	}
+	return
+}
+
+var executionCSVHeader = []string{"eid", "time", "trans", "symbol", "side", "shares", "price", "amount", "fees", "source", "currency", "fxRate", "localPrice"}
+
+// history lists the user's executions newest first. They can be filtered
+// with the from and to query parameters (unix seconds or RFC 3339), symbol
+// and side, and paged with offset and limit. With format=csv they are
+// written as a CSV attachment instead of JSON.
+func (env *Env) history(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	tdb := env.databases[hash(username)%len(env.databases)]
+	asCSV := r.URL.Query().Get("format") == "csv"
+
+	f, err := executionFilter(r, asCSV)
+	if err != nil {
+		env.respondWithError(ctx, w, http.StatusBadRequest, err, err.Error(), command, vars)
+		return
+	}
+
+	executions, total, err := tdb.QueryUserExecutions(ctx, username, f)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to get executions for %s.", username)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+
+	if !asCSV {
+		if executions == nil {
+			executions = []transdb.Execution{}
+		}
+		env.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"executions": executions,
+			"total":      total,
+			"offset":     f.Offset,
+			"limit":      f.Limit,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", username+"-executions.csv"))
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	cw := csv.NewWriter(w)
+	cw.Write(executionCSVHeader)
+	for _, e := range executions {
+		cw.Write([]string{
+			strconv.FormatInt(e.ID, 10),
+			time.Unix(e.Time, 0).UTC().Format(time.RFC3339),
+			e.Trans,
+			e.Symbol,
+			string(e.Side),
+			tdb.ShareScale().Format(e.Shares),
+			strconv.Itoa(e.Price),
+			strconv.Itoa(e.Amount),
+			strconv.Itoa(e.Fees),
+			e.Source,
+			e.Currency,
+			e.FXRate.String(),
+			strconv.Itoa(e.LocalPrice),
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		applog.FromContext(ctx).Warn("Failed to write execution history", "error", err)
+	}
+}
+
+// placeOrder places a limit or stop order for shares of symbol. Prices are
+// given in cents by the limitPrice and stopPrice query parameters, and tif
+// sets the time in force, GTC by default. The order is checked against the
+// current quote straight away.
+func (env *Env) placeOrder(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	symbol := vars["symbol"]
+	trans := vars["trans"]
+	tdb := env.databases[hash(username)%len(env.databases)]
+
+	o := transdb.Order{Username: username, Symbol: symbol, Kind: transdb.OrderKind(vars["kind"]), TimeInForce: transdb.GTC}
+	if tif := r.URL.Query().Get("tif"); tif != "" {
+		o.TimeInForce = transdb.TimeInForce(tif)
+	}
+	var err error
+	o.Shares, err = tdb.ShareScale().Parse(vars["shares"])
+	if err == nil {
+		o.LimitPrice, err = queryInt(r, "limitPrice", 0)
+	}
+	if err == nil {
+		o.StopPrice, err = queryInt(r, "stopPrice", 0)
+	}
+	if err == nil {
+		err = o.Validate()
+	}
+	if err != nil {
+		env.respondWithError(ctx, w, http.StatusBadRequest, err, err.Error(), command, vars)
+		return
+	}
+
+	quote, err := transdb.BaseQuotes(tdb, env.quotes).QueryQuotePrice(ctx, username, symbol, trans)
+	if err != nil {
+		errMsg := fmt.Sprintf("Error getting quote from quote server for %s: %s.", username, symbol)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+
+	o, err = tdb.PlaceOrderTransaction(ctx, o, quote, trans)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to place %s order for %s and %s.", o.Kind, username, symbol)
+		if err == transdb.ErrInsufficientFunds || err == transdb.ErrInsufficientShares {
+			errMsg = fmt.Sprintf("Error %s for %s order.", err, o.Kind)
+		}
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+
+	env.respondWithJSON(w, http.StatusOK, o)
+}
+
+// cancelPlacedOrder cancels an open limit or stop order, returning what it
+// held.
+func (env *Env) cancelPlacedOrder(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	trans := vars["trans"]
+	tdb := env.databases[hash(username)%len(env.databases)]
+
+	oid, err := strconv.ParseInt(vars["oid"], 10, 64)
+	if err != nil {
+		errMsg := fmt.Sprintf("Invalid order %s.", vars["oid"])
+		env.respondWithError(ctx, w, http.StatusBadRequest, err, errMsg, command, vars)
+		return
+	}
+
+	o, err := tdb.QueryOrder(ctx, nil, oid)
+	if err == nil && o.Username != username {
+		err = transdb.ErrNoRows
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("Error no order %d exists for %s.", oid, username)
+		env.respondWithError(ctx, w, http.StatusNotFound, err, errMsg, command, vars)
+		return
+	}
+
+	o, err = tdb.CloseOrderTransaction(ctx, o, transdb.OrderCancelled, trans)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to cancel order %d for %s.", oid, username)
+		code := http.StatusInternalServerError
+		if err == transdb.ErrOrderClosed {
+			code = http.StatusConflict
+		}
+		env.respondWithError(ctx, w, code, err, errMsg, command, vars)
+		return
+	}
+
+	env.respondWithJSON(w, http.StatusOK, o)
+}
+
+// listOrders returns the user's orders, only the open ones with open=true.
+func (env *Env) listOrders(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	tdb := env.databases[hash(username)%len(env.databases)]
+
+	orders, err := tdb.QueryUserOrders(ctx, username, r.URL.Query().Get("open") == "true")
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to get orders for %s.", username)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+	if orders == nil {
+		orders = []transdb.Order{}
+	}
+
+	env.respondWithJSON(w, http.StatusOK, orders)
+}
+
+// exitOrders builds the take profit and stop orders of an OCO or bracket
+// from the takeProfit, stopLoss and optional stopLimit query parameters.
+func exitOrders(r *http.Request, symbol string, shares int, tif transdb.TimeInForce) (orders []transdb.Order, err error) {
+	profit := transdb.Order{Symbol: symbol, Kind: transdb.LimitSell, Shares: shares, TimeInForce: tif}
+	stop := transdb.Order{Symbol: symbol, Kind: transdb.StopLoss, Shares: shares, TimeInForce: tif}
+	if profit.LimitPrice, err = queryInt(r, "takeProfit", 0); err != nil {
+		return
+	}
+	if stop.StopPrice, err = queryInt(r, "stopLoss", 0); err != nil {
+		return
+	}
+	if stop.LimitPrice, err = queryInt(r, "stopLimit", 0); err != nil {
+		return
+	}
+	if stop.LimitPrice != 0 {
+		stop.Kind = transdb.StopLimit
+	}
+	return []transdb.Order{profit, stop}, nil
+}
+
+// placeOrderGroup places a take profit and a stop for shares the user
+// holds as an OCO group, or with kind bracket buys them first at
+// entryPrice.
+func (env *Env) placeOrderGroup(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	symbol := vars["symbol"]
+	trans := vars["trans"]
+	tdb := env.databases[hash(username)%len(env.databases)]
+
+	g := transdb.OrderGroup{Username: username, Kind: transdb.GroupKind(vars["kind"])}
+	tif := transdb.GTC
+	if t := r.URL.Query().Get("tif"); t != "" {
+		tif = transdb.TimeInForce(t)
+	}
+	shares, err := tdb.ShareScale().Parse(vars["shares"])
+	if err == nil && g.Kind == transdb.Bracket {
+		entry := transdb.Order{Symbol: symbol, Kind: transdb.LimitBuy, Shares: shares, TimeInForce: tif}
+		entry.LimitPrice, err = queryInt(r, "entryPrice", 0)
+		g.Orders = append(g.Orders, entry)
+	}
+	var exits []transdb.Order
+	if err == nil {
+		exits, err = exitOrders(r, symbol, shares, tif)
+		g.Orders = append(g.Orders, exits...)
+	}
+	if err == nil {
+		err = g.Validate()
+	}
+	if err != nil {
+		env.respondWithError(ctx, w, http.StatusBadRequest, err, err.Error(), command, vars)
+		return
+	}
+
+	quote, err := transdb.BaseQuotes(tdb, env.quotes).QueryQuotePrice(ctx, username, symbol, trans)
+	if err != nil {
+		errMsg := fmt.Sprintf("Error getting quote from quote server for %s: %s.", username, symbol)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+
+	g, err = tdb.PlaceOrderGroupTransaction(ctx, g, quote, trans)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to place %s group for %s and %s.", vars["kind"], username, symbol)
+		if err == transdb.ErrInsufficientFunds || err == transdb.ErrInsufficientShares {
+			errMsg = fmt.Sprintf("Error %s for %s group.", err, vars["kind"])
+		}
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+
+	env.respondWithJSON(w, http.StatusOK, g)
+}
+
+// listOrderGroups returns the user's order groups, only the open ones with
+// open=true.
+func (env *Env) listOrderGroups(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	tdb := env.databases[hash(username)%len(env.databases)]
+
+	groups, err := tdb.QueryUserOrderGroups(ctx, username, r.URL.Query().Get("open") == "true")
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to get order groups for %s.", username)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+	if groups == nil {
+		groups = []transdb.OrderGroup{}
+	}
+
+	env.respondWithJSON(w, http.StatusOK, groups)
+}
+
+// summarySchedule is a schedule with its state and latest run.
+type summarySchedule struct {
+	transdb.Schedule
+	State   string               `json:"state"`
+	LastRun *transdb.ScheduleRun `json:"lastRun,omitempty"`
+}
+
+// addSchedule creates a recurring buy of amount cents of symbol, run on the
+// cadence query parameter until the optional ends time.
+func (env *Env) addSchedule(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	symbol := vars["symbol"]
+	trans := vars["trans"]
+	tdb := env.databases[hash(username)%len(env.databases)]
+
+	amount, err := strconv.Atoi(vars["amount"])
+	if err != nil {
+		errMsg := fmt.Sprintf("Invalid amount %s.", vars["amount"])
+		env.respondWithError(ctx, w, http.StatusBadRequest, err, errMsg, command, vars)
+		return
+	}
+	ends, err := queryTime(r, "ends")
+	if err != nil {
+		env.respondWithError(ctx, w, http.StatusBadRequest, err, err.Error(), command, vars)
+		return
+	}
+	sch, err := transdb.NewSchedule(username, symbol, amount, r.URL.Query().Get("cadence"), ends, env.clock.Now().Unix(), trans)
+	if err != nil {
+		env.respondWithError(ctx, w, http.StatusBadRequest, err, err.Error(), command, vars)
+		return
+	}
+
+	if _, err = tdb.QueryUser(ctx, username); err != nil {
+		errMsg := fmt.Sprintf("Failed to find user %s.", username)
+		env.respondWithError(ctx, w, http.StatusNotFound, err, errMsg, command, vars)
+		return
+	}
+
+	sch.ID, err = tdb.AddSchedule(ctx, nil, sch)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to add schedule for %s and %s.", username, symbol)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+
+	env.respondWithJSON(w, http.StatusOK, summarySchedule{Schedule: sch, State: sch.State()})
+}
+
+// userSchedule loads the {sid} schedule, responding with 404 if the user
+// has no such schedule.
+func (env *Env) userSchedule(w http.ResponseWriter, r *http.Request, command logging.Command) (tdb transdb.TransactionDataStore, sch transdb.Schedule, ok bool) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	tdb = env.databases[hash(username)%len(env.databases)]
+
+	sid, err := strconv.ParseInt(vars["sid"], 10, 64)
+	if err == nil {
+		sch, err = tdb.QuerySchedule(ctx, nil, sid)
+	}
+	if err == nil && sch.Username != username {
+		err = transdb.ErrNoRows
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("Error no schedule %s exists for %s.", vars["sid"], username)
+		env.respondWithError(ctx, w, http.StatusNotFound, err, errMsg, command, vars)
+		return
+	}
+	return tdb, sch, true
+}
+
+// pauseSchedule stops a schedule running until it is resumed.
+func (env *Env) pauseSchedule(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	env.setSchedulePaused(w, r, command, true)
+}
+
+// resumeSchedule restarts a paused schedule from its next run after now.
+func (env *Env) resumeSchedule(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	env.setSchedulePaused(w, r, command, false)
+}
+
+func (env *Env) setSchedulePaused(w http.ResponseWriter, r *http.Request, command logging.Command, paused bool) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	tdb, sch, ok := env.userSchedule(w, r, command)
+	if !ok {
+		return
+	}
+
+	var err error
+	if paused {
+		sch.Paused = true
+	} else {
+		err = sch.Resume(env.clock.Now().Unix())
+	}
+	if err == nil {
+		err = tdb.UpdateSchedule(ctx, nil, sch)
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to update schedule %d for %s.", sch.ID, sch.Username)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+
+	env.respondWithJSON(w, http.StatusOK, summarySchedule{Schedule: sch, State: sch.State()})
+}
+
+// deleteSchedule removes a schedule. Its runs stay in the run history.
+func (env *Env) deleteSchedule(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	tdb, sch, ok := env.userSchedule(w, r, command)
+	if !ok {
+		return
+	}
+
+	if err := tdb.RemoveSchedule(ctx, nil, sch.ID); err != nil {
+		errMsg := fmt.Sprintf("Failed to delete schedule %d for %s.", sch.ID, sch.Username)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+
+	env.respondWithJSON(w, http.StatusOK, sch)
+}
+
+// listSchedules returns the user's schedules with their state and latest
+// run.
+func (env *Env) listSchedules(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	tdb := env.databases[hash(username)%len(env.databases)]
+
+	schedules, err := tdb.QueryUserSchedules(ctx, username)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to get schedules for %s.", username)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+
+	summaries := make([]summarySchedule, 0, len(schedules))
+	for _, sch := range schedules {
+		summary := summarySchedule{Schedule: sch, State: sch.State()}
+		runs, err := tdb.QueryScheduleRuns(ctx, username, sch.ID, 1)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to get runs of schedule %d for %s.", sch.ID, username)
+			env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+			return
+		}
+		if len(runs) > 0 {
+			summary.LastRun = &runs[0]
+		}
+		summaries = append(summaries, summary)
+	}
+
+	env.respondWithJSON(w, http.StatusOK, summaries)
+}
+
+// scheduleRuns returns the runs of the user's schedules, newest first,
+// limited to those of one schedule with sid.
+func (env *Env) scheduleRuns(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	tdb := env.databases[hash(username)%len(env.databases)]
+
+	var sid int64
+	limit, err := queryInt(r, "limit", defaultPageLimit)
+	if err == nil && r.URL.Query().Get("sid") != "" {
+		sid, err = strconv.ParseInt(r.URL.Query().Get("sid"), 10, 64)
+	}
+	if err != nil {
+		env.respondWithError(ctx, w, http.StatusBadRequest, err, err.Error(), command, vars)
+		return
+	}
+	if limit == 0 || limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+
+	runs, err := tdb.QueryScheduleRuns(ctx, username, sid, limit)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to get schedule runs for %s.", username)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+	if runs == nil {
+		runs = []transdb.ScheduleRun{}
+	}
+
+	env.respondWithJSON(w, http.StatusOK, runs)
+}
+
+// setSymbolCurrency records the currency a symbol is quoted in on every
+// database, so its quotes are converted into the base currency.
+func (env *Env) setSymbolCurrency(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	symbol := vars["symbol"]
+
+	currency, err := transdb.ParseCurrency(vars["currency"])
+	if err != nil {
+		env.respondWithError(ctx, w, http.StatusBadRequest, err, err.Error(), command, vars)
+		return
+	}
+
+	for i := 0; i < len(env.databases); i++ {
+		if err := env.databases[i].SetSymbolCurrency(ctx, symbol, currency); err != nil {
+			errMsg := fmt.Sprintf("Failed to set currency of %s.", symbol)
+			env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+			return
+		}
+	}
+
+	env.respondWithJSON(w, http.StatusOK, map[string]string{"symbol": symbol, "currency": currency})
+}
+
+// exchange converts an amount of one of the user's balances into another
+// currency at the current rate.
+func (env *Env) exchange(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	tdb := env.databases[hash(username)%len(env.databases)]
+
+	from, err := transdb.ParseCurrency(vars["from"])
+	if err != nil {
+		env.respondWithError(ctx, w, http.StatusBadRequest, err, err.Error(), command, vars)
+		return
+	}
+	to, err := transdb.ParseCurrency(vars["to"])
+	if err != nil {
+		env.respondWithError(ctx, w, http.StatusBadRequest, err, err.Error(), command, vars)
+		return
+	}
+	amount, err := strconv.Atoi(vars["amount"])
+	if err != nil || amount <= 0 || from == to {
+		errMsg := fmt.Sprintf("Invalid exchange of %s %s to %s.", vars["amount"], from, to)
+		env.respondWithError(ctx, w, http.StatusBadRequest, errors.New(errMsg), errMsg, command, vars)
+		return
+	}
+
+	ex, err := tdb.ExchangeTransaction(ctx, username, from, to, amount, vars["trans"])
+	if err != nil {
+		code, errMsg := http.StatusInternalServerError, fmt.Sprintf("Failed to exchange %s for %s.", from, username)
+		switch err {
+		case transdb.ErrInsufficientFunds:
+			code, errMsg = http.StatusBadRequest, fmt.Sprintf("%s has less than %d %s.", username, amount, from)
+		case transdb.ErrNoRates:
+			code, errMsg = http.StatusServiceUnavailable, "Exchange rates are not configured."
+		}
+		env.respondWithError(ctx, w, code, err, errMsg, command, vars)
+		return
+	}
+
+	env.respondWithJSON(w, http.StatusOK, ex)
+}
+
+// withdraw takes cash out of the user's available balance.
+func (env *Env) withdraw(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	tdb := env.databases[hash(username)%len(env.databases)]
+
+	amount, err := strconv.Atoi(vars["amount"])
+	if err != nil || amount <= 0 {
+		errMsg := fmt.Sprintf("Invalid withdrawal of %s.", vars["amount"])
+		env.respondWithError(ctx, w, http.StatusBadRequest, errors.New(errMsg), errMsg, command, vars)
+		return
+	}
+
+	t, err := tdb.WithdrawTransaction(ctx, username, amount, vars["trans"])
+	if err != nil {
+		code, errMsg := http.StatusInternalServerError, fmt.Sprintf("Failed to withdraw %d for %s.", amount, username)
+		switch err {
+		case transdb.ErrInsufficientFunds:
+			code, errMsg = http.StatusConflict, fmt.Sprintf("%s has less than %d available.", username, amount)
+		case transdb.ErrNoRows:
+			code, errMsg = http.StatusNotFound, fmt.Sprintf("No such user %s exists.", username)
+		}
+		env.respondWithError(ctx, w, code, err, errMsg, command, vars)
+		return
+	}
+
+	env.respondWithJSON(w, http.StatusOK, t)
+}
+
+// transfer moves cash from the user to another. A transfer to a user on
+// another database that can't be finished right away is accepted pending
+// and finished by the transfer recovery.
+func (env *Env) transfer(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	recipient := vars["recipient"]
+
+	amount, err := strconv.Atoi(vars["amount"])
+	if err != nil || amount <= 0 {
+		errMsg := fmt.Sprintf("Invalid transfer of %s.", vars["amount"])
+		env.respondWithError(ctx, w, http.StatusBadRequest, errors.New(errMsg), errMsg, command, vars)
+		return
+	}
+
+	t, err := transdb.TransferMoney(ctx, env.userDatabase(username), env.userDatabase(recipient), env.clock.Now().Unix(), username, recipient, amount, vars["trans"])
+	if err == transdb.ErrSelfTransfer {
+		env.respondWithError(ctx, w, http.StatusBadRequest, err, "Cannot transfer to yourself.", command, vars)
+		return
+	} else if err != nil {
+		code, errMsg := http.StatusInternalServerError, fmt.Sprintf("Failed to transfer %d from %s to %s.", amount, username, recipient)
+		switch err {
+		case transdb.ErrInsufficientFunds:
+			code, errMsg = http.StatusConflict, fmt.Sprintf("%s has less than %d available.", username, amount)
+		case transdb.ErrNoRecipient:
+			code, errMsg = http.StatusNotFound, fmt.Sprintf("%s does not exist or is closed.", recipient)
+		case transdb.ErrNoRows:
+			code, errMsg = http.StatusNotFound, fmt.Sprintf("No such user %s exists.", username)
+		}
+		env.respondWithError(ctx, w, code, err, errMsg, command, vars)
+		return
+	}
+
+	code := http.StatusOK
+	if t.State == transdb.TransferPending {
+		code = http.StatusAccepted
+	}
+	env.respondWithJSON(w, code, t)
+}
+
+// listTransfers returns the user's withdrawals and transfers newest first,
+// paged with limit.
+func (env *Env) listTransfers(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	tdb := env.databases[hash(username)%len(env.databases)]
+
+	limit, err := queryInt(r, "limit", defaultPageLimit)
+	if err != nil {
+		env.respondWithError(ctx, w, http.StatusBadRequest, err, err.Error(), command, vars)
+		return
+	}
+	if limit == 0 || limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+
+	transfers, err := tdb.QueryUserTransfers(ctx, username, limit)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to get transfers for %s.", username)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+	if transfers == nil {
+		transfers = []transdb.Transfer{}
+	}
+
+	env.respondWithJSON(w, http.StatusOK, transfers)
+}
+
+// queryAccount returns the user and the status of their account.
+func queryAccount(ctx context.Context, tdb transdb.TransactionDataStore, username string) (acct transdb.Account, err error) {
+	if acct.User, err = tdb.QueryUser(ctx, username); err != nil {
+		return
+	}
+	acct.Status, err = tdb.QueryUserStatus(ctx, nil, username)
+	return
+}
+
+// respondWithAccount answers with the user's account, or the error getting
+// it.
+func (env *Env) respondWithAccount(w http.ResponseWriter, r *http.Request, command logging.Command, code int) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	tdb := env.databases[hash(username)%len(env.databases)]
+
+	acct, err := queryAccount(ctx, tdb, username)
+	if err != nil {
+		errMsg := fmt.Sprintf("Error retrieving user %s.", username)
+		if err == transdb.ErrNoRows {
+			errMsg = fmt.Sprintf("No such user %s exists.", username)
+		}
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+	env.respondWithJSON(w, code, acct)
+}
+
+// createUser creates an active user, with the money query parameter as
+// their balance.
+func (env *Env) createUser(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	tdb := env.databases[hash(username)%len(env.databases)]
+
+	money, err := queryInt(r, "money", 0)
+	if err != nil {
+		env.respondWithError(ctx, w, http.StatusBadRequest, err, err.Error(), command, vars)
+		return
+	}
+
+	if _, err = tdb.QueryUser(ctx, username); err == nil {
+		errMsg := fmt.Sprintf("User %s already exists.", username)
+		env.respondWithError(ctx, w, http.StatusConflict, errors.New(errMsg), errMsg, command, vars)
+		return
+	} else if err != transdb.ErrNoRows {
+		errMsg := fmt.Sprintf("Error retrieving user %s.", username)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+
+	if err = tdb.InsertUser(ctx, models.User{Username: username, Money: money}); err != nil {
+		errMsg := fmt.Sprintf("Failed to create user %s.", username)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+	env.respondWithAccount(w, r, command, http.StatusCreated)
+}
+
+// getUser returns the user's balance and account status.
+func (env *Env) getUser(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	env.respondWithAccount(w, r, command, http.StatusOK)
+}
+
+// updateUser sets the user's balance with the money query parameter, and
+// suspends or reinstates them with status. Closing and closed accounts
+// can't be changed.
+func (env *Env) updateUser(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	tdb := env.databases[hash(username)%len(env.databases)]
+	errMsg := fmt.Sprintf("Failed to update user %s.", username)
+
+	acct, err := queryAccount(ctx, tdb, username)
+	if err != nil {
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+	if acct.Status == transdb.UserClosing || acct.Status == transdb.UserClosed {
+		errMsg = fmt.Sprintf("The account of %s is %s.", username, acct.Status)
+		env.respondWithError(ctx, w, http.StatusConflict, acct.Status.Err(), errMsg, command, vars)
+		return
+	}
+
+	status := acct.Status
+	if str := r.URL.Query().Get("status"); str != "" {
+		if status, err = transdb.ParseUserStatus(str); err == nil && (status == transdb.UserClosing || status == transdb.UserClosed) {
+			err = errors.New("accounts are closed with closeUser")
+		}
+		if err != nil {
+			env.respondWithError(ctx, w, http.StatusBadRequest, err, err.Error(), command, vars)
+			return
+		}
+	}
+	money, err := queryInt(r, "money", acct.Money)
+	if err != nil {
+		env.respondWithError(ctx, w, http.StatusBadRequest, err, err.Error(), command, vars)
+		return
+	}
+
+	if money != acct.Money {
+		acct.Money = money
+		if err = tdb.UpdateUser(ctx, acct.User); err != nil {
+			env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+			return
+		}
+	}
+	if status != acct.Status {
+		if err = tdb.SetUserStatus(ctx, nil, username, status); err != nil {
+			env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+			return
+		}
+	}
+	env.respondWithAccount(w, r, command, http.StatusOK)
+}
+
+// suspendUser stops the user trading or moving money until they are
+// reinstated with updateUser.
+func (env *Env) suspendUser(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	tdb := env.databases[hash(username)%len(env.databases)]
+
+	status, err := tdb.QueryUserStatus(ctx, nil, username)
+	if err == nil && (status == transdb.UserClosing || status == transdb.UserClosed) {
+		errMsg := fmt.Sprintf("The account of %s is %s.", username, status)
+		env.respondWithError(ctx, w, http.StatusConflict, status.Err(), errMsg, command, vars)
+		return
+	}
+	if err == nil {
+		err = tdb.SetUserStatus(ctx, nil, username, transdb.UserSuspended)
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to suspend user %s.", username)
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+	env.respondWithAccount(w, r, command, http.StatusOK)
+}
+
+// closeUser closes the user's account. With liquidate=true their triggers
+// and orders are cancelled and their shares sold; otherwise they must have
+// none. Closing an account left closing by a failed close finishes it.
+func (env *Env) closeUser(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	tdb := env.databases[hash(username)%len(env.databases)]
+	liquidate := r.URL.Query().Get("liquidate") == "true"
+
+	err := transdb.CloseAccount(ctx, tdb, username, liquidate, env.quotes, vars["trans"])
+	if err != nil {
+		code, errMsg := http.StatusInternalServerError, fmt.Sprintf("Failed to close the account of %s.", username)
+		switch err {
+		case transdb.ErrOpenPositions:
+			code, errMsg = http.StatusConflict, fmt.Sprintf("%s still holds shares, triggers or orders; close with liquidate=true to sell them.", username)
+		case transdb.ErrUserClosed:
+			code, errMsg = http.StatusConflict, fmt.Sprintf("The account of %s is already closed.", username)
+		case transdb.ErrNoRows:
+			errMsg = fmt.Sprintf("No such user %s exists.", username)
+		}
+		env.respondWithError(ctx, w, code, err, errMsg, command, vars)
+		return
+	}
+	env.respondWithAccount(w, r, command, http.StatusOK)
+}
+
+// deleteUser removes every row belonging to a closed account, once
+// everything left in it has been withdrawn.
+func (env *Env) deleteUser(w http.ResponseWriter, r *http.Request, command logging.Command) {
+	vars := mux.Vars(r)
+	ctx := r.Context()
+	username := vars["username"]
+	tdb := env.databases[hash(username)%len(env.databases)]
+	errMsg := fmt.Sprintf("Failed to delete user %s.", username)
+
+	status, err := tdb.QueryUserStatus(ctx, nil, username)
+	if err != nil {
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+	if status != transdb.UserClosed {
+		errMsg = fmt.Sprintf("The account of %s must be closed before it is deleted.", username)
+		env.respondWithError(ctx, w, http.StatusConflict, errors.New(errMsg), errMsg, command, vars)
+		return
+	}
+	if err = transdb.CheckEmpty(ctx, tdb, username); err == transdb.ErrFundsLeft {
+		errMsg = fmt.Sprintf("%s still has money or a pending transfer; withdraw it before deleting the account.", username)
+		env.respondWithError(ctx, w, http.StatusConflict, err, errMsg, command, vars)
+		return
+	} else if err != nil {
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+
+	if err = tdb.DeleteUser(ctx, username); err != nil {
+		env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("Deleted user %s.", username)))
+}
+
+func validateURLParams(r *http.Request) (err error) {
+	vars := mux.Vars(r)
+
+	username, ok := vars["username"]
+	if ok != false {
+		if len(username) <= 0 {
+			return errors.New("Invalid username\n")
+		}
+	}
+
+	stock, ok := vars["stock"]
+	if ok != false {
+		// v, err := strconv.Atoi(stock)
+		if len(stock) <= 0 || len(stock) > 3 {
+			return errors.New("Invalid stock\n")
+		}
+		// allows stocks to be numbers
+		// could add check for stocks not being number values
+	}
+
+	amount, ok := vars["amount"]
+	if ok != false {
+		floatAmount, err := strconv.ParseFloat(amount, 64)
+		if floatAmount <= 0 || err != nil {
+			return errors.New("Invalid amount\n")
+		}
+	}
+
+	money, ok := vars["money"]
+	if ok != false {
+		floatMoney, err := strconv.ParseFloat(money, 64)
+		if floatMoney <= 0 || err != nil {
+			return errors.New("Invalid money\n")
+		}
+	}
+
+	triggerPrice, ok := vars["triggerPrice"]
+	if ok != false {
+		floatTriggerPrice, err := strconv.ParseFloat(triggerPrice, 64)
+		if floatTriggerPrice <= 0 || err != nil {
+			return errors.New("Invalid trigger price\n")
+		}
+	}
+
+	shares, ok := vars["shares"]
+	if ok != false {
+		floatShares, err := strconv.ParseFloat(shares, 64)
+		if floatShares <= 0 || err != nil {
+			return errors.New("Invalid number of shares\n")
+		}
+	}
+
+	orderType, ok := vars["orderType"]
+	if ok != false {
+		if len(orderType) <= 0 {
+			return errors.New("Invalid order type\n")
+		}
+	}
+
+	totalValue, ok := vars["totalValue"]
+	if ok != false {
+		floatTotalValue, err := strconv.ParseFloat(totalValue, 64)
+		if floatTotalValue <= 0 || err != nil {
+			return errors.New("Invalid totalValue\n")
+		}
+	}
+
+	err = nil
+	return err
+}
+
+// statusWriter records the status code written by a handler.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	sw.status = code
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+// authHandler authenticates the caller before running next. Routes needing
+// role admin reject everyone else, and a {username} in the path must be the
+// caller's own unless they are an admin. A nil env.auth disables the check.
+func (env *Env) authHandler(role auth.Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if env.auth == nil {
+			next(w, r)
+			return
+		}
+
+		p, err := env.auth.Authenticate(r)
+		if err != nil {
+			env.log.Warn("Authentication failed.", "url", r.URL.String(), "error", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="transaction-service"`)
+			env.respondWithJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error(), "message": "Authentication required."})
+			return
+		}
+
+		username, hasUser := mux.Vars(r)["username"]
+		if (role == auth.RoleAdmin && !p.IsAdmin()) || (hasUser && !p.CanActAs(username)) {
+			env.log.Warn("Authorization failed.", "principal", p.Name, "role", p.Role, "url", r.URL.String())
+			errMsg := fmt.Sprintf("%s is not allowed to perform this action.", p.Name)
+			env.respondWithJSON(w, http.StatusForbidden, map[string]string{"error": auth.ErrForbidden.Error(), "message": errMsg})
+			return
+		}
+
+		next(w, r.WithContext(auth.WithPrincipal(r.Context(), p)))
+	}
+}
+
+// rateLimitHandler takes a token from the caller's bucket and the global
+// bucket for class, answering 429 with Retry-After when either is empty.
+func (env *Env) rateLimitHandler(class ratelimit.Class, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limits, ok := env.limits[class]
+		if env.limiter == nil || !ok {
+			next(w, r)
+			return
+		}
+
+		user := mux.Vars(r)["username"]
+		if p, ok := auth.FromContext(r.Context()); ok && user == "" {
+			user = p.Name
+		}
+
+		buckets := []struct {
+			key   string
+			limit ratelimit.Limit
+		}{
+			{fmt.Sprintf("%s:user:%s", class, user), limits.PerUser},
+			{fmt.Sprintf("%s:global", class), limits.Global},
+		}
+		for _, b := range buckets {
+			allowed, wait, err := env.limiter.Allow(r.Context(), b.key, b.limit)
+			if err != nil {
+				// fail open, an unavailable limiter shouldn't take down trading
+				env.log.Error("Rate limiter failed.", "key", b.key, "error", err)
+				continue
+			}
+			if !allowed {
+				env.log.Warn("Rate limit exceeded.", "key", b.key, "retry_after", wait)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				env.respondWithJSON(w, http.StatusTooManyRequests, map[string]string{"error": "Rate limit exceeded", "message": fmt.Sprintf("Too many %s requests, retry after %s.", class, wait)})
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+// sequenceHandler queues fn behind the user's other commands so they run one
+// at a time in transaction number order. Commands without a {username} run
+// immediately.
+func (env *Env) sequenceHandler(fn extendedHandlerFunc) extendedHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, command logging.Command) {
+		vars := mux.Vars(r)
+		username, ok := vars["username"]
+		if env.seq == nil || !ok {
+			fn(w, r, command)
+			return
+		}
+
+		// commands without a transaction number go after numbered ones
+		trans, err := strconv.Atoi(vars["trans"])
+		if err != nil {
+			trans = math.MaxInt32
+		}
+
+		ctx := r.Context()
+		err = env.seq.Submit(ctx, username, trans, func() { fn(w, r, command) })
+		if err == context.Canceled {
+			// the client went away, there is no one to answer
+			return
+		} else if err == sequencer.ErrClosed {
+			env.respondWithError(ctx, w, http.StatusServiceUnavailable, err, "Server is shutting down.", command, vars)
+		} else if err == sequencer.ErrPanicked {
+			env.respondWithError(ctx, w, http.StatusInternalServerError, err, "Failed to run the command.", command, vars)
+		} else if err != nil {
+			errMsg := fmt.Sprintf("Timed out waiting for earlier commands for %s.", username)
+			env.respondWithError(ctx, w, http.StatusServiceUnavailable, err, errMsg, command, vars)
+		}
+	}
+}
+
+// requireStatus answers 403 unless the user's account has one of the
+// allowed statuses. Unknown users are passed on for fn to report.
+func (env *Env) requireStatus(fn extendedHandlerFunc, allowed ...transdb.UserStatus) extendedHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, command logging.Command) {
+		vars := mux.Vars(r)
+		ctx := r.Context()
+		username := vars["username"]
+		tdb := env.databases[hash(username)%len(env.databases)]
+
+		status, err := tdb.QueryUserStatus(ctx, nil, username)
+		if err != nil && err != transdb.ErrNoRows {
+			errMsg := fmt.Sprintf("Error retrieving user %s.", username)
+			env.respondWithError(ctx, w, http.StatusInternalServerError, err, errMsg, command, vars)
+			return
+		}
+		if err == nil {
+			ok := false
+			for _, st := range allowed {
+				ok = ok || status == st
+			}
+			if !ok {
+				errMsg := fmt.Sprintf("The account of %s is %s.", username, status)
+				env.respondWithError(ctx, w, http.StatusForbidden, status.Err(), errMsg, command, vars)
+				return
+			}
+		}
+		fn(w, r, command)
+	}
+}
+
+// chain wraps a command handler in the standard middleware: authentication
+// and authorization, rate limiting, logging and deadlines, then per-user
+// ordering.
+func (env *Env) chain(role auth.Role, class ratelimit.Class, fn extendedHandlerFunc, command logging.Command) http.HandlerFunc {
+	return env.authHandler(role, env.rateLimitHandler(class, env.logHandler(env.sequenceHandler(fn), command)))
+}
+
+func (env *Env) logHandler(fn extendedHandlerFunc, command logging.Command) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		env.logger.LogCommand(command, vars)
+
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = applog.NewRequestID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		// continue any trace started by the web server in front of us
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		spanName := string(command)
+		if route := mux.CurrentRoute(r); spanName == "" && route != nil {
+			if tpl, err := route.GetPathTemplate(); err == nil {
+				spanName = tpl
+			}
+		}
+		ctx, span := tracing.StartKind(ctx, spanName, trace.SpanKindServer,
+			attribute.String("http.method", r.Method),
+			attribute.String("app.request_id", requestID),
+			attribute.String("app.username", vars["username"]),
+			attribute.String("app.trans", vars["trans"]),
+		)
+		defer span.End()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		w = sw
+		defer func() {
+			span.SetAttributes(attribute.Int("http.status_code", sw.status))
+			if sw.status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(sw.status))
+			}
+		}()
+
+		log := env.log.With(
+			slog.String(applog.RequestIDKey, requestID),
+			slog.String(applog.UsernameKey, vars["username"]),
+			slog.String(applog.CommandKey, string(command)),
+			slog.String(applog.TransKey, vars["trans"]),
+			slog.String("trace_id", span.SpanContext().TraceID().String()),
+		)
+		ctx = applog.WithLogger(ctx, log)
+
+		err := validateURLParams(r)
+		if err != nil {
+			log.Warn("Url params invalid.", "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			env.logger.LogErrorEvent(command, vars, "URL param validation failed.")
+			return
+		}
+
+		log.Info("Handling request", "method", r.Method, "host", r.Host, "url", r.URL.String())
+		w.Header().Set("Connection", "close")
+
+		ctx, cancel := context.WithTimeout(ctx, env.requestTimeout)
+		defer cancel()
+		fn(w, r.WithContext(ctx), command)
+		if val, exist := vars["trans"]; exist {
+			env.logger.LogSystemEvent(command, "ROOT_LOG", "1", "2", val)
+		}
+	}
+}
+
+// newRouter registers every command route, and the static client, on a new
+// router.
+func (env *Env) newRouter() *mux.Router {
+	router := mux.NewRouter()
+	active := func(fn extendedHandlerFunc) extendedHandlerFunc {
+		return env.requireStatus(fn, transdb.UserActive)
+	}
+	// suspended users can still cancel what they have open, to get its cash
+	// or shares back, but nothing is cancelled under a close in progress,
+	// which cancels everything itself
+	cancellable := func(fn extendedHandlerFunc) extendedHandlerFunc {
+		return env.requireStatus(fn, transdb.UserActive, transdb.UserSuspended)
+	}
+
+	router.HandleFunc("/api/clearUsers", env.chain(auth.RoleAdmin, ratelimit.Admin, env.clearUsers, ""))
+	router.HandleFunc("/api/availableBalance/{username}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, env.availableBalance, ""))
+	router.HandleFunc("/api/availableShares/{username}/{symbol}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, env.availableShares, ""))
+
+	router.HandleFunc("/api/add/{username}/{money}/{trans}", env.chain(auth.RoleAdmin, ratelimit.Admin, env.addUser, logging.ADD))
+	router.HandleFunc("/api/getQuote/{username}/{symbol}/{trans}", env.chain(auth.RoleUser, ratelimit.Quote, env.getQuoute, logging.QUOTE))
+
+	router.HandleFunc("/api/buy/{username}/{symbol}/{amount}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, active(env.buyOrder), logging.BUY))
+	router.HandleFunc("/api/buyShares/{username}/{symbol}/{shares}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, active(env.buyShares), logging.BUY))
+	router.HandleFunc("/api/commitBuy/{username}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, active(env.commitBuy), logging.COMMIT_BUY))
+	router.HandleFunc("/api/cancelBuy/{username}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, cancellable(env.cancelBuy), logging.CANCEL_BUY))
+
+	router.HandleFunc("/api/sell/{username}/{symbol}/{amount}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, active(env.sellOrder), logging.SELL))
+	router.HandleFunc("/api/sellShares/{username}/{symbol}/{shares}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, active(env.sellShares), logging.SELL))
+	router.HandleFunc("/api/sellAll/{username}/{symbol}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, active(env.sellAll), logging.SELL))
+	router.HandleFunc("/api/commitSell/{username}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, active(env.commitSell), logging.COMMIT_SELL))
+	router.HandleFunc("/api/cancelSell/{username}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, cancellable(env.cancelSell), logging.CANCEL_SELL))
+
+	router.HandleFunc("/api/setBuyAmount/{username}/{symbol}/{amount}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, active(env.setBuyAmount), logging.SET_BUY_AMOUNT))
+	router.HandleFunc("/api/setBuyTrigger/{username}/{symbol}/{triggerPrice}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, active(env.setBuyTrigger), logging.SET_BUY_TRIGGER))
+	router.HandleFunc("/api/cancelSetBuy/{username}/{symbol}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, cancellable(env.cancelSetBuy), logging.CANCEL_SET_BUY))
+
+	router.HandleFunc("/api/setSellAmount/{username}/{symbol}/{amount}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, active(env.setSellAmount), logging.SET_SELL_AMOUNT))
+	router.HandleFunc("/api/cancelSetSell/{username}/{symbol}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, cancellable(env.cancelSetSell), logging.CANCEL_SET_SELL))
+	router.HandleFunc("/api/setSellTrigger/{username}/{symbol}/{triggerPrice}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, active(env.setSellTrigger), logging.SET_SELL_TRIGGER))
+	router.HandleFunc("/api/setSellTrailingStop/{username}/{symbol}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, active(env.setSellTrailingStop), logging.SET_SELL_TRIGGER))
+
+	router.HandleFunc("/api/dumplog/{filename}/{trans}", env.chain(auth.RoleAdmin, ratelimit.Admin, env.dumplog, logging.DUMPLOG))
+	router.HandleFunc("/api/dumplog/{filename}/{username}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, env.dumplogUser, logging.DUMPLOG))
+	router.HandleFunc("/api/displaySummary/{username}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, env.displaySummary, logging.DISPLAY_SUMMARY))
+	router.HandleFunc("/api/portfolio/{username}/{trans}", env.chain(auth.RoleUser, ratelimit.Quote, env.portfolio, ""))
+	router.HandleFunc("/api/history/{username}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, env.history, ""))
+
+	router.HandleFunc("/api/placeOrder/{username}/{symbol}/{kind}/{shares}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, active(env.placeOrder), ""))
+	router.HandleFunc("/api/cancelOrder/{username}/{oid}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, cancellable(env.cancelPlacedOrder), ""))
+	router.HandleFunc("/api/orders/{username}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, env.listOrders, ""))
+	router.HandleFunc("/api/placeOrderGroup/{username}/{symbol}/{kind}/{shares}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, active(env.placeOrderGroup), ""))
+	router.HandleFunc("/api/orderGroups/{username}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, env.listOrderGroups, ""))
+
+	router.HandleFunc("/api/addSchedule/{username}/{symbol}/{amount}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, active(env.addSchedule), ""))
+	router.HandleFunc("/api/pauseSchedule/{username}/{sid}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, cancellable(env.pauseSchedule), ""))
+	router.HandleFunc("/api/resumeSchedule/{username}/{sid}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, active(env.resumeSchedule), ""))
+	router.HandleFunc("/api/deleteSchedule/{username}/{sid}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, cancellable(env.deleteSchedule), ""))
+	router.HandleFunc("/api/schedules/{username}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, env.listSchedules, ""))
+	router.HandleFunc("/api/scheduleRuns/{username}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, env.scheduleRuns, ""))
+
+	router.HandleFunc("/api/setSymbolCurrency/{symbol}/{currency}/{trans}", env.chain(auth.RoleAdmin, ratelimit.Admin, env.setSymbolCurrency, ""))
+	router.HandleFunc("/api/exchange/{username}/{from}/{to}/{amount}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, active(env.exchange), ""))
+
+	router.HandleFunc("/api/withdraw/{username}/{amount}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, env.requireStatus(env.withdraw, transdb.UserActive, transdb.UserClosed), ""))
+	router.HandleFunc("/api/transfer/{username}/{recipient}/{amount}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, active(env.transfer), ""))
+	router.HandleFunc("/api/transfers/{username}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, env.listTransfers, ""))
+
+	router.HandleFunc("/api/createUser/{username}/{trans}", env.chain(auth.RoleAdmin, ratelimit.Admin, env.createUser, ""))
+	router.HandleFunc("/api/user/{username}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, env.getUser, ""))
+	router.HandleFunc("/api/updateUser/{username}/{trans}", env.chain(auth.RoleAdmin, ratelimit.Admin, env.updateUser, ""))
+	router.HandleFunc("/api/suspendUser/{username}/{trans}", env.chain(auth.RoleAdmin, ratelimit.Admin, env.suspendUser, ""))
+	router.HandleFunc("/api/closeUser/{username}/{trans}", env.chain(auth.RoleUser, ratelimit.Order, env.closeUser, ""))
+	router.HandleFunc("/api/deleteUser/{username}/{trans}", env.chain(auth.RoleAdmin, ratelimit.Admin, env.deleteUser, ""))
+
+	router.PathPrefix("/").Handler(http.FileServer(http.Dir("./static/")))
+	// router.HandleFunc("/api/executeTriggers/{username}/{trans}", env.logHandler(env.executeTriggerTest, ""))
+	return router
+}
+
+// sequencerOptionsFromEnv reads USER_QUEUE_SHARDS, USER_QUEUE_SIZE and
+// USER_QUEUE_HOLD over the defaults. Zero shards turns ordering off.
+func sequencerOptionsFromEnv() (opts sequencer.Options, err error) {
+	opts = defaultSequencerOptions
+	for _, v := range []struct {
+		name string
+		dst  *int
+	}{{"USER_QUEUE_SHARDS", &opts.Shards}, {"USER_QUEUE_SIZE", &opts.QueueSize}} {
+		if str, ok := os.LookupEnv(v.name); ok {
+			if *v.dst, err = strconv.Atoi(str); err != nil || *v.dst < 0 {
+				return opts, fmt.Errorf("invalid %s %s", v.name, str)
+			}
+		}
+	}
+	if str, ok := os.LookupEnv("USER_QUEUE_HOLD"); ok {
+		if opts.Hold, err = time.ParseDuration(str); err != nil {
+			return opts, fmt.Errorf("invalid USER_QUEUE_HOLD %s: %s", str, err)
+		}
+	}
+	return opts, nil
+}
+
+// feeScheduleFromEnv reads the default commission from FEES and per-symbol
+// overrides from FEES_<SYMBOL>, each written like "flat=5,rate=25,min=10".
+func feeScheduleFromEnv(environ []string) (fees transdb.FeeSchedule, err error) {
+	for _, kv := range environ {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			continue
+		}
+		name, value := kv[:i], kv[i+1:]
+		if name != "FEES" && !strings.HasPrefix(name, "FEES_") {
+			continue
+		}
+		rule, err := transdb.ParseFeeRule(value)
+		if err != nil {
+			return fees, fmt.Errorf("invalid %s: %s", name, err)
+		}
+		if name == "FEES" {
+			fees.Default = rule
+			continue
+		}
+		if fees.Symbols == nil {
+			fees.Symbols = make(map[string]transdb.FeeRule)
+		}
+		fees.Symbols[strings.TrimPrefix(name, "FEES_")] = rule
+	}
+	return fees, nil
+}
+
+// newEnv connects to the databases, quote cache and audit log named by the
+// environment. Authentication and rate limiting are left off, main turns
+// them on for the API server.
+func newEnv(log *slog.Logger) (*Env, error) {
 	logger := logging.NewLoggerConnection()
-	quoteCache := transdb.NewQuoteCacheConnection()
-	defer quoteCache.Close()
+	quoteCache := transdb.NewQuoteCacheConnection(log)
+
+	costBasis := transdb.FIFO
+	var err error
+	if str, ok := os.LookupEnv("COST_BASIS"); ok {
+		if costBasis, err = transdb.ParseCostBasis(str); err != nil {
+			return nil, err
+		}
+	}
+
+	tdb := transdb.NewTransactionDBConnection(log, clock.Real, "transdb", "5432")
+	tdb.CostBasis = costBasis
+	if tdb.FeeSchedule, err = feeScheduleFromEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+	if path, ok := os.LookupEnv("FX_RATES_FILE"); ok {
+		rates, err := dbutils.LoadStaticRates(path)
+		if err != nil {
+			return nil, err
+		}
+		tdb.Rates = rates
+	}
 
-	tdb := transdb.NewTransactionDBConnection("transdb", "5432")
-	defer tdb.DB.Close()
+	scale := transdb.WholeShares
+	if os.Getenv("FRACTIONAL_SHARES") == "true" {
+		scale = transdb.MicroShares
+	}
+	if err := tdb.SetShareScale(context.Background(), scale); err != nil {
+		return nil, fmt.Errorf("setting share scale: %s", err)
+	}
 
 	databases := make(map[int]transdb.TransactionDataStore)
 	databases[0] = tdb
 
-
 	logHost := os.Getenv("LOG_DB_HOST")
 	logPort := os.Getenv("LOG_DB_PORT")
 	logDB := logging.NewLogDBConnection(logHost, logPort)
 
-	env := &Env{quoteCache: quoteCache, logger: logger, tdb: databases[0], databases: databases, logDB: logDB}
-	log.SetFlags(0)
-	//log.SetOutput(ioutil.Discard)
+	requestTimeout := defaultRequestTimeout
+	if timeoutStr, ok := os.LookupEnv("REQUEST_TIMEOUT"); ok {
+		timeout, err := time.ParseDuration(timeoutStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REQUEST_TIMEOUT %s: %s", timeoutStr, err)
+		}
+		requestTimeout = timeout
+	}
 
+	scheduleInterval := defaultScheduleInterval
+	if str, ok := os.LookupEnv("SCHEDULE_INTERVAL"); ok {
+		interval, err := time.ParseDuration(str)
+		if err != nil || interval < 0 {
+			return nil, fmt.Errorf("invalid SCHEDULE_INTERVAL %s", str)
+		}
+		scheduleInterval = interval
+	}
 
+	triggerInterval := defaultTriggerInterval
+	if str, ok := os.LookupEnv("TRIGGER_INTERVAL"); ok {
+		interval, err := time.ParseDuration(str)
+		if err != nil || interval < 0 {
+			return nil, fmt.Errorf("invalid TRIGGER_INTERVAL %s", str)
+		}
+		triggerInterval = interval
+	}
 
-	router := mux.NewRouter()
-	port := os.Getenv("TRANS_PORT")
+	seqOpts, err := sequencerOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	var seq *sequencer.Sequencer
+	if seqOpts.Shards > 0 {
+		seq = sequencer.New(seqOpts, clock.Real)
+	}
+
+	quotes := &dbutils.CachedQuoteProvider{Cache: &dbutils.RedisQuoteCache{Client: quoteCache}, Logger: logger}
+
+	env := &Env{log: log, quoteCache: quoteCache, quotes: quotes, logger: logger, tdb: databases[0], databases: databases, logDB: logDB, requestTimeout: requestTimeout, scheduleInterval: scheduleInterval, triggerInterval: triggerInterval, allowClearUsers: os.Getenv("ALLOW_CLEAR_USERS") == "true", clock: clock.Real, costBasis: costBasis, seq: seq}
+	return env, nil
+}
+
+// The transaction numbers recorded for the work of the background jobs,
+// which doesn't come from a numbered command.
+const (
+	triggerTrans  = "trigger"
+	scheduleTrans = "schedule"
+)
 
-	router.HandleFunc("/api/clearUsers", env.logHandler(env.clearUsers, ""))
-	router.HandleFunc("/api/availableBalance/{username}/{trans}", env.logHandler(env.availableBalance, ""))
-	router.HandleFunc("/api/availableShares/{username}/{symbol}/{trans}", env.logHandler(env.availableShares, ""))
+// every runs job once each interval of env.clock until ctx is done. The
+// background jobs started by main all run this way.
+func (env *Env) every(ctx context.Context, interval time.Duration, job func(context.Context)) {
+	for {
+		select {
+		case <-env.clock.After(interval):
+		case <-ctx.Done():
+			return
+		}
+		job(ctx)
+	}
+}
 
-	router.HandleFunc("/api/add/{username}/{money}/{trans}", env.logHandler(env.addUser, logging.ADD))
-	router.HandleFunc("/api/getQuote/{username}/{symbol}/{trans}", env.logHandler(env.getQuoute, logging.QUOTE))
+func main() {
+	log, err := applog.NewFromEnv()
+	if err != nil {
+		slog.Error("Failed to configure logging", "error", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(log)
 
-	router.HandleFunc("/api/buy/{username}/{symbol}/{amount}/{trans}", env.logHandler(env.buyOrder, logging.BUY))
-	router.HandleFunc("/api/commitBuy/{username}/{trans}", env.logHandler(env.commitBuy, logging.COMMIT_BUY))
-	router.HandleFunc("/api/cancelBuy/{username}/{trans}", env.logHandler(env.cancelBuy, logging.CANCEL_BUY))
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		log.Error("Failed to configure tracing", "error", err)
+		os.Exit(1)
+	}
+
+	if len(os.Args) > 1 {
+		var code int
+		switch os.Args[1] {
+		case "replay":
+			code = runReplay(log, os.Args[2:])
+		case "loadtest":
+			code = runLoadTest(log, os.Args[2:])
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command %s, expected replay or loadtest\n", os.Args[1])
+			code = 2
+		}
+		shutdownTracing(context.Background())
+		os.Exit(code)
+	}
 
-	router.HandleFunc("/api/sell/{username}/{symbol}/{amount}/{trans}", env.logHandler(env.sellOrder, logging.SELL))
-	router.HandleFunc("/api/commitSell/{username}/{trans}", env.logHandler(env.commitSell, logging.COMMIT_SELL))
-	router.HandleFunc("/api/cancelSell/{username}/{trans}", env.logHandler(env.cancelSell, logging.CANCEL_SELL))
+	env, err := newEnv(log)
+	if err != nil {
+		log.Error("Failed to configure service", "error", err)
+		os.Exit(1)
+	}
 
-	router.HandleFunc("/api/setBuyAmount/{username}/{symbol}/{amount}/{trans}", env.logHandler(env.setBuyAmount, logging.SET_BUY_AMOUNT))
-	router.HandleFunc("/api/setBuyTrigger/{username}/{symbol}/{triggerPrice}/{trans}", env.logHandler(env.setBuyTrigger, logging.SET_BUY_TRIGGER))
-	router.HandleFunc("/api/cancelSetBuy/{username}/{symbol}/{trans}", env.logHandler(env.cancelSetBuy, logging.CANCEL_SET_BUY))
+	if os.Getenv("AUTH_DISABLED") == "true" {
+		log.Warn("Authentication is disabled, all API callers are trusted.")
+	} else {
+		env.auth, err = auth.NewAuthenticatorFromEnv()
+		if err != nil {
+			log.Error("Failed to configure authentication", "error", err)
+			os.Exit(1)
+		}
+	}
 
-	router.HandleFunc("/api/setSellAmount/{username}/{symbol}/{amount}/{trans}", env.logHandler(env.setSellAmount, logging.SET_SELL_AMOUNT))
-	router.HandleFunc("/api/cancelSetSell/{username}/{symbol}/{trans}", env.logHandler(env.cancelSetSell, logging.CANCEL_SET_SELL))
-	router.HandleFunc("/api/setSellTrigger/{username}/{symbol}/{triggerPrice}/{trans}", env.logHandler(env.setSellTrigger, logging.SET_SELL_TRIGGER))
+	env.limits, err = ratelimit.LimitsFromEnv()
+	if err != nil {
+		log.Error("Failed to configure rate limits", "error", err)
+		os.Exit(1)
+	}
+	env.limiter = ratelimit.NewMemoryLimiter(env.clock)
+	if os.Getenv("RATE_LIMIT_BACKEND") == "redis" {
+		env.limiter = ratelimit.NewRedisLimiter(env.quoteCache)
+	}
 
-	router.HandleFunc("/api/dumplog/{filename}/{trans}", env.logHandler(env.dumplog, logging.DUMPLOG))
-	router.HandleFunc("/api/dumplog/{filename}/{username}/{trans}", env.logHandler(env.dumplogUser, logging.DUMPLOG))
-	router.HandleFunc("/api/displaySummary/{username}/{trans}", env.logHandler(env.displaySummary, logging.DISPLAY_SUMMARY))
+	if env.scheduleInterval > 0 {
+		go env.every(context.Background(), env.scheduleInterval, env.runDueSchedules)
+	}
+	if env.triggerInterval > 0 {
+		go env.every(context.Background(), env.triggerInterval, env.executeCurrentTriggers)
+	}
+	go env.every(context.Background(), transferRetryAfter, env.resumeTransfers)
 
-	router.PathPrefix("/").Handler(http.FileServer(http.Dir("./static/")))
-	// router.HandleFunc("/api/executeTriggers/{username}/{trans}", env.logHandler(env.executeTriggerTest, ""))
-	// timeoutRouter := http.TimeoutHandler(router, time.Second*5, "Request timed out!")
-	// http.Handle("/", timeoutRouter)
+	router := env.newRouter()
+	port := os.Getenv("TRANS_PORT")
 
 	server := &http.Server{
 		Handler:      router,
@@ -910,8 +2830,11 @@ func main() {
 		IdleTimeout:  2 * time.Second,
 	}
 
-	log.Println("Running transaction server on port: " + port)
-	log.Fatal(server.ListenAndServe())
+	log.Info("Running transaction server", "port", port)
+	err = server.ListenAndServe()
+	log.Error("Transaction server stopped", "error", err)
+	shutdownTracing(context.Background())
+	os.Exit(1)
 
 	// if err := http.ListenAndServe(":"+port, nil); err != nil {
 	// 	log.Fatal(err)
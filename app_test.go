@@ -0,0 +1,1516 @@
+package main
+
+import (
+	"common/logging"
+	"common/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"transaction_service/auth"
+	"transaction_service/clock"
+	"transaction_service/queries/transdb"
+	"transaction_service/queries/utils"
+	"transaction_service/sequencer"
+	"transaction_service/workload"
+)
+
+// fakeLogger records what the handlers send to the audit log.
+type fakeLogger struct {
+	mu       sync.Mutex
+	commands []logging.Command
+	errors   []string
+	dumps    []string
+}
+
+func (l *fakeLogger) LogCommand(command logging.Command, vars map[string]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.commands = append(l.commands, command)
+}
+
+func (l *fakeLogger) LogErrorEvent(command logging.Command, vars map[string]string, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors = append(l.errors, msg)
+}
+
+func (l *fakeLogger) SendDumpLog(filename string, username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.dumps = append(l.dumps, username+":"+filename)
+}
+
+func (l *fakeLogger) LogTransaction(action string, username string, money int, trans string)       {}
+func (l *fakeLogger) LogQuoteServ(quote *models.StockQuote, trans string)                          {}
+func (l *fakeLogger) LogSystemEvent(command logging.Command, username, stock, funds, trans string) {}
+
+type fakeLogDB struct {
+	commands map[string][]logging.UserCommandType
+}
+
+func (db *fakeLogDB) GetSingleUserCommands(username string) ([]logging.UserCommandType, error) {
+	return db.commands[username], nil
+}
+
+// fakeQuotes serves fixed prices, and err instead when it is set. Every
+// price is cached except the uncached symbols.
+type fakeQuotes struct {
+	mu       sync.Mutex
+	prices   map[string]int
+	uncached map[string]bool
+	err      error
+}
+
+func (q *fakeQuotes) QueryQuotePrice(ctx context.Context, username string, symbol string, trans string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return 0, q.err
+	}
+	price, ok := q.prices[symbol]
+	if !ok {
+		return 0, fmt.Errorf("no quote for %s", symbol)
+	}
+	return price, nil
+}
+
+func (q *fakeQuotes) CachedQuote(ctx context.Context, symbol string) (int, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	price, ok := q.prices[symbol]
+	return price, ok && !q.uncached[symbol], nil
+}
+
+type testEnv struct {
+	env    *Env
+	db     *transdb.MemoryDB
+	router http.Handler
+	logger *fakeLogger
+	logDB  *fakeLogDB
+	quotes *fakeQuotes
+	clock  *clock.Fake
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	te := &testEnv{
+		logger: &fakeLogger{},
+		logDB:  &fakeLogDB{commands: make(map[string][]logging.UserCommandType)},
+		quotes: &fakeQuotes{prices: map[string]int{"ABC": 100, "DEF": 40}},
+		clock:  clock.NewFake(time.Unix(1500000000, 0)),
+	}
+	te.db = transdb.NewMemoryDB(te.logger, te.clock)
+
+	databases := map[int]transdb.TransactionDataStore{0: te.db}
+	te.env = &Env{
+		log:            slog.New(slog.NewTextHandler(io.Discard, nil)),
+		logger:         te.logger,
+		tdb:            te.db,
+		quotes:         te.quotes,
+		databases:      databases,
+		logDB:          te.logDB,
+		requestTimeout: defaultRequestTimeout,
+		clock:          te.clock,
+		costBasis:      transdb.FIFO,
+	}
+	te.router = te.env.newRouter()
+	return te
+}
+
+// do sends a request for path and checks the status code, decoding a JSON
+// body into out when it is non-nil.
+func (te *testEnv) do(t *testing.T, path string, wantCode int, out interface{}) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	rec := httptest.NewRecorder()
+	te.router.ServeHTTP(rec, req)
+
+	if rec.Code != wantCode {
+		t.Fatalf("GET %s = %d, want %d: %s", path, rec.Code, wantCode, rec.Body.String())
+	}
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("GET %s: decoding %q: %s", path, rec.Body.String(), err)
+		}
+	}
+}
+
+func (te *testEnv) addUser(t *testing.T, username string, money int) {
+	t.Helper()
+	te.do(t, fmt.Sprintf("/api/add/%s/%d/1", username, money), http.StatusOK, nil)
+}
+
+func (te *testEnv) assertBalance(t *testing.T, username string, want int) {
+	t.Helper()
+	var m map[string]int
+	te.do(t, fmt.Sprintf("/api/availableBalance/%s/1", username), http.StatusOK, &m)
+	if m["balance"] != want {
+		t.Errorf("balance of %s = %d, want %d", username, m["balance"], want)
+	}
+}
+
+func (te *testEnv) assertShares(t *testing.T, username string, symbol string, want int) {
+	t.Helper()
+	var m map[string]int
+	te.do(t, fmt.Sprintf("/api/availableShares/%s/%s/1", username, symbol), http.StatusOK, &m)
+	if m["shares"] != want {
+		t.Errorf("%s shares of %s = %d, want %d", symbol, username, m["shares"], want)
+	}
+}
+
+func TestAddAndQuote(t *testing.T) {
+	te := newTestEnv(t)
+
+	var user models.User
+	te.do(t, "/api/add/alice/1000/1", http.StatusOK, &user)
+	if user.Username != "alice" || user.Money != 1000 {
+		t.Errorf("add = %+v", user)
+	}
+	te.do(t, "/api/add/alice/500/2", http.StatusOK, &user)
+	if user.Money != 1500 {
+		t.Errorf("second add = %+v, want money 1500", user)
+	}
+	te.assertBalance(t, "alice", 1500)
+	te.assertShares(t, "alice", "ABC", 0)
+
+	var quote map[string]string
+	te.do(t, "/api/getQuote/alice/ABC/3", http.StatusOK, &quote)
+	if quote["price"] != "100" || quote["symbol"] != "ABC" {
+		t.Errorf("getQuote = %v", quote)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	te := newTestEnv(t)
+	te.addUser(t, "alice", 100)
+	te.env.auth = auth.NewAuthenticator(nil, "")
+	te.env.auth.AddAPIKey("alice-key", auth.Principal{Name: "alice", Role: auth.RoleUser})
+	te.env.auth.AddAPIKey("admin-key", auth.Principal{Name: "ops", Role: auth.RoleAdmin})
+
+	tests := []struct {
+		path string
+		key  string
+		want int
+	}{
+		{"/api/availableBalance/alice/1", "", http.StatusUnauthorized},
+		{"/api/availableBalance/alice/1", "wrong-key", http.StatusUnauthorized},
+		{"/api/availableBalance/alice/1", "alice-key", http.StatusOK},
+		{"/api/availableBalance/bob/1", "alice-key", http.StatusForbidden},
+		{"/api/add/alice/100/1", "alice-key", http.StatusForbidden},
+		{"/api/availableBalance/alice/1", "admin-key", http.StatusOK},
+		{"/api/add/alice/100/1", "admin-key", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.key != "" {
+			req.Header.Set("X-API-Key", tt.key)
+		}
+		rec := httptest.NewRecorder()
+		te.router.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("GET %s with %q = %d, want %d", tt.path, tt.key, rec.Code, tt.want)
+		}
+	}
+}
+
+// failingClear is a store whose ClearUsers always fails.
+type failingClear struct {
+	transdb.TransactionDataStore
+}
+
+func (failingClear) ClearUsers(ctx context.Context, tx transdb.Tx) error {
+	return errors.New("clear failed")
+}
+
+func TestClearUsers(t *testing.T) {
+	te := newTestEnv(t)
+	// alice is on the second database, bob on the first
+	second := transdb.NewMemoryDB(te.logger, te.clock)
+	te.env.databases[1] = second
+	te.addUser(t, "alice", 1000)
+	te.addUser(t, "bob", 1000)
+	te.do(t, "/api/buyShares/alice/ABC/3/2", http.StatusOK, nil)
+	te.do(t, "/api/commitBuy/alice/3", http.StatusOK, nil)
+	te.do(t, "/api/setSellAmount/alice/ABC/100/4", http.StatusOK, nil)
+	te.do(t, "/api/buy/bob/DEF/80/5", http.StatusOK, nil)
+
+	te.do(t, "/api/clearUsers", http.StatusForbidden, nil)
+	te.env.allowClearUsers = true
+	te.do(t, "/api/clearUsers", http.StatusMethodNotAllowed, nil)
+
+	var result struct {
+		DryRun    bool `json:"dryRun"`
+		Databases []struct {
+			Rows    map[string]int `json:"rows"`
+			Cleared bool           `json:"cleared"`
+		} `json:"databases"`
+	}
+	te.do(t, "/api/clearUsers?dryRun=true", http.StatusOK, &result)
+	if !result.DryRun || len(result.Databases) != 2 || result.Databases[0].Cleared || result.Databases[1].Cleared {
+		t.Fatalf("dry run = %+v", result)
+	}
+	if rows := result.Databases[0].Rows; rows["users"] != 1 || rows["reservations"] != 1 {
+		t.Errorf("first database rows = %v, want bob and his reservation", rows)
+	}
+	if rows := result.Databases[1].Rows; rows["users"] != 1 || rows["stocks"] != 1 || rows["triggers"] != 1 || rows["executions"] != 1 {
+		t.Errorf("second database rows = %v, want alice, her stock, trigger and execution", rows)
+	}
+	te.assertBalance(t, "alice", 700)
+
+	// the first database isn't cleared when the second fails
+	te.env.databases[1] = failingClear{second}
+	rec := httptest.NewRecorder()
+	te.router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/clearUsers", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("clearUsers with a failing database = %d: %s", rec.Code, rec.Body.String())
+	}
+	te.env.databases[1] = second
+	te.assertBalance(t, "alice", 700)
+	if rows, err := te.db.CountUserRows(context.Background()); err != nil || rows["users"] != 1 || rows["reservations"] != 1 {
+		t.Errorf("first database rows after a failed clear = %v, %v", rows, err)
+	}
+
+	rec = httptest.NewRecorder()
+	te.router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/clearUsers", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("clearUsers = %d: %s", rec.Code, rec.Body.String())
+	}
+	result.DryRun = true
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.DryRun || !result.Databases[0].Cleared || !result.Databases[1].Cleared {
+		t.Errorf("clearUsers = %+v", result)
+	}
+
+	for i, db := range []transdb.TransactionDataStore{te.db, second} {
+		rows, err := db.CountUserRows(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for table, n := range rows {
+			if n != 0 {
+				t.Errorf("database %d has %d rows in %s after clearing", i, n, table)
+			}
+		}
+	}
+	te.do(t, "/api/availableBalance/alice/6", http.StatusInternalServerError, nil)
+	te.do(t, "/api/availableBalance/bob/7", http.StatusInternalServerError, nil)
+}
+
+func TestBuyCommitCancel(t *testing.T) {
+	te := newTestEnv(t)
+	te.addUser(t, "alice", 1000)
+
+	var res models.Reservation
+	te.do(t, "/api/buy/alice/ABC/250/2", http.StatusOK, &res)
+	if res.Shares != 2 || res.Amount != 200 || res.Order != models.BUY {
+		t.Errorf("buy = %+v", res)
+	}
+
+	var stock models.Stock
+	te.do(t, "/api/commitBuy/alice/3", http.StatusOK, &stock)
+	if stock.Symbol != "ABC" || stock.Shares != 2 {
+		t.Errorf("commitBuy = %+v", stock)
+	}
+	te.assertBalance(t, "alice", 800)
+	te.assertShares(t, "alice", "ABC", 2)
+
+	te.do(t, "/api/buy/alice/DEF/100/4", http.StatusOK, &res)
+	var cancelled models.Reservation
+	te.do(t, "/api/cancelBuy/alice/5", http.StatusOK, &cancelled)
+	if cancelled.ID != res.ID {
+		t.Errorf("cancelBuy removed %d, want %d", cancelled.ID, res.ID)
+	}
+	te.do(t, "/api/commitBuy/alice/6", http.StatusInternalServerError, nil)
+	te.assertBalance(t, "alice", 800)
+}
+
+func TestSellCommitCancel(t *testing.T) {
+	te := newTestEnv(t)
+	te.addUser(t, "alice", 1000)
+	te.do(t, "/api/buy/alice/ABC/300/2", http.StatusOK, nil)
+	te.do(t, "/api/commitBuy/alice/3", http.StatusOK, nil)
+
+	var res models.Reservation
+	te.do(t, "/api/sell/alice/ABC/150/4", http.StatusOK, &res)
+	if res.Shares != 1 || res.Amount != 100 || res.Order != models.SELL {
+		t.Errorf("sell = %+v", res)
+	}
+	var stock models.Stock
+	te.do(t, "/api/commitSell/alice/5", http.StatusOK, &stock)
+	if stock.Shares != 2 {
+		t.Errorf("commitSell = %+v, want 2 shares left", stock)
+	}
+	te.assertBalance(t, "alice", 800)
+
+	te.do(t, "/api/sell/alice/ABC/200/6", http.StatusOK, nil)
+	te.do(t, "/api/cancelSell/alice/7", http.StatusOK, nil)
+	te.do(t, "/api/commitSell/alice/8", http.StatusInternalServerError, nil)
+	te.assertShares(t, "alice", "ABC", 2)
+	te.assertBalance(t, "alice", 800)
+}
+
+func TestShareCountOrders(t *testing.T) {
+	te := newTestEnv(t)
+	te.addUser(t, "alice", 1000)
+
+	var res struct {
+		models.Reservation
+		Price     int   `json:"price"`
+		ExpiresAt int64 `json:"expiresAt"`
+	}
+	te.do(t, "/api/buyShares/alice/ABC/3/2", http.StatusOK, &res)
+	if res.Shares != 3 || res.Amount != 300 || res.Price != 100 || res.ExpiresAt != res.Time+60 {
+		t.Errorf("buyShares = %+v", res)
+	}
+	te.do(t, "/api/commitBuy/alice/3", http.StatusOK, nil)
+	te.assertShares(t, "alice", "ABC", 3)
+
+	te.do(t, "/api/buyShares/alice/ABC/8/4", http.StatusInternalServerError, nil)
+	te.do(t, "/api/buyShares/alice/ABC/1.5/5", http.StatusBadRequest, nil)
+
+	te.do(t, "/api/sellShares/alice/ABC/1/6", http.StatusOK, &res)
+	if res.Shares != 1 || res.Amount != 100 || res.Order != models.SELL {
+		t.Errorf("sellShares = %+v", res)
+	}
+	te.do(t, "/api/commitSell/alice/7", http.StatusOK, nil)
+	te.do(t, "/api/sellShares/alice/ABC/3/8", http.StatusInternalServerError, nil)
+
+	te.quotes.prices["ABC"] = 130
+	te.do(t, "/api/sellAll/alice/ABC/9", http.StatusOK, &res)
+	if res.Shares != 2 || res.Amount != 260 {
+		t.Errorf("sellAll = %+v", res)
+	}
+	te.do(t, "/api/commitSell/alice/10", http.StatusOK, nil)
+	te.assertShares(t, "alice", "ABC", 0)
+	te.assertBalance(t, "alice", 1060)
+
+	te.do(t, "/api/sellAll/alice/ABC/11", http.StatusInternalServerError, nil)
+}
+
+func TestFees(t *testing.T) {
+	te := newTestEnv(t)
+	te.db.FeeSchedule = transdb.FeeSchedule{Default: transdb.FeeRule{Flat: 5}}
+	te.addUser(t, "alice", 1000)
+
+	var res struct {
+		models.Reservation
+		Fees int `json:"fees"`
+		Net  int `json:"net"`
+	}
+	te.do(t, "/api/buy/alice/ABC/305/2", http.StatusOK, &res)
+	if res.Shares != 3 || res.Amount != 300 || res.Fees != 5 || res.Net != 305 {
+		t.Errorf("buy = %+v", res)
+	}
+	te.do(t, "/api/commitBuy/alice/3", http.StatusOK, nil)
+	te.assertBalance(t, "alice", 695)
+
+	te.do(t, "/api/sellShares/alice/ABC/1/4", http.StatusOK, &res)
+	if res.Amount != 100 || res.Fees != 5 || res.Net != 95 {
+		t.Errorf("sell = %+v", res)
+	}
+
+	var summary struct {
+		FeesPaid     int `json:"feesPaid"`
+		Reservations []struct {
+			Fees int `json:"fees"`
+		} `json:"reservations"`
+	}
+	te.do(t, "/api/displaySummary/alice/5", http.StatusOK, &summary)
+	if summary.FeesPaid != 5 || len(summary.Reservations) != 1 || summary.Reservations[0].Fees != 5 {
+		t.Errorf("summary = %+v", summary)
+	}
+
+	te.do(t, "/api/commitSell/alice/6", http.StatusOK, nil)
+	te.assertBalance(t, "alice", 790)
+	te.do(t, "/api/displaySummary/alice/7", http.StatusOK, &summary)
+	if summary.FeesPaid != 10 {
+		t.Errorf("feesPaid = %d, want 10", summary.FeesPaid)
+	}
+
+	// the balance covers the amount of the buy but not its commission
+	te.do(t, "/api/buy/alice/ABC/305/8", http.StatusOK, nil)
+	te.do(t, "/api/withdraw/alice/488/9", http.StatusOK, nil)
+	te.assertBalance(t, "alice", 302)
+	te.do(t, "/api/commitBuy/alice/10", http.StatusInternalServerError, nil)
+	te.assertBalance(t, "alice", 302)
+	te.assertShares(t, "alice", "ABC", 2)
+	te.do(t, "/api/displaySummary/alice/11", http.StatusOK, &summary)
+	if len(summary.Reservations) != 0 {
+		t.Errorf("reservations after the rejected commit = %+v", summary.Reservations)
+	}
+}
+
+func TestFeeScheduleFromEnv(t *testing.T) {
+	fees, err := feeScheduleFromEnv([]string{"PATH=/bin", "FEES=flat=5,min=10", "FEES_ABC=rate=25"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := transdb.FeeSchedule{Default: transdb.FeeRule{Flat: 5, Min: 10}, Symbols: map[string]transdb.FeeRule{"ABC": {Rate: 25}}}
+	if !reflect.DeepEqual(fees, want) {
+		t.Errorf("feeScheduleFromEnv = %+v, want %+v", fees, want)
+	}
+	if _, err := feeScheduleFromEnv([]string{"FEES_DEF=flat"}); err == nil {
+		t.Error("feeScheduleFromEnv accepted an invalid rule")
+	}
+}
+
+func TestMultiCurrency(t *testing.T) {
+	te := newTestEnv(t)
+	te.db.Rates = dbutils.StaticRates{"USD": dbutils.RateOne, "EUR": 1080000}
+	te.quotes.prices["EUA"] = 50
+	te.addUser(t, "alice", 1000)
+
+	te.do(t, "/api/setSymbolCurrency/EUA/eur/1", http.StatusBadRequest, nil)
+	te.do(t, "/api/setSymbolCurrency/EUA/EUR/2", http.StatusOK, nil)
+
+	var quote map[string]string
+	te.do(t, "/api/getQuote/alice/EUA/3", http.StatusOK, &quote)
+	if quote["price"] != "50" || quote["currency"] != "EUR" {
+		t.Errorf("quote = %v, want 50 EUR", quote)
+	}
+
+	// 50 EUR is 54 USD
+	var res struct {
+		models.Reservation
+		Price int `json:"price"`
+	}
+	te.do(t, "/api/buyShares/alice/EUA/3/4", http.StatusOK, &res)
+	if res.Amount != 162 || res.Price != 54 {
+		t.Errorf("buy = %+v, want 3 shares at 54", res)
+	}
+	te.do(t, "/api/commitBuy/alice/5", http.StatusOK, nil)
+	te.assertBalance(t, "alice", 838)
+
+	var history struct {
+		Executions []transdb.Execution `json:"executions"`
+	}
+	te.do(t, "/api/history/alice/6", http.StatusOK, &history)
+	if e := history.Executions; len(e) != 1 || e[0].Currency != "EUR" || e[0].FXRate != 1080000 || e[0].LocalPrice != 50 {
+		t.Errorf("executions = %+v", e)
+	}
+
+	te.do(t, "/api/add/alice/100/7?currency=EUR", http.StatusOK, nil)
+	te.assertBalance(t, "alice", 838)
+
+	var ex transdb.Exchange
+	te.do(t, "/api/exchange/alice/EUR/USD/50/8", http.StatusOK, &ex)
+	if ex.Received != 54 {
+		t.Errorf("exchange = %+v, want 54 USD", ex)
+	}
+	te.assertBalance(t, "alice", 892)
+	te.do(t, "/api/exchange/alice/EUR/USD/60/9", http.StatusBadRequest, nil)
+	te.do(t, "/api/exchange/alice/USD/USD/5/10", http.StatusBadRequest, nil)
+	te.db.Rates = nil
+	te.do(t, "/api/exchange/alice/EUR/USD/5/10", http.StatusServiceUnavailable, nil)
+	te.db.Rates = dbutils.StaticRates{"USD": dbutils.RateOne, "EUR": 1080000}
+
+	var summary struct {
+		Balances  map[string]int    `json:"balances"`
+		Valuation *summaryValuation `json:"valuation"`
+	}
+	te.do(t, "/api/displaySummary/alice/11?value=true", http.StatusOK, &summary)
+	if summary.Balances["EUR"] != 50 {
+		t.Errorf("balances = %v, want 50 EUR", summary.Balances)
+	}
+	// 3 EUA at 54, 892 USD and 50 EUR
+	if v := summary.Valuation; v == nil || v.StocksValue != 162 || v.TotalValue != 1108 {
+		t.Errorf("valuation = %+v", v)
+	}
+}
+
+func TestWithdrawAndTransfer(t *testing.T) {
+	te := newTestEnv(t)
+	// alice is on the second database, bob and carol on the first
+	te.env.databases[1] = transdb.NewMemoryDB(te.logger, te.clock)
+	te.addUser(t, "alice", 1000)
+	te.addUser(t, "bob", 100)
+	te.addUser(t, "carol", 1)
+
+	var w transdb.Transfer
+	te.do(t, "/api/withdraw/alice/200/2", http.StatusOK, &w)
+	if w.Kind != transdb.TransferWithdrawal || w.Amount != 200 {
+		t.Errorf("withdrawal = %+v", w)
+	}
+	te.assertBalance(t, "alice", 800)
+	te.do(t, "/api/withdraw/alice/900/3", http.StatusConflict, nil)
+	te.do(t, "/api/withdraw/nobody/10/3", http.StatusNotFound, nil)
+
+	var sent transdb.Transfer
+	te.do(t, "/api/transfer/alice/bob/300/4", http.StatusOK, &sent)
+	if sent.State != transdb.TransferCompleted {
+		t.Errorf("transfer = %+v, want completed", sent)
+	}
+	te.assertBalance(t, "alice", 500)
+	te.assertBalance(t, "bob", 400)
+
+	te.do(t, "/api/transfer/bob/carol/50/5", http.StatusOK, nil)
+	te.assertBalance(t, "bob", 350)
+	te.assertBalance(t, "carol", 51)
+
+	te.do(t, "/api/transfer/alice/nobody/10/6", http.StatusNotFound, nil)
+	te.do(t, "/api/transfer/alice/bob/900/6", http.StatusConflict, nil)
+	te.do(t, "/api/transfer/alice/alice/10/7", http.StatusBadRequest, nil)
+	te.assertBalance(t, "alice", 500)
+
+	var transfers []transdb.Transfer
+	te.do(t, "/api/transfers/bob/8", http.StatusOK, &transfers)
+	if len(transfers) != 2 || transfers[0].Kind != transdb.TransferSent || transfers[1].Kind != transdb.TransferReceived || transfers[1].Ref != sent.Ref {
+		t.Errorf("transfers = %+v", transfers)
+	}
+	te.do(t, "/api/transfers/alice/9?limit=1", http.StatusOK, &transfers)
+	if len(transfers) != 1 || transfers[0].Counterparty != "bob" {
+		t.Errorf("transfers = %+v", transfers)
+	}
+}
+
+func TestUserLifecycle(t *testing.T) {
+	te := newTestEnv(t)
+	te.addUser(t, "alice", 100)
+
+	var acct transdb.Account
+	te.do(t, "/api/createUser/dave/1?money=500", http.StatusCreated, &acct)
+	if acct.Username != "dave" || acct.Money != 500 || acct.Status != transdb.UserActive {
+		t.Errorf("created = %+v", acct)
+	}
+	te.do(t, "/api/createUser/dave/2", http.StatusConflict, nil)
+
+	te.do(t, "/api/buyShares/dave/ABC/2/3", http.StatusOK, nil)
+	te.do(t, "/api/commitBuy/dave/4", http.StatusOK, nil)
+	te.do(t, "/api/setBuyAmount/dave/ABC/100/4", http.StatusOK, nil)
+
+	te.do(t, "/api/suspendUser/dave/5", http.StatusOK, &acct)
+	if acct.Status != transdb.UserSuspended {
+		t.Errorf("suspended = %+v", acct)
+	}
+	te.do(t, "/api/buy/dave/ABC/100/6", http.StatusForbidden, nil)
+	te.do(t, "/api/withdraw/dave/10/7", http.StatusForbidden, nil)
+
+	// a suspended user can cancel, but not while their account is closing
+	if err := te.db.SetUserStatus(context.Background(), nil, "dave", transdb.UserClosing); err != nil {
+		t.Fatal(err)
+	}
+	te.do(t, "/api/cancelSetBuy/dave/ABC/7", http.StatusForbidden, nil)
+	te.do(t, "/api/updateUser/dave/7?status=active", http.StatusConflict, nil)
+	te.do(t, "/api/suspendUser/dave/7", http.StatusConflict, nil)
+	if err := te.db.SetUserStatus(context.Background(), nil, "dave", transdb.UserSuspended); err != nil {
+		t.Fatal(err)
+	}
+	te.do(t, "/api/cancelSetBuy/dave/ABC/7", http.StatusOK, nil)
+
+	te.do(t, "/api/updateUser/dave/8?status=active&money=400", http.StatusOK, &acct)
+	if acct.Status != transdb.UserActive || acct.Money != 400 {
+		t.Errorf("updated = %+v", acct)
+	}
+	te.do(t, "/api/updateUser/dave/9?status=closed", http.StatusBadRequest, nil)
+
+	te.do(t, "/api/closeUser/dave/10", http.StatusConflict, nil)
+	te.do(t, "/api/closeUser/dave/11?liquidate=true", http.StatusOK, &acct)
+	if acct.Status != transdb.UserClosed || acct.Money != 600 {
+		t.Errorf("closed = %+v, want 600 after selling 2 ABC", acct)
+	}
+	te.assertShares(t, "dave", "ABC", 0)
+
+	// what is left can be withdrawn but nothing else
+	te.do(t, "/api/buyShares/dave/ABC/1/12", http.StatusForbidden, nil)
+	te.do(t, "/api/add/dave/100/13", http.StatusConflict, nil)
+	te.do(t, "/api/transfer/alice/dave/10/14", http.StatusNotFound, nil)
+	te.do(t, "/api/deleteUser/dave/15", http.StatusConflict, nil)
+	te.do(t, "/api/withdraw/dave/600/15", http.StatusOK, nil)
+	te.assertBalance(t, "dave", 0)
+
+	// nor can it be deleted with a transfer the recipient hasn't had yet
+	pending := transdb.Transfer{Username: "dave", Kind: transdb.TransferSent, Counterparty: "alice", Amount: 10, State: transdb.TransferPending, Ref: "pending", Trans: "15"}
+	id, err := te.db.AddTransfer(context.Background(), nil, pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	te.do(t, "/api/deleteUser/dave/15", http.StatusConflict, nil)
+	if err := te.db.SettleTransfer(context.Background(), nil, id, transdb.TransferCompleted); err != nil {
+		t.Fatal(err)
+	}
+
+	te.do(t, "/api/deleteUser/alice/16", http.StatusConflict, nil)
+	te.do(t, "/api/deleteUser/dave/17", http.StatusOK, nil)
+	te.do(t, "/api/user/dave/18", http.StatusInternalServerError, nil)
+	te.do(t, "/api/user/alice/19", http.StatusOK, &acct)
+	if acct.Money != 100 || acct.Status != transdb.UserActive {
+		t.Errorf("alice = %+v", acct)
+	}
+}
+
+func TestBuyTrigger(t *testing.T) {
+	te := newTestEnv(t)
+	te.addUser(t, "alice", 1000)
+
+	var trig models.Trigger
+	te.do(t, "/api/setBuyAmount/alice/ABC/300/2", http.StatusOK, &trig)
+	if trig.Amount != 300 || trig.Order != models.BUY || trig.Executable {
+		t.Errorf("setBuyAmount = %+v", trig)
+	}
+	te.assertBalance(t, "alice", 700)
+
+	te.do(t, "/api/setBuyTrigger/alice/ABC/90/3", http.StatusOK, &trig)
+	if trig.TriggerPrice != 90 || !trig.Executable {
+		t.Errorf("setBuyTrigger = %+v", trig)
+	}
+
+	te.do(t, "/api/cancelSetBuy/alice/ABC/4", http.StatusOK, &trig)
+	if trig.Amount != 300 {
+		t.Errorf("cancelSetBuy = %+v", trig)
+	}
+	te.assertBalance(t, "alice", 1000)
+	te.do(t, "/api/cancelSetBuy/alice/ABC/5", http.StatusInternalServerError, nil)
+}
+
+func TestSellTrigger(t *testing.T) {
+	te := newTestEnv(t)
+	te.addUser(t, "alice", 1000)
+	te.do(t, "/api/buy/alice/ABC/300/2", http.StatusOK, nil)
+	te.do(t, "/api/commitBuy/alice/3", http.StatusOK, nil)
+
+	var trig models.Trigger
+	te.do(t, "/api/setSellAmount/alice/ABC/200/4", http.StatusOK, &trig)
+	if trig.Amount != 2 || trig.Order != models.SELL {
+		t.Errorf("setSellAmount = %+v, want 2 shares", trig)
+	}
+	te.assertShares(t, "alice", "ABC", 1)
+
+	te.do(t, "/api/setSellTrigger/alice/ABC/120/5", http.StatusOK, &trig)
+	if trig.TriggerPrice != 120 || !trig.Executable {
+		t.Errorf("setSellTrigger = %+v", trig)
+	}
+
+	te.do(t, "/api/cancelSetSell/alice/ABC/6", http.StatusOK, nil)
+	te.assertShares(t, "alice", "ABC", 3)
+}
+
+func TestReservationExpiry(t *testing.T) {
+	te := newTestEnv(t)
+	te.addUser(t, "alice", 1000)
+
+	var res models.Reservation
+	te.do(t, "/api/buy/alice/ABC/250/2", http.StatusOK, &res)
+	if res.Time != te.clock.Now().Unix() {
+		t.Errorf("reservation time = %d, want %d", res.Time, te.clock.Now().Unix())
+	}
+	te.clock.BlockUntil(1)
+
+	// still committable until the timeout fires
+	te.clock.Advance(59 * time.Second)
+	if _, err := te.db.QueryReservation(context.Background(), res.ID); err != nil {
+		t.Fatalf("reservation missing before expiry: %s", err)
+	}
+	te.clock.Advance(time.Second)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := te.db.QueryReservation(context.Background(), res.ID)
+		if err == transdb.ErrNoRows {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("reservation not removed after expiry, err = %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	te.do(t, "/api/commitBuy/alice/3", http.StatusInternalServerError, nil)
+	te.assertBalance(t, "alice", 1000)
+	te.assertShares(t, "alice", "ABC", 0)
+}
+
+func TestDumplogAndSummary(t *testing.T) {
+	te := newTestEnv(t)
+	te.addUser(t, "alice", 1000)
+	te.do(t, "/api/setBuyAmount/alice/ABC/300/2", http.StatusOK, nil)
+	te.logDB.commands["alice"] = []logging.UserCommandType{{TransactionNum: 1, Command: "ADD", Username: "alice"}}
+
+	var m map[string]string
+	te.do(t, "/api/dumplog/all.log/3", http.StatusOK, &m)
+	if m["filename"] != "all.log" {
+		t.Errorf("dumplog = %v", m)
+	}
+	te.do(t, "/api/dumplog/alice.log/alice/4", http.StatusOK, nil)
+	if want := []string{":all.log", "alice:alice.log"}; fmt.Sprint(te.logger.dumps) != fmt.Sprint(want) {
+		t.Errorf("dumps = %v, want %v", te.logger.dumps, want)
+	}
+
+	var summary struct {
+		UserCommands []logging.UserCommandType `json:"userCommands"`
+		Balance      int                       `json:"balance"`
+		Triggers     []models.Trigger          `json:"triggers"`
+	}
+	te.do(t, "/api/displaySummary/alice/5", http.StatusOK, &summary)
+	if len(summary.UserCommands) != 1 || summary.Balance != 700 || len(summary.Triggers) != 1 {
+		t.Errorf("displaySummary = %+v", summary)
+	}
+}
+
+func TestDisplaySummary(t *testing.T) {
+	te := newTestEnv(t)
+	te.addUser(t, "alice", 1000)
+	te.do(t, "/api/buy/alice/ABC/300/2", http.StatusOK, nil)
+	te.do(t, "/api/commitBuy/alice/3", http.StatusOK, nil)
+	te.do(t, "/api/setSellAmount/alice/ABC/200/4", http.StatusOK, nil)
+	te.do(t, "/api/setSellTrigger/alice/ABC/120/5", http.StatusOK, nil)
+	te.do(t, "/api/setBuyAmount/alice/DEF/100/6", http.StatusOK, nil)
+	var res models.Reservation
+	te.do(t, "/api/buy/alice/DEF/100/7", http.StatusOK, &res)
+	te.logDB.commands["alice"] = []logging.UserCommandType{
+		{TransactionNum: 1, Command: "ADD"},
+		{TransactionNum: 2, Command: "BUY"},
+		{TransactionNum: 3, Command: "COMMIT_BUY"},
+	}
+
+	type summary struct {
+		UserCommands   []logging.UserCommandType `json:"userCommands"`
+		CommandsTotal  int                       `json:"commandsTotal"`
+		Balance        int                       `json:"balance"`
+		ReservedFunds  int                       `json:"reservedFunds"`
+		ReservedShares map[string]int            `json:"reservedShares"`
+		Stocks         []summaryStock            `json:"stocks"`
+		Reservations   []summaryReservation      `json:"reservations"`
+		Triggers       []summaryTrigger          `json:"triggers"`
+		Valuation      *summaryValuation         `json:"valuation"`
+	}
+
+	var s summary
+	te.do(t, "/api/displaySummary/alice/8?offset=1&limit=1", http.StatusOK, &s)
+	if len(s.UserCommands) != 1 || s.UserCommands[0].TransactionNum != 2 || s.CommandsTotal != 3 {
+		t.Errorf("commands = %+v of %d, want trans 2 of 3", s.UserCommands, s.CommandsTotal)
+	}
+	if s.Balance != 600 || s.ReservedFunds != 100 || s.ReservedShares["ABC"] != 2 {
+		t.Errorf("balance %d, reserved %d and %v", s.Balance, s.ReservedFunds, s.ReservedShares)
+	}
+	if len(s.Stocks) != 1 || s.Stocks[0].Symbol != "ABC" || s.Stocks[0].Shares != 1 || s.Stocks[0].Price != nil {
+		t.Errorf("stocks = %+v", s.Stocks)
+	}
+	if len(s.Reservations) != 1 || s.Reservations[0].ID != res.ID || s.Reservations[0].ExpiresAt != res.Time+reservationTimeout {
+		t.Errorf("reservations = %+v", s.Reservations)
+	}
+	if len(s.Triggers) != 2 || s.Triggers[0].State != "active" || s.Triggers[1].State != "pending" {
+		t.Errorf("triggers = %+v", s.Triggers)
+	}
+	if s.Valuation != nil {
+		t.Errorf("valuation = %+v without value=true", s.Valuation)
+	}
+
+	s = summary{}
+	te.do(t, "/api/displaySummary/alice/9?value=true", http.StatusOK, &s)
+	if len(s.UserCommands) != 3 {
+		t.Errorf("%d commands, want 3", len(s.UserCommands))
+	}
+	if len(s.Stocks) != 1 || s.Stocks[0].MarketValue == nil || *s.Stocks[0].MarketValue != 100 {
+		t.Errorf("stocks = %+v", s.Stocks)
+	}
+	// 1 ABC held and 2 in the sell trigger at 100, plus 600 cash and 100 in the buy trigger
+	if v := s.Valuation; v == nil || v.StocksValue != 300 || v.TotalValue != 1000 || len(v.Unpriced) != 0 {
+		t.Errorf("valuation = %+v", v)
+	}
+
+	te.quotes.uncached = map[string]bool{"ABC": true}
+	s = summary{}
+	te.do(t, "/api/displaySummary/alice/10?value=true", http.StatusOK, &s)
+	if v := s.Valuation; v == nil || v.StocksValue != 0 || v.TotalValue != 700 || fmt.Sprint(v.Unpriced) != "[ABC]" {
+		t.Errorf("valuation without cached quotes = %+v", v)
+	}
+
+	te.clock.Advance(reservationTimeout * time.Second)
+	s = summary{}
+	te.do(t, "/api/displaySummary/alice/11", http.StatusOK, &s)
+	if len(s.Reservations) != 0 {
+		t.Errorf("expired reservations listed: %+v", s.Reservations)
+	}
+
+	te.do(t, "/api/displaySummary/alice/12?limit=x", http.StatusBadRequest, nil)
+}
+
+func TestPortfolio(t *testing.T) {
+	te := newTestEnv(t)
+	te.addUser(t, "alice", 1000)
+	te.do(t, "/api/buy/alice/ABC/300/2", http.StatusOK, nil)
+	te.do(t, "/api/commitBuy/alice/3", http.StatusOK, nil)
+
+	te.quotes.prices["ABC"] = 120
+	te.do(t, "/api/sell/alice/ABC/120/4", http.StatusOK, nil)
+	te.do(t, "/api/commitSell/alice/5", http.StatusOK, nil)
+
+	te.do(t, "/api/setBuyAmount/alice/DEF/100/6", http.StatusOK, nil)
+	te.do(t, "/api/setBuyTrigger/alice/DEF/50/7", http.StatusOK, nil)
+	if _, err := te.db.QueryAndExecuteCurrentTriggers(context.Background(), te.quotes, "8"); err != nil {
+		t.Fatal(err)
+	}
+
+	var p struct {
+		CostBasis        string     `json:"costBasis"`
+		Positions        []position `json:"positions"`
+		Cost             int        `json:"cost"`
+		MarketValue      int        `json:"marketValue"`
+		UnrealizedGain   int        `json:"unrealizedGain"`
+		UnrealizedReturn float64    `json:"unrealizedReturn"`
+		RealizedGain     int        `json:"realizedGain"`
+	}
+	te.do(t, "/api/portfolio/alice/9", http.StatusOK, &p)
+	if p.CostBasis != "fifo" || len(p.Positions) != 2 {
+		t.Fatalf("portfolio = %+v", p)
+	}
+	// 2 ABC left of 3 bought at 100, 1 sold at 120
+	abc := p.Positions[0]
+	if abc.Symbol != "ABC" || abc.Shares != 2 || abc.Cost != 200 || abc.MarketValue != 240 || abc.UnrealizedGain != 40 || abc.UnrealizedReturn != 0.2 || abc.RealizedGain != 20 || len(abc.Lots) != 1 {
+		t.Errorf("ABC position = %+v", abc)
+	}
+	// 2 DEF bought by the trigger at 40
+	def := p.Positions[1]
+	if def.Symbol != "DEF" || def.Shares != 2 || def.Cost != 80 || def.AverageCost != 40 || def.MarketValue != 80 || def.UnrealizedGain != 0 {
+		t.Errorf("DEF position = %+v", def)
+	}
+	if p.Cost != 280 || p.MarketValue != 320 || p.UnrealizedGain != 40 || p.RealizedGain != 20 {
+		t.Errorf("portfolio totals = %+v", p)
+	}
+
+	te.quotes.err = dbutils.ErrTimeout
+	te.do(t, "/api/portfolio/alice/10", http.StatusGatewayTimeout, nil)
+}
+
+func TestHistory(t *testing.T) {
+	te := newTestEnv(t)
+	te.addUser(t, "alice", 1000)
+	te.do(t, "/api/buy/alice/ABC/300/2", http.StatusOK, nil)
+	te.do(t, "/api/commitBuy/alice/3", http.StatusOK, nil)
+	te.clock.Advance(time.Hour)
+	te.do(t, "/api/sell/alice/ABC/100/4", http.StatusOK, nil)
+	te.do(t, "/api/commitSell/alice/5", http.StatusOK, nil)
+	te.do(t, "/api/setBuyAmount/alice/DEF/100/6", http.StatusOK, nil)
+	te.do(t, "/api/setBuyTrigger/alice/DEF/50/7", http.StatusOK, nil)
+	if _, err := te.db.QueryAndExecuteCurrentTriggers(context.Background(), te.quotes, "8"); err != nil {
+		t.Fatal(err)
+	}
+
+	type history struct {
+		Executions []transdb.Execution `json:"executions"`
+		Total      int                 `json:"total"`
+	}
+	var h history
+	te.do(t, "/api/history/alice/9", http.StatusOK, &h)
+	if h.Total != 3 || len(h.Executions) != 3 {
+		t.Fatalf("history = %+v", h)
+	}
+	if e := h.Executions[0]; e.Symbol != "DEF" || e.Side != models.BUY || e.Shares != 2 || e.Price != 40 || e.Source != transdb.SourceTrigger || e.Trans != "8" {
+		t.Errorf("newest execution = %+v", e)
+	}
+
+	tests := []struct {
+		query string
+		trans []string
+		total int
+	}{
+		{"symbol=ABC", []string{"5", "3"}, 2},
+		{"side=sell", []string{"5"}, 1},
+		{"to=1500000000", []string{"3"}, 1},
+		{"from=2017-07-14T03:00:00Z", []string{"8", "5"}, 2},
+		{"offset=1&limit=1", []string{"5"}, 3},
+	}
+	for _, tt := range tests {
+		h = history{}
+		te.do(t, "/api/history/alice/10?"+tt.query, http.StatusOK, &h)
+		var trans []string
+		for _, e := range h.Executions {
+			trans = append(trans, e.Trans)
+		}
+		if fmt.Sprint(trans) != fmt.Sprint(tt.trans) || h.Total != tt.total {
+			t.Errorf("history?%s = %v of %d, want %v of %d", tt.query, trans, h.Total, tt.trans, tt.total)
+		}
+	}
+
+	te.do(t, "/api/history/alice/11?side=short", http.StatusBadRequest, nil)
+	te.do(t, "/api/history/alice/12?from=yesterday", http.StatusBadRequest, nil)
+
+	rec := httptest.NewRecorder()
+	te.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/history/alice/13?format=csv&symbol=ABC", nil))
+	if ct := rec.Header().Get("Content-Type"); rec.Code != http.StatusOK || ct != "text/csv" {
+		t.Fatalf("CSV export = %d %s: %s", rec.Code, ct, rec.Body.String())
+	}
+	want := `eid,time,trans,symbol,side,shares,price,amount,fees,source,currency,fxRate,localPrice
+2,2017-07-14T03:40:00Z,5,ABC,sell,1,100,100,0,manual,USD,1,100
+1,2017-07-14T02:40:00Z,3,ABC,buy,3,100,300,0,manual,USD,1,100
+`
+	if rec.Body.String() != want {
+		t.Errorf("CSV export =\n%s\nwant\n%s", rec.Body.String(), want)
+	}
+}
+
+func TestOrders(t *testing.T) {
+	te := newTestEnv(t)
+	te.addUser(t, "alice", 1000)
+	te.do(t, "/api/buy/alice/ABC/300/2", http.StatusOK, nil)
+	te.do(t, "/api/commitBuy/alice/3", http.StatusOK, nil)
+	executeOrders := func(trans string) {
+		t.Helper()
+		if _, err := te.db.QueryAndExecuteCurrentTriggers(context.Background(), te.quotes, trans); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var limitBuy, marketable, ioc, stopLoss, stopLimit transdb.Order
+	te.do(t, "/api/placeOrder/alice/DEF/limit_buy/5/4?limitPrice=30", http.StatusOK, &limitBuy)
+	if limitBuy.Status != transdb.OrderOpen || limitBuy.Held != 150 || limitBuy.TimeInForce != transdb.GTC {
+		t.Errorf("limit buy = %+v", limitBuy)
+	}
+	te.do(t, "/api/placeOrder/alice/DEF/limit_buy/1/5?limitPrice=50", http.StatusOK, &marketable)
+	if marketable.Status != transdb.OrderFilled || marketable.FillPrice != 40 {
+		t.Errorf("marketable limit buy = %+v", marketable)
+	}
+	te.assertBalance(t, "alice", 700-150-40)
+
+	te.do(t, "/api/placeOrder/alice/ABC/limit_sell/1/6?limitPrice=150&tif=IOC", http.StatusOK, &ioc)
+	if ioc.Status != transdb.OrderCancelled {
+		t.Errorf("unfilled IOC order = %+v", ioc)
+	}
+	te.assertShares(t, "alice", "ABC", 3)
+
+	te.do(t, "/api/placeOrder/alice/ABC/stop_loss/2/7?stopPrice=90&tif=DAY", http.StatusOK, &stopLoss)
+	te.do(t, "/api/placeOrder/alice/ABC/stop_limit/1/8?stopPrice=95&limitPrice=92", http.StatusOK, &stopLimit)
+	if stopLoss.Expires != time.Date(2017, 7, 15, 0, 0, 0, 0, time.UTC).Unix() || stopLimit.Expires != 0 {
+		t.Errorf("expiry = %d and %d", stopLoss.Expires, stopLimit.Expires)
+	}
+	te.assertShares(t, "alice", "ABC", 0)
+
+	var summary struct {
+		ReservedFunds  int             `json:"reservedFunds"`
+		ReservedShares map[string]int  `json:"reservedShares"`
+		Orders         []transdb.Order `json:"orders"`
+	}
+	te.do(t, "/api/displaySummary/alice/9", http.StatusOK, &summary)
+	if summary.ReservedFunds != 150 || summary.ReservedShares["ABC"] != 3 || len(summary.Orders) != 3 {
+		t.Errorf("summary = %+v", summary)
+	}
+
+	// the stop limit stops but is below its limit, the stop loss holds
+	te.quotes.prices["ABC"] = 91
+	executeOrders("10")
+	got, _ := te.db.QueryOrder(context.Background(), nil, stopLimit.ID)
+	if !got.Stopped || got.Status != transdb.OrderOpen {
+		t.Errorf("stop limit at 91 = %+v", got)
+	}
+
+	te.quotes.prices["ABC"] = 93
+	te.quotes.prices["DEF"] = 30
+	executeOrders("11")
+	var orders []transdb.Order
+	te.do(t, "/api/orders/alice/12", http.StatusOK, &orders)
+	status := map[int64]transdb.OrderStatus{}
+	for _, o := range orders {
+		status[o.ID] = o.Status
+	}
+	if status[stopLimit.ID] != transdb.OrderFilled || status[limitBuy.ID] != transdb.OrderFilled || status[stopLoss.ID] != transdb.OrderOpen {
+		t.Errorf("statuses = %v", status)
+	}
+
+	te.clock.Advance(24 * time.Hour)
+	executeOrders("13")
+	te.do(t, "/api/orders/alice/14?open=true", http.StatusOK, &orders)
+	if len(orders) != 0 {
+		t.Errorf("open orders after the day ended = %+v", orders)
+	}
+	te.assertBalance(t, "alice", 700-150-40+93)
+	te.assertShares(t, "alice", "ABC", 2)
+	te.assertShares(t, "alice", "DEF", 6)
+
+	te.do(t, fmt.Sprintf("/api/cancelOrder/alice/%d/15", limitBuy.ID), http.StatusConflict, nil)
+	te.do(t, "/api/cancelOrder/alice/999/16", http.StatusNotFound, nil)
+	te.do(t, fmt.Sprintf("/api/cancelOrder/bob/%d/17", stopLoss.ID), http.StatusNotFound, nil)
+	te.do(t, "/api/placeOrder/alice/ABC/market/1/18", http.StatusBadRequest, nil)
+	te.do(t, "/api/placeOrder/alice/ABC/stop_limit/1/19?stopPrice=90", http.StatusBadRequest, nil)
+	te.do(t, "/api/placeOrder/alice/ABC/limit_buy/1000/20?limitPrice=100", http.StatusInternalServerError, nil)
+
+	var open transdb.Order
+	te.do(t, "/api/placeOrder/alice/ABC/limit_sell/1/21?limitPrice=500", http.StatusOK, &open)
+	te.do(t, fmt.Sprintf("/api/cancelOrder/alice/%d/22", open.ID), http.StatusOK, &open)
+	if open.Status != transdb.OrderCancelled {
+		t.Errorf("cancelled order = %+v", open)
+	}
+	te.assertShares(t, "alice", "ABC", 2)
+}
+
+func TestTriggerRunner(t *testing.T) {
+	te := newTestEnv(t)
+	te.addUser(t, "alice", 1000)
+
+	var day, gtc transdb.Order
+	te.do(t, "/api/placeOrder/alice/ABC/limit_buy/1/2?limitPrice=50&tif=DAY", http.StatusOK, &day)
+	te.do(t, "/api/placeOrder/alice/DEF/limit_buy/2/3?limitPrice=30", http.StatusOK, &gtc)
+	if day.Status != transdb.OrderOpen || gtc.Status != transdb.OrderOpen {
+		t.Fatalf("placed %+v and %+v, want both open", day, gtc)
+	}
+	te.assertBalance(t, "alice", 1000-50-60)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		te.env.every(ctx, time.Second, te.env.executeCurrentTriggers)
+		close(done)
+	}()
+	order := func(oid int64) transdb.Order {
+		t.Helper()
+		o, err := te.db.QueryOrder(context.Background(), nil, oid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+
+	// the resting GTC order fills on a later quote
+	te.clock.BlockUntil(1)
+	te.quotes.prices["DEF"] = 30
+	te.clock.Advance(time.Second)
+	te.clock.BlockUntil(1)
+	if o := order(gtc.ID); o.Status != transdb.OrderFilled || o.FillPrice != 30 {
+		t.Errorf("GTC order after the quote fell = %+v", o)
+	}
+	if o := order(day.ID); o.Status != transdb.OrderOpen {
+		t.Errorf("DAY order before the end of the day = %+v", o)
+	}
+	te.assertShares(t, "alice", "DEF", 2)
+
+	// the DAY order expires once its day has ended and returns its cash
+	te.clock.Advance(24 * time.Hour)
+	te.clock.BlockUntil(1)
+	if o := order(day.ID); o.Status != transdb.OrderExpired || o.Held != 0 {
+		t.Errorf("DAY order after the end of the day = %+v", o)
+	}
+	te.assertBalance(t, "alice", 1000-60)
+
+	cancel()
+	<-done
+}
+
+func TestOrderGroups(t *testing.T) {
+	te := newTestEnv(t)
+	te.addUser(t, "alice", 1000)
+	te.do(t, "/api/buy/alice/ABC/300/2", http.StatusOK, nil)
+	te.do(t, "/api/commitBuy/alice/3", http.StatusOK, nil)
+
+	var oco, bracket transdb.OrderGroup
+	te.do(t, "/api/placeOrderGroup/alice/ABC/oco/3/4?takeProfit=120&stopLoss=90", http.StatusOK, &oco)
+	if oco.Status != transdb.OrderOpen || len(oco.Orders) != 2 || oco.Orders[0].Held+oco.Orders[1].Held != 3 {
+		t.Errorf("oco = %+v", oco)
+	}
+	te.assertShares(t, "alice", "ABC", 0)
+
+	// the entry fills when placed, so the exits open and hold its shares
+	te.do(t, "/api/placeOrderGroup/alice/DEF/bracket/2/5?entryPrice=40&takeProfit=50&stopLoss=35&stopLimit=34", http.StatusOK, &bracket)
+	if bracket.Orders[0].Status != transdb.OrderFilled || bracket.Orders[1].Held != 2 || bracket.Orders[2].Kind != transdb.StopLimit || bracket.Orders[2].Status != transdb.OrderOpen {
+		t.Errorf("bracket = %+v", bracket)
+	}
+	te.assertBalance(t, "alice", 700-80)
+	te.assertShares(t, "alice", "DEF", 0)
+
+	te.quotes.prices["ABC"] = 85
+	if _, err := te.db.QueryAndExecuteCurrentTriggers(context.Background(), te.quotes, "6"); err != nil {
+		t.Fatal(err)
+	}
+	te.assertBalance(t, "alice", 700-80+255)
+
+	var groups []transdb.OrderGroup
+	te.do(t, "/api/orderGroups/alice/7", http.StatusOK, &groups)
+	if len(groups) != 2 || groups[0].Status != transdb.OrderFilled || groups[0].Orders[0].Status != transdb.OrderCancelled {
+		t.Errorf("groups = %+v", groups)
+	}
+
+	te.do(t, fmt.Sprintf("/api/cancelOrder/alice/%d/8", bracket.Orders[2].ID), http.StatusOK, nil)
+	te.assertShares(t, "alice", "DEF", 2)
+	te.do(t, "/api/orderGroups/alice/9?open=true", http.StatusOK, &groups)
+	if len(groups) != 0 {
+		t.Errorf("open groups after cancelling = %+v", groups)
+	}
+
+	te.do(t, "/api/placeOrderGroup/alice/ABC/bracket/1/10?entryPrice=80&takeProfit=120", http.StatusBadRequest, nil)
+	te.do(t, "/api/placeOrderGroup/alice/ABC/oco/1/11?takeProfit=80&stopLoss=90&tif=IOC", http.StatusBadRequest, nil)
+	te.do(t, "/api/placeOrderGroup/alice/ABC/oco/5/12?takeProfit=120&stopLoss=90", http.StatusInternalServerError, nil)
+}
+
+func TestOrderGroupRunner(t *testing.T) {
+	te := newTestEnv(t)
+	te.addUser(t, "alice", 1000)
+	te.do(t, "/api/placeOrder/alice/ABC/limit_buy/3/2?limitPrice=100", http.StatusOK, nil)
+
+	var oco transdb.OrderGroup
+	te.do(t, "/api/placeOrderGroup/alice/ABC/oco/2/3?takeProfit=120&stopLoss=90", http.StatusOK, &oco)
+	profit, stop := oco.Orders[0], oco.Orders[1]
+	if profit.Held != 2 || stop.Held != 0 {
+		t.Fatalf("oco = %+v, want the take profit holding both shares", oco)
+	}
+	te.assertShares(t, "alice", "ABC", 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go te.env.every(ctx, time.Second, te.env.executeCurrentTriggers)
+
+	// nothing fills between the two prices
+	te.clock.BlockUntil(1)
+	te.quotes.prices["ABC"] = 110
+	te.clock.Advance(time.Second)
+	te.clock.BlockUntil(1)
+	var groups []transdb.OrderGroup
+	te.do(t, "/api/orderGroups/alice/4", http.StatusOK, &groups)
+	if len(groups) != 1 || groups[0].Status != transdb.OrderOpen {
+		t.Fatalf("groups after a quote of 110 = %+v", groups)
+	}
+
+	// the stop loss fills with the shares the take profit held, and the take
+	// profit is cancelled holding nothing
+	te.quotes.prices["ABC"] = 85
+	te.clock.Advance(time.Second)
+	te.clock.BlockUntil(1)
+	te.do(t, "/api/orderGroups/alice/5", http.StatusOK, &groups)
+	if len(groups) != 1 || groups[0].Status != transdb.OrderFilled {
+		t.Fatalf("groups after a quote of 85 = %+v", groups)
+	}
+	profit, stop = groups[0].Orders[0], groups[0].Orders[1]
+	if stop.Status != transdb.OrderFilled || stop.FillPrice != 85 || stop.Held != 0 {
+		t.Errorf("stop loss = %+v", stop)
+	}
+	if profit.Status != transdb.OrderCancelled || profit.Held != 0 {
+		t.Errorf("take profit = %+v", profit)
+	}
+	te.assertBalance(t, "alice", 700+2*85)
+	te.assertShares(t, "alice", "ABC", 1)
+}
+
+func TestSchedules(t *testing.T) {
+	te := newTestEnv(t)
+	te.addUser(t, "alice", 1000)
+	ctx := context.Background()
+
+	var sch summarySchedule
+	te.do(t, "/api/addSchedule/alice/ABC/250/2?cadence=@daily", http.StatusOK, &sch)
+	if sch.State != "active" || sch.Next != time.Date(2017, 7, 15, 0, 0, 0, 0, time.UTC).Unix() {
+		t.Errorf("schedule = %+v", sch)
+	}
+	te.do(t, "/api/addSchedule/alice/ABC/250/3?cadence=daily", http.StatusBadRequest, nil)
+	te.do(t, "/api/addSchedule/bob/ABC/250/4?cadence=@daily", http.StatusNotFound, nil)
+
+	te.clock.Advance(22 * time.Hour)
+	te.env.runDueSchedules(ctx)
+	te.assertBalance(t, "alice", 800)
+	te.assertShares(t, "alice", "ABC", 2)
+
+	path := fmt.Sprintf("/api/%%s/alice/%d/%%d", sch.ID)
+	te.do(t, fmt.Sprintf(path, "pauseSchedule", 5), http.StatusOK, &sch)
+	te.clock.Advance(24 * time.Hour)
+	te.env.runDueSchedules(ctx)
+	te.assertBalance(t, "alice", 800)
+
+	// missed runs are skipped on resume, and a short balance skips a run
+	te.do(t, fmt.Sprintf(path, "resumeSchedule", 6), http.StatusOK, &sch)
+	if sch.State != "active" || sch.Next != time.Date(2017, 7, 17, 0, 0, 0, 0, time.UTC).Unix() {
+		t.Errorf("resumed schedule = %+v", sch)
+	}
+	te.do(t, "/api/buy/alice/ABC/700/7", http.StatusOK, nil)
+	te.do(t, "/api/commitBuy/alice/8", http.StatusOK, nil)
+	te.clock.Advance(24 * time.Hour)
+	te.env.runDueSchedules(ctx)
+
+	var schedules []summarySchedule
+	te.do(t, "/api/schedules/alice/9", http.StatusOK, &schedules)
+	if len(schedules) != 1 || schedules[0].LastRun == nil || schedules[0].LastRun.Reason != transdb.SkipInsufficient {
+		t.Errorf("schedules = %+v", schedules)
+	}
+	var runs []transdb.ScheduleRun
+	te.do(t, fmt.Sprintf("/api/scheduleRuns/alice/10?sid=%d", sch.ID), http.StatusOK, &runs)
+	if len(runs) != 2 || runs[1].Status != transdb.RunBought || runs[1].Shares != 2 || runs[0].Status != transdb.RunSkipped {
+		t.Errorf("runs = %+v", runs)
+	}
+
+	te.do(t, fmt.Sprintf("/api/deleteSchedule/bob/%d/11", sch.ID), http.StatusNotFound, nil)
+	te.do(t, fmt.Sprintf(path, "deleteSchedule", 12), http.StatusOK, nil)
+	te.do(t, fmt.Sprintf(path, "pauseSchedule", 13), http.StatusNotFound, nil)
+	te.do(t, "/api/schedules/alice/14", http.StatusOK, &schedules)
+	if len(schedules) != 0 {
+		t.Errorf("schedules after delete = %+v", schedules)
+	}
+}
+
+func TestFractionalShares(t *testing.T) {
+	te := newTestEnv(t)
+	te.db.Scale = transdb.MicroShares
+	te.addUser(t, "alice", 1000)
+
+	te.do(t, "/api/buy/alice/ABC/50/2", http.StatusOK, nil)
+	te.do(t, "/api/commitBuy/alice/3", http.StatusOK, nil)
+	te.assertBalance(t, "alice", 950)
+	te.assertShares(t, "alice", "ABC", 500000)
+
+	te.do(t, "/api/sell/alice/ABC/25/4", http.StatusOK, nil)
+	te.do(t, "/api/commitSell/alice/5", http.StatusOK, nil)
+	te.assertBalance(t, "alice", 975)
+	te.assertShares(t, "alice", "ABC", 250000)
+
+	// a third of a DEF share, charged up to the next cent
+	te.do(t, "/api/setBuyAmount/alice/DEF/10/6", http.StatusOK, nil)
+	te.do(t, "/api/setBuyTrigger/alice/DEF/40/7", http.StatusOK, nil)
+	te.quotes.prices["DEF"] = 30
+	if _, err := te.db.QueryAndExecuteCurrentTriggers(context.Background(), te.quotes, "8"); err != nil {
+		t.Fatal(err)
+	}
+	te.assertShares(t, "alice", "DEF", 333333)
+	te.assertBalance(t, "alice", 965)
+
+	var o transdb.Order
+	te.do(t, "/api/placeOrder/alice/ABC/limit_sell/0.25/9?limitPrice=100", http.StatusOK, &o)
+	if o.Status != transdb.OrderFilled || o.Shares != 250000 {
+		t.Errorf("fractional order = %+v", o)
+	}
+	te.assertBalance(t, "alice", 990)
+	te.assertShares(t, "alice", "ABC", 0)
+	te.do(t, "/api/placeOrder/alice/ABC/limit_sell/0.0000001/10?limitPrice=100", http.StatusBadRequest, nil)
+
+	var history struct {
+		Executions []transdb.Execution `json:"executions"`
+	}
+	te.do(t, "/api/history/alice/11?symbol=DEF", http.StatusOK, &history)
+	if len(history.Executions) != 1 || history.Executions[0].Shares != 333333 || history.Executions[0].Amount != 10 {
+		t.Errorf("executions = %+v", history.Executions)
+	}
+}
+
+func TestTrailingStop(t *testing.T) {
+	te := newTestEnv(t)
+	ctx := context.Background()
+	te.addUser(t, "alice", 1000)
+	te.do(t, "/api/buy/alice/ABC/300/2", http.StatusOK, nil)
+	te.do(t, "/api/commitBuy/alice/3", http.StatusOK, nil)
+	te.do(t, "/api/setSellAmount/alice/ABC/200/4", http.StatusOK, nil)
+
+	var trig summaryTrigger
+	te.do(t, "/api/setSellTrailingStop/alice/ABC/5?trailPercent=10", http.StatusOK, &trig)
+	if trig.TriggerPrice != 90 || !trig.Executable || trig.Trailing == nil || trig.Trailing.HighWater != 100 {
+		t.Errorf("setSellTrailingStop = %+v", trig)
+	}
+	te.do(t, "/api/setSellTrailingStop/alice/ABC/6?trailPercent=10", http.StatusInternalServerError, nil)
+
+	stop := func() int {
+		t.Helper()
+		trigs, err := te.db.QueryAllUserTriggers(ctx, "alice")
+		if err != nil || len(trigs) != 1 {
+			t.Fatalf("triggers = %+v, %v", trigs, err)
+		}
+		return trigs[0].TriggerPrice
+	}
+	for _, step := range []struct{ quote, stop int }{{120, 108}, {110, 108}, {125, 113}} {
+		te.quotes.prices["ABC"] = step.quote
+		if _, err := te.db.QueryAndExecuteCurrentTriggers(ctx, te.quotes, "7"); err != nil {
+			t.Fatal(err)
+		}
+		if got := stop(); got != step.stop {
+			t.Errorf("stop after a quote of %d = %d, want %d", step.quote, got, step.stop)
+		}
+	}
+
+	te.quotes.prices["ABC"] = 113
+	if _, err := te.db.QueryAndExecuteCurrentTriggers(ctx, te.quotes, "8"); err != nil {
+		t.Fatal(err)
+	}
+	te.assertBalance(t, "alice", 700+2*113)
+	te.assertShares(t, "alice", "ABC", 1)
+	if stops, _ := te.db.QueryTrailingStops(ctx, "alice"); len(stops) != 0 {
+		t.Errorf("trailing stops left after execution: %+v", stops)
+	}
+
+	te.do(t, "/api/setSellTrailingStop/alice/ABC/9?trailAmount=5", http.StatusInternalServerError, nil)
+	te.quotes.prices["ABC"] = 100
+	te.do(t, "/api/setSellAmount/alice/ABC/100/10", http.StatusOK, nil)
+	te.do(t, "/api/setSellTrailingStop/alice/ABC/11?trailAmount=5&trailPercent=1", http.StatusBadRequest, nil)
+	te.do(t, "/api/setSellTrailingStop/alice/ABC/12?trailAmount=500", http.StatusBadRequest, nil)
+	te.do(t, "/api/setSellTrailingStop/alice/ABC/13?trailAmount=5", http.StatusOK, &trig)
+	if trig.TriggerPrice != 95 {
+		t.Errorf("stop with a trail of 5 = %d, want 95", trig.TriggerPrice)
+	}
+	te.do(t, "/api/cancelSetSell/alice/ABC/14", http.StatusOK, nil)
+	if stops, _ := te.db.QueryTrailingStops(ctx, "alice"); len(stops) != 0 {
+		t.Errorf("trailing stops left after cancel: %+v", stops)
+	}
+}
+
+func TestTrailingStopRunner(t *testing.T) {
+	te := newTestEnv(t)
+	te.addUser(t, "alice", 1000)
+	// an order fills at once, leaving no reservation waiting on the clock
+	te.do(t, "/api/placeOrder/alice/ABC/limit_buy/3/2?limitPrice=100", http.StatusOK, nil)
+	te.do(t, "/api/setSellAmount/alice/ABC/100/4", http.StatusOK, nil)
+	te.do(t, "/api/setSellTrailingStop/alice/ABC/5?trailPercent=10", http.StatusOK, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go te.env.every(ctx, time.Second, te.env.executeCurrentTriggers)
+	tick := func(quote int) {
+		t.Helper()
+		te.clock.BlockUntil(1)
+		te.quotes.prices["ABC"] = quote
+		te.clock.Advance(time.Second)
+		te.clock.BlockUntil(1)
+	}
+	stop := func() int {
+		t.Helper()
+		trigs, err := te.db.QueryAllUserTriggers(context.Background(), "alice")
+		if err != nil || len(trigs) != 1 {
+			t.Fatalf("triggers = %+v, %v", trigs, err)
+		}
+		return trigs[0].TriggerPrice
+	}
+
+	// the stop ratchets up with the quote, then sells once it falls back
+	tick(120)
+	if got := stop(); got != 108 {
+		t.Errorf("stop after a quote of 120 = %d, want 108", got)
+	}
+	tick(108)
+	te.assertBalance(t, "alice", 700+108)
+	te.assertShares(t, "alice", "ABC", 2)
+
+	// a fixed trigger price replaces the trailing stop, so a higher quote
+	// sells instead of raising the stop
+	te.quotes.prices["ABC"] = 100
+	te.do(t, "/api/setSellAmount/alice/ABC/100/6", http.StatusOK, nil)
+	te.do(t, "/api/setSellTrailingStop/alice/ABC/7?trailPercent=10", http.StatusOK, nil)
+	te.do(t, "/api/setSellTrigger/alice/ABC/150/8", http.StatusOK, nil)
+	if stops, _ := te.db.QueryTrailingStops(context.Background(), "alice"); len(stops) != 0 {
+		t.Errorf("trailing stops left after setting the trigger price: %+v", stops)
+	}
+	tick(160)
+	te.assertBalance(t, "alice", 700+108+160)
+	te.assertShares(t, "alice", "ABC", 1)
+}
+
+func TestErrors(t *testing.T) {
+	te := newTestEnv(t)
+	te.addUser(t, "alice", 1000)
+	te.do(t, "/api/setBuyAmount/alice/ABC/300/2", http.StatusOK, nil)
+
+	tests := []struct {
+		name string
+		path string
+		code int
+	}{
+		{"invalid money", "/api/add/bob/-5/3", http.StatusBadRequest},
+		{"invalid amount", "/api/buy/alice/ABC/abc/3", http.StatusBadRequest},
+		{"invalid trigger price", "/api/setBuyTrigger/alice/ABC/0/3", http.StatusBadRequest},
+		{"unknown quote", "/api/getQuote/alice/XYZ/3", http.StatusInternalServerError},
+		{"balance of unknown user", "/api/availableBalance/bob/3", http.StatusInternalServerError},
+		{"buy unknown user", "/api/buy/bob/ABC/100/3", http.StatusInternalServerError},
+		{"buy too much", "/api/buy/alice/ABC/5000/3", http.StatusInternalServerError},
+		{"buy under one share", "/api/buy/alice/ABC/50/3", http.StatusInternalServerError},
+		{"commit buy without reservation", "/api/commitBuy/alice/3", http.StatusInternalServerError},
+		{"cancel buy without reservation", "/api/cancelBuy/alice/3", http.StatusInternalServerError},
+		{"sell without shares", "/api/sell/alice/ABC/100/3", http.StatusInternalServerError},
+		{"cancel sell without reservation", "/api/cancelSell/alice/3", http.StatusInternalServerError},
+		{"duplicate buy amount", "/api/setBuyAmount/alice/ABC/100/3", http.StatusInternalServerError},
+		{"buy amount over balance", "/api/setBuyAmount/alice/DEF/5000/3", http.StatusInternalServerError},
+		{"sell amount without shares", "/api/setSellAmount/alice/ABC/100/3", http.StatusInternalServerError},
+		{"sell trigger without amount", "/api/setSellTrigger/alice/ABC/100/3", http.StatusInternalServerError},
+		{"cancel missing sell trigger", "/api/cancelSetSell/alice/ABC/3", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			te.do(t, tt.path, tt.code, nil)
+		})
+	}
+
+	te.assertBalance(t, "alice", 700)
+	if len(te.logger.errors) == 0 {
+		t.Error("no error events logged")
+	}
+}
+
+func TestQuoteTimeout(t *testing.T) {
+	te := newTestEnv(t)
+	te.addUser(t, "alice", 1000)
+	te.quotes.err = dbutils.ErrTimeout
+
+	var m map[string]string
+	te.do(t, "/api/buy/alice/ABC/250/2", http.StatusGatewayTimeout, &m)
+	if m["error"] != dbutils.ErrTimeout.Error() {
+		t.Errorf("buy error = %q, want %q", m["error"], dbutils.ErrTimeout)
+	}
+}
+
+func TestReplayWorkload(t *testing.T) {
+	te := newTestEnv(t)
+	cmds, err := workload.Parse(strings.NewReader(`[1] ADD,alice,10.00
+[2] ADD,bob,5.00
+[3] BUY,alice,ABC,2.50
+[4] COMMIT_BUY,alice
+[5] SET_BUY_AMOUNT,bob,DEF,1.00
+[6] SET_BUY_TRIGGER,bob,DEF,0.30
+[7] SELL,alice,ABC,1.00
+[8] CANCEL_SELL,alice
+[9] COMMIT_SELL,alice
+[10] DISPLAY_SUMMARY,bob
+[11] DUMPLOG,./testLOG
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := workload.Replay(context.Background(), cmds, &workload.HandlerDispatcher{Handler: te.router}, 4)
+	if report.Commands != len(cmds) {
+		t.Errorf("replayed %d commands, want %d", report.Commands, len(cmds))
+	}
+	// only the COMMIT_SELL after CANCEL_SELL should fail
+	if report.Errors != 1 || report.ErrorsByCommand["COMMIT_SELL"] != 1 {
+		t.Errorf("errors = %d, by command %v", report.Errors, report.ErrorsByCommand)
+	}
+	te.assertBalance(t, "alice", 800)
+	te.assertShares(t, "alice", "ABC", 2)
+	te.assertBalance(t, "bob", 400)
+}
+
+func TestCommandOrdering(t *testing.T) {
+	te := newTestEnv(t)
+	te.addUser(t, "alice", 1000)
+	te.env.seq = sequencer.New(sequencer.Options{Shards: 4, QueueSize: 10, Hold: 10 * time.Millisecond}, te.clock)
+	defer te.env.seq.Close()
+
+	send := func(path string) <-chan int {
+		code := make(chan int, 1)
+		go func() {
+			rec := httptest.NewRecorder()
+			te.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			code <- rec.Code
+		}()
+		return code
+	}
+
+	// the commit arrives before the buy it depends on
+	commit := send("/api/commitBuy/alice/3")
+	for te.env.seq.Queued() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	buy := send("/api/buy/alice/ABC/250/2")
+	for te.env.seq.Queued() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	te.clock.Advance(10 * time.Millisecond)
+	if code := <-buy; code != http.StatusOK {
+		t.Errorf("buy = %d", code)
+	}
+	if code := <-commit; code != http.StatusOK {
+		t.Errorf("commitBuy = %d, want it to run after the buy", code)
+	}
+	shares, err := te.db.QueryUserAvailableShares(context.Background(), "alice", "ABC")
+	if err != nil || shares != 2 {
+		t.Errorf("shares = %d, %v, want 2", shares, err)
+	}
+}
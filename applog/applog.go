@@ -0,0 +1,108 @@
+// Package applog provides the service's structured, leveled logger and the
+// helpers used to carry a request-scoped logger through a context.
+package applog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Attribute keys attached to every request-scoped log line.
+const (
+	RequestIDKey = "request_id"
+	UsernameKey  = "username"
+	CommandKey   = "command"
+	TransKey     = "trans"
+)
+
+type ctxKey struct{}
+
+// New builds a logger writing to w in the given format ("json" or "text").
+func New(w io.Writer, level slog.Level, format string) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level, AddSource: true}
+	if format == "text" {
+		return slog.New(slog.NewTextHandler(w, opts))
+	}
+	return slog.New(slog.NewJSONHandler(w, opts))
+}
+
+// NewFromEnv builds a logger configured by LOG_LEVEL (debug, info, warn,
+// error), LOG_FORMAT (json, text) and LOG_OUTPUT (stdout, stderr or a file
+// path). Defaults are info, json and stdout.
+func NewFromEnv() (*slog.Logger, error) {
+	var level slog.Level
+	if lvl, ok := os.LookupEnv("LOG_LEVEL"); ok {
+		if err := level.UnmarshalText([]byte(lvl)); err != nil {
+			return nil, fmt.Errorf("invalid LOG_LEVEL %s: %s", lvl, err)
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	switch out := os.Getenv("LOG_OUTPUT"); out {
+	case "", "stdout":
+	case "stderr":
+		w = os.Stderr
+	default:
+		f, err := os.OpenFile(out, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("opening LOG_OUTPUT %s: %s", out, err)
+		}
+		w = f
+	}
+
+	return New(w, level, strings.ToLower(os.Getenv("LOG_FORMAT"))), nil
+}
+
+// WithLogger returns a copy of ctx carrying l.
+func WithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(ctxKey{}).(*slog.Logger); ok {
+			return l
+		}
+	}
+	return slog.Default()
+}
+
+// With returns a copy of ctx whose logger has args attached to every line.
+func With(ctx context.Context, args ...any) context.Context {
+	return WithLogger(ctx, FromContext(ctx).With(args...))
+}
+
+// NewRequestID returns a random identifier for correlating a request's logs.
+func NewRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// LogErrSkip logs err at error level, attributing the line to the caller
+// skip stack frames above the caller of LogErrSkip.
+func LogErrSkip(ctx context.Context, err error, msg string, skip int) {
+	l := FromContext(ctx)
+	if !l.Enabled(ctx, slog.LevelError) {
+		return
+	}
+
+	var pcs [1]uintptr
+	runtime.Callers(skip+2, pcs[:])
+	r := slog.NewRecord(time.Now(), slog.LevelError, msg, pcs[0])
+	if err != nil {
+		r.AddAttrs(slog.String("error", err.Error()))
+	}
+	l.Handler().Handle(ctx, r)
+}
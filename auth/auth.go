@@ -0,0 +1,185 @@
+// Package auth authenticates API callers, either with a JWT bearer token or
+// with a static API key, and records the resulting principal on the request
+// context.
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type Role string
+
+const (
+	RoleUser  Role = "user"
+	RoleAdmin Role = "admin"
+)
+
+// valid reports whether r is one of the roles above.
+func (r Role) valid() bool {
+	return r == RoleUser || r == RoleAdmin
+}
+
+var (
+	ErrNoCredentials  = errors.New("Missing credentials")
+	ErrBadCredentials = errors.New("Invalid credentials")
+	ErrForbidden      = errors.New("Forbidden")
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Name string `json:"name"`
+	Role Role   `json:"role"`
+}
+
+// IsAdmin reports whether p holds the admin role.
+func (p Principal) IsAdmin() bool {
+	return p.Role == RoleAdmin
+}
+
+// CanActAs reports whether p may issue commands for username. Admins may
+// act on behalf of any user.
+func (p Principal) CanActAs(username string) bool {
+	return p.IsAdmin() || p.Name == username
+}
+
+// Claims are the JWT claims we expect: the subject is the username.
+type Claims struct {
+	Role Role `json:"role"`
+	jwt.RegisteredClaims
+}
+
+type apiKey struct {
+	key       []byte
+	principal Principal
+}
+
+type Authenticator struct {
+	jwtKey  []byte
+	issuer  string
+	apiKeys []apiKey
+}
+
+// NewAuthenticator returns an Authenticator verifying HS256 tokens signed
+// with jwtKey. An empty issuer skips the issuer check.
+func NewAuthenticator(jwtKey []byte, issuer string) *Authenticator {
+	return &Authenticator{jwtKey: jwtKey, issuer: issuer}
+}
+
+// AddAPIKey registers a static API key which authenticates as p.
+func (a *Authenticator) AddAPIKey(key string, p Principal) {
+	a.apiKeys = append(a.apiKeys, apiKey{key: []byte(key), principal: p})
+}
+
+// NewAuthenticatorFromEnv builds an Authenticator from AUTH_JWT_SECRET,
+// AUTH_JWT_ISSUER and AUTH_API_KEYS, a comma separated list of
+// name:key:role entries used by the workload generator and other services.
+func NewAuthenticatorFromEnv() (*Authenticator, error) {
+	secret := os.Getenv("AUTH_JWT_SECRET")
+	apiKeys := os.Getenv("AUTH_API_KEYS")
+	if secret == "" && apiKeys == "" {
+		return nil, errors.New("AUTH_JWT_SECRET or AUTH_API_KEYS must be set")
+	}
+
+	a := NewAuthenticator([]byte(secret), os.Getenv("AUTH_JWT_ISSUER"))
+	for _, entry := range strings.Split(apiKeys, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid AUTH_API_KEYS entry for %s", parts[0])
+		}
+		role := Role(parts[2])
+		if !role.valid() {
+			return nil, fmt.Errorf("invalid role %s for API key %s", parts[2], parts[0])
+		}
+		a.AddAPIKey(parts[1], Principal{Name: parts[0], Role: role})
+	}
+	return a, nil
+}
+
+// Authenticate returns the principal identified by the request's
+// "Authorization: Bearer" token or "X-API-Key" header.
+func (a *Authenticator) Authenticate(r *http.Request) (p Principal, err error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return a.authenticateAPIKey(key)
+	}
+
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return p, ErrNoCredentials
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == header {
+		return p, ErrBadCredentials
+	}
+	return a.authenticateJWT(token)
+}
+
+func (a *Authenticator) authenticateAPIKey(key string) (p Principal, err error) {
+	found := false
+	for _, k := range a.apiKeys {
+		// compare against every key so timing doesn't reveal which matched
+		if subtle.ConstantTimeCompare(k.key, []byte(key)) == 1 {
+			p = k.principal
+			found = true
+		}
+	}
+	if !found {
+		return p, ErrBadCredentials
+	}
+	return p, nil
+}
+
+func (a *Authenticator) authenticateJWT(token string) (p Principal, err error) {
+	if len(a.jwtKey) == 0 {
+		return p, ErrBadCredentials
+	}
+
+	opts := []jwt.ParserOption{jwt.WithValidMethods([]string{"HS256"}), jwt.WithExpirationRequired()}
+	if a.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(a.issuer))
+	}
+
+	claims := &Claims{}
+	_, err = jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return a.jwtKey, nil
+	}, opts...)
+	if err != nil {
+		return p, ErrBadCredentials
+	}
+	if claims.Subject == "" {
+		return p, ErrBadCredentials
+	}
+
+	role := claims.Role
+	if role == "" {
+		role = RoleUser
+	}
+	if !role.valid() {
+		return p, ErrBadCredentials
+	}
+	return Principal{Name: claims.Subject, Role: role}, nil
+}
+
+type ctxKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying p.
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, ctxKey{}, p)
+}
+
+// FromContext returns the principal carried by ctx, if any.
+func FromContext(ctx context.Context) (p Principal, ok bool) {
+	p, ok = ctx.Value(ctxKey{}).(Principal)
+	return
+}
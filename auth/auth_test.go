@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var testSecret = []byte("secret")
+
+// sign returns a token for claims signed with method and key.
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, claims jwt.Claims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// claims returns claims for subject with role, issued by issuer and
+// expiring in an hour.
+func claims(subject string, role Role, issuer string) *Claims {
+	return &Claims{Role: role, RegisteredClaims: jwt.RegisteredClaims{
+		Subject:   subject,
+		Issuer:    issuer,
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}}
+}
+
+func TestAuthenticateJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := claims("alice", RoleUser, "issuer")
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	noExpiry := claims("alice", RoleUser, "issuer")
+	noExpiry.ExpiresAt = nil
+
+	tests := []struct {
+		name  string
+		token string
+		want  Principal
+		err   error
+	}{
+		{"user", sign(t, jwt.SigningMethodHS256, testSecret, claims("alice", RoleUser, "issuer")), Principal{"alice", RoleUser}, nil},
+		{"admin", sign(t, jwt.SigningMethodHS256, testSecret, claims("root", RoleAdmin, "issuer")), Principal{"root", RoleAdmin}, nil},
+		{"no role", sign(t, jwt.SigningMethodHS256, testSecret, claims("alice", "", "issuer")), Principal{"alice", RoleUser}, nil},
+		{"unknown role", sign(t, jwt.SigningMethodHS256, testSecret, claims("alice", "superuser", "issuer")), Principal{}, ErrBadCredentials},
+		{"no subject", sign(t, jwt.SigningMethodHS256, testSecret, claims("", RoleUser, "issuer")), Principal{}, ErrBadCredentials},
+		{"expired", sign(t, jwt.SigningMethodHS256, testSecret, expired), Principal{}, ErrBadCredentials},
+		{"no expiry", sign(t, jwt.SigningMethodHS256, testSecret, noExpiry), Principal{}, ErrBadCredentials},
+		{"wrong issuer", sign(t, jwt.SigningMethodHS256, testSecret, claims("alice", RoleUser, "other")), Principal{}, ErrBadCredentials},
+		{"bad signature", sign(t, jwt.SigningMethodHS256, []byte("other"), claims("alice", RoleUser, "issuer")), Principal{}, ErrBadCredentials},
+		{"alg none", sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, claims("alice", RoleUser, "issuer")), Principal{}, ErrBadCredentials},
+		{"alg RS256", sign(t, jwt.SigningMethodRS256, rsaKey, claims("alice", RoleUser, "issuer")), Principal{}, ErrBadCredentials},
+		{"garbage", "not.a.token", Principal{}, ErrBadCredentials},
+	}
+
+	a := NewAuthenticator(testSecret, "issuer")
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+		p, err := a.Authenticate(r)
+		if err != tt.err || p != tt.want {
+			t.Errorf("%s: Authenticate = %+v, %v, want %+v, %v", tt.name, p, err, tt.want, tt.err)
+		}
+	}
+
+	// without an issuer configured any issuer is accepted
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+sign(t, jwt.SigningMethodHS256, testSecret, claims("alice", RoleUser, "other")))
+	if p, err := NewAuthenticator(testSecret, "").Authenticate(r); err != nil || p.Name != "alice" {
+		t.Errorf("Authenticate without issuer = %+v, %v", p, err)
+	}
+	// nor are tokens accepted when no secret is configured
+	if _, err := NewAuthenticator(nil, "").Authenticate(r); err != ErrBadCredentials {
+		t.Errorf("Authenticate without secret = %v, want %v", err, ErrBadCredentials)
+	}
+}
+
+func TestAuthenticateHeaders(t *testing.T) {
+	a := NewAuthenticator(testSecret, "")
+	a.AddAPIKey("user-key", Principal{"workload", RoleUser})
+	a.AddAPIKey("admin-key", Principal{"ops", RoleAdmin})
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		want   Principal
+		err    error
+	}{
+		{"user key", "X-API-Key", "user-key", Principal{"workload", RoleUser}, nil},
+		{"admin key", "X-API-Key", "admin-key", Principal{"ops", RoleAdmin}, nil},
+		{"wrong key", "X-API-Key", "user-key2", Principal{}, ErrBadCredentials},
+		{"not bearer", "Authorization", "Basic dXNlcjpwYXNz", Principal{}, ErrBadCredentials},
+		{"nothing", "", "", Principal{}, ErrNoCredentials},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		p, err := a.Authenticate(r)
+		if err != tt.err || p != tt.want {
+			t.Errorf("%s: Authenticate = %+v, %v, want %+v, %v", tt.name, p, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestRoles(t *testing.T) {
+	user := Principal{"alice", RoleUser}
+	admin := Principal{"root", RoleAdmin}
+
+	tests := []struct {
+		p        Principal
+		username string
+		admin    bool
+		actAs    bool
+	}{
+		{user, "alice", false, true},
+		{user, "bob", false, false},
+		{admin, "alice", true, true},
+		{admin, "root", true, true},
+	}
+	for _, tt := range tests {
+		if got := tt.p.IsAdmin(); got != tt.admin {
+			t.Errorf("%+v.IsAdmin() = %t, want %t", tt.p, got, tt.admin)
+		}
+		if got := tt.p.CanActAs(tt.username); got != tt.actAs {
+			t.Errorf("%+v.CanActAs(%s) = %t, want %t", tt.p, tt.username, got, tt.actAs)
+		}
+	}
+}
+
+func TestNewAuthenticatorFromEnv(t *testing.T) {
+	tests := []struct {
+		keys string
+		ok   bool
+	}{
+		{"workload:key1:user, ops:key2:admin", true},
+		{"workload:key1:superuser", false},
+		{"workload:key1", false},
+		{":key1:user", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("AUTH_JWT_SECRET", "")
+		t.Setenv("AUTH_API_KEYS", tt.keys)
+		if _, err := NewAuthenticatorFromEnv(); (err == nil) != tt.ok {
+			t.Errorf("NewAuthenticatorFromEnv(%q) error = %v, want ok %t", tt.keys, err, tt.ok)
+		}
+	}
+
+	t.Setenv("AUTH_API_KEYS", "")
+	if _, err := NewAuthenticatorFromEnv(); err == nil {
+		t.Error("NewAuthenticatorFromEnv without a secret or keys succeeded")
+	}
+}
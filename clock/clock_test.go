@@ -0,0 +1,62 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	f := NewFake(start)
+
+	later := f.After(10 * time.Second)
+	sooner := f.After(5 * time.Second)
+	if n := f.Waiters(); n != 2 {
+		t.Fatalf("Waiters = %d, want 2", n)
+	}
+
+	f.Advance(4 * time.Second)
+	select {
+	case <-sooner:
+		t.Fatal("After(5s) fired after 4s")
+	default:
+	}
+
+	f.Advance(time.Second)
+	if got := <-sooner; !got.Equal(start.Add(5 * time.Second)) {
+		t.Errorf("After(5s) fired at %s", got)
+	}
+	select {
+	case <-later:
+		t.Fatal("After(10s) fired after 5s")
+	default:
+	}
+
+	f.Advance(time.Minute)
+	<-later
+	if n := f.Waiters(); n != 0 {
+		t.Errorf("Waiters = %d after firing, want 0", n)
+	}
+	if got := f.Now(); !got.Equal(start.Add(65 * time.Second)) {
+		t.Errorf("Now = %s", got)
+	}
+
+	select {
+	case <-f.After(0):
+	default:
+		t.Error("After(0) didn't fire immediately")
+	}
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+	f := NewFake(time.Unix(0, 0))
+	fired := make(chan struct{})
+	go func() {
+		<-f.After(time.Second)
+		close(fired)
+	}()
+
+	f.BlockUntil(1)
+	f.Advance(time.Second)
+	<-fired
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"transaction_service/workload"
+)
+
+// runLoadTest implements the loadtest subcommand, returning the exit code:
+//
+//	transaction_service loadtest -url URL [-users N] [-sessions N] [-concurrency N] [-seed N] [-json]
+//
+// It synthesizes user sessions and replays them against a running instance.
+// Runs with the same -users, -sessions and -seed send the same commands, so
+// their reports can be compared; the username prefix defaults to one made
+// from the seed for that reason.
+func runLoadTest(log *slog.Logger, args []string) int {
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	baseURL := fs.String("url", "", "base URL of the service under test, e.g. http://localhost:8888")
+	users := fs.Int("users", 100, "number of simulated users")
+	sessions := fs.Int("sessions", 5, "trading sessions per user")
+	concurrency := fs.Int("concurrency", 50, "maximum number of commands in flight")
+	seed := fs.Int64("seed", 1, "random seed for the generated sessions")
+	prefix := fs.String("prefix", "", "prefix for generated usernames (default load<seed>_)")
+	apiKey := fs.String("api-key", os.Getenv("REPLAY_API_KEY"), "admin API key sent as X-API-Key")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *baseURL == "" || fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: transaction_service loadtest -url URL [flags]")
+		fs.PrintDefaults()
+		return 2
+	}
+
+	if *prefix == "" {
+		*prefix = fmt.Sprintf("load%d_", *seed)
+	}
+
+	cmds := workload.Generate(workload.GenerateOptions{Users: *users, SessionsPerUser: *sessions, Prefix: *prefix, Seed: *seed})
+	d := newHTTPDispatcher(*baseURL, *apiKey, *concurrency)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	log.Info("Running load test", "url", *baseURL, "users", *users, "sessions", *sessions, "concurrency", *concurrency, "commands", len(cmds))
+	report := workload.Replay(ctx, cmds, d, *concurrency)
+	printReport(report, *asJSON)
+
+	if ctx.Err() != nil {
+		log.Warn("Load test interrupted", "completed", report.Commands, "total", len(cmds))
+		return 1
+	}
+	return 0
+}
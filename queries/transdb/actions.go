@@ -1,22 +1,25 @@
 package transdb
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"time"
 	"strconv"
+	"strings"
 
 	"common/logging"
 	"common/models"
-	"common/utils"
+	"transaction_service/applog"
+	"transaction_service/clock"
 	"transaction_service/queries/utils"
 
 	"github.com/go-redis/redis"
 	"github.com/jackc/pgx"
 )
 
-func NewQuoteCacheConnection() (cache *redis.Client) {
+func NewQuoteCacheConnection(log *slog.Logger) (cache *redis.Client) {
 	host := os.Getenv("REDIS_HOST")
 	port := os.Getenv("REDIS_PORT")
 	addr := fmt.Sprintf("%s:%s", host, port)
@@ -29,20 +32,20 @@ func NewQuoteCacheConnection() (cache *redis.Client) {
 
 	_, err := cache.Ping().Result()
 	if err != nil {
-		utils.LogErr(err, "Error connecting to quote cache.")
+		log.Error("Error connecting to quote cache.", "addr", addr, "error", err)
 		panic(err)
 	}
 
 	return
 }
 
-func NewTransactionDBConnection(host string, port string) (tdb *TransactionDB) {
+func NewTransactionDBConnection(log *slog.Logger, clk clock.Clock, host string, port string) (tdb *TransactionDB) {
 	user := os.Getenv("PGUSER")
 	password := os.Getenv("PGPASSWORD")
 	dbname := os.Getenv("TRANS_DB")
 	uport, err := strconv.ParseUint(port, 10, 16)
 	if err != nil {
-		utils.LogErr(err, "Error parsing port")
+		log.Error("Error parsing port", "port", port, "error", err)
 		panic(err)
 	}
 	u16port := uint16(uport)
@@ -62,75 +65,153 @@ func NewTransactionDBConnection(host string, port string) (tdb *TransactionDB) {
 
 	db, err := pgx.NewConnPool(connPoolConfig)
 	if err != nil {
-		utils.LogErr(err, "Error connecting to DB.")
+		log.Error("Error connecting to DB.", "host", host, "port", port, "error", err)
 		panic(err)
 	}
 
 	logger := logging.NewLoggerConnection()
-	tdb = &TransactionDB{DB: db, logger: logger}
+	tdb = &TransactionDB{DB: db, logger: logger, log: log, clock: clk, CostBasis: FIFO, Scale: WholeShares}
+	if err = tdb.Migrate(context.Background()); err != nil {
+		log.Error("Error migrating DB.", "host", host, "port", port, "error", err)
+		panic(err)
+	}
 	return
 }
 
-func (tdb *TransactionDB) ClearUsers() (err error) {
-	query := "DELETE FROM Users"
-	_, err = tdb.DB.Exec(query)
+// ClearUsers empties every table of user data at once, within tx so it can
+// be rolled back. Symbols and settings are kept.
+func (tdb *TransactionDB) ClearUsers(ctx context.Context, tx Tx) (err error) {
+	ctx, span := startSpan(ctx, "ClearUsers")
+	defer endSpan(span, &err)
+
+	_, err = tdb.q(tx).ExecEx(ctx, "TRUNCATE "+strings.Join(userTables, ", "), nil)
+	return
+}
+
+// userTables are the tables with rows belonging to a user, which ClearUsers
+// empties.
+var userTables = []string{"users", "stocks", "reservations", "triggers", "lots", "realizations", "executions", "orders", "order_groups", "trailing_stops", "schedules", "schedule_runs", "balances", "transfers"}
+
+// DeleteUser removes every row belonging to the user.
+func (tdb *TransactionDB) DeleteUser(ctx context.Context, username string) (err error) {
+	ctx, span := startSpan(ctx, "DeleteUser")
+	defer endSpan(span, &err)
+
+	tx, err := tdb.Begin(ctx)
+	if err != nil {
+		return
+	}
+	for _, table := range userTables {
+		if _, err = tdb.q(tx).ExecEx(ctx, "DELETE FROM "+table+" WHERE username = $1", nil, username); err != nil {
+			tx.Rollback(ctx)
+			return
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (tdb *TransactionDB) SetUserStatus(ctx context.Context, tx Tx, username string, status UserStatus) (err error) {
+	ctx, span := startSpan(ctx, "SetUserStatus")
+	defer endSpan(span, &err)
+
+	query := "UPDATE users SET status=$1 WHERE username=$2"
+	tag, err := tdb.q(tx).ExecEx(ctx, query, nil, status, username)
+	if err == nil && tag.RowsAffected() == 0 {
+		err = ErrNoRows
+	}
 	return
 }
 
-func (tdb *TransactionDB) InsertUser(user models.User) (res pgx.CommandTag, err error) {
+func (tdb *TransactionDB) InsertUser(ctx context.Context, user models.User) (err error) {
+	ctx, span := startSpan(ctx, "InsertUser")
+	defer endSpan(span, &err)
+
 	//add new user
 	query := "INSERT INTO users(username, money) VALUES($1,$2)"
-	res, err = tdb.DB.Exec(query, user.Username, user.Money)
+	_, err = tdb.DB.ExecEx(ctx, query, nil, user.Username, user.Money)
 	return
 }
 
-func (tdb *TransactionDB) UpdateUser(user models.User) (res pgx.CommandTag, err error) {
+func (tdb *TransactionDB) UpdateUser(ctx context.Context, user models.User) (err error) {
+	ctx, span := startSpan(ctx, "UpdateUser")
+	defer endSpan(span, &err)
+
 	query := "UPDATE users SET money = $1 WHERE username = $2"
 	money := fmt.Sprintf("%d", user.Money)
-	res, err = tdb.DB.Exec(query, money, user.Username)
+	_, err = tdb.DB.ExecEx(ctx, query, nil, money, user.Username)
 	return
 }
 
-func (tdb *TransactionDB) AddReservation(tx *pgx.Tx, res models.Reservation) (rid int64, err error) {
+func (tdb *TransactionDB) AddReservation(ctx context.Context, tx Tx, res models.Reservation) (rid int64, err error) {
+	ctx, span := startSpan(ctx, "AddReservation")
+	defer endSpan(span, &err)
+
 	query := "INSERT INTO reservations(username, symbol, type, shares, amount, time) VALUES($1,$2,$3,$4,$5,$6) RETURNING rid"
-	if tx == nil {
-		err = tdb.DB.QueryRow(query, res.Username, res.Symbol, res.Order, res.Shares, res.Amount, res.Time).Scan(&rid)
-	} else {
-		err = tx.QueryRow(query, res.Username, res.Symbol, res.Order, res.Shares, res.Amount, res.Time).Scan(&rid)
-	}
+	err = tdb.q(tx).QueryRowEx(ctx, query, nil, res.Username, res.Symbol, res.Order, res.Shares, res.Amount, res.Time).Scan(&rid)
 	return
 }
 
-func (tdb *TransactionDB) UpdateUserStock(tx *pgx.Tx, username string, symbol string, shares int, order models.OrderType) (err error) {
-	stock, err := tdb.QueryUserStock(username, symbol)
+// SetReservationRate records the currency the reservation's symbol was
+// quoted in and the rate its price was converted into the base currency at.
+func (tdb *TransactionDB) SetReservationRate(ctx context.Context, tx Tx, rid int64, currency string, rate dbutils.Rate) (err error) {
+	ctx, span := startSpan(ctx, "SetReservationRate")
+	defer endSpan(span, &err)
+
+	query := "UPDATE reservations SET currency=$2, fx_rate=$3 WHERE rid=$1"
+	_, err = tdb.q(tx).ExecEx(ctx, query, nil, rid, currency, rate)
+	return
+}
+
+func (tdb *TransactionDB) UpdateUserStock(ctx context.Context, tx Tx, username string, symbol string, shares int, order models.OrderType) (err error) {
+	ctx, span := startSpan(ctx, "UpdateUserStock")
+	defer endSpan(span, &err)
+
+	var stock models.Stock
+	query := "SELECT sid, username, symbol, shares FROM stocks WHERE username = $1 AND symbol = $2 FOR UPDATE"
+	err = tdb.q(tx).QueryRowEx(ctx, query, nil, username, symbol).Scan(&stock.ID, &stock.Username, &stock.Symbol, &stock.Shares)
 	if err != nil {
-		if err == pgx.ErrNoRows {
+		if err == ErrNoRows {
+			if order == models.SELL && shares > 0 {
+				return ErrInsufficientShares
+			}
 			query := "INSERT INTO stocks(username,symbol,shares) VALUES($1,$2,$3)"
-			_, err = tx.Exec(query, username, symbol, shares)
+			_, err = tdb.q(tx).ExecEx(ctx, query, nil, username, symbol, shares)
 			return
 		}
 		return
 	}
 
-	// adjust shares depending on order type
+	// adjust shares depending on order type, never selling more than the
+	// locked row holds
 	if order == models.BUY {
 		stock.Shares += shares
+	} else if stock.Shares < shares {
+		return ErrInsufficientShares
 	} else {
 		stock.Shares -= shares
 	}
 
-	query := "UPDATE stocks SET shares=$1 WHERE username=$2 AND symbol=$3"
-	_, err = tx.Exec(query, stock.Shares, stock.Username, stock.Symbol)
+	query = "UPDATE stocks SET shares=$1 WHERE username=$2 AND symbol=$3"
+	_, err = tdb.q(tx).ExecEx(ctx, query, nil, stock.Shares, stock.Username, stock.Symbol)
 	return
 }
 
-func (tdb *TransactionDB) UpdateUserMoney(tx *pgx.Tx, username string, money int, order models.OrderType, trans string) (err error) {
-	user, err := tdb.QueryUser(username)
+func (tdb *TransactionDB) UpdateUserMoney(ctx context.Context, tx Tx, username string, money int, order models.OrderType, trans string) (err error) {
+	ctx, span := startSpan(ctx, "UpdateUserMoney")
+	defer endSpan(span, &err)
+
+	var user models.User
+	query := "SELECT uid, username, money FROM users WHERE username = $1 FOR UPDATE"
+	err = tdb.q(tx).QueryRowEx(ctx, query, nil, username).Scan(&user.ID, &user.Username, &user.Money)
 	if err != nil {
 		return
 	}
 
+	// the row lock keeps the balance checked here until the tx ends
 	if order == models.BUY {
+		if user.Money < money {
+			return ErrInsufficientFunds
+		}
 		user.Money -= money
 		tdb.logger.LogTransaction("remove", username, money, trans)
 
@@ -139,248 +220,410 @@ func (tdb *TransactionDB) UpdateUserMoney(tx *pgx.Tx, username string, money int
 		tdb.logger.LogTransaction("add", username, money, trans)
 	}
 
-	query := "UPDATE users SET money=$1 WHERE username=$2"
-	if tx == nil {
-		_, err = tdb.DB.Exec(query, user.Money, user.Username)
-	} else {
-		_, err = tx.Exec(query, user.Money, user.Username)
-	}
+	query = "UPDATE users SET money=$1 WHERE username=$2"
+	_, err = tdb.q(tx).ExecEx(ctx, query, nil, user.Money, user.Username)
 	return
 }
 
-func (tdb *TransactionDB) RemoveReservation(tx *pgx.Tx, rid int64) (err error) {
+func (tdb *TransactionDB) RemoveReservation(ctx context.Context, tx Tx, rid int64) (err error) {
+	ctx, span := startSpan(ctx, "RemoveReservation")
+	defer endSpan(span, &err)
+
 	query := "DELETE FROM reservations WHERE rid = $1"
-	if tx == nil {
-		_, err = tdb.DB.Exec(query, rid)
-	} else {
-		_, err = tx.Exec(query, rid)
-	}
+	_, err = tdb.q(tx).ExecEx(ctx, query, nil, rid)
 	return
 }
 
-func (tdb *TransactionDB) RemoveOrder(rid int64, timeout time.Duration) {
-	time.Sleep(timeout * time.Second)
+func (tdb *TransactionDB) RemoveOrder(ctx context.Context, rid int64, timeout time.Duration) {
+	ctx, span := startSpan(ctx, "RemoveOrder")
+	defer span.End()
+
+	select {
+	case <-tdb.clock.After(timeout * time.Second):
+	case <-ctx.Done():
+		return
+	}
 
-	err := tdb.RemoveReservation(nil, rid)
+	err := tdb.RemoveReservation(ctx, nil, rid)
 	if err != nil {
-		log.Println("Error removing reservation due to timeout.")
+		applog.FromContext(ctx).Error("Error removing reservation due to timeout.", "rid", rid, "error", err)
 	}
 }
 
-func (tdb *TransactionDB) RemoveLastOrderTypeReservation(username string, orderType models.OrderType) (res models.Reservation, err error) {
+func (tdb *TransactionDB) RemoveLastOrderTypeReservation(ctx context.Context, username string, orderType models.OrderType) (res models.Reservation, err error) {
+	ctx, span := startSpan(ctx, "RemoveLastOrderTypeReservation")
+	defer endSpan(span, &err)
+
 	query := `DELETE FROM reservations WHERE rid IN ( 
 				SELECT rid FROM reservations WHERE username=$1 AND type=$2 ORDER BY time DESC, rid DESC LIMIT(1)) 
 				RETURNING rid, username, symbol, shares, amount, type, time`
 
-	err = tdb.DB.QueryRow(query, username, orderType).Scan(&res.ID, &res.Username, &res.Symbol, &res.Shares, &res.Amount, &res.Order, &res.Time)
+	err = tdb.DB.QueryRowEx(ctx, query, nil, username, orderType).Scan(&res.ID, &res.Username, &res.Symbol, &res.Shares, &res.Amount, &res.Order, &res.Time)
 	return
 }
 
-func (tdb *TransactionDB) SetUserOrderTypeAmount(tx *pgx.Tx, username string, symbol string, orderType models.OrderType, amount int) (tid int64, err error) {
+func (tdb *TransactionDB) SetUserOrderTypeAmount(ctx context.Context, tx Tx, username string, symbol string, orderType models.OrderType, amount int) (tid int64, err error) {
+	ctx, span := startSpan(ctx, "SetUserOrderTypeAmount")
+	defer endSpan(span, &err)
+
 	query := "INSERT INTO triggers(username, symbol, type, amount, trigger_price, executable, time) VALUES($1,$2,$3,$4,$5,$6,$7) RETURNING tid"
-	t := time.Now().Unix()
-	if tx != nil {
-		err = tx.QueryRow(query, username, symbol, orderType, amount, 0, false, t).Scan(&tid)
-	} else {
-		err = tdb.DB.QueryRow(query, username, symbol, orderType, amount, 0, false, t).Scan(&tid)
-	}
+	t := tdb.clock.Now().Unix()
+	err = tdb.q(tx).QueryRowEx(ctx, query, nil, username, symbol, orderType, amount, 0, false, t).Scan(&tid)
 	return
 }
 
-func (tdb *TransactionDB) RemoveUserStockTrigger(tx *pgx.Tx, tid int64) (trig models.Trigger, err error) {
+func (tdb *TransactionDB) RemoveUserStockTrigger(ctx context.Context, tx Tx, tid int64) (trig models.Trigger, err error) {
+	ctx, span := startSpan(ctx, "RemoveUserStockTrigger")
+	defer endSpan(span, &err)
+
 	query := `DELETE FROM triggers WHERE tid=$1 RETURNING tid, username, symbol, type, amount, trigger_price, executable, time`
-	if tx != nil {
-		trig, err = ScanTrigger(tx.QueryRow(query, tid))
-	} else {
-		trig, err = ScanTrigger(tdb.DB.QueryRow(query, tid))
-	}
+	trig, err = ScanTrigger(tdb.q(tx).QueryRowEx(ctx, query, nil, tid))
 	return
 }
 
-func (tdb *TransactionDB) UpdateTrigger(trig models.Trigger) (err error) {
+func (tdb *TransactionDB) UpdateTrigger(ctx context.Context, tx Tx, trig models.Trigger) (err error) {
+	ctx, span := startSpan(ctx, "UpdateTrigger")
+	defer endSpan(span, &err)
+
 	query := "UPDATE Triggers SET username=$2, symbol=$3, type=$4, amount=$5, trigger_price=$6, executable=$7, time=$8 WHERE tid=$1"
-	_, err = tdb.DB.Exec(query, trig.ID, trig.Username, trig.Symbol, trig.Order, trig.Amount, trig.TriggerPrice, trig.Executable, trig.Time)
+	_, err = tdb.q(tx).ExecEx(ctx, query, nil, trig.ID, trig.Username, trig.Symbol, trig.Order, trig.Amount, trig.TriggerPrice, trig.Executable, trig.Time)
 	return
 }
 
-func (tdb *TransactionDB) UpdateUserStockTriggerPrice(username string, stock string, orderType string, triggerPrice string) (err error) {
-	query := "UPDATE triggers SET trigger_price=$1 WHERE username=$2 AND symbol=$3 AND type=$4"
-	_, err = tdb.DB.Exec(query, triggerPrice, username, stock, orderType)
-	return
-}
+// UpdateUserBalance adds amount to, or for a BUY takes it from, the user's
+// balance in currency, which must not be the base currency. A BUY of more
+// than the balance fails with ErrInsufficientFunds.
+func (tdb *TransactionDB) UpdateUserBalance(ctx context.Context, tx Tx, username string, currency string, amount int, order models.OrderType) (err error) {
+	ctx, span := startSpan(ctx, "UpdateUserBalance")
+	defer endSpan(span, &err)
 
-func (tdb *TransactionDB) CommitSetOrderTransaction(username string, symbol string, orderType models.OrderType, amount int, trans string) (tid int64, err error) {
-	tx, err := tdb.DB.Begin()
-	if err != nil {
+	if order == models.BUY {
+		// the row lock keeps the balance checked here until the tx ends
+		var balance int
+		query := "SELECT amount FROM balances WHERE username = $1 AND currency = $2 FOR UPDATE"
+		err = tdb.q(tx).QueryRowEx(ctx, query, nil, username, currency).Scan(&balance)
+		if err == ErrNoRows || err == nil && balance < amount {
+			return ErrInsufficientFunds
+		}
+		if err != nil {
+			return
+		}
+		query = "UPDATE balances SET amount = amount - $3 WHERE username = $1 AND currency = $2"
+		_, err = tdb.q(tx).ExecEx(ctx, query, nil, username, currency, amount)
 		return
 	}
+	query := "INSERT INTO balances(username, currency, amount) VALUES($1,$2,$3) ON CONFLICT (username, currency) DO UPDATE SET amount = balances.amount + EXCLUDED.amount"
+	_, err = tdb.q(tx).ExecEx(ctx, query, nil, username, currency, amount)
+	return
+}
 
-	if orderType == models.BUY {
-		err = tdb.UpdateUserMoney(tx, username, amount, orderType, trans)
-	} else {
-		//TODO: check for sell
-		err = tdb.UpdateUserStock(tx, username, symbol, amount, orderType)
-	}
-	if err != nil {
-		tx.Rollback()
-		return
-	}
+// SetSymbolCurrency sets the currency symbol is quoted in.
+func (tdb *TransactionDB) SetSymbolCurrency(ctx context.Context, symbol string, currency string) (err error) {
+	ctx, span := startSpan(ctx, "SetSymbolCurrency")
+	defer endSpan(span, &err)
 
-	//TODO: check for sell
-	tid, err = tdb.SetUserOrderTypeAmount(tx, username, symbol, orderType, amount)
-	if err != nil {
-		tx.Rollback()
-		return
-	}
+	query := "INSERT INTO symbols(symbol, currency) VALUES($1,$2) ON CONFLICT (symbol) DO UPDATE SET currency = EXCLUDED.currency"
+	_, err = tdb.DB.ExecEx(ctx, query, nil, symbol, currency)
+	return
+}
 
-	err = tx.Commit()
-	if err != nil {
-		tx.Rollback()
-		return
-	}
+func (tdb *TransactionDB) ExchangeTransaction(ctx context.Context, username string, from string, to string, amount int, trans string) (ex Exchange, err error) {
+	ctx, span := startSpan(ctx, "ExchangeTransaction")
+	defer endSpan(span, &err)
+
+	return exchangeTransaction(ctx, tdb, tdb.clock.Now().Unix(), username, from, to, amount, trans)
+}
 
+func (tdb *TransactionDB) AddTransfer(ctx context.Context, tx Tx, t Transfer) (id int64, err error) {
+	ctx, span := startSpan(ctx, "AddTransfer")
+	defer endSpan(span, &err)
+
+	query := "INSERT INTO transfers(username, kind, counterparty, amount, state, ref, time, trans) VALUES($1,$2,$3,$4,$5,$6,$7,$8) RETURNING id"
+	err = tdb.q(tx).QueryRowEx(ctx, query, nil, t.Username, t.Kind, t.Counterparty, t.Amount, t.State, t.Ref, t.Time, t.Trans).Scan(&id)
 	return
 }
 
-func (tdb *TransactionDB) CancelOrderTransaction(trig models.Trigger, trans string) (rtrig models.Trigger, err error) {
-	tx, err := tdb.DB.Begin()
-	if err != nil {
-		return
-	}
+// SettleTransfer moves a pending transfer to state, returning ErrNoRows if
+// it isn't pending.
+func (tdb *TransactionDB) SettleTransfer(ctx context.Context, tx Tx, id int64, state string) (err error) {
+	ctx, span := startSpan(ctx, "SettleTransfer")
+	defer endSpan(span, &err)
 
-	if trig.Order == models.BUY {
-		err = tdb.UpdateUserMoney(tx, trig.Username, trig.Amount, models.SELL, trans)
-	} else {
-		err = tdb.UpdateUserStock(tx, trig.Username, trig.Symbol, trig.Amount, models.BUY)
-	}
-	if err != nil {
-		tx.Rollback()
-		return
+	query := "UPDATE transfers SET state=$1 WHERE id=$2 AND state=$3"
+	tag, err := tdb.q(tx).ExecEx(ctx, query, nil, state, id, TransferPending)
+	if err == nil && tag.RowsAffected() == 0 {
+		err = ErrNoRows
 	}
+	return
+}
 
-	rtrig, err = tdb.RemoveUserStockTrigger(tx, trig.ID)
-	if err != nil {
-		tx.Rollback()
-		return
-	}
+func (tdb *TransactionDB) WithdrawTransaction(ctx context.Context, username string, amount int, trans string) (t Transfer, err error) {
+	ctx, span := startSpan(ctx, "WithdrawTransaction")
+	defer endSpan(span, &err)
 
-	err = tx.Commit()
-	if err != nil {
-		tx.Rollback()
-		return
-	}
+	return withdrawTransaction(ctx, tdb, tdb.clock.Now().Unix(), username, amount, trans)
+}
+
+func (tdb *TransactionDB) UpdateUserStockTriggerPrice(ctx context.Context, username string, stock string, orderType string, triggerPrice string) (err error) {
+	ctx, span := startSpan(ctx, "UpdateUserStockTriggerPrice")
+	defer endSpan(span, &err)
 
+	query := "UPDATE triggers SET trigger_price=$1 WHERE username=$2 AND symbol=$3 AND type=$4"
+	_, err = tdb.DB.ExecEx(ctx, query, nil, triggerPrice, username, stock, orderType)
 	return
 }
 
-func (tdb *TransactionDB) CommitBuySellTransaction(res models.Reservation, trans string) (err error) {
-	tx, err := tdb.DB.Begin()
-	if err != nil {
-		return
-	}
+func (tdb *TransactionDB) AddLot(ctx context.Context, tx Tx, lot Lot) (lid int64, err error) {
+	ctx, span := startSpan(ctx, "AddLot")
+	defer endSpan(span, &err)
 
-	err = tdb.UpdateUserStock(tx, res.Username, res.Symbol, res.Shares, res.Order)
-	if err != nil {
-		tx.Rollback()
-		return
-	}
+	query := "INSERT INTO lots(username, symbol, shares, cost, time, trans) VALUES($1,$2,$3,$4,$5,$6) RETURNING lid"
+	err = tdb.q(tx).QueryRowEx(ctx, query, nil, lot.Username, lot.Symbol, lot.Shares, lot.Cost, lot.Time, lot.Trans).Scan(&lid)
+	return
+}
 
-	err = tdb.UpdateUserMoney(tx, res.Username, res.Amount, res.Order, trans)
-	if err != nil {
-		tx.Rollback()
-		return
-	}
+func (tdb *TransactionDB) UpdateLot(ctx context.Context, tx Tx, lot Lot) (err error) {
+	ctx, span := startSpan(ctx, "UpdateLot")
+	defer endSpan(span, &err)
 
-	err = tdb.RemoveReservation(tx, res.ID)
-	if err != nil {
-		tx.Rollback()
-		return
-	}
+	query := "UPDATE lots SET shares=$2, cost=$3 WHERE lid=$1"
+	_, err = tdb.q(tx).ExecEx(ctx, query, nil, lot.ID, lot.Shares, lot.Cost)
+	return
+}
+
+func (tdb *TransactionDB) RemoveLot(ctx context.Context, tx Tx, lid int64) (err error) {
+	ctx, span := startSpan(ctx, "RemoveLot")
+	defer endSpan(span, &err)
+
+	query := "DELETE FROM lots WHERE lid=$1"
+	_, err = tdb.q(tx).ExecEx(ctx, query, nil, lid)
+	return
+}
+
+func (tdb *TransactionDB) AddRealization(ctx context.Context, tx Tx, r Realization) (id int64, err error) {
+	ctx, span := startSpan(ctx, "AddRealization")
+	defer endSpan(span, &err)
+
+	query := "INSERT INTO realizations(username, symbol, shares, proceeds, cost, time, trans) VALUES($1,$2,$3,$4,$5,$6,$7) RETURNING id"
+	err = tdb.q(tx).QueryRowEx(ctx, query, nil, r.Username, r.Symbol, r.Shares, r.Proceeds, r.Cost, r.Time, r.Trans).Scan(&id)
+	return
+}
+
+func (tdb *TransactionDB) AddExecution(ctx context.Context, tx Tx, e Execution) (eid int64, err error) {
+	ctx, span := startSpan(ctx, "AddExecution")
+	defer endSpan(span, &err)
+
+	query := "INSERT INTO executions(username, symbol, side, shares, price, amount, fees, currency, fx_rate, local_price, source, trans, time) VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13) RETURNING eid"
+	err = tdb.q(tx).QueryRowEx(ctx, query, nil, e.Username, e.Symbol, e.Side, e.Shares, e.Price, e.Amount, e.Fees, e.Currency, e.FXRate, e.LocalPrice, e.Source, e.Trans, e.Time).Scan(&eid)
+	return
+}
+
+func (tdb *TransactionDB) AddOrder(ctx context.Context, tx Tx, o Order) (oid int64, err error) {
+	ctx, span := startSpan(ctx, "AddOrder")
+	defer endSpan(span, &err)
+
+	query := `INSERT INTO orders(username, symbol, kind, shares, limit_price, stop_price, tif, held, stopped, status, fill_price, time, expires, gid, trans)
+				VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15) RETURNING oid`
+	err = tdb.q(tx).QueryRowEx(ctx, query, nil, o.Username, o.Symbol, o.Kind, o.Shares, o.LimitPrice, o.StopPrice, o.TimeInForce, o.Held, o.Stopped, o.Status, o.FillPrice, o.Time, o.Expires, o.GroupID, o.Trans).Scan(&oid)
+	return
+}
+
+// UpdateOrder saves an order's progress: what it holds, whether its stop
+// has been reached, its status and fill price.
+func (tdb *TransactionDB) UpdateOrder(ctx context.Context, tx Tx, o Order) (err error) {
+	ctx, span := startSpan(ctx, "UpdateOrder")
+	defer endSpan(span, &err)
+
+	query := "UPDATE orders SET held=$2, stopped=$3, status=$4, fill_price=$5 WHERE oid=$1"
+	_, err = tdb.q(tx).ExecEx(ctx, query, nil, o.ID, o.Held, o.Stopped, o.Status, o.FillPrice)
+	return
+}
+
+func (tdb *TransactionDB) PlaceOrderTransaction(ctx context.Context, o Order, quote int, trans string) (rorder Order, err error) {
+	ctx, span := startSpan(ctx, "PlaceOrderTransaction")
+	defer endSpan(span, &err)
+
+	return placeOrderTransaction(ctx, tdb, tdb.CostBasis, tdb.clock.Now().Unix(), o, quote, trans)
+}
+
+func (tdb *TransactionDB) CloseOrderTransaction(ctx context.Context, o Order, status OrderStatus, trans string) (rorder Order, err error) {
+	ctx, span := startSpan(ctx, "CloseOrderTransaction")
+	defer endSpan(span, &err)
+
+	return closeOrderTransaction(ctx, tdb, o, status, trans)
+}
+
+func (tdb *TransactionDB) ExecuteOrder(ctx context.Context, o Order, quote int, trans string) (rorder Order, err error) {
+	ctx, span := startSpan(ctx, "ExecuteOrder")
+	defer endSpan(span, &err)
+
+	return executeOrder(ctx, tdb, tdb.CostBasis, tdb.clock.Now().Unix(), o, quote, trans)
+}
+
+func (tdb *TransactionDB) AddOrderGroup(ctx context.Context, tx Tx, g OrderGroup) (gid int64, err error) {
+	ctx, span := startSpan(ctx, "AddOrderGroup")
+	defer endSpan(span, &err)
+
+	query := "INSERT INTO order_groups(username, kind, time, trans) VALUES($1,$2,$3,$4) RETURNING gid"
+	err = tdb.q(tx).QueryRowEx(ctx, query, nil, g.Username, g.Kind, g.Time, g.Trans).Scan(&gid)
+	return
+}
+
+func (tdb *TransactionDB) PlaceOrderGroupTransaction(ctx context.Context, g OrderGroup, quote int, trans string) (rgroup OrderGroup, err error) {
+	ctx, span := startSpan(ctx, "PlaceOrderGroupTransaction")
+	defer endSpan(span, &err)
+
+	return placeOrderGroupTransaction(ctx, tdb, tdb.CostBasis, tdb.clock.Now().Unix(), g, quote, trans)
+}
+
+func (tdb *TransactionDB) AddSchedule(ctx context.Context, tx Tx, sch Schedule) (sid int64, err error) {
+	ctx, span := startSpan(ctx, "AddSchedule")
+	defer endSpan(span, &err)
+
+	query := "INSERT INTO schedules(username, symbol, amount, cadence, next, ends, paused, time, trans) VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9) RETURNING sid"
+	err = tdb.q(tx).QueryRowEx(ctx, query, nil, sch.Username, sch.Symbol, sch.Amount, sch.Cadence, sch.Next, sch.Ends, sch.Paused, sch.Time, sch.Trans).Scan(&sid)
+	return
+}
+
+// UpdateSchedule saves when a schedule runs next and whether it is paused.
+func (tdb *TransactionDB) UpdateSchedule(ctx context.Context, tx Tx, sch Schedule) (err error) {
+	ctx, span := startSpan(ctx, "UpdateSchedule")
+	defer endSpan(span, &err)
+
+	query := "UPDATE schedules SET next=$2, paused=$3 WHERE sid=$1"
+	_, err = tdb.q(tx).ExecEx(ctx, query, nil, sch.ID, sch.Next, sch.Paused)
+	return
+}
 
-	err = tx.Commit()
+// RemoveSchedule deletes a schedule, keeping the record of its runs.
+func (tdb *TransactionDB) RemoveSchedule(ctx context.Context, tx Tx, sid int64) (err error) {
+	ctx, span := startSpan(ctx, "RemoveSchedule")
+	defer endSpan(span, &err)
+
+	query := "DELETE FROM schedules WHERE sid = $1"
+	_, err = tdb.q(tx).ExecEx(ctx, query, nil, sid)
+	return
+}
+
+func (tdb *TransactionDB) AddScheduleRun(ctx context.Context, tx Tx, run ScheduleRun) (id int64, err error) {
+	ctx, span := startSpan(ctx, "AddScheduleRun")
+	defer endSpan(span, &err)
+
+	query := "INSERT INTO schedule_runs(sid, username, symbol, status, reason, shares, price, amount, time, trans) VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10) RETURNING id"
+	err = tdb.q(tx).QueryRowEx(ctx, query, nil, run.SID, run.Username, run.Symbol, run.Status, run.Reason, run.Shares, run.Price, run.Amount, run.Time, run.Trans).Scan(&id)
+	return
+}
+
+// QueryAndRunDueSchedules runs every schedule due by now, returning the
+// runs made.
+func (tdb *TransactionDB) QueryAndRunDueSchedules(ctx context.Context, quotes dbutils.QuoteProvider, trans string) (runs []ScheduleRun, err error) {
+	ctx, span := startSpan(ctx, "QueryAndRunDueSchedules")
+	defer endSpan(span, &err)
+
+	now := tdb.clock.Now().Unix()
+	schedules, err := tdb.QueryDueSchedules(ctx, now)
 	if err != nil {
-		tx.Rollback()
 		return
 	}
-	return
+	return runSchedules(ctx, tdb, tdb.CostBasis, now, schedules, quotes, trans), nil
 }
 
-func (tdb *TransactionDB) QueryAndExecuteCurrentTriggers(quoteCache *redis.Client, trans string) (rTrigs []models.Trigger, err error) {
-	query := `SELECT tid, username, symbol, type, amount, trigger_price, executable, time FROM triggers WHERE executable=TRUE`
+// SetTrailingStop saves ts and sets its trigger's price to the effective
+// stop, making the trigger executable.
+func (tdb *TransactionDB) SetTrailingStop(ctx context.Context, tx Tx, ts TrailingStop) (err error) {
+	ctx, span := startSpan(ctx, "SetTrailingStop")
+	defer endSpan(span, &err)
 
-	rows, err := tdb.DB.Query(query)
+	query := `INSERT INTO trailing_stops(tid, username, symbol, trail_amount, trail_bps, high_water) VALUES($1,$2,$3,$4,$5,$6)
+				ON CONFLICT (tid) DO UPDATE SET trail_amount=EXCLUDED.trail_amount, trail_bps=EXCLUDED.trail_bps, high_water=EXCLUDED.high_water`
+	_, err = tdb.q(tx).ExecEx(ctx, query, nil, ts.TID, ts.Username, ts.Symbol, ts.TrailAmount, ts.TrailBasisPoints, ts.HighWater)
 	if err != nil {
 		return
 	}
 
-	defer rows.Close()
+	query = "UPDATE triggers SET trigger_price=$2, executable=TRUE WHERE tid=$1"
+	_, err = tdb.q(tx).ExecEx(ctx, query, nil, ts.TID, ts.Stop())
+	return
+}
 
-	for rows.Next() {
-		trig, err := ScanTriggerRows(rows)
-		if err == nil {
-			quote, err := dbutils.QueryQuotePrice(quoteCache, tdb.logger, trig.Username, trig.Symbol, trans)
-			if err == nil {
-				if trig.Order == models.BUY {
-					if quote <= trig.TriggerPrice {
-						trig, err = tdb.ExecuteTrigger(trig, quote, trans)
-					}
-
-				} else {
-					if quote >= trig.TriggerPrice {
-						trig, err = tdb.ExecuteTrigger(trig, quote, trans)
-					}
-				}
-				if err == nil {
-					rTrigs = append(rTrigs, trig)
-				}
-			}
-		}
-	}
+func (tdb *TransactionDB) RemoveTrailingStop(ctx context.Context, tx Tx, tid int64) (err error) {
+	ctx, span := startSpan(ctx, "RemoveTrailingStop")
+	defer endSpan(span, &err)
+
+	query := "DELETE FROM trailing_stops WHERE tid=$1"
+	_, err = tdb.q(tx).ExecEx(ctx, query, nil, tid)
 	return
 }
 
-func (tdb *TransactionDB) ExecuteTrigger(trig models.Trigger, quote int, trans string) (rtrig models.Trigger, err error) {
-	tx, err := tdb.DB.Begin()
-	if err != nil {
-		return
-	}
+func (tdb *TransactionDB) CommitSetOrderTransaction(ctx context.Context, username string, symbol string, orderType models.OrderType, amount int, trans string) (tid int64, err error) {
+	ctx, span := startSpan(ctx, "CommitSetOrderTransaction")
+	defer endSpan(span, &err)
 
-	if trig.Order == models.BUY {
-		shares := trig.Amount / quote
-		remainder := trig.Amount - (shares * quote)
+	return commitSetOrderTransaction(ctx, tdb, username, symbol, orderType, amount, trans)
+}
 
-		// add stock
-		err = tdb.UpdateUserStock(tx, trig.Username, trig.Symbol, shares, trig.Order)
-		if err != nil {
-			tx.Rollback()
-			return
-		}
+func (tdb *TransactionDB) CancelOrderTransaction(ctx context.Context, trig models.Trigger, trans string) (rtrig models.Trigger, err error) {
+	ctx, span := startSpan(ctx, "CancelOrderTransaction")
+	defer endSpan(span, &err)
 
-		//add remainder back
-		err = tdb.UpdateUserMoney(tx, trig.Username, remainder, models.SELL, trans)
-		if err != nil {
-			tx.Rollback()
-			return
-		}
+	return cancelOrderTransaction(ctx, tdb, trig, trans)
+}
 
-	} else {
-		// add spendings
-		err = tdb.UpdateUserMoney(tx, trig.Username, trig.Amount, trig.Order, trans)
+func (tdb *TransactionDB) CommitBuySellTransaction(ctx context.Context, res models.Reservation, trans string) (err error) {
+	ctx, span := startSpan(ctx, "CommitBuySellTransaction")
+	defer endSpan(span, &err)
+
+	return commitBuySellTransaction(ctx, tdb, tdb.CostBasis, tdb.clock.Now().Unix(), res, trans)
+}
+
+func (tdb *TransactionDB) ReserveOrder(ctx context.Context, username string, symbol string, side models.OrderType, q Quantity, quote int) (res models.Reservation, err error) {
+	ctx, span := startSpan(ctx, "ReserveOrder")
+	defer endSpan(span, &err)
+
+	return reserveOrder(ctx, tdb, tdb.clock.Now().Unix(), username, symbol, side, q, quote)
+}
+
+func (tdb *TransactionDB) QueryAndExecuteCurrentTriggers(ctx context.Context, quotes dbutils.QuoteProvider, trans string) (rTrigs []models.Trigger, err error) {
+	ctx, span := startSpan(ctx, "QueryAndExecuteCurrentTriggers")
+	defer endSpan(span, &err)
+
+	query := `SELECT tid, username, symbol, type, amount, trigger_price, executable, time FROM triggers WHERE executable=TRUE ORDER BY tid`
+
+	rows, err := tdb.DB.QueryEx(ctx, query, nil)
+	if err != nil {
+		return
+	}
+
+	// read every trigger before executing, so the scan doesn't hold a
+	// connection open while each execution takes another
+	var trigs []models.Trigger
+	for rows.Next() {
+		trig, err := ScanTriggerRows(rows)
 		if err != nil {
-			tx.Rollback()
-			return
+			applog.FromContext(ctx).Warn("Failed to scan trigger", "error", err)
+			continue
 		}
+		trigs = append(trigs, trig)
 	}
-	rtrig, err = tdb.RemoveUserStockTrigger(tx, trig.ID)
+	rows.Close()
+
+	stops, err := tdb.QueryTrailingStops(ctx, "")
 	if err != nil {
-		tx.Rollback()
 		return
 	}
+	rTrigs = executeTriggers(ctx, tdb, trigs, trailingStops(stops), quotes, trans)
 
-	err = tx.Commit()
+	orders, err := tdb.QueryOpenOrders(ctx)
 	if err != nil {
-		tx.Rollback()
 		return
 	}
-	return
+	executeOrders(ctx, tdb, orders, quotes, tdb.clock.Now().Unix(), trans)
+	return rTrigs, nil
+}
+
+func (tdb *TransactionDB) ExecuteTrigger(ctx context.Context, trig models.Trigger, quote int, trans string) (rtrig models.Trigger, err error) {
+	ctx, span := startSpan(ctx, "ExecuteTrigger")
+	defer endSpan(span, &err)
+
+	return executeTrigger(ctx, tdb, tdb.CostBasis, tdb.clock.Now().Unix(), trig, quote, trans)
 }
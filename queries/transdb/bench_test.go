@@ -0,0 +1,85 @@
+package transdb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"common/models"
+	"transaction_service/clock"
+)
+
+// benchStores runs bench against the in-memory store and, when
+// TRANSDB_TEST_HOST is set, Postgres.
+func benchStores(b *testing.B, bench func(b *testing.B, s TransactionDataStore)) {
+	b.Run("memory", func(b *testing.B) {
+		bench(b, NewMemoryDB(nopLogger{}, clock.Real))
+	})
+	b.Run("postgres", func(b *testing.B) {
+		bench(b, testTransactionDB(b))
+	})
+}
+
+func BenchmarkCommitBuySellTransaction(b *testing.B) {
+	benchStores(b, func(b *testing.B, s TransactionDataStore) {
+		ctx := context.Background()
+		username := addUser(b, ctx, s, 100*(b.N+1))
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			res := models.Reservation{Username: username, Symbol: "ABC", Order: models.BUY, Shares: 1, Amount: 100}
+			rid, err := s.AddReservation(ctx, nil, res)
+			if err != nil {
+				b.Fatal(err)
+			}
+			res.ID = rid
+			b.StartTimer()
+
+			if err := s.CommitBuySellTransaction(ctx, res, "1"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkTriggerScan measures checking executable triggers whose prices
+// haven't been reached, the common case on every scan.
+func BenchmarkTriggerScan(b *testing.B) {
+	for _, n := range []int{100, 1000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			benchStores(b, func(b *testing.B, s TransactionDataStore) {
+				ctx := context.Background()
+				// the scan reads every trigger, so the test database must
+				// hold only these n, however often the benchmark is run
+				if err := s.ClearUsers(ctx, nil); err != nil {
+					b.Fatal(err)
+				}
+				username := addUser(b, ctx, s, 100*n)
+				for i := 0; i < n; i++ {
+					tid, err := s.CommitSetOrderTransaction(ctx, username, "ABC", models.BUY, 100, "1")
+					if err != nil {
+						b.Fatal(err)
+					}
+					trig, err := s.QueryStockTrigger(ctx, tid)
+					if err != nil {
+						b.Fatal(err)
+					}
+					trig.TriggerPrice = 1
+					trig.Executable = true
+					if err := s.UpdateTrigger(ctx, nil, trig); err != nil {
+						b.Fatal(err)
+					}
+				}
+				quotes := fixedQuotes{"ABC": 100}
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := s.QueryAndExecuteCurrentTriggers(ctx, quotes, "2"); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
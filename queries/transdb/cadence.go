@@ -0,0 +1,118 @@
+package transdb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cadence is when a schedule runs: a five field cron expression of minute,
+// hour, day of month, month and day of week, read in UTC.
+type Cadence struct {
+	minute, hour, dom, month, dow uint64
+	// a day matches either restricted day field, as in cron
+	domAny, dowAny bool
+}
+
+var cadenceMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// cadenceSearch bounds how far ahead Next looks for a matching time.
+const cadenceSearch = 5
+
+// ParseCadence parses a cron expression such as "30 14 * * 1-5", or one
+// of @hourly, @daily, @weekly and @monthly.
+func ParseCadence(spec string) (c Cadence, err error) {
+	if macro, ok := cadenceMacros[spec]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return c, fmt.Errorf("invalid cadence %q: expected 5 fields", spec)
+	}
+
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := [5]*uint64{&c.minute, &c.hour, &c.dom, &c.month, &c.dow}
+	for i, field := range fields {
+		if *sets[i], err = parseCadenceField(field, bounds[i][0], bounds[i][1]); err != nil {
+			return c, fmt.Errorf("invalid cadence %q: %s", spec, err)
+		}
+	}
+	// 7 is also Sunday
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny = fields[2] == "*"
+	c.dowAny = fields[4] == "*"
+	return c, nil
+}
+
+func parseCadenceField(field string, min, max int) (set uint64, err error) {
+	for _, item := range strings.Split(field, ",") {
+		lo, hi, step := min, max, 1
+		rng := item
+		if i := strings.Index(item, "/"); i >= 0 {
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("bad step in %q", item)
+			}
+			rng = item[:i]
+		}
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("bad value in %q", item)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("bad value in %q", item)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", item, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func (c Cadence) day(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first time after t the cadence matches, or the zero
+// time if it doesn't match within five years.
+func (c Cadence) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cadenceSearch, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.day(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
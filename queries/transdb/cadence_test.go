@@ -0,0 +1,46 @@
+package transdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCadenceNext(t *testing.T) {
+	// a Friday
+	from := time.Date(2017, 7, 14, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"@hourly", time.Date(2017, 7, 14, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2017, 7, 15, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2017, 7, 16, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2017, 7, 14, 10, 45, 0, 0, time.UTC)},
+		{"30 14 * * 1-5", time.Date(2017, 7, 14, 14, 30, 0, 0, time.UTC)},
+		{"0 9 * * 1,3", time.Date(2017, 7, 17, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2017, 7, 16, 9, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// either day field matches when both are set
+		{"0 0 20 * 6", time.Date(2017, 7, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		c, err := ParseCadence(tt.spec)
+		if err != nil {
+			t.Errorf("ParseCadence(%q): %s", tt.spec, err)
+			continue
+		}
+		if got := c.Next(from); !got.Equal(tt.want) {
+			t.Errorf("%q.Next = %s, want %s", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestParseCadenceInvalid(t *testing.T) {
+	for _, spec := range []string{"", "@yearly", "* * * *", "60 * * * *", "* 24 * * *", "0 0 0 * *", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := ParseCadence(spec); err == nil {
+			t.Errorf("ParseCadence(%q) succeeded", spec)
+		}
+	}
+}
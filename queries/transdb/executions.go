@@ -0,0 +1,83 @@
+package transdb
+
+import (
+	"context"
+	"fmt"
+
+	"common/models"
+	"transaction_service/queries/utils"
+)
+
+// Execution sources.
+const (
+	SourceManual  = "manual"
+	SourceTrigger = "trigger"
+)
+
+// Execution is a completed buy or sell: a committed reservation or an
+// executed trigger. Price is per share and Amount the total in cents,
+// before Fees. Symbols quoted in another Currency are priced at LocalPrice
+// converted into the base currency at FXRate.
+type Execution struct {
+	ID         int64            `json:"eid"`
+	Username   string           `json:"username"`
+	Symbol     string           `json:"symbol"`
+	Side       models.OrderType `json:"side"`
+	Shares     int              `json:"shares"`
+	Price      int              `json:"price"`
+	Amount     int              `json:"amount"`
+	Fees       int              `json:"fees"`
+	Currency   string           `json:"currency"`
+	FXRate     dbutils.Rate     `json:"fxRate"`
+	LocalPrice int              `json:"localPrice"`
+	Source     string           `json:"source"`
+	Trans      string           `json:"trans"`
+	Time       int64            `json:"time"`
+}
+
+// ExecutionFilter selects a page of a user's executions, newest first.
+// Zero fields don't filter; a zero Limit returns every match.
+type ExecutionFilter struct {
+	// From and To bound Time, inclusive.
+	From   int64
+	To     int64
+	Symbol string
+	Side   models.OrderType
+	Offset int
+	Limit  int
+}
+
+func (f ExecutionFilter) match(e Execution) bool {
+	return (f.From == 0 || e.Time >= f.From) &&
+		(f.To == 0 || e.Time <= f.To) &&
+		(f.Symbol == "" || e.Symbol == f.Symbol) &&
+		(f.Side == "" || e.Side == f.Side)
+}
+
+// recordExecution records an execution of shares at price, charged fees,
+// converted from the symbol's currency at the current rate.
+func recordExecution(ctx context.Context, s TransactionDataStore, tx Tx, username string, symbol string, side models.OrderType, shares int, price int, fees int, source string, now int64, trans string) (err error) {
+	currency, rate, err := symbolRate(ctx, s, tx, symbol)
+	if err != nil {
+		return
+	}
+	return recordExecutionAt(ctx, s, tx, currency, rate, username, symbol, side, shares, price, fees, source, now, trans)
+}
+
+// recordExecutionAt records an execution of shares at price, charged fees,
+// which was converted from currency at rate.
+func recordExecutionAt(ctx context.Context, s TransactionDataStore, tx Tx, currency string, rate dbutils.Rate, username string, symbol string, side models.OrderType, shares int, price int, fees int, source string, now int64, trans string) (err error) {
+	if shares <= 0 {
+		return nil
+	}
+	if rate <= 0 {
+		return fmt.Errorf("invalid exchange rate %s for %s", rate, currency)
+	}
+	e := Execution{Username: username, Symbol: symbol, Side: side, Shares: shares, Price: price, Amount: s.ShareScale().Value(shares, price), Fees: fees, Currency: currency, FXRate: rate, Source: source, Trans: trans, Time: now}
+	if side == models.BUY {
+		e.Amount = s.ShareScale().Cost(shares, price)
+	}
+	e.LocalPrice = int(int64(price) * int64(dbutils.RateOne) / int64(e.FXRate))
+	_, err = s.AddExecution(ctx, tx, e)
+	return
+}
@@ -0,0 +1,98 @@
+package transdb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"common/models"
+)
+
+// FeeRule is a commission of Flat cents plus Rate basis points of a
+// trade's amount, rounded up to the cent and kept between Min and Max. A
+// zero Max means no cap.
+type FeeRule struct {
+	Flat int `json:"flat"`
+	Rate int `json:"rate"`
+	Min  int `json:"min"`
+	Max  int `json:"max"`
+}
+
+// FeeSchedule is the commission charged on every execution. Symbols
+// overrides Default for the symbols it lists. The zero schedule charges
+// nothing.
+type FeeSchedule struct {
+	Default FeeRule            `json:"default"`
+	Symbols map[string]FeeRule `json:"symbols,omitempty"`
+}
+
+// ParseFeeRule reads a rule written as comma separated key=value pairs,
+// e.g. "flat=5,rate=25,min=10,max=500". Missing keys are zero.
+func ParseFeeRule(spec string) (rule FeeRule, err error) {
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return rule, fmt.Errorf("invalid fee rule %q: expected key=value", field)
+		}
+		v, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || v < 0 {
+			return rule, fmt.Errorf("invalid fee rule %q: bad value", field)
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "flat":
+			rule.Flat = v
+		case "rate":
+			rule.Rate = v
+		case "min":
+			rule.Min = v
+		case "max":
+			rule.Max = v
+		default:
+			return rule, fmt.Errorf("invalid fee rule %q: unknown key", field)
+		}
+	}
+	if rule.Max != 0 && rule.Max < rule.Min {
+		return rule, fmt.Errorf("invalid fee rule %q: max is below min", spec)
+	}
+	return rule, nil
+}
+
+// Rule returns the rule charged on trades of symbol.
+func (fs FeeSchedule) Rule(symbol string) FeeRule {
+	if rule, ok := fs.Symbols[symbol]; ok {
+		return rule
+	}
+	return fs.Default
+}
+
+// Fee returns the commission on a buy or sell of amount cents of symbol.
+// A sale is never charged more than it raises.
+func (fs FeeSchedule) Fee(symbol string, side models.OrderType, amount int) int {
+	rule := fs.Rule(symbol)
+	fee := rule.Flat + (amount*rule.Rate+9999)/10000
+	if fee < rule.Min {
+		fee = rule.Min
+	}
+	if rule.Max != 0 && fee > rule.Max {
+		fee = rule.Max
+	}
+	if side == models.SELL && fee > amount {
+		fee = amount
+	}
+	return fee
+}
+
+// Afford returns the most units of symbol amount cents buys at price once
+// the commission is paid out of it.
+func (fs FeeSchedule) Afford(sc ShareScale, symbol string, amount int, price int) int {
+	// the fee on less than amount is never more than the fee on amount
+	budget := amount - fs.Fee(symbol, models.BUY, amount)
+	if budget <= 0 {
+		return 0
+	}
+	return sc.Buy(budget, price)
+}
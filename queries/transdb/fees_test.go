@@ -0,0 +1,81 @@
+package transdb
+
+import (
+	"testing"
+
+	"common/models"
+)
+
+func TestParseFeeRule(t *testing.T) {
+	tests := []struct {
+		spec  string
+		rule  FeeRule
+		valid bool
+	}{
+		{"", FeeRule{}, true},
+		{"flat=5", FeeRule{Flat: 5}, true},
+		{"flat=5, rate=25,min=10,max=500", FeeRule{Flat: 5, Rate: 25, Min: 10, Max: 500}, true},
+		{"rate", FeeRule{}, false},
+		{"rate=-1", FeeRule{}, false},
+		{"percent=1", FeeRule{}, false},
+		{"min=10,max=5", FeeRule{}, false},
+	}
+	for _, tt := range tests {
+		rule, err := ParseFeeRule(tt.spec)
+		if (err == nil) != tt.valid || (tt.valid && rule != tt.rule) {
+			t.Errorf("ParseFeeRule(%q) = %+v, %v", tt.spec, rule, err)
+		}
+	}
+}
+
+func TestFeeScheduleFee(t *testing.T) {
+	fs := FeeSchedule{
+		Default: FeeRule{Flat: 5, Rate: 25, Min: 10, Max: 500},
+		Symbols: map[string]FeeRule{"DEF": {Rate: 100}},
+	}
+	tests := []struct {
+		symbol string
+		side   models.OrderType
+		amount int
+		want   int
+	}{
+		{"ABC", models.BUY, 100, 10},      // 5 + 0.25 rounds up to 6, below the minimum
+		{"ABC", models.BUY, 10000, 30},    // 5 + 25
+		{"ABC", models.BUY, 1000000, 500}, // capped
+		{"ABC", models.SELL, 4, 4},        // never more than the sale raises
+		{"DEF", models.BUY, 150, 2},       // 1.5 rounds up
+		{"DEF", models.SELL, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := fs.Fee(tt.symbol, tt.side, tt.amount); got != tt.want {
+			t.Errorf("Fee(%s, %s, %d) = %d, want %d", tt.symbol, tt.side, tt.amount, got, tt.want)
+		}
+	}
+	if got := (FeeSchedule{}).Fee("ABC", models.BUY, 1000); got != 0 {
+		t.Errorf("zero schedule Fee = %d, want 0", got)
+	}
+}
+
+func TestFeeScheduleAfford(t *testing.T) {
+	fs := FeeSchedule{Default: FeeRule{Flat: 5}}
+	tests := []struct {
+		scale  ShareScale
+		amount int
+		price  int
+		want   int
+	}{
+		{WholeShares, 305, 100, 3},
+		{WholeShares, 304, 100, 2},
+		{WholeShares, 5, 100, 0},
+		{MicroShares, 55, 100, 500000},
+	}
+	for _, tt := range tests {
+		units := fs.Afford(tt.scale, "ABC", tt.amount, tt.price)
+		if units != tt.want {
+			t.Errorf("Afford(%d, %d, %d) = %d, want %d", tt.scale, tt.amount, tt.price, units, tt.want)
+		}
+		if cost := tt.scale.Cost(units, tt.price); units > 0 && cost+fs.Fee("ABC", models.BUY, cost) > tt.amount {
+			t.Errorf("Afford(%d, %d, %d) costs %d with its fee", tt.scale, tt.amount, tt.price, cost)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package transdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"common/models"
+	"transaction_service/queries/utils"
+)
+
+// BaseCurrency is the currency of users.money. Every price, amount and
+// hold the service trades with is in it; symbols quoted in another
+// currency are converted when they are quoted.
+const BaseCurrency = "USD"
+
+var ErrNoRates = errors.New("no exchange rate provider")
+
+// ParseCurrency checks str is a three letter currency code such as EUR.
+func ParseCurrency(str string) (string, error) {
+	if len(str) != 3 || strings.Trim(str, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+		return "", fmt.Errorf("invalid currency %q", str)
+	}
+	return str, nil
+}
+
+// Exchange is a conversion of Amount of one of a user's balances into
+// Received of another at Rate.
+type Exchange struct {
+	Username string       `json:"username"`
+	From     string       `json:"from"`
+	To       string       `json:"to"`
+	Amount   int          `json:"amount"`
+	Received int          `json:"received"`
+	Rate     dbutils.Rate `json:"rate"`
+	Time     int64        `json:"time"`
+	Trans    string       `json:"trans"`
+}
+
+// ExchangeRate returns the current rate from one currency to another.
+func ExchangeRate(ctx context.Context, s TransactionDataStore, from string, to string) (dbutils.Rate, error) {
+	if from == to {
+		return dbutils.RateOne, nil
+	}
+	if s.FXRates() == nil {
+		return 0, ErrNoRates
+	}
+	return s.FXRates().QueryRate(ctx, from, to)
+}
+
+// symbolRate returns the currency symbol is quoted in and its rate into the
+// base currency.
+func symbolRate(ctx context.Context, s TransactionDataStore, tx Tx, symbol string) (currency string, r dbutils.Rate, err error) {
+	if currency, err = s.QuerySymbolCurrency(ctx, tx, symbol); err != nil {
+		return
+	}
+	r, err = ExchangeRate(ctx, s, currency, BaseCurrency)
+	return
+}
+
+// ToBase converts a price of symbol in its own currency into the base
+// currency at the current rate.
+func ToBase(ctx context.Context, s TransactionDataStore, symbol string, local int) (int, error) {
+	_, r, err := symbolRate(ctx, s, nil, symbol)
+	if err != nil {
+		return 0, err
+	}
+	return r.Convert(local), nil
+}
+
+type baseQuotes struct {
+	s      TransactionDataStore
+	quotes dbutils.QuoteProvider
+}
+
+// BaseQuotes returns quotes converted into the base currency as they are
+// looked up, so trades price foreign symbols at the rate when they execute.
+func BaseQuotes(s TransactionDataStore, quotes dbutils.QuoteProvider) dbutils.QuoteProvider {
+	return baseQuotes{s: s, quotes: quotes}
+}
+
+func (q baseQuotes) QueryQuotePrice(ctx context.Context, username string, symbol string, trans string) (int, error) {
+	local, err := q.quotes.QueryQuotePrice(ctx, username, symbol, trans)
+	if err != nil {
+		return 0, err
+	}
+	return ToBase(ctx, q.s, symbol, local)
+}
+
+// moveMoney adds money to, or for a BUY takes it from, the user's balance
+// in currency, failing with ErrInsufficientFunds if it would go negative.
+func moveMoney(ctx context.Context, s TransactionDataStore, tx Tx, username string, currency string, money int, order models.OrderType, trans string) error {
+	if currency == BaseCurrency {
+		return s.UpdateUserMoney(ctx, tx, username, money, order, trans)
+	}
+	return s.UpdateUserBalance(ctx, tx, username, currency, money, order)
+}
+
+// exchangeTransaction converts amount of the user's from balance into
+// their to balance at the current rate.
+func exchangeTransaction(ctx context.Context, s TransactionDataStore, now int64, username string, from string, to string, amount int, trans string) (ex Exchange, err error) {
+	ex = Exchange{Username: username, From: from, To: to, Amount: amount, Time: now, Trans: trans}
+	if from == to || amount <= 0 {
+		return ex, fmt.Errorf("invalid exchange of %d %s to %s", amount, from, to)
+	}
+	if ex.Rate, err = ExchangeRate(ctx, s, from, to); err != nil {
+		return
+	}
+	ex.Received = ex.Rate.Convert(amount)
+
+	// money held for open orders can't be exchanged; the debit below
+	// re-checks the balance itself under the row lock
+	if from == BaseCurrency {
+		var balance int
+		if balance, err = s.QueryUserAvailableBalance(ctx, username); err != nil {
+			return
+		}
+		if balance < amount {
+			return ex, ErrInsufficientFunds
+		}
+	}
+
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		return
+	}
+
+	err = moveMoney(ctx, s, tx, username, from, amount, models.BUY, trans)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = moveMoney(ctx, s, tx, username, to, ex.Received, models.SELL, trans)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+	return ex, nil
+}
@@ -0,0 +1,262 @@
+package transdb
+
+import (
+	"context"
+	"fmt"
+
+	"common/models"
+)
+
+// GroupKind is how the orders of a group are linked.
+type GroupKind string
+
+const (
+	// OCO groups orders on one symbol and side. When one fills the others
+	// are cancelled.
+	OCO GroupKind = "oco"
+	// Bracket groups a limit buy entry with a limit sell take profit and a
+	// stop loss or stop limit exit. The exits wait until the entry fills and
+	// then act as an OCO group.
+	Bracket GroupKind = "bracket"
+)
+
+// OrderPending marks a bracket exit waiting for its entry to fill. Pending
+// orders hold nothing and are not executed.
+const OrderPending OrderStatus = "pending"
+
+// OrderGroup is a set of linked orders. While a group is open only one of
+// its orders holds the group's cash or shares, and whichever order fills
+// takes the holds of the rest.
+type OrderGroup struct {
+	ID       int64     `json:"gid"`
+	Username string    `json:"username"`
+	Kind     GroupKind `json:"kind"`
+	// Status is open while any order is open or pending, then filled if
+	// one filled, otherwise the status the orders were closed with.
+	Status OrderStatus `json:"status"`
+	Orders []Order     `json:"orders"`
+	Time   int64       `json:"time"`
+	Trans  string      `json:"trans"`
+}
+
+// groupStatus returns the status of a group with the given orders.
+func groupStatus(orders []Order) (status OrderStatus) {
+	for i, o := range orders {
+		switch {
+		case o.Status == OrderOpen || o.Status == OrderPending:
+			return OrderOpen
+		case o.Status == OrderFilled || i == 0:
+			status = o.Status
+		}
+	}
+	return
+}
+
+// groupOrders adds orders to the groups they belong to, dropping groups
+// that aren't open when openOnly is set.
+func groupOrders(groups []OrderGroup, orders []Order, openOnly bool) []OrderGroup {
+	index := make(map[int64]int, len(groups))
+	for i, g := range groups {
+		index[g.ID] = i
+	}
+	for _, o := range orders {
+		if i, ok := index[o.GroupID]; ok {
+			groups[i].Orders = append(groups[i].Orders, o)
+		}
+	}
+
+	kept := groups[:0]
+	for _, g := range groups {
+		g.Status = groupStatus(g.Orders)
+		if !openOnly || g.Status == OrderOpen {
+			kept = append(kept, g)
+		}
+	}
+	return kept
+}
+
+// need returns the cash, with its commission, or shares an order holds on
+// its own.
+func (o Order) need(sc ShareScale, fs FeeSchedule) int {
+	if o.Side() == models.BUY {
+		cost := sc.Cost(o.Shares, o.LimitPrice)
+		return cost + fs.Fee(o.Symbol, models.BUY, cost)
+	}
+	return o.Shares
+}
+
+// Validate checks the group's orders fit its kind.
+func (g OrderGroup) Validate() error {
+	for _, o := range g.Orders {
+		if err := o.Validate(); err != nil {
+			return err
+		}
+		if o.TimeInForce == IOC {
+			return fmt.Errorf("orders in a group can't be IOC")
+		}
+		if o.Symbol != g.Orders[0].Symbol {
+			return fmt.Errorf("orders must be for one symbol")
+		}
+	}
+
+	switch g.Kind {
+	case OCO:
+		if len(g.Orders) < 2 {
+			return fmt.Errorf("oco groups need at least two orders")
+		}
+		for _, o := range g.Orders {
+			if o.Side() != g.Orders[0].Side() {
+				return fmt.Errorf("oco orders must all buy or all sell")
+			}
+		}
+	case Bracket:
+		if len(g.Orders) != 3 {
+			return fmt.Errorf("brackets need an entry, a take profit and a stop")
+		}
+		entry, profit, stop := g.Orders[0], g.Orders[1], g.Orders[2]
+		if entry.Kind != LimitBuy || profit.Kind != LimitSell || (stop.Kind != StopLoss && stop.Kind != StopLimit) {
+			return fmt.Errorf("brackets need a limit buy, a limit sell and a stop")
+		}
+		if profit.Shares != entry.Shares || stop.Shares != entry.Shares {
+			return fmt.Errorf("bracket exits must sell the shares the entry buys")
+		}
+		if stop.StopPrice >= profit.LimitPrice {
+			return fmt.Errorf("the stop must be below the take profit")
+		}
+	default:
+		return fmt.Errorf("unknown kind %q", g.Kind)
+	}
+	return nil
+}
+
+// placeOrderGroupTransaction holds the cash or shares for the group and
+// opens its orders, then tries each open order at quote in turn.
+func placeOrderGroupTransaction(ctx context.Context, s TransactionDataStore, method CostBasis, now int64, g OrderGroup, quote int, trans string) (rgroup OrderGroup, err error) {
+	if err = g.Validate(); err != nil {
+		return
+	}
+	g.Time = now
+	g.Trans = trans
+
+	// the order needing the most holds for the whole group; bracket exits
+	// hold nothing until the entry fills
+	holder := 0
+	for i := range g.Orders {
+		o := &g.Orders[i]
+		o.Username = g.Username
+		o.Status = OrderOpen
+		o.Stopped = false
+		o.Held = 0
+		o.Time = now
+		o.Trans = trans
+		o.Expires = 0
+		if o.TimeInForce == DAY {
+			o.Expires = endOfDay(now)
+		}
+		if g.Kind == Bracket && i > 0 {
+			o.Status = OrderPending
+			o.TimeInForce = GTC
+			o.Expires = 0
+		}
+		if o.need(s.ShareScale(), s.Fees()) > g.Orders[holder].need(s.ShareScale(), s.Fees()) && o.Status == OrderOpen {
+			holder = i
+		}
+	}
+	first := &g.Orders[holder]
+	first.Held = first.need(s.ShareScale(), s.Fees())
+
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		return
+	}
+
+	// like placeOrderTransaction, the hold itself checks the funds or shares
+	if first.Side() == models.BUY {
+		err = s.UpdateUserMoney(ctx, tx, g.Username, first.Held, models.BUY, trans)
+	} else {
+		err = s.UpdateUserStock(ctx, tx, g.Username, first.Symbol, first.Held, models.SELL)
+	}
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	g.ID, err = s.AddOrderGroup(ctx, tx, g)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+	for i := range g.Orders {
+		g.Orders[i].GroupID = g.ID
+		if g.Orders[i].ID, err = s.AddOrder(ctx, tx, g.Orders[i]); err != nil {
+			tx.Rollback(ctx)
+			return
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	for _, o := range g.Orders {
+		// a fill earlier in the loop may have opened or closed this order
+		if o, err = s.QueryOrder(ctx, nil, o.ID); err != nil {
+			return
+		}
+		if o.Status != OrderOpen {
+			continue
+		}
+		if _, err = executeOrder(ctx, s, method, now, o, quote, trans); err != nil && err != ErrOrderClosed {
+			return
+		}
+	}
+	return s.QueryOrderGroup(ctx, nil, g.ID)
+}
+
+// fillGroupOrder fills o, one of a group's orders, within tx. Filling a
+// bracket's entry opens its exits and holds the bought shares for them.
+// Filling any other order moves the holds of its open siblings onto it and
+// cancels them.
+func fillGroupOrder(ctx context.Context, s TransactionDataStore, tx Tx, method CostBasis, now int64, o *Order, quote int, trans string) (err error) {
+	g, err := s.QueryOrderGroup(ctx, tx, o.GroupID)
+	if err != nil {
+		return
+	}
+
+	if g.Kind == Bracket && o.ID == g.Orders[0].ID {
+		if err = fillOrder(ctx, s, tx, method, now, o, quote, trans); err != nil {
+			return
+		}
+		for i, exit := range g.Orders[1:] {
+			if exit.Status != OrderPending {
+				continue
+			}
+			exit.Status = OrderOpen
+			if i == 0 {
+				exit.Held = exit.Shares
+				if err = s.UpdateUserStock(ctx, tx, exit.Username, exit.Symbol, exit.Held, models.SELL); err != nil {
+					return
+				}
+			}
+			if err = s.UpdateOrder(ctx, tx, exit); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	for _, sibling := range g.Orders {
+		if sibling.ID == o.ID || (sibling.Status != OrderOpen && sibling.Status != OrderPending) {
+			continue
+		}
+		o.Held += sibling.Held
+		sibling.Held = 0
+		sibling.Status = OrderCancelled
+		if err = s.UpdateOrder(ctx, tx, sibling); err != nil {
+			return
+		}
+	}
+	return fillOrder(ctx, s, tx, method, now, o, quote, trans)
+}
@@ -2,39 +2,96 @@ package transdb
 
 import (
 	"common/models"
+	"context"
 	"time"
-
-	"github.com/go-redis/redis"
-	"github.com/jackc/pgx"
+	"transaction_service/queries/utils"
 )
 
 //TODO: think about splitting queries and actions again
 type TransactionDataStore interface {
-	QueryUserAvailableBalance(username string) (int, error)
-	QueryUserAvailableShares(username string, symbol string) (shares int, err error)
-	QueryUser(username string) (user models.User, err error)
-	QueryUserStock(username string, symbol string) (stock models.Stock, err error)
-	QueryStockTrigger(tid int64) (trig models.Trigger, err error)
-	QueryUserTrigger(username string, symbol string, orderType models.OrderType) (trig models.Trigger, err error)
-	QueryReservation(rid int64) (res models.Reservation, err error)
-	QueryLastReservation(username string, resType models.OrderType) (res models.Reservation, err error)
-	ClearUsers() (err error)
-	InsertUser(user models.User) (res pgx.CommandTag, err error)
-	UpdateUser(user models.User) (res pgx.CommandTag, err error)
-	AddReservation(tx *pgx.Tx, res models.Reservation) (rid int64, err error)
-	UpdateUserStock(tx *pgx.Tx, username string, symbol string, shares int, order models.OrderType) (err error)
-	UpdateUserMoney(tx *pgx.Tx, username string, money int, order models.OrderType, trans string) (err error)
-	RemoveReservation(tx *pgx.Tx, rid int64) (err error)
-	RemoveOrder(rid int64, timeout time.Duration)
-	RemoveLastOrderTypeReservation(username string, orderType models.OrderType) (res models.Reservation, err error)
-	SetUserOrderTypeAmount(tx *pgx.Tx, username string, symbol string, orderType models.OrderType, amount int) (tid int64, err error)
-	RemoveUserStockTrigger(tx *pgx.Tx, tid int64) (trig models.Trigger, err error)
-	UpdateTrigger(trig models.Trigger) (err error)
-	UpdateUserStockTriggerPrice(username string, stock string, orderType string, triggerPrice string) (err error)
-	CommitSetOrderTransaction(username string, symbol string, orderType models.OrderType, amount int, trans string) (tid int64, err error)
-	CancelOrderTransaction(trig models.Trigger, trans string) (rtrig models.Trigger, err error)
-	CommitBuySellTransaction(res models.Reservation, trans string) (err error)
-	QueryAndExecuteCurrentTriggers(quoteCache *redis.Client, trans string) (rTrigs []models.Trigger, err error)
-	QueryAllUserTriggers(username string) (trigs []models.Trigger, err error)
-	ExecuteTrigger(trig models.Trigger, quote int, trans string) (rtrig models.Trigger, err error)
+	Begin(ctx context.Context) (Tx, error)
+	ShareScale() ShareScale
+	Fees() FeeSchedule
+	FXRates() dbutils.RateProvider
+	QuerySymbolCurrency(ctx context.Context, tx Tx, symbol string) (currency string, err error)
+	SetSymbolCurrency(ctx context.Context, symbol string, currency string) (err error)
+	QueryUserBalances(ctx context.Context, username string) (balances map[string]int, err error)
+	UpdateUserBalance(ctx context.Context, tx Tx, username string, currency string, amount int, order models.OrderType) (err error)
+	ExchangeTransaction(ctx context.Context, username string, from string, to string, amount int, trans string) (ex Exchange, err error)
+	QueryTransfer(ctx context.Context, tx Tx, ref string, kind string) (t Transfer, err error)
+	QueryUserTransfers(ctx context.Context, username string, limit int) (transfers []Transfer, err error)
+	QueryPendingTransfers(ctx context.Context, before int64) (transfers []Transfer, err error)
+	AddTransfer(ctx context.Context, tx Tx, t Transfer) (id int64, err error)
+	SettleTransfer(ctx context.Context, tx Tx, id int64, state string) (err error)
+	WithdrawTransaction(ctx context.Context, username string, amount int, trans string) (t Transfer, err error)
+	QueryUserAvailableBalance(ctx context.Context, username string) (int, error)
+	QueryUserAvailableShares(ctx context.Context, username string, symbol string) (shares int, err error)
+	QueryUser(ctx context.Context, username string) (user models.User, err error)
+	QueryUserStatus(ctx context.Context, tx Tx, username string) (status UserStatus, err error)
+	LockUser(ctx context.Context, tx Tx, username string) (acct Account, err error)
+	SetUserStatus(ctx context.Context, tx Tx, username string, status UserStatus) (err error)
+	DeleteUser(ctx context.Context, username string) (err error)
+	QueryUserStock(ctx context.Context, username string, symbol string) (stock models.Stock, err error)
+	QueryStockTrigger(ctx context.Context, tid int64) (trig models.Trigger, err error)
+	QueryUserTrigger(ctx context.Context, username string, symbol string, orderType models.OrderType) (trig models.Trigger, err error)
+	QueryReservation(ctx context.Context, rid int64) (res models.Reservation, err error)
+	QueryLastReservation(ctx context.Context, username string, resType models.OrderType) (res models.Reservation, err error)
+	ClearUsers(ctx context.Context, tx Tx) (err error)
+	CountUserRows(ctx context.Context) (counts map[string]int, err error)
+	InsertUser(ctx context.Context, user models.User) (err error)
+	UpdateUser(ctx context.Context, user models.User) (err error)
+	AddReservation(ctx context.Context, tx Tx, res models.Reservation) (rid int64, err error)
+	SetReservationRate(ctx context.Context, tx Tx, rid int64, currency string, rate dbutils.Rate) (err error)
+	QueryReservationRate(ctx context.Context, tx Tx, rid int64) (currency string, rate dbutils.Rate, err error)
+	UpdateUserStock(ctx context.Context, tx Tx, username string, symbol string, shares int, order models.OrderType) (err error)
+	UpdateUserMoney(ctx context.Context, tx Tx, username string, money int, order models.OrderType, trans string) (err error)
+	RemoveReservation(ctx context.Context, tx Tx, rid int64) (err error)
+	RemoveOrder(ctx context.Context, rid int64, timeout time.Duration)
+	RemoveLastOrderTypeReservation(ctx context.Context, username string, orderType models.OrderType) (res models.Reservation, err error)
+	SetUserOrderTypeAmount(ctx context.Context, tx Tx, username string, symbol string, orderType models.OrderType, amount int) (tid int64, err error)
+	RemoveUserStockTrigger(ctx context.Context, tx Tx, tid int64) (trig models.Trigger, err error)
+	UpdateTrigger(ctx context.Context, tx Tx, trig models.Trigger) (err error)
+	UpdateUserStockTriggerPrice(ctx context.Context, username string, stock string, orderType string, triggerPrice string) (err error)
+	CommitSetOrderTransaction(ctx context.Context, username string, symbol string, orderType models.OrderType, amount int, trans string) (tid int64, err error)
+	CancelOrderTransaction(ctx context.Context, trig models.Trigger, trans string) (rtrig models.Trigger, err error)
+	CommitBuySellTransaction(ctx context.Context, res models.Reservation, trans string) (err error)
+	ReserveOrder(ctx context.Context, username string, symbol string, side models.OrderType, q Quantity, quote int) (res models.Reservation, err error)
+	QueryAndExecuteCurrentTriggers(ctx context.Context, quotes dbutils.QuoteProvider, trans string) (rTrigs []models.Trigger, err error)
+	QueryAllUserTriggers(ctx context.Context, username string) (trigs []models.Trigger, err error)
+	QueryAllUserStocks(ctx context.Context, username string) (stocks []models.Stock, err error)
+	QueryAllUserReservations(ctx context.Context, username string) (reservations []models.Reservation, err error)
+	QueryUserLots(ctx context.Context, tx Tx, username string, symbol string) (lots []Lot, err error)
+	QueryUserRealizations(ctx context.Context, username string) (realizations []Realization, err error)
+	AddLot(ctx context.Context, tx Tx, lot Lot) (lid int64, err error)
+	UpdateLot(ctx context.Context, tx Tx, lot Lot) (err error)
+	RemoveLot(ctx context.Context, tx Tx, lid int64) (err error)
+	AddRealization(ctx context.Context, tx Tx, r Realization) (id int64, err error)
+	QueryUserExecutions(ctx context.Context, username string, f ExecutionFilter) (executions []Execution, total int, err error)
+	QueryUserFees(ctx context.Context, username string) (fees int, err error)
+	AddExecution(ctx context.Context, tx Tx, e Execution) (eid int64, err error)
+	QueryOrder(ctx context.Context, tx Tx, oid int64) (o Order, err error)
+	QueryUserOrders(ctx context.Context, username string, openOnly bool) (orders []Order, err error)
+	QueryOpenOrders(ctx context.Context) (orders []Order, err error)
+	AddOrder(ctx context.Context, tx Tx, o Order) (oid int64, err error)
+	UpdateOrder(ctx context.Context, tx Tx, o Order) (err error)
+	PlaceOrderTransaction(ctx context.Context, o Order, quote int, trans string) (rorder Order, err error)
+	CloseOrderTransaction(ctx context.Context, o Order, status OrderStatus, trans string) (rorder Order, err error)
+	ExecuteOrder(ctx context.Context, o Order, quote int, trans string) (rorder Order, err error)
+	QueryOrderGroup(ctx context.Context, tx Tx, gid int64) (g OrderGroup, err error)
+	QueryUserOrderGroups(ctx context.Context, username string, openOnly bool) (groups []OrderGroup, err error)
+	AddOrderGroup(ctx context.Context, tx Tx, g OrderGroup) (gid int64, err error)
+	PlaceOrderGroupTransaction(ctx context.Context, g OrderGroup, quote int, trans string) (rgroup OrderGroup, err error)
+	QuerySchedule(ctx context.Context, tx Tx, sid int64) (sch Schedule, err error)
+	QueryUserSchedules(ctx context.Context, username string) (schedules []Schedule, err error)
+	QueryDueSchedules(ctx context.Context, now int64) (schedules []Schedule, err error)
+	QueryScheduleRuns(ctx context.Context, username string, sid int64, limit int) (runs []ScheduleRun, err error)
+	AddSchedule(ctx context.Context, tx Tx, sch Schedule) (sid int64, err error)
+	UpdateSchedule(ctx context.Context, tx Tx, sch Schedule) (err error)
+	RemoveSchedule(ctx context.Context, tx Tx, sid int64) (err error)
+	AddScheduleRun(ctx context.Context, tx Tx, run ScheduleRun) (id int64, err error)
+	QueryAndRunDueSchedules(ctx context.Context, quotes dbutils.QuoteProvider, trans string) (runs []ScheduleRun, err error)
+	QueryTrailingStops(ctx context.Context, username string) (stops []TrailingStop, err error)
+	SetTrailingStop(ctx context.Context, tx Tx, ts TrailingStop) (err error)
+	RemoveTrailingStop(ctx context.Context, tx Tx, tid int64) (err error)
+	ExecuteTrigger(ctx context.Context, trig models.Trigger, quote int, trans string) (rtrig models.Trigger, err error)
 }
@@ -0,0 +1,137 @@
+package transdb
+
+import (
+	"context"
+	"fmt"
+)
+
+// CostBasis selects how the cost of sold shares is taken from a user's
+// lots.
+type CostBasis string
+
+const (
+	// FIFO sells the oldest lots first.
+	FIFO CostBasis = "fifo"
+	// AverageCost sells at the average cost of every lot, then merges the
+	// remaining shares into a single lot.
+	AverageCost CostBasis = "average"
+)
+
+// ParseCostBasis parses a COST_BASIS setting.
+func ParseCostBasis(s string) (CostBasis, error) {
+	switch CostBasis(s) {
+	case FIFO, AverageCost:
+		return CostBasis(s), nil
+	}
+	return "", fmt.Errorf("unknown cost basis %q, want fifo or average", s)
+}
+
+// Lot is a purchase of shares still held, with the cost of those shares in
+// cents.
+type Lot struct {
+	ID       int64  `json:"lid"`
+	Username string `json:"username"`
+	Symbol   string `json:"symbol"`
+	Shares   int    `json:"shares"`
+	Cost     int    `json:"cost"`
+	Time     int64  `json:"time"`
+	Trans    string `json:"trans"`
+}
+
+// Realization records the profit or loss of a sale: the proceeds less the
+// cost of the lots it sold.
+type Realization struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+	Symbol   string `json:"symbol"`
+	Shares   int    `json:"shares"`
+	Proceeds int    `json:"proceeds"`
+	Cost     int    `json:"cost"`
+	Time     int64  `json:"time"`
+	Trans    string `json:"trans"`
+}
+
+// Gain is the realized profit, negative for a loss.
+func (r Realization) Gain() int {
+	return r.Proceeds - r.Cost
+}
+
+// addLot records a purchase of shares for cost.
+func addLot(ctx context.Context, s TransactionDataStore, tx Tx, username string, symbol string, shares int, cost int, now int64, trans string) (err error) {
+	if shares <= 0 {
+		return nil
+	}
+	_, err = s.AddLot(ctx, tx, Lot{Username: username, Symbol: symbol, Shares: shares, Cost: cost, Time: now, Trans: trans})
+	return
+}
+
+// realizeSale takes the cost of shares sold for proceeds from the user's
+// lots and records the realized profit or loss. Shares bought before lots
+// were tracked have no recorded cost; they are taken at the sale price so
+// they realize nothing.
+func realizeSale(ctx context.Context, s TransactionDataStore, tx Tx, method CostBasis, username string, symbol string, shares int, proceeds int, now int64, trans string) (err error) {
+	if shares <= 0 {
+		return nil
+	}
+	lots, err := s.QueryUserLots(ctx, tx, username, symbol)
+	if err != nil {
+		return
+	}
+
+	held, heldCost := 0, 0
+	for _, lot := range lots {
+		held += lot.Shares
+		heldCost += lot.Cost
+	}
+	sold := shares
+	if sold > held {
+		sold = held
+	}
+
+	cost := 0
+	if method == AverageCost {
+		if sold > 0 {
+			cost = heldCost * sold / held
+		}
+		for _, lot := range lots {
+			if err = s.RemoveLot(ctx, tx, lot.ID); err != nil {
+				return
+			}
+		}
+		if held > sold {
+			err = addLot(ctx, s, tx, username, symbol, held-sold, heldCost-cost, lots[0].Time, lots[0].Trans)
+			if err != nil {
+				return
+			}
+		}
+	} else {
+		remaining := sold
+		for _, lot := range lots {
+			if remaining == 0 {
+				break
+			}
+			if lot.Shares <= remaining {
+				remaining -= lot.Shares
+				cost += lot.Cost
+				if err = s.RemoveLot(ctx, tx, lot.ID); err != nil {
+					return
+				}
+				continue
+			}
+			part := lot.Cost * remaining / lot.Shares
+			cost += part
+			lot.Shares -= remaining
+			lot.Cost -= part
+			remaining = 0
+			if err = s.UpdateLot(ctx, tx, lot); err != nil {
+				return
+			}
+		}
+	}
+
+	// untracked shares cost what they sold for
+	cost += proceeds * (shares - sold) / shares
+
+	_, err = s.AddRealization(ctx, tx, Realization{Username: username, Symbol: symbol, Shares: shares, Proceeds: proceeds, Cost: cost, Time: now, Trans: trans})
+	return
+}
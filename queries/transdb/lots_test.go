@@ -0,0 +1,84 @@
+package transdb
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"common/models"
+	"transaction_service/clock"
+)
+
+func TestRealizeSale(t *testing.T) {
+	tests := []struct {
+		method   CostBasis
+		cost     int
+		leftCost int
+	}{
+		// 2 at 100 then 2 at 150, selling 3 for 600
+		{FIFO, 200 + 150, 150},
+		{AverageCost, 375, 125},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.method), func(t *testing.T) {
+			ctx := context.Background()
+			db := NewMemoryDB(nopLogger{}, clock.Real)
+			db.CostBasis = tt.method
+			username := addUser(t, ctx, db, 1000)
+
+			for i, res := range []models.Reservation{
+				{Username: username, Symbol: "ABC", Order: models.BUY, Shares: 2, Amount: 200},
+				{Username: username, Symbol: "ABC", Order: models.BUY, Shares: 2, Amount: 300},
+				{Username: username, Symbol: "ABC", Order: models.SELL, Shares: 3, Amount: 600},
+			} {
+				if err := db.CommitBuySellTransaction(ctx, res, strconv.Itoa(i+1)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			realizations, _ := db.QueryUserRealizations(ctx, username)
+			if len(realizations) != 1 || realizations[0].Cost != tt.cost || realizations[0].Proceeds != 600 {
+				t.Errorf("realizations = %+v, want cost %d", realizations, tt.cost)
+			}
+			lots, _ := db.QueryUserLots(ctx, nil, username, "")
+			if len(lots) != 1 || lots[0].Shares != 1 || lots[0].Cost != tt.leftCost {
+				t.Errorf("lots = %+v, want 1 share costing %d", lots, tt.leftCost)
+			}
+		})
+	}
+}
+
+func TestRealizeSaleUntracked(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemoryDB(nopLogger{}, clock.Real)
+	username := addUser(t, ctx, db, 1000)
+
+	// one share held from before lots were tracked
+	if err := db.UpdateUserStock(ctx, nil, username, "ABC", 1, models.BUY); err != nil {
+		t.Fatal(err)
+	}
+	buy := models.Reservation{Username: username, Symbol: "ABC", Order: models.BUY, Shares: 4, Amount: 500}
+	if err := db.CommitBuySellTransaction(ctx, buy, "1"); err != nil {
+		t.Fatal(err)
+	}
+	sell := models.Reservation{Username: username, Symbol: "ABC", Order: models.SELL, Shares: 5, Amount: 1000}
+	if err := db.CommitBuySellTransaction(ctx, sell, "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	realizations, _ := db.QueryUserRealizations(ctx, username)
+	if len(realizations) != 1 || realizations[0].Cost != 700 {
+		t.Errorf("realizations = %+v, want the untracked share at its sale price of 200", realizations)
+	}
+}
+
+func TestParseCostBasis(t *testing.T) {
+	for _, s := range []string{"fifo", "average"} {
+		if m, err := ParseCostBasis(s); err != nil || string(m) != s {
+			t.Errorf("ParseCostBasis(%q) = %q, %v", s, m, err)
+		}
+	}
+	if _, err := ParseCostBasis("lifo"); err == nil {
+		t.Error("ParseCostBasis(lifo) succeeded")
+	}
+}
@@ -0,0 +1,1270 @@
+package transdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"common/logging"
+	"common/models"
+	"transaction_service/applog"
+	"transaction_service/clock"
+	"transaction_service/queries/utils"
+)
+
+var ErrTxClosed = errors.New("transaction already committed or rolled back")
+
+type stockKey struct {
+	username string
+	symbol   string
+}
+
+type balanceKey struct {
+	username string
+	currency string
+}
+
+// quotedRate is the currency and rate a reservation was priced at.
+type quotedRate struct {
+	currency string
+	rate     dbutils.Rate
+}
+
+// memState holds every table of a MemoryDB.
+type memState struct {
+	users        map[string]models.User
+	stocks       map[stockKey]models.Stock
+	reservations map[int64]models.Reservation
+	resRates     map[int64]quotedRate
+	triggers     map[int64]models.Trigger
+	lots         map[int64]Lot
+	realizations map[int64]Realization
+	executions   map[int64]Execution
+	orders       map[int64]Order
+	groups       map[int64]OrderGroup
+	schedules    map[int64]Schedule
+	runs         map[int64]ScheduleRun
+	trailing     map[int64]TrailingStop
+	symbols      map[string]string
+	balances     map[balanceKey]int
+	transfers    map[int64]Transfer
+	statuses     map[string]UserStatus
+
+	lastUID           int
+	lastSID           int
+	lastRID           int64
+	lastTID           int64
+	lastLID           int64
+	lastRealizationID int64
+	lastEID           int64
+	lastOID           int64
+	lastGID           int64
+	lastSchedID       int64
+	lastRunID         int64
+	lastTransferID    int64
+}
+
+func newMemState() *memState {
+	return &memState{
+		users:        make(map[string]models.User),
+		stocks:       make(map[stockKey]models.Stock),
+		reservations: make(map[int64]models.Reservation),
+		resRates:     make(map[int64]quotedRate),
+		triggers:     make(map[int64]models.Trigger),
+		lots:         make(map[int64]Lot),
+		realizations: make(map[int64]Realization),
+		executions:   make(map[int64]Execution),
+		orders:       make(map[int64]Order),
+		groups:       make(map[int64]OrderGroup),
+		schedules:    make(map[int64]Schedule),
+		runs:         make(map[int64]ScheduleRun),
+		trailing:     make(map[int64]TrailingStop),
+		symbols:      make(map[string]string),
+		balances:     make(map[balanceKey]int),
+		transfers:    make(map[int64]Transfer),
+		statuses:     make(map[string]UserStatus),
+	}
+}
+
+func (s *memState) clone() *memState {
+	c := *s
+	c.users = make(map[string]models.User, len(s.users))
+	for k, v := range s.users {
+		c.users[k] = v
+	}
+	c.stocks = make(map[stockKey]models.Stock, len(s.stocks))
+	for k, v := range s.stocks {
+		c.stocks[k] = v
+	}
+	c.reservations = make(map[int64]models.Reservation, len(s.reservations))
+	for k, v := range s.reservations {
+		c.reservations[k] = v
+	}
+	c.resRates = make(map[int64]quotedRate, len(s.resRates))
+	for k, v := range s.resRates {
+		c.resRates[k] = v
+	}
+	c.triggers = make(map[int64]models.Trigger, len(s.triggers))
+	for k, v := range s.triggers {
+		c.triggers[k] = v
+	}
+	c.lots = make(map[int64]Lot, len(s.lots))
+	for k, v := range s.lots {
+		c.lots[k] = v
+	}
+	c.realizations = make(map[int64]Realization, len(s.realizations))
+	for k, v := range s.realizations {
+		c.realizations[k] = v
+	}
+	c.executions = make(map[int64]Execution, len(s.executions))
+	for k, v := range s.executions {
+		c.executions[k] = v
+	}
+	c.orders = make(map[int64]Order, len(s.orders))
+	for k, v := range s.orders {
+		c.orders[k] = v
+	}
+	c.groups = make(map[int64]OrderGroup, len(s.groups))
+	for k, v := range s.groups {
+		c.groups[k] = v
+	}
+	c.schedules = make(map[int64]Schedule, len(s.schedules))
+	for k, v := range s.schedules {
+		c.schedules[k] = v
+	}
+	c.runs = make(map[int64]ScheduleRun, len(s.runs))
+	for k, v := range s.runs {
+		c.runs[k] = v
+	}
+	c.trailing = make(map[int64]TrailingStop, len(s.trailing))
+	for k, v := range s.trailing {
+		c.trailing[k] = v
+	}
+	c.symbols = make(map[string]string, len(s.symbols))
+	for k, v := range s.symbols {
+		c.symbols[k] = v
+	}
+	c.balances = make(map[balanceKey]int, len(s.balances))
+	for k, v := range s.balances {
+		c.balances[k] = v
+	}
+	c.transfers = make(map[int64]Transfer, len(s.transfers))
+	for k, v := range s.transfers {
+		c.transfers[k] = v
+	}
+	c.statuses = make(map[string]UserStatus, len(s.statuses))
+	for k, v := range s.statuses {
+		c.statuses[k] = v
+	}
+	return &c
+}
+
+// sortedTriggers returns the triggers matching keep in tid order.
+func (s *memState) sortedTriggers(keep func(models.Trigger) bool) (trigs []models.Trigger) {
+	for _, trig := range s.triggers {
+		if keep(trig) {
+			trigs = append(trigs, trig)
+		}
+	}
+	sort.Slice(trigs, func(i, j int) bool { return trigs[i].ID < trigs[j].ID })
+	return
+}
+
+// sortedOrders returns the orders matching keep in oid order.
+func (s *memState) sortedOrders(keep func(Order) bool) (orders []Order) {
+	for _, o := range s.orders {
+		if keep(o) {
+			orders = append(orders, o)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID < orders[j].ID })
+	return
+}
+
+// lastReservation returns the newest reservation of orderType for username.
+func (s *memState) lastReservation(username string, orderType models.OrderType) (res models.Reservation, err error) {
+	found := false
+	for _, r := range s.reservations {
+		if r.Username != username || r.Order != orderType {
+			continue
+		}
+		if !found || r.Time > res.Time || (r.Time == res.Time && r.ID > res.ID) {
+			res = r
+			found = true
+		}
+	}
+	if !found {
+		return res, ErrNoRows
+	}
+	return res, nil
+}
+
+// MemoryDB is a thread-safe, in-memory TransactionDataStore with the same
+// semantics as TransactionDB, for tests. A transaction holds the store's
+// lock from Begin until Commit or Rollback, so methods called with a nil Tx
+// must not be used by the goroutine holding a transaction.
+type MemoryDB struct {
+	// CostBasis is how sales are matched to lots, FIFO by default.
+	CostBasis CostBasis
+	// Scale is how share quantities are stored, whole shares by default.
+	Scale ShareScale
+	// FeeSchedule is the commission charged on executions, none by default.
+	FeeSchedule FeeSchedule
+	// Rates converts symbols quoted in other currencies, which can't be
+	// traded without it.
+	Rates dbutils.RateProvider
+
+	mu     sync.Mutex
+	state  *memState
+	logger logging.Logger
+	clock  clock.Clock
+}
+
+func NewMemoryDB(logger logging.Logger, clk clock.Clock) *MemoryDB {
+	return &MemoryDB{CostBasis: FIFO, Scale: WholeShares, state: newMemState(), logger: logger, clock: clk}
+}
+
+func (db *MemoryDB) ShareScale() ShareScale {
+	return db.Scale
+}
+
+func (db *MemoryDB) Fees() FeeSchedule {
+	return db.FeeSchedule
+}
+
+func (db *MemoryDB) FXRates() dbutils.RateProvider {
+	return db.Rates
+}
+
+type memTx struct {
+	db       *MemoryDB
+	snapshot *memState
+	done     bool
+}
+
+func (t *memTx) Commit(ctx context.Context) error {
+	if t.done {
+		return ErrTxClosed
+	}
+	t.done = true
+	t.db.mu.Unlock()
+	return nil
+}
+
+func (t *memTx) Rollback(ctx context.Context) error {
+	if t.done {
+		return ErrTxClosed
+	}
+	t.done = true
+	t.db.state = t.snapshot
+	t.db.mu.Unlock()
+	return nil
+}
+
+func (db *MemoryDB) Begin(ctx context.Context) (Tx, error) {
+	db.mu.Lock()
+	return &memTx{db: db, snapshot: db.state.clone()}, nil
+}
+
+// with runs fn against the store's tables, taking the lock unless tx
+// already holds it.
+func (db *MemoryDB) with(tx Tx, fn func(s *memState) error) error {
+	if tx == nil {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+	} else if mtx, ok := tx.(*memTx); !ok || mtx.db != db || mtx.done {
+		return ErrTxClosed
+	}
+	return fn(db.state)
+}
+
+func (db *MemoryDB) QueryUserAvailableBalance(ctx context.Context, username string) (balance int, err error) {
+	err = db.with(nil, func(s *memState) error {
+		user, ok := s.users[username]
+		if !ok {
+			return ErrNoRows
+		}
+		balance = user.Money
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) QueryUserAvailableShares(ctx context.Context, username string, symbol string) (shares int, err error) {
+	err = db.with(nil, func(s *memState) error {
+		shares = s.stocks[stockKey{username, symbol}].Shares
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) QueryUser(ctx context.Context, username string) (user models.User, err error) {
+	err = db.with(nil, func(s *memState) error {
+		var ok bool
+		if user, ok = s.users[username]; !ok {
+			return ErrNoRows
+		}
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) QueryUserStock(ctx context.Context, username string, symbol string) (stock models.Stock, err error) {
+	err = db.with(nil, func(s *memState) error {
+		var ok bool
+		if stock, ok = s.stocks[stockKey{username, symbol}]; !ok {
+			return ErrNoRows
+		}
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) QueryStockTrigger(ctx context.Context, tid int64) (trig models.Trigger, err error) {
+	err = db.with(nil, func(s *memState) error {
+		var ok bool
+		if trig, ok = s.triggers[tid]; !ok {
+			return ErrNoRows
+		}
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) QueryUserTrigger(ctx context.Context, username string, symbol string, orderType models.OrderType) (trig models.Trigger, err error) {
+	err = db.with(nil, func(s *memState) error {
+		trigs := s.sortedTriggers(func(t models.Trigger) bool {
+			return t.Username == username && t.Symbol == symbol && t.Order == orderType
+		})
+		if len(trigs) == 0 {
+			return ErrNoRows
+		}
+		trig = trigs[0]
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) QueryAllUserTriggers(ctx context.Context, username string) (trigs []models.Trigger, err error) {
+	err = db.with(nil, func(s *memState) error {
+		trigs = s.sortedTriggers(func(t models.Trigger) bool { return t.Username == username })
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) QueryAllUserStocks(ctx context.Context, username string) (stocks []models.Stock, err error) {
+	err = db.with(nil, func(s *memState) error {
+		for _, stock := range s.stocks {
+			if stock.Username == username {
+				stocks = append(stocks, stock)
+			}
+		}
+		return nil
+	})
+	sort.Slice(stocks, func(i, j int) bool { return stocks[i].Symbol < stocks[j].Symbol })
+	return
+}
+
+func (db *MemoryDB) QueryAllUserReservations(ctx context.Context, username string) (reservations []models.Reservation, err error) {
+	err = db.with(nil, func(s *memState) error {
+		for _, res := range s.reservations {
+			if res.Username == username {
+				reservations = append(reservations, res)
+			}
+		}
+		return nil
+	})
+	sort.Slice(reservations, func(i, j int) bool { return reservations[i].ID < reservations[j].ID })
+	return
+}
+
+func (db *MemoryDB) QueryUserLots(ctx context.Context, tx Tx, username string, symbol string) (lots []Lot, err error) {
+	err = db.with(tx, func(s *memState) error {
+		for _, lot := range s.lots {
+			if lot.Username == username && (symbol == "" || lot.Symbol == symbol) {
+				lots = append(lots, lot)
+			}
+		}
+		return nil
+	})
+	sort.Slice(lots, func(i, j int) bool { return lots[i].ID < lots[j].ID })
+	return
+}
+
+func (db *MemoryDB) QueryUserRealizations(ctx context.Context, username string) (realizations []Realization, err error) {
+	err = db.with(nil, func(s *memState) error {
+		for _, r := range s.realizations {
+			if r.Username == username {
+				realizations = append(realizations, r)
+			}
+		}
+		return nil
+	})
+	sort.Slice(realizations, func(i, j int) bool { return realizations[i].ID < realizations[j].ID })
+	return
+}
+
+func (db *MemoryDB) QueryUserExecutions(ctx context.Context, username string, f ExecutionFilter) (executions []Execution, total int, err error) {
+	err = db.with(nil, func(s *memState) error {
+		for _, e := range s.executions {
+			if e.Username == username && f.match(e) {
+				executions = append(executions, e)
+			}
+		}
+		return nil
+	})
+	sort.Slice(executions, func(i, j int) bool {
+		if executions[i].Time != executions[j].Time {
+			return executions[i].Time > executions[j].Time
+		}
+		return executions[i].ID > executions[j].ID
+	})
+
+	total = len(executions)
+	if f.Offset > total {
+		f.Offset = total
+	}
+	executions = executions[f.Offset:]
+	if f.Limit > 0 && len(executions) > f.Limit {
+		executions = executions[:f.Limit]
+	}
+	return
+}
+
+func (db *MemoryDB) QueryUserFees(ctx context.Context, username string) (fees int, err error) {
+	err = db.with(nil, func(s *memState) error {
+		for _, e := range s.executions {
+			if e.Username == username {
+				fees += e.Fees
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) QuerySymbolCurrency(ctx context.Context, tx Tx, symbol string) (currency string, err error) {
+	err = db.with(tx, func(s *memState) error {
+		var ok bool
+		if currency, ok = s.symbols[symbol]; !ok {
+			currency = BaseCurrency
+		}
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) SetSymbolCurrency(ctx context.Context, symbol string, currency string) (err error) {
+	return db.with(nil, func(s *memState) error {
+		s.symbols[symbol] = currency
+		return nil
+	})
+}
+
+func (db *MemoryDB) QueryUserBalances(ctx context.Context, username string) (balances map[string]int, err error) {
+	balances = make(map[string]int)
+	err = db.with(nil, func(s *memState) error {
+		for k, amount := range s.balances {
+			if k.username == username {
+				balances[k.currency] = amount
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) UpdateUserBalance(ctx context.Context, tx Tx, username string, currency string, amount int, order models.OrderType) (err error) {
+	return db.with(tx, func(s *memState) error {
+		key := balanceKey{username, currency}
+		if order == models.BUY {
+			if s.balances[key] < amount {
+				return ErrInsufficientFunds
+			}
+			amount = -amount
+		}
+		s.balances[key] += amount
+		return nil
+	})
+}
+
+func (db *MemoryDB) ExchangeTransaction(ctx context.Context, username string, from string, to string, amount int, trans string) (ex Exchange, err error) {
+	return exchangeTransaction(ctx, db, db.clock.Now().Unix(), username, from, to, amount, trans)
+}
+
+func (db *MemoryDB) QueryTransfer(ctx context.Context, tx Tx, ref string, kind string) (t Transfer, err error) {
+	err = db.with(tx, func(s *memState) error {
+		for _, st := range s.transfers {
+			if st.Ref == ref && st.Kind == kind {
+				t = st
+				return nil
+			}
+		}
+		return ErrNoRows
+	})
+	return
+}
+
+func (db *MemoryDB) QueryUserTransfers(ctx context.Context, username string, limit int) (transfers []Transfer, err error) {
+	err = db.with(nil, func(s *memState) error {
+		for _, t := range s.transfers {
+			if t.Username == username {
+				transfers = append(transfers, t)
+			}
+		}
+		return nil
+	})
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].ID > transfers[j].ID })
+	if limit > 0 && len(transfers) > limit {
+		transfers = transfers[:limit]
+	}
+	return
+}
+
+func (db *MemoryDB) QueryPendingTransfers(ctx context.Context, before int64) (transfers []Transfer, err error) {
+	err = db.with(nil, func(s *memState) error {
+		for _, t := range s.transfers {
+			if t.State == TransferPending && t.Kind == TransferSent && t.Time <= before {
+				transfers = append(transfers, t)
+			}
+		}
+		return nil
+	})
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].ID < transfers[j].ID })
+	return
+}
+
+func (db *MemoryDB) AddTransfer(ctx context.Context, tx Tx, t Transfer) (id int64, err error) {
+	err = db.with(tx, func(s *memState) error {
+		for _, st := range s.transfers {
+			if st.Ref == t.Ref && st.Kind == t.Kind {
+				return fmt.Errorf("duplicate %s transfer %s", t.Kind, t.Ref)
+			}
+		}
+		s.lastTransferID++
+		t.ID = s.lastTransferID
+		s.transfers[t.ID] = t
+		id = t.ID
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) SettleTransfer(ctx context.Context, tx Tx, id int64, state string) (err error) {
+	return db.with(tx, func(s *memState) error {
+		t, ok := s.transfers[id]
+		if !ok || t.State != TransferPending {
+			return ErrNoRows
+		}
+		t.State = state
+		s.transfers[id] = t
+		return nil
+	})
+}
+
+func (db *MemoryDB) WithdrawTransaction(ctx context.Context, username string, amount int, trans string) (t Transfer, err error) {
+	return withdrawTransaction(ctx, db, db.clock.Now().Unix(), username, amount, trans)
+}
+
+func (db *MemoryDB) QueryOrder(ctx context.Context, tx Tx, oid int64) (o Order, err error) {
+	err = db.with(tx, func(s *memState) error {
+		var ok bool
+		if o, ok = s.orders[oid]; !ok {
+			return ErrNoRows
+		}
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) QueryUserOrders(ctx context.Context, username string, openOnly bool) (orders []Order, err error) {
+	err = db.with(nil, func(s *memState) error {
+		orders = s.sortedOrders(func(o Order) bool {
+			return o.Username == username && (!openOnly || o.Status == OrderOpen)
+		})
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) QueryOpenOrders(ctx context.Context) (orders []Order, err error) {
+	err = db.with(nil, func(s *memState) error {
+		orders = s.sortedOrders(func(o Order) bool { return o.Status == OrderOpen })
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) QueryOrderGroup(ctx context.Context, tx Tx, gid int64) (g OrderGroup, err error) {
+	err = db.with(tx, func(s *memState) error {
+		var ok bool
+		if g, ok = s.groups[gid]; !ok {
+			return ErrNoRows
+		}
+		g.Orders = s.sortedOrders(func(o Order) bool { return o.GroupID == gid })
+		g.Status = groupStatus(g.Orders)
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) QueryUserOrderGroups(ctx context.Context, username string, openOnly bool) (groups []OrderGroup, err error) {
+	err = db.with(nil, func(s *memState) error {
+		for _, g := range s.groups {
+			if g.Username == username {
+				groups = append(groups, g)
+			}
+		}
+		sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+		orders := s.sortedOrders(func(o Order) bool { return o.Username == username && o.GroupID != 0 })
+		groups = groupOrders(groups, orders, openOnly)
+		return nil
+	})
+	return
+}
+
+// sortedSchedules returns the schedules matching keep in sid order.
+func (s *memState) sortedSchedules(keep func(Schedule) bool) (schedules []Schedule) {
+	for _, sch := range s.schedules {
+		if keep(sch) {
+			schedules = append(schedules, sch)
+		}
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].ID < schedules[j].ID })
+	return
+}
+
+func (db *MemoryDB) QuerySchedule(ctx context.Context, tx Tx, sid int64) (sch Schedule, err error) {
+	err = db.with(tx, func(s *memState) error {
+		var ok bool
+		if sch, ok = s.schedules[sid]; !ok {
+			return ErrNoRows
+		}
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) QueryUserSchedules(ctx context.Context, username string) (schedules []Schedule, err error) {
+	err = db.with(nil, func(s *memState) error {
+		schedules = s.sortedSchedules(func(sch Schedule) bool { return sch.Username == username })
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) QueryDueSchedules(ctx context.Context, now int64) (schedules []Schedule, err error) {
+	err = db.with(nil, func(s *memState) error {
+		schedules = s.sortedSchedules(func(sch Schedule) bool {
+			return !sch.Paused && !sch.Ended() && sch.Next <= now
+		})
+		return nil
+	})
+	sort.SliceStable(schedules, func(i, j int) bool { return schedules[i].Next < schedules[j].Next })
+	return
+}
+
+func (db *MemoryDB) QueryScheduleRuns(ctx context.Context, username string, sid int64, limit int) (runs []ScheduleRun, err error) {
+	err = db.with(nil, func(s *memState) error {
+		for _, run := range s.runs {
+			if run.Username == username && (sid == 0 || run.SID == sid) {
+				runs = append(runs, run)
+			}
+		}
+		return nil
+	})
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ID > runs[j].ID })
+	if limit > 0 && len(runs) > limit {
+		runs = runs[:limit]
+	}
+	return
+}
+
+func (db *MemoryDB) QueryTrailingStops(ctx context.Context, username string) (stops []TrailingStop, err error) {
+	err = db.with(nil, func(s *memState) error {
+		for _, ts := range s.trailing {
+			if username == "" || ts.Username == username {
+				stops = append(stops, ts)
+			}
+		}
+		return nil
+	})
+	sort.Slice(stops, func(i, j int) bool { return stops[i].TID < stops[j].TID })
+	return
+}
+
+func (db *MemoryDB) QueryReservation(ctx context.Context, rid int64) (res models.Reservation, err error) {
+	err = db.with(nil, func(s *memState) error {
+		var ok bool
+		if res, ok = s.reservations[rid]; !ok {
+			return ErrNoRows
+		}
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) QueryLastReservation(ctx context.Context, username string, resType models.OrderType) (res models.Reservation, err error) {
+	err = db.with(nil, func(s *memState) (err error) {
+		res, err = s.lastReservation(username, resType)
+		return
+	})
+	return
+}
+
+func (db *MemoryDB) ClearUsers(ctx context.Context, tx Tx) (err error) {
+	return db.with(tx, func(s *memState) error {
+		s.users = make(map[string]models.User)
+		s.stocks = make(map[stockKey]models.Stock)
+		s.reservations = make(map[int64]models.Reservation)
+		s.resRates = make(map[int64]quotedRate)
+		s.triggers = make(map[int64]models.Trigger)
+		s.lots = make(map[int64]Lot)
+		s.realizations = make(map[int64]Realization)
+		s.executions = make(map[int64]Execution)
+		s.orders = make(map[int64]Order)
+		s.groups = make(map[int64]OrderGroup)
+		s.schedules = make(map[int64]Schedule)
+		s.runs = make(map[int64]ScheduleRun)
+		s.trailing = make(map[int64]TrailingStop)
+		s.balances = make(map[balanceKey]int)
+		s.transfers = make(map[int64]Transfer)
+		s.statuses = make(map[string]UserStatus)
+		return nil
+	})
+}
+
+func (db *MemoryDB) CountUserRows(ctx context.Context) (counts map[string]int, err error) {
+	err = db.with(nil, func(s *memState) error {
+		counts = map[string]int{
+			"users":          len(s.users),
+			"stocks":         len(s.stocks),
+			"reservations":   len(s.reservations),
+			"triggers":       len(s.triggers),
+			"lots":           len(s.lots),
+			"realizations":   len(s.realizations),
+			"executions":     len(s.executions),
+			"orders":         len(s.orders),
+			"order_groups":   len(s.groups),
+			"trailing_stops": len(s.trailing),
+			"schedules":      len(s.schedules),
+			"schedule_runs":  len(s.runs),
+			"balances":       len(s.balances),
+			"transfers":      len(s.transfers),
+		}
+		return nil
+	})
+	return
+}
+
+// DeleteUser removes every row belonging to the user.
+func (db *MemoryDB) DeleteUser(ctx context.Context, username string) (err error) {
+	return db.with(nil, func(s *memState) error {
+		delete(s.users, username)
+		delete(s.statuses, username)
+		for k := range s.stocks {
+			if k.username == username {
+				delete(s.stocks, k)
+			}
+		}
+		for k, v := range s.reservations {
+			if v.Username == username {
+				delete(s.reservations, k)
+				delete(s.resRates, k)
+			}
+		}
+		for k, v := range s.triggers {
+			if v.Username == username {
+				delete(s.triggers, k)
+			}
+		}
+		for k, v := range s.lots {
+			if v.Username == username {
+				delete(s.lots, k)
+			}
+		}
+		for k, v := range s.realizations {
+			if v.Username == username {
+				delete(s.realizations, k)
+			}
+		}
+		for k, v := range s.executions {
+			if v.Username == username {
+				delete(s.executions, k)
+			}
+		}
+		for k, v := range s.orders {
+			if v.Username == username {
+				delete(s.orders, k)
+			}
+		}
+		for k, v := range s.groups {
+			if v.Username == username {
+				delete(s.groups, k)
+			}
+		}
+		for k, v := range s.trailing {
+			if v.Username == username {
+				delete(s.trailing, k)
+			}
+		}
+		for k, v := range s.schedules {
+			if v.Username == username {
+				delete(s.schedules, k)
+			}
+		}
+		for k, v := range s.runs {
+			if v.Username == username {
+				delete(s.runs, k)
+			}
+		}
+		for k := range s.balances {
+			if k.username == username {
+				delete(s.balances, k)
+			}
+		}
+		for k, v := range s.transfers {
+			if v.Username == username {
+				delete(s.transfers, k)
+			}
+		}
+		return nil
+	})
+}
+
+func (db *MemoryDB) QueryUserStatus(ctx context.Context, tx Tx, username string) (status UserStatus, err error) {
+	err = db.with(tx, func(s *memState) error {
+		if _, ok := s.users[username]; !ok {
+			return ErrNoRows
+		}
+		status = UserActive
+		if st, ok := s.statuses[username]; ok {
+			status = st
+		}
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) LockUser(ctx context.Context, tx Tx, username string) (acct Account, err error) {
+	err = db.with(tx, func(s *memState) error {
+		var ok bool
+		if acct.User, ok = s.users[username]; !ok {
+			return ErrNoRows
+		}
+		acct.Status = UserActive
+		if st, ok := s.statuses[username]; ok {
+			acct.Status = st
+		}
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) SetUserStatus(ctx context.Context, tx Tx, username string, status UserStatus) (err error) {
+	return db.with(tx, func(s *memState) error {
+		if _, ok := s.users[username]; !ok {
+			return ErrNoRows
+		}
+		s.statuses[username] = status
+		return nil
+	})
+}
+
+func (db *MemoryDB) InsertUser(ctx context.Context, user models.User) (err error) {
+	return db.with(nil, func(s *memState) error {
+		if _, exists := s.users[user.Username]; exists {
+			return fmt.Errorf("duplicate user %s", user.Username)
+		}
+		s.lastUID++
+		user.ID = s.lastUID
+		s.users[user.Username] = user
+		return nil
+	})
+}
+
+func (db *MemoryDB) UpdateUser(ctx context.Context, user models.User) (err error) {
+	return db.with(nil, func(s *memState) error {
+		if existing, ok := s.users[user.Username]; ok {
+			existing.Money = user.Money
+			s.users[user.Username] = existing
+		}
+		return nil
+	})
+}
+
+func (db *MemoryDB) AddReservation(ctx context.Context, tx Tx, res models.Reservation) (rid int64, err error) {
+	err = db.with(tx, func(s *memState) error {
+		s.lastRID++
+		res.ID = s.lastRID
+		s.reservations[res.ID] = res
+		rid = res.ID
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) SetReservationRate(ctx context.Context, tx Tx, rid int64, currency string, rate dbutils.Rate) (err error) {
+	return db.with(tx, func(s *memState) error {
+		if _, ok := s.reservations[rid]; ok {
+			s.resRates[rid] = quotedRate{currency, rate}
+		}
+		return nil
+	})
+}
+
+func (db *MemoryDB) QueryReservationRate(ctx context.Context, tx Tx, rid int64) (currency string, rate dbutils.Rate, err error) {
+	err = db.with(tx, func(s *memState) error {
+		r, ok := s.resRates[rid]
+		if !ok {
+			return ErrNoRows
+		}
+		currency, rate = r.currency, r.rate
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) UpdateUserStock(ctx context.Context, tx Tx, username string, symbol string, shares int, order models.OrderType) (err error) {
+	return db.with(tx, func(s *memState) error {
+		key := stockKey{username, symbol}
+		stock, ok := s.stocks[key]
+		if !ok {
+			if order == models.SELL && shares > 0 {
+				return ErrInsufficientShares
+			}
+			s.lastSID++
+			s.stocks[key] = models.Stock{ID: s.lastSID, Username: username, Symbol: symbol, Shares: shares}
+			return nil
+		}
+
+		// adjust shares depending on order type
+		if order == models.BUY {
+			stock.Shares += shares
+		} else if stock.Shares < shares {
+			return ErrInsufficientShares
+		} else {
+			stock.Shares -= shares
+		}
+		s.stocks[key] = stock
+		return nil
+	})
+}
+
+func (db *MemoryDB) UpdateUserMoney(ctx context.Context, tx Tx, username string, money int, order models.OrderType, trans string) (err error) {
+	return db.with(tx, func(s *memState) error {
+		user, ok := s.users[username]
+		if !ok {
+			return ErrNoRows
+		}
+
+		if order == models.BUY {
+			if user.Money < money {
+				return ErrInsufficientFunds
+			}
+			user.Money -= money
+			db.logger.LogTransaction("remove", username, money, trans)
+		} else {
+			user.Money += money
+			db.logger.LogTransaction("add", username, money, trans)
+		}
+		s.users[username] = user
+		return nil
+	})
+}
+
+func (db *MemoryDB) RemoveReservation(ctx context.Context, tx Tx, rid int64) (err error) {
+	return db.with(tx, func(s *memState) error {
+		delete(s.reservations, rid)
+		delete(s.resRates, rid)
+		return nil
+	})
+}
+
+func (db *MemoryDB) RemoveOrder(ctx context.Context, rid int64, timeout time.Duration) {
+	select {
+	case <-db.clock.After(timeout * time.Second):
+	case <-ctx.Done():
+		return
+	}
+
+	err := db.RemoveReservation(ctx, nil, rid)
+	if err != nil {
+		applog.FromContext(ctx).Error("Error removing reservation due to timeout.", "rid", rid, "error", err)
+	}
+}
+
+func (db *MemoryDB) RemoveLastOrderTypeReservation(ctx context.Context, username string, orderType models.OrderType) (res models.Reservation, err error) {
+	err = db.with(nil, func(s *memState) (err error) {
+		res, err = s.lastReservation(username, orderType)
+		if err == nil {
+			delete(s.reservations, res.ID)
+			delete(s.resRates, res.ID)
+		}
+		return
+	})
+	return
+}
+
+func (db *MemoryDB) SetUserOrderTypeAmount(ctx context.Context, tx Tx, username string, symbol string, orderType models.OrderType, amount int) (tid int64, err error) {
+	err = db.with(tx, func(s *memState) error {
+		s.lastTID++
+		tid = s.lastTID
+		s.triggers[tid] = models.Trigger{ID: tid, Username: username, Symbol: symbol, Order: orderType, Amount: amount, Time: db.clock.Now().Unix()}
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) RemoveUserStockTrigger(ctx context.Context, tx Tx, tid int64) (trig models.Trigger, err error) {
+	err = db.with(tx, func(s *memState) error {
+		var ok bool
+		if trig, ok = s.triggers[tid]; !ok {
+			return ErrNoRows
+		}
+		delete(s.triggers, tid)
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) UpdateTrigger(ctx context.Context, tx Tx, trig models.Trigger) (err error) {
+	return db.with(tx, func(s *memState) error {
+		if _, ok := s.triggers[trig.ID]; ok {
+			s.triggers[trig.ID] = trig
+		}
+		return nil
+	})
+}
+
+func (db *MemoryDB) UpdateUserStockTriggerPrice(ctx context.Context, username string, stock string, orderType string, triggerPrice string) (err error) {
+	price, err := strconv.Atoi(triggerPrice)
+	if err != nil {
+		return
+	}
+	return db.with(nil, func(s *memState) error {
+		for tid, trig := range s.triggers {
+			if trig.Username == username && trig.Symbol == stock && string(trig.Order) == orderType {
+				trig.TriggerPrice = price
+				s.triggers[tid] = trig
+			}
+		}
+		return nil
+	})
+}
+
+func (db *MemoryDB) AddLot(ctx context.Context, tx Tx, lot Lot) (lid int64, err error) {
+	err = db.with(tx, func(s *memState) error {
+		s.lastLID++
+		lot.ID = s.lastLID
+		s.lots[lot.ID] = lot
+		lid = lot.ID
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) UpdateLot(ctx context.Context, tx Tx, lot Lot) (err error) {
+	return db.with(tx, func(s *memState) error {
+		if existing, ok := s.lots[lot.ID]; ok {
+			existing.Shares = lot.Shares
+			existing.Cost = lot.Cost
+			s.lots[lot.ID] = existing
+		}
+		return nil
+	})
+}
+
+func (db *MemoryDB) RemoveLot(ctx context.Context, tx Tx, lid int64) (err error) {
+	return db.with(tx, func(s *memState) error {
+		delete(s.lots, lid)
+		return nil
+	})
+}
+
+func (db *MemoryDB) AddRealization(ctx context.Context, tx Tx, r Realization) (id int64, err error) {
+	err = db.with(tx, func(s *memState) error {
+		s.lastRealizationID++
+		r.ID = s.lastRealizationID
+		s.realizations[r.ID] = r
+		id = r.ID
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) AddExecution(ctx context.Context, tx Tx, e Execution) (eid int64, err error) {
+	err = db.with(tx, func(s *memState) error {
+		s.lastEID++
+		e.ID = s.lastEID
+		s.executions[e.ID] = e
+		eid = e.ID
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) AddOrder(ctx context.Context, tx Tx, o Order) (oid int64, err error) {
+	err = db.with(tx, func(s *memState) error {
+		s.lastOID++
+		o.ID = s.lastOID
+		s.orders[o.ID] = o
+		oid = o.ID
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) UpdateOrder(ctx context.Context, tx Tx, o Order) (err error) {
+	return db.with(tx, func(s *memState) error {
+		if existing, ok := s.orders[o.ID]; ok {
+			existing.Held = o.Held
+			existing.Stopped = o.Stopped
+			existing.Status = o.Status
+			existing.FillPrice = o.FillPrice
+			s.orders[o.ID] = existing
+		}
+		return nil
+	})
+}
+
+func (db *MemoryDB) PlaceOrderTransaction(ctx context.Context, o Order, quote int, trans string) (rorder Order, err error) {
+	return placeOrderTransaction(ctx, db, db.CostBasis, db.clock.Now().Unix(), o, quote, trans)
+}
+
+func (db *MemoryDB) CloseOrderTransaction(ctx context.Context, o Order, status OrderStatus, trans string) (rorder Order, err error) {
+	return closeOrderTransaction(ctx, db, o, status, trans)
+}
+
+func (db *MemoryDB) ExecuteOrder(ctx context.Context, o Order, quote int, trans string) (rorder Order, err error) {
+	return executeOrder(ctx, db, db.CostBasis, db.clock.Now().Unix(), o, quote, trans)
+}
+
+func (db *MemoryDB) AddOrderGroup(ctx context.Context, tx Tx, g OrderGroup) (gid int64, err error) {
+	err = db.with(tx, func(s *memState) error {
+		s.lastGID++
+		g.ID = s.lastGID
+		g.Orders = nil
+		s.groups[g.ID] = g
+		gid = g.ID
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) PlaceOrderGroupTransaction(ctx context.Context, g OrderGroup, quote int, trans string) (rgroup OrderGroup, err error) {
+	return placeOrderGroupTransaction(ctx, db, db.CostBasis, db.clock.Now().Unix(), g, quote, trans)
+}
+
+func (db *MemoryDB) AddSchedule(ctx context.Context, tx Tx, sch Schedule) (sid int64, err error) {
+	err = db.with(tx, func(s *memState) error {
+		s.lastSchedID++
+		sch.ID = s.lastSchedID
+		s.schedules[sch.ID] = sch
+		sid = sch.ID
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) UpdateSchedule(ctx context.Context, tx Tx, sch Schedule) (err error) {
+	return db.with(tx, func(s *memState) error {
+		if existing, ok := s.schedules[sch.ID]; ok {
+			existing.Next = sch.Next
+			existing.Paused = sch.Paused
+			s.schedules[sch.ID] = existing
+		}
+		return nil
+	})
+}
+
+func (db *MemoryDB) RemoveSchedule(ctx context.Context, tx Tx, sid int64) (err error) {
+	return db.with(tx, func(s *memState) error {
+		delete(s.schedules, sid)
+		return nil
+	})
+}
+
+func (db *MemoryDB) AddScheduleRun(ctx context.Context, tx Tx, run ScheduleRun) (id int64, err error) {
+	err = db.with(tx, func(s *memState) error {
+		s.lastRunID++
+		run.ID = s.lastRunID
+		s.runs[run.ID] = run
+		id = run.ID
+		return nil
+	})
+	return
+}
+
+func (db *MemoryDB) QueryAndRunDueSchedules(ctx context.Context, quotes dbutils.QuoteProvider, trans string) (runs []ScheduleRun, err error) {
+	now := db.clock.Now().Unix()
+	schedules, err := db.QueryDueSchedules(ctx, now)
+	if err != nil {
+		return
+	}
+	return runSchedules(ctx, db, db.CostBasis, now, schedules, quotes, trans), nil
+}
+
+func (db *MemoryDB) SetTrailingStop(ctx context.Context, tx Tx, ts TrailingStop) (err error) {
+	return db.with(tx, func(s *memState) error {
+		s.trailing[ts.TID] = ts
+		if trig, ok := s.triggers[ts.TID]; ok {
+			trig.TriggerPrice = ts.Stop()
+			trig.Executable = true
+			s.triggers[ts.TID] = trig
+		}
+		return nil
+	})
+}
+
+func (db *MemoryDB) RemoveTrailingStop(ctx context.Context, tx Tx, tid int64) (err error) {
+	return db.with(tx, func(s *memState) error {
+		delete(s.trailing, tid)
+		return nil
+	})
+}
+
+func (db *MemoryDB) CommitSetOrderTransaction(ctx context.Context, username string, symbol string, orderType models.OrderType, amount int, trans string) (tid int64, err error) {
+	return commitSetOrderTransaction(ctx, db, username, symbol, orderType, amount, trans)
+}
+
+func (db *MemoryDB) CancelOrderTransaction(ctx context.Context, trig models.Trigger, trans string) (rtrig models.Trigger, err error) {
+	return cancelOrderTransaction(ctx, db, trig, trans)
+}
+
+func (db *MemoryDB) CommitBuySellTransaction(ctx context.Context, res models.Reservation, trans string) (err error) {
+	return commitBuySellTransaction(ctx, db, db.CostBasis, db.clock.Now().Unix(), res, trans)
+}
+
+func (db *MemoryDB) ReserveOrder(ctx context.Context, username string, symbol string, side models.OrderType, q Quantity, quote int) (res models.Reservation, err error) {
+	return reserveOrder(ctx, db, db.clock.Now().Unix(), username, symbol, side, q, quote)
+}
+
+func (db *MemoryDB) QueryAndExecuteCurrentTriggers(ctx context.Context, quotes dbutils.QuoteProvider, trans string) (rTrigs []models.Trigger, err error) {
+	var trigs []models.Trigger
+	db.with(nil, func(s *memState) error {
+		trigs = s.sortedTriggers(func(t models.Trigger) bool { return t.Executable })
+		return nil
+	})
+	stops, err := db.QueryTrailingStops(ctx, "")
+	if err != nil {
+		return
+	}
+	rTrigs = executeTriggers(ctx, db, trigs, trailingStops(stops), quotes, trans)
+
+	orders, err := db.QueryOpenOrders(ctx)
+	if err != nil {
+		return
+	}
+	executeOrders(ctx, db, orders, quotes, db.clock.Now().Unix(), trans)
+	return rTrigs, nil
+}
+
+func (db *MemoryDB) ExecuteTrigger(ctx context.Context, trig models.Trigger, quote int, trans string) (rtrig models.Trigger, err error) {
+	return executeTrigger(ctx, db, db.CostBasis, db.clock.Now().Unix(), trig, quote, trans)
+}
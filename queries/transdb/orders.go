@@ -0,0 +1,382 @@
+package transdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"common/models"
+	"transaction_service/applog"
+	"transaction_service/queries/utils"
+)
+
+// OrderKind is the type of a price-conditional order.
+type OrderKind string
+
+const (
+	// LimitBuy buys when the price is at or below LimitPrice.
+	LimitBuy OrderKind = "limit_buy"
+	// LimitSell sells when the price is at or above LimitPrice.
+	LimitSell OrderKind = "limit_sell"
+	// StopLoss sells at the market once the price falls to StopPrice.
+	StopLoss OrderKind = "stop_loss"
+	// StopLimit becomes a limit sell at LimitPrice once the price falls to
+	// StopPrice.
+	StopLimit OrderKind = "stop_limit"
+)
+
+// TimeInForce is how long an order stays open.
+type TimeInForce string
+
+const (
+	// GTC orders stay open until they fill or are cancelled.
+	GTC TimeInForce = "GTC"
+	// DAY orders expire at the end of the UTC day they were placed.
+	DAY TimeInForce = "DAY"
+	// IOC orders fill when placed or not at all.
+	IOC TimeInForce = "IOC"
+)
+
+// OrderStatus is where an order is in its life.
+type OrderStatus string
+
+const (
+	OrderOpen      OrderStatus = "open"
+	OrderFilled    OrderStatus = "filled"
+	OrderCancelled OrderStatus = "cancelled"
+	OrderExpired   OrderStatus = "expired"
+)
+
+// SourceOrder marks executions of orders.
+const SourceOrder = "order"
+
+var (
+	ErrInsufficientFunds  = errors.New("not enough money")
+	ErrInsufficientShares = errors.New("not enough shares")
+	ErrOrderClosed        = errors.New("order is no longer open")
+)
+
+// Order is a limit or stop order. While it is open the cash for a buy, or
+// the shares for a sell, are held out of the user's balance.
+type Order struct {
+	ID          int64       `json:"oid"`
+	Username    string      `json:"username"`
+	Symbol      string      `json:"symbol"`
+	Kind        OrderKind   `json:"kind"`
+	Shares      int         `json:"shares"`
+	LimitPrice  int         `json:"limitPrice"`
+	StopPrice   int         `json:"stopPrice"`
+	TimeInForce TimeInForce `json:"timeInForce"`
+	// Held is the cash or shares set aside for the order.
+	Held int `json:"held"`
+	// Stopped is set once a stop limit order's stop price is reached.
+	Stopped   bool        `json:"stopped"`
+	Status    OrderStatus `json:"status"`
+	FillPrice int         `json:"fillPrice"`
+	Time      int64       `json:"time"`
+	// Expires is when a DAY order expires, 0 for other orders.
+	Expires int64 `json:"expires"`
+	// GroupID is the order group the order belongs to, 0 if none.
+	GroupID int64  `json:"gid,omitempty"`
+	Trans   string `json:"trans"`
+}
+
+// Side returns whether the order buys or sells.
+func (o Order) Side() models.OrderType {
+	if o.Kind == LimitBuy {
+		return models.BUY
+	}
+	return models.SELL
+}
+
+// Validate checks the order has the prices its kind needs.
+func (o Order) Validate() error {
+	if o.Shares <= 0 {
+		return fmt.Errorf("invalid number of shares %d", o.Shares)
+	}
+	switch o.Kind {
+	case LimitBuy, LimitSell:
+		if o.LimitPrice <= 0 {
+			return fmt.Errorf("%s orders need a limit price", o.Kind)
+		}
+	case StopLoss:
+		if o.StopPrice <= 0 {
+			return fmt.Errorf("%s orders need a stop price", o.Kind)
+		}
+	case StopLimit:
+		if o.LimitPrice <= 0 || o.StopPrice <= 0 {
+			return fmt.Errorf("%s orders need a limit and a stop price", o.Kind)
+		}
+	default:
+		return fmt.Errorf("unknown order kind %q", o.Kind)
+	}
+	switch o.TimeInForce {
+	case GTC, DAY, IOC:
+	default:
+		return fmt.Errorf("unknown time in force %q", o.TimeInForce)
+	}
+	return nil
+}
+
+// match reports whether the order fills at quote, and whether a stop limit
+// order's stop is reached.
+func (o Order) match(quote int) (fill bool, stopped bool) {
+	switch o.Kind {
+	case LimitBuy:
+		return quote <= o.LimitPrice, false
+	case LimitSell:
+		return quote >= o.LimitPrice, false
+	case StopLoss:
+		return quote <= o.StopPrice, false
+	case StopLimit:
+		stopped = o.Stopped || quote <= o.StopPrice
+		return stopped && quote >= o.LimitPrice, stopped
+	}
+	return false, false
+}
+
+// endOfDay returns the end of the UTC day containing now.
+func endOfDay(now int64) int64 {
+	return time.Unix(now, 0).UTC().Truncate(24 * time.Hour).Add(24 * time.Hour).Unix()
+}
+
+// placeOrderTransaction holds the order's cash or shares and opens it, then
+// tries to fill it at quote. An IOC order that doesn't fill is cancelled.
+func placeOrderTransaction(ctx context.Context, s TransactionDataStore, method CostBasis, now int64, o Order, quote int, trans string) (rorder Order, err error) {
+	if err = o.Validate(); err != nil {
+		return
+	}
+	o.Status = OrderOpen
+	o.Stopped = false
+	o.Time = now
+	o.Trans = trans
+	o.Expires = 0
+	if o.TimeInForce == DAY {
+		o.Expires = endOfDay(now)
+	}
+
+	o.Held = o.Shares
+	if o.Side() == models.BUY {
+		o.Held = o.need(s.ShareScale(), s.Fees())
+	}
+
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		return
+	}
+
+	// the hold fails with ErrInsufficientFunds or ErrInsufficientShares
+	// once the user's row is locked, so concurrent orders can't both take it
+	if o.Side() == models.BUY {
+		err = s.UpdateUserMoney(ctx, tx, o.Username, o.Held, models.BUY, trans)
+	} else {
+		err = s.UpdateUserStock(ctx, tx, o.Username, o.Symbol, o.Held, models.SELL)
+	}
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	o.ID, err = s.AddOrder(ctx, tx, o)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	rorder, err = executeOrder(ctx, s, method, now, o, quote, trans)
+	if err != nil || rorder.Status != OrderOpen || o.TimeInForce != IOC {
+		return
+	}
+	return closeOrderTransaction(ctx, s, rorder, OrderCancelled, trans)
+}
+
+// executeOrder fills o if quote meets its price, or records that its stop
+// has been reached.
+func executeOrder(ctx context.Context, s TransactionDataStore, method CostBasis, now int64, o Order, quote int, trans string) (rorder Order, err error) {
+	fill, stopped := o.match(quote)
+	if !fill && stopped == o.Stopped {
+		return o, nil
+	}
+
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		return
+	}
+
+	// the order may have been cancelled since it was read
+	o, err = s.QueryOrder(ctx, tx, o.ID)
+	if err == nil && o.Status != OrderOpen {
+		err = ErrOrderClosed
+	}
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	o.Stopped = stopped
+	if fill {
+		if o.GroupID != 0 {
+			err = fillGroupOrder(ctx, s, tx, method, now, &o, quote, trans)
+		} else {
+			err = fillOrder(ctx, s, tx, method, now, &o, quote, trans)
+		}
+		if err != nil {
+			tx.Rollback(ctx)
+			return
+		}
+	}
+
+	err = s.UpdateOrder(ctx, tx, o)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+	return o, nil
+}
+
+// fillOrder buys or sells o's shares at quote within tx, returning any cash
+// held beyond the fill and its commission.
+func fillOrder(ctx context.Context, s TransactionDataStore, tx Tx, method CostBasis, now int64, o *Order, quote int, trans string) (err error) {
+	amount := s.ShareScale().Value(o.Shares, quote)
+	if o.Side() == models.BUY {
+		amount = s.ShareScale().Cost(o.Shares, quote)
+	}
+	fee := s.Fees().Fee(o.Symbol, o.Side(), amount)
+	if o.Side() == models.BUY {
+		if err = s.UpdateUserStock(ctx, tx, o.Username, o.Symbol, o.Shares, models.BUY); err != nil {
+			return
+		}
+		if err = s.UpdateUserMoney(ctx, tx, o.Username, o.Held-amount-fee, models.SELL, trans); err != nil {
+			return
+		}
+		err = addLot(ctx, s, tx, o.Username, o.Symbol, o.Shares, amount+fee, now, trans)
+	} else {
+		if err = s.UpdateUserMoney(ctx, tx, o.Username, amount-fee, models.SELL, trans); err != nil {
+			return
+		}
+		// a group order may hold more shares than it sells
+		if extra := o.Held - o.Shares; extra > 0 {
+			if err = s.UpdateUserStock(ctx, tx, o.Username, o.Symbol, extra, models.BUY); err != nil {
+				return
+			}
+		}
+		err = realizeSale(ctx, s, tx, method, o.Username, o.Symbol, o.Shares, amount-fee, now, trans)
+	}
+	if err != nil {
+		return
+	}
+
+	err = recordExecution(ctx, s, tx, o.Username, o.Symbol, o.Side(), o.Shares, quote, fee, SourceOrder, now, trans)
+	if err != nil {
+		return
+	}
+
+	o.Status = OrderFilled
+	o.FillPrice = quote
+	o.Held = 0
+	return
+}
+
+// closeOrderTransaction returns an open order's held cash or shares and
+// marks it with status. Closing an order in a group closes the whole group.
+func closeOrderTransaction(ctx context.Context, s TransactionDataStore, o Order, status OrderStatus, trans string) (rorder Order, err error) {
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		return
+	}
+
+	o, err = s.QueryOrder(ctx, tx, o.ID)
+	if err == nil && o.Status != OrderOpen && o.Status != OrderPending {
+		err = ErrOrderClosed
+	}
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	orders := []Order{o}
+	if o.GroupID != 0 {
+		var g OrderGroup
+		if g, err = s.QueryOrderGroup(ctx, tx, o.GroupID); err != nil {
+			tx.Rollback(ctx)
+			return
+		}
+		orders = g.Orders
+	}
+
+	for _, closing := range orders {
+		if closing.Status != OrderOpen && closing.Status != OrderPending {
+			continue
+		}
+		if err = closeOrder(ctx, s, tx, &closing, status, trans); err != nil {
+			tx.Rollback(ctx)
+			return
+		}
+		if closing.ID == o.ID {
+			o = closing
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+	return o, nil
+}
+
+// closeOrder returns what o holds and marks it with status within tx.
+func closeOrder(ctx context.Context, s TransactionDataStore, tx Tx, o *Order, status OrderStatus, trans string) (err error) {
+	if o.Held > 0 {
+		if o.Side() == models.BUY {
+			err = s.UpdateUserMoney(ctx, tx, o.Username, o.Held, models.SELL, trans)
+		} else {
+			err = s.UpdateUserStock(ctx, tx, o.Username, o.Symbol, o.Held, models.BUY)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	o.Status = status
+	o.Held = 0
+	return s.UpdateOrder(ctx, tx, *o)
+}
+
+// executeOrders expires open orders past their end and fills the rest whose
+// prices have been reached.
+func executeOrders(ctx context.Context, s TransactionDataStore, orders []Order, quotes dbutils.QuoteProvider, now int64, trans string) {
+	quotes = BaseQuotes(s, quotes)
+	for _, o := range orders {
+		var err error
+		if o.Expires != 0 && now >= o.Expires {
+			_, err = s.CloseOrderTransaction(ctx, o, OrderExpired, trans)
+		} else if err = canTrade(ctx, s, nil, o.Username); inactive(err) {
+			continue
+		} else if err == nil {
+			var quote int
+			quote, err = quotes.QueryQuotePrice(ctx, o.Username, o.Symbol, trans)
+			if err != nil {
+				applog.FromContext(ctx).Warn("Failed to get quote for order", "oid", o.ID, "symbol", o.Symbol, "error", err)
+				continue
+			}
+			_, err = s.ExecuteOrder(ctx, o, quote, trans)
+		}
+		if err != nil && err != ErrOrderClosed {
+			applog.FromContext(ctx).Warn("Failed to execute order", "oid", o.ID, "error", err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package transdb
+
+import "testing"
+
+func TestOrderMatch(t *testing.T) {
+	tests := []struct {
+		o             Order
+		quote         int
+		fill, stopped bool
+	}{
+		{Order{Kind: LimitBuy, LimitPrice: 100}, 100, true, false},
+		{Order{Kind: LimitBuy, LimitPrice: 100}, 101, false, false},
+		{Order{Kind: LimitSell, LimitPrice: 100}, 100, true, false},
+		{Order{Kind: LimitSell, LimitPrice: 100}, 99, false, false},
+		{Order{Kind: StopLoss, StopPrice: 90}, 90, true, false},
+		{Order{Kind: StopLoss, StopPrice: 90}, 91, false, false},
+		{Order{Kind: StopLimit, StopPrice: 90, LimitPrice: 85}, 95, false, false},
+		{Order{Kind: StopLimit, StopPrice: 90, LimitPrice: 85}, 88, true, true},
+		{Order{Kind: StopLimit, StopPrice: 90, LimitPrice: 85}, 80, false, true},
+		{Order{Kind: StopLimit, StopPrice: 90, LimitPrice: 85, Stopped: true}, 95, true, true},
+	}
+	for _, tt := range tests {
+		fill, stopped := tt.o.match(tt.quote)
+		if fill != tt.fill || stopped != tt.stopped {
+			t.Errorf("%+v at %d = %t, %t, want %t, %t", tt.o, tt.quote, fill, stopped, tt.fill, tt.stopped)
+		}
+	}
+}
+
+func TestEndOfDay(t *testing.T) {
+	// 2017-07-14T02:40:00Z
+	if got, want := endOfDay(1500000000), int64(1499990400+86400); got != want {
+		t.Errorf("endOfDay = %d, want %d", got, want)
+	}
+}
+
+func TestTrailingStopStop(t *testing.T) {
+	tests := []struct {
+		ts   TrailingStop
+		want int
+	}{
+		{TrailingStop{TrailAmount: 150, HighWater: 1000}, 850},
+		{TrailingStop{TrailBasisPoints: 1000, HighWater: 1000}, 900},
+		{TrailingStop{TrailBasisPoints: 250, HighWater: 1010}, 985},
+	}
+	for _, tt := range tests {
+		if got := tt.ts.Stop(); got != tt.want {
+			t.Errorf("%+v.Stop() = %d, want %d", tt.ts, got, tt.want)
+		}
+	}
+}
+
+func TestGroupStatus(t *testing.T) {
+	tests := []struct {
+		statuses []OrderStatus
+		want     OrderStatus
+	}{
+		{[]OrderStatus{OrderFilled, OrderPending, OrderPending}, OrderOpen},
+		{[]OrderStatus{OrderCancelled, OrderFilled}, OrderFilled},
+		{[]OrderStatus{OrderExpired, OrderExpired}, OrderExpired},
+	}
+	for _, tt := range tests {
+		var orders []Order
+		for _, status := range tt.statuses {
+			orders = append(orders, Order{Status: status})
+		}
+		if got := groupStatus(orders); got != tt.want {
+			t.Errorf("groupStatus(%v) = %s, want %s", tt.statuses, got, tt.want)
+		}
+	}
+}
+
+func TestOrderGroupValidate(t *testing.T) {
+	profit := Order{Symbol: "ABC", Kind: LimitSell, Shares: 4, LimitPrice: 150, TimeInForce: GTC}
+	stop := Order{Symbol: "ABC", Kind: StopLoss, Shares: 4, StopPrice: 80, TimeInForce: GTC}
+	entry := Order{Symbol: "ABC", Kind: LimitBuy, Shares: 4, LimitPrice: 100, TimeInForce: GTC}
+	buy := entry
+	buy.LimitPrice = 90
+	other := stop
+	other.Symbol = "DEF"
+	ioc := stop
+	ioc.TimeInForce = IOC
+	high := stop
+	high.StopPrice = 150
+
+	tests := []struct {
+		g     OrderGroup
+		valid bool
+	}{
+		{OrderGroup{Kind: OCO, Orders: []Order{profit, stop}}, true},
+		{OrderGroup{Kind: OCO, Orders: []Order{entry, buy}}, true},
+		{OrderGroup{Kind: OCO, Orders: []Order{profit}}, false},
+		{OrderGroup{Kind: OCO, Orders: []Order{profit, entry}}, false},
+		{OrderGroup{Kind: OCO, Orders: []Order{profit, other}}, false},
+		{OrderGroup{Kind: OCO, Orders: []Order{profit, ioc}}, false},
+		{OrderGroup{Kind: Bracket, Orders: []Order{entry, profit, stop}}, true},
+		{OrderGroup{Kind: Bracket, Orders: []Order{profit, entry, stop}}, false},
+		{OrderGroup{Kind: Bracket, Orders: []Order{entry, profit, high}}, false},
+		{OrderGroup{Kind: "ladder", Orders: []Order{profit, stop}}, false},
+	}
+	for i, tt := range tests {
+		if err := tt.g.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%d: Validate() = %v, want valid %v", i, err, tt.valid)
+		}
+	}
+}
@@ -1,15 +1,50 @@
 package transdb
 
 import (
+	"context"
+	"log/slog"
+
 	"github.com/jackc/pgx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"common/logging"
 	"common/models"
+	"transaction_service/clock"
+	"transaction_service/queries/utils"
+	"transaction_service/tracing"
 )
 
 type TransactionDB struct {
 	DB *pgx.ConnPool
+	// CostBasis is how sales are matched to lots, FIFO by default.
+	CostBasis CostBasis
+	// Scale is how share quantities are stored, whole shares by default.
+	Scale ShareScale
+	// FeeSchedule is the commission charged on executions, none by default.
+	FeeSchedule FeeSchedule
+	// Rates converts symbols quoted in other currencies, which can't be
+	// traded without it.
+	Rates dbutils.RateProvider
+
 	logger logging.Logger
+	log    *slog.Logger
+	clock  clock.Clock
+}
+
+// startSpan starts a child span around a single query or transaction.
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracing.StartKind(ctx, "transdb."+name, trace.SpanKindClient, attribute.String("db.system", "postgresql"))
+}
+
+// endSpan ends span, recording err unless it only means no rows matched.
+func endSpan(span trace.Span, err *error) {
+	if *err == ErrNoRows {
+		span.SetAttributes(attribute.Bool("db.no_rows", true))
+		span.End()
+		return
+	}
+	tracing.End(span, err)
 }
 
 func ScanTrigger(row *pgx.Row) (trig models.Trigger, err error) {
@@ -22,50 +57,107 @@ func ScanTriggerRows(rows *pgx.Rows) (trig models.Trigger, err error) {
 	return
 }
 
-func (tdb *TransactionDB) QueryUserAvailableBalance(username string) (balance int, err error) {
-	query := `SELECT (SELECT money FROM USERS WHERE username = $1) as available_balance;`
-	err = tdb.DB.QueryRow(query, username).Scan(&balance)
+func (tdb *TransactionDB) QueryUserAvailableBalance(ctx context.Context, username string) (balance int, err error) {
+	ctx, span := startSpan(ctx, "QueryUserAvailableBalance")
+	defer endSpan(span, &err)
+
+	query := `SELECT money FROM users WHERE username = $1`
+	err = tdb.DB.QueryRowEx(ctx, query, nil, username).Scan(&balance)
 	return
 }
 
-func (tdb *TransactionDB) QueryUserAvailableShares(username string, symbol string) (shares int, err error) {
+func (tdb *TransactionDB) QueryUserAvailableShares(ctx context.Context, username string, symbol string) (shares int, err error) {
+	ctx, span := startSpan(ctx, "QueryUserAvailableShares")
+	defer endSpan(span, &err)
+
 	query := `SELECT (SELECT COALESCE(SUM(shares), 0) FROM Stocks WHERE username = $1 and symbol = $2)`
-	err = tdb.DB.QueryRow(query, username, symbol).Scan(&shares)
+	err = tdb.DB.QueryRowEx(ctx, query, nil, username, symbol).Scan(&shares)
 	return
 }
 
-func (tdb *TransactionDB) QueryUser(username string) (user models.User, err error) {
+// CountUserRows returns how many rows each table of user data has.
+func (tdb *TransactionDB) CountUserRows(ctx context.Context) (counts map[string]int, err error) {
+	ctx, span := startSpan(ctx, "CountUserRows")
+	defer endSpan(span, &err)
+
+	counts = make(map[string]int, len(userTables))
+	for _, table := range userTables {
+		var n int
+		if err = tdb.DB.QueryRowEx(ctx, "SELECT COUNT(*) FROM "+table, nil).Scan(&n); err != nil {
+			return
+		}
+		counts[table] = n
+	}
+	return
+}
+
+func (tdb *TransactionDB) QueryUserStatus(ctx context.Context, tx Tx, username string) (status UserStatus, err error) {
+	ctx, span := startSpan(ctx, "QueryUserStatus")
+	defer endSpan(span, &err)
+
+	query := `SELECT status FROM users WHERE username = $1`
+	err = tdb.q(tx).QueryRowEx(ctx, query, nil, username).Scan(&status)
+	return
+}
+
+// LockUser returns the user's account, locking their row until tx ends so
+// their balance and status can't change under it.
+func (tdb *TransactionDB) LockUser(ctx context.Context, tx Tx, username string) (acct Account, err error) {
+	ctx, span := startSpan(ctx, "LockUser")
+	defer endSpan(span, &err)
+
+	query := "SELECT uid, username, money, status FROM users WHERE username = $1 FOR UPDATE"
+	err = tdb.q(tx).QueryRowEx(ctx, query, nil, username).Scan(&acct.ID, &acct.Username, &acct.Money, &acct.Status)
+	return
+}
+
+func (tdb *TransactionDB) QueryUser(ctx context.Context, username string) (user models.User, err error) {
+	ctx, span := startSpan(ctx, "QueryUser")
+	defer endSpan(span, &err)
+
 	query := "SELECT uid, username, money FROM users WHERE username = $1"
-	err = tdb.DB.QueryRow(query, username).Scan(&user.ID, &user.Username, &user.Money)
+	err = tdb.DB.QueryRowEx(ctx, query, nil, username).Scan(&user.ID, &user.Username, &user.Money)
 	return
 }
 
-func (tdb *TransactionDB) QueryUserStock(username string, symbol string) (stock models.Stock, err error) {
+func (tdb *TransactionDB) QueryUserStock(ctx context.Context, username string, symbol string) (stock models.Stock, err error) {
+	ctx, span := startSpan(ctx, "QueryUserStock")
+	defer endSpan(span, &err)
 
 	query := "SELECT sid, username, symbol, shares FROM stocks WHERE username = $1 AND symbol = $2"
-	err = tdb.DB.QueryRow(query, username, symbol).Scan(&stock.ID, &stock.Username, &stock.Symbol, &stock.Shares)
+	err = tdb.DB.QueryRowEx(ctx, query, nil, username, symbol).Scan(&stock.ID, &stock.Username, &stock.Symbol, &stock.Shares)
 	return
 }
 
-func (tdb *TransactionDB) QueryStockTrigger(tid int64) (trig models.Trigger, err error) {
+func (tdb *TransactionDB) QueryStockTrigger(ctx context.Context, tid int64) (trig models.Trigger, err error) {
+	ctx, span := startSpan(ctx, "QueryStockTrigger")
+	defer endSpan(span, &err)
+
 	query := "SELECT tid, username, symbol, type, amount, trigger_price, executable, time FROM triggers WHERE tid = $1"
-	trig, err = ScanTrigger(tdb.DB.QueryRow(query, tid))
+	trig, err = ScanTrigger(tdb.DB.QueryRowEx(ctx, query, nil, tid))
 	return
 }
 
-func (tdb *TransactionDB) QueryUserTrigger(username string, symbol string, orderType models.OrderType) (trig models.Trigger, err error) {
-	query := "SELECT tid, username, symbol, type, amount, trigger_price, executable, time FROM triggers WHERE username = $1 AND symbol=$2 AND type=$3"
-	trig, err = ScanTrigger(tdb.DB.QueryRow(query, username, symbol, orderType))
+func (tdb *TransactionDB) QueryUserTrigger(ctx context.Context, username string, symbol string, orderType models.OrderType) (trig models.Trigger, err error) {
+	ctx, span := startSpan(ctx, "QueryUserTrigger")
+	defer endSpan(span, &err)
+
+	query := "SELECT tid, username, symbol, type, amount, trigger_price, executable, time FROM triggers WHERE username = $1 AND symbol=$2 AND type=$3 ORDER BY tid LIMIT 1"
+	trig, err = ScanTrigger(tdb.DB.QueryRowEx(ctx, query, nil, username, symbol, orderType))
 	return
 }
 
-func (tdb *TransactionDB) QueryAllUserTriggers(username string) (trigs []models.Trigger, err error) {
-	query := "SELECT tid, username, symbol, type, amount, trigger_price, executable, time FROM triggers WHERE username = $1"
-	rows, err := tdb.DB.Query(query, username)
+func (tdb *TransactionDB) QueryAllUserTriggers(ctx context.Context, username string) (trigs []models.Trigger, err error) {
+	ctx, span := startSpan(ctx, "QueryAllUserTriggers")
+	defer endSpan(span, &err)
+
+	query := "SELECT tid, username, symbol, type, amount, trigger_price, executable, time FROM triggers WHERE username = $1 ORDER BY tid"
+	rows, err := tdb.DB.QueryEx(ctx, query, nil, username)
 
 	if err != nil {
 		return
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		trig := models.Trigger{}
@@ -80,14 +172,474 @@ func (tdb *TransactionDB) QueryAllUserTriggers(username string) (trigs []models.
 	return
 }
 
-func (tdb *TransactionDB) QueryReservation(rid int64) (res models.Reservation, err error) {
+func (tdb *TransactionDB) QueryAllUserStocks(ctx context.Context, username string) (stocks []models.Stock, err error) {
+	ctx, span := startSpan(ctx, "QueryAllUserStocks")
+	defer endSpan(span, &err)
+
+	query := "SELECT sid, username, symbol, shares FROM stocks WHERE username = $1 ORDER BY symbol"
+	rows, err := tdb.DB.QueryEx(ctx, query, nil, username)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		stock := models.Stock{}
+		if err = rows.Scan(&stock.ID, &stock.Username, &stock.Symbol, &stock.Shares); err != nil {
+			return
+		}
+		stocks = append(stocks, stock)
+	}
+	err = rows.Err()
+	return
+}
+
+func (tdb *TransactionDB) QueryAllUserReservations(ctx context.Context, username string) (reservations []models.Reservation, err error) {
+	ctx, span := startSpan(ctx, "QueryAllUserReservations")
+	defer endSpan(span, &err)
+
+	query := "SELECT rid, username, symbol, shares, amount, type, time FROM reservations WHERE username = $1 ORDER BY rid"
+	rows, err := tdb.DB.QueryEx(ctx, query, nil, username)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		res := models.Reservation{}
+		if err = rows.Scan(&res.ID, &res.Username, &res.Symbol, &res.Shares, &res.Amount, &res.Order, &res.Time); err != nil {
+			return
+		}
+		reservations = append(reservations, res)
+	}
+	err = rows.Err()
+	return
+}
+
+// QueryUserLots returns the user's lots of symbol, or of every symbol when
+// symbol is empty, oldest first. Within tx the lots are locked for update.
+func (tdb *TransactionDB) QueryUserLots(ctx context.Context, tx Tx, username string, symbol string) (lots []Lot, err error) {
+	ctx, span := startSpan(ctx, "QueryUserLots")
+	defer endSpan(span, &err)
+
+	query := "SELECT lid, username, symbol, shares, cost, time, trans FROM lots WHERE username = $1 AND ($2 = '' OR symbol = $2) ORDER BY lid"
+	if tx != nil {
+		query += " FOR UPDATE"
+	}
+	rows, err := tdb.q(tx).QueryEx(ctx, query, nil, username, symbol)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		lot := Lot{}
+		if err = rows.Scan(&lot.ID, &lot.Username, &lot.Symbol, &lot.Shares, &lot.Cost, &lot.Time, &lot.Trans); err != nil {
+			return
+		}
+		lots = append(lots, lot)
+	}
+	err = rows.Err()
+	return
+}
+
+func (tdb *TransactionDB) QueryUserRealizations(ctx context.Context, username string) (realizations []Realization, err error) {
+	ctx, span := startSpan(ctx, "QueryUserRealizations")
+	defer endSpan(span, &err)
+
+	query := "SELECT id, username, symbol, shares, proceeds, cost, time, trans FROM realizations WHERE username = $1 ORDER BY id"
+	rows, err := tdb.DB.QueryEx(ctx, query, nil, username)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r := Realization{}
+		if err = rows.Scan(&r.ID, &r.Username, &r.Symbol, &r.Shares, &r.Proceeds, &r.Cost, &r.Time, &r.Trans); err != nil {
+			return
+		}
+		realizations = append(realizations, r)
+	}
+	err = rows.Err()
+	return
+}
+
+// QueryUserExecutions returns the page of the user's executions selected by
+// f, newest first, and the number matching f across every page.
+func (tdb *TransactionDB) QueryUserExecutions(ctx context.Context, username string, f ExecutionFilter) (executions []Execution, total int, err error) {
+	ctx, span := startSpan(ctx, "QueryUserExecutions")
+	defer endSpan(span, &err)
+
+	where := `WHERE username = $1 AND ($2 = 0 OR time >= $2) AND ($3 = 0 OR time <= $3) AND ($4 = '' OR symbol = $4) AND ($5 = '' OR side = $5)`
+	args := []interface{}{username, f.From, f.To, f.Symbol, string(f.Side)}
+	err = tdb.DB.QueryRowEx(ctx, "SELECT COUNT(*) FROM executions "+where, nil, args...).Scan(&total)
+	if err != nil {
+		return
+	}
+
+	// LIMIT NULL returns every row
+	var limit interface{}
+	if f.Limit > 0 {
+		limit = f.Limit
+	}
+	query := "SELECT eid, username, symbol, side, shares, price, amount, fees, currency, fx_rate, COALESCE(local_price, price), source, trans, time FROM executions " + where + " ORDER BY time DESC, eid DESC LIMIT $6 OFFSET $7"
+	rows, err := tdb.DB.QueryEx(ctx, query, nil, append(args, limit, f.Offset)...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := Execution{}
+		if err = rows.Scan(&e.ID, &e.Username, &e.Symbol, &e.Side, &e.Shares, &e.Price, &e.Amount, &e.Fees, &e.Currency, &e.FXRate, &e.LocalPrice, &e.Source, &e.Trans, &e.Time); err != nil {
+			return
+		}
+		executions = append(executions, e)
+	}
+	err = rows.Err()
+	return
+}
+
+// QueryUserFees returns the commission the user has paid on every execution.
+func (tdb *TransactionDB) QueryUserFees(ctx context.Context, username string) (fees int, err error) {
+	ctx, span := startSpan(ctx, "QueryUserFees")
+	defer endSpan(span, &err)
+
+	err = tdb.DB.QueryRowEx(ctx, "SELECT COALESCE(SUM(fees), 0) FROM executions WHERE username = $1", nil, username).Scan(&fees)
+	return
+}
+
+// QuerySymbolCurrency returns the currency symbol is quoted in, the base
+// currency unless it has been set.
+func (tdb *TransactionDB) QuerySymbolCurrency(ctx context.Context, tx Tx, symbol string) (currency string, err error) {
+	ctx, span := startSpan(ctx, "QuerySymbolCurrency")
+	defer endSpan(span, &err)
+
+	err = tdb.q(tx).QueryRowEx(ctx, "SELECT currency FROM symbols WHERE symbol = $1", nil, symbol).Scan(&currency)
+	if err == ErrNoRows {
+		return BaseCurrency, nil
+	}
+	return
+}
+
+// QueryUserBalances returns the user's balances in currencies other than
+// the base currency.
+func (tdb *TransactionDB) QueryUserBalances(ctx context.Context, username string) (balances map[string]int, err error) {
+	ctx, span := startSpan(ctx, "QueryUserBalances")
+	defer endSpan(span, &err)
+
+	rows, err := tdb.DB.QueryEx(ctx, "SELECT currency, amount FROM balances WHERE username = $1", nil, username)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	balances = make(map[string]int)
+	for rows.Next() {
+		var currency string
+		var amount int
+		if err = rows.Scan(&currency, &amount); err != nil {
+			return
+		}
+		balances[currency] = amount
+	}
+	err = rows.Err()
+	return
+}
+
+const orderColumns = "oid, username, symbol, kind, shares, limit_price, stop_price, tif, held, stopped, status, fill_price, time, expires, gid, trans"
+
+func scanOrder(row interface{ Scan(...interface{}) error }) (o Order, err error) {
+	err = row.Scan(&o.ID, &o.Username, &o.Symbol, &o.Kind, &o.Shares, &o.LimitPrice, &o.StopPrice, &o.TimeInForce, &o.Held, &o.Stopped, &o.Status, &o.FillPrice, &o.Time, &o.Expires, &o.GroupID, &o.Trans)
+	return
+}
+
+func (tdb *TransactionDB) queryOrders(ctx context.Context, tx Tx, query string, args ...interface{}) (orders []Order, err error) {
+	rows, err := tdb.q(tx).QueryEx(ctx, query, nil, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var o Order
+		if o, err = scanOrder(rows); err != nil {
+			return
+		}
+		orders = append(orders, o)
+	}
+	err = rows.Err()
+	return
+}
+
+// QueryOrder returns order oid, locked for update within tx.
+func (tdb *TransactionDB) QueryOrder(ctx context.Context, tx Tx, oid int64) (o Order, err error) {
+	ctx, span := startSpan(ctx, "QueryOrder")
+	defer endSpan(span, &err)
+
+	query := "SELECT " + orderColumns + " FROM orders WHERE oid = $1"
+	if tx != nil {
+		query += " FOR UPDATE"
+	}
+	return scanOrder(tdb.q(tx).QueryRowEx(ctx, query, nil, oid))
+}
+
+// QueryUserOrders returns the user's orders, or only the open ones, oldest
+// first.
+func (tdb *TransactionDB) QueryUserOrders(ctx context.Context, username string, openOnly bool) (orders []Order, err error) {
+	ctx, span := startSpan(ctx, "QueryUserOrders")
+	defer endSpan(span, &err)
+
+	query := "SELECT " + orderColumns + " FROM orders WHERE username = $1 AND (NOT $2 OR status = 'open') ORDER BY oid"
+	return tdb.queryOrders(ctx, nil, query, username, openOnly)
+}
+
+func (tdb *TransactionDB) QueryOpenOrders(ctx context.Context) (orders []Order, err error) {
+	ctx, span := startSpan(ctx, "QueryOpenOrders")
+	defer endSpan(span, &err)
+
+	query := "SELECT " + orderColumns + " FROM orders WHERE status = 'open' ORDER BY oid"
+	return tdb.queryOrders(ctx, nil, query)
+}
+
+// QueryOrderGroup returns group gid with its orders, locked for update
+// within tx.
+func (tdb *TransactionDB) QueryOrderGroup(ctx context.Context, tx Tx, gid int64) (g OrderGroup, err error) {
+	ctx, span := startSpan(ctx, "QueryOrderGroup")
+	defer endSpan(span, &err)
+
+	query := "SELECT gid, username, kind, time, trans FROM order_groups WHERE gid = $1"
+	err = tdb.q(tx).QueryRowEx(ctx, query, nil, gid).Scan(&g.ID, &g.Username, &g.Kind, &g.Time, &g.Trans)
+	if err != nil {
+		return
+	}
+
+	query = "SELECT " + orderColumns + " FROM orders WHERE gid = $1 ORDER BY oid"
+	if tx != nil {
+		query += " FOR UPDATE"
+	}
+	g.Orders, err = tdb.queryOrders(ctx, tx, query, gid)
+	g.Status = groupStatus(g.Orders)
+	return
+}
+
+// QueryUserOrderGroups returns the user's order groups, or only the open
+// ones, oldest first.
+func (tdb *TransactionDB) QueryUserOrderGroups(ctx context.Context, username string, openOnly bool) (groups []OrderGroup, err error) {
+	ctx, span := startSpan(ctx, "QueryUserOrderGroups")
+	defer endSpan(span, &err)
+
+	query := "SELECT gid, username, kind, time, trans FROM order_groups WHERE username = $1 ORDER BY gid"
+	rows, err := tdb.DB.QueryEx(ctx, query, nil, username)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		g := OrderGroup{}
+		if err = rows.Scan(&g.ID, &g.Username, &g.Kind, &g.Time, &g.Trans); err != nil {
+			return
+		}
+		groups = append(groups, g)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	orders, err := tdb.queryOrders(ctx, nil, "SELECT "+orderColumns+" FROM orders WHERE username = $1 AND gid != 0 ORDER BY oid", username)
+	if err != nil {
+		return
+	}
+	return groupOrders(groups, orders, openOnly), nil
+}
+
+const scheduleColumns = "sid, username, symbol, amount, cadence, next, ends, paused, time, trans"
+
+func scanSchedule(row interface{ Scan(...interface{}) error }) (sch Schedule, err error) {
+	err = row.Scan(&sch.ID, &sch.Username, &sch.Symbol, &sch.Amount, &sch.Cadence, &sch.Next, &sch.Ends, &sch.Paused, &sch.Time, &sch.Trans)
+	return
+}
+
+func (tdb *TransactionDB) querySchedules(ctx context.Context, query string, args ...interface{}) (schedules []Schedule, err error) {
+	rows, err := tdb.DB.QueryEx(ctx, query, nil, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sch Schedule
+		if sch, err = scanSchedule(rows); err != nil {
+			return
+		}
+		schedules = append(schedules, sch)
+	}
+	err = rows.Err()
+	return
+}
+
+// QuerySchedule returns schedule sid, locked for update within tx.
+func (tdb *TransactionDB) QuerySchedule(ctx context.Context, tx Tx, sid int64) (sch Schedule, err error) {
+	ctx, span := startSpan(ctx, "QuerySchedule")
+	defer endSpan(span, &err)
+
+	query := "SELECT " + scheduleColumns + " FROM schedules WHERE sid = $1"
+	if tx != nil {
+		query += " FOR UPDATE"
+	}
+	return scanSchedule(tdb.q(tx).QueryRowEx(ctx, query, nil, sid))
+}
+
+func (tdb *TransactionDB) QueryUserSchedules(ctx context.Context, username string) (schedules []Schedule, err error) {
+	ctx, span := startSpan(ctx, "QueryUserSchedules")
+	defer endSpan(span, &err)
+
+	query := "SELECT " + scheduleColumns + " FROM schedules WHERE username = $1 ORDER BY sid"
+	return tdb.querySchedules(ctx, query, username)
+}
+
+// QueryDueSchedules returns the schedules that should have run by now.
+func (tdb *TransactionDB) QueryDueSchedules(ctx context.Context, now int64) (schedules []Schedule, err error) {
+	ctx, span := startSpan(ctx, "QueryDueSchedules")
+	defer endSpan(span, &err)
+
+	query := "SELECT " + scheduleColumns + " FROM schedules WHERE NOT paused AND next != 0 AND next <= $1 AND (ends = 0 OR next <= ends) ORDER BY next, sid"
+	return tdb.querySchedules(ctx, query, now)
+}
+
+// QueryScheduleRuns returns the runs of the user's schedule sid, or of all
+// their schedules when sid is 0, newest first. A limit of 0 returns all.
+func (tdb *TransactionDB) QueryScheduleRuns(ctx context.Context, username string, sid int64, limit int) (runs []ScheduleRun, err error) {
+	ctx, span := startSpan(ctx, "QueryScheduleRuns")
+	defer endSpan(span, &err)
+
+	var lim *int
+	if limit > 0 {
+		lim = &limit
+	}
+	query := `SELECT id, sid, username, symbol, status, reason, shares, price, amount, time, trans FROM schedule_runs
+				WHERE username = $1 AND ($2 = 0 OR sid = $2) ORDER BY id DESC LIMIT $3`
+	rows, err := tdb.DB.QueryEx(ctx, query, nil, username, sid, lim)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		run := ScheduleRun{}
+		if err = rows.Scan(&run.ID, &run.SID, &run.Username, &run.Symbol, &run.Status, &run.Reason, &run.Shares, &run.Price, &run.Amount, &run.Time, &run.Trans); err != nil {
+			return
+		}
+		runs = append(runs, run)
+	}
+	err = rows.Err()
+	return
+}
+
+func (tdb *TransactionDB) QueryTransfer(ctx context.Context, tx Tx, ref string, kind string) (t Transfer, err error) {
+	ctx, span := startSpan(ctx, "QueryTransfer")
+	defer endSpan(span, &err)
+
+	query := `SELECT id, username, kind, counterparty, amount, state, ref, time, trans FROM transfers WHERE ref = $1 AND kind = $2`
+	err = tdb.q(tx).QueryRowEx(ctx, query, nil, ref, kind).Scan(&t.ID, &t.Username, &t.Kind, &t.Counterparty, &t.Amount, &t.State, &t.Ref, &t.Time, &t.Trans)
+	return
+}
+
+// QueryUserTransfers returns the user's transfers newest first, at most
+// limit of them when it is positive.
+func (tdb *TransactionDB) QueryUserTransfers(ctx context.Context, username string, limit int) (transfers []Transfer, err error) {
+	ctx, span := startSpan(ctx, "QueryUserTransfers")
+	defer endSpan(span, &err)
+
+	var lim *int
+	if limit > 0 {
+		lim = &limit
+	}
+	query := `SELECT id, username, kind, counterparty, amount, state, ref, time, trans FROM transfers
+				WHERE username = $1 ORDER BY id DESC LIMIT $2`
+	return tdb.queryTransfers(ctx, query, username, lim)
+}
+
+// QueryPendingTransfers returns the transfers sent from this database that
+// have been pending since before, oldest first.
+func (tdb *TransactionDB) QueryPendingTransfers(ctx context.Context, before int64) (transfers []Transfer, err error) {
+	ctx, span := startSpan(ctx, "QueryPendingTransfers")
+	defer endSpan(span, &err)
+
+	query := `SELECT id, username, kind, counterparty, amount, state, ref, time, trans FROM transfers
+				WHERE state = $1 AND kind = $2 AND time <= $3 ORDER BY id`
+	return tdb.queryTransfers(ctx, query, TransferPending, TransferSent, before)
+}
+
+func (tdb *TransactionDB) queryTransfers(ctx context.Context, query string, args ...interface{}) (transfers []Transfer, err error) {
+	rows, err := tdb.DB.QueryEx(ctx, query, nil, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t := Transfer{}
+		if err = rows.Scan(&t.ID, &t.Username, &t.Kind, &t.Counterparty, &t.Amount, &t.State, &t.Ref, &t.Time, &t.Trans); err != nil {
+			return
+		}
+		transfers = append(transfers, t)
+	}
+	err = rows.Err()
+	return
+}
+
+// QueryTrailingStops returns the user's trailing stops, or everyone's when
+// username is empty.
+func (tdb *TransactionDB) QueryTrailingStops(ctx context.Context, username string) (stops []TrailingStop, err error) {
+	ctx, span := startSpan(ctx, "QueryTrailingStops")
+	defer endSpan(span, &err)
+
+	query := "SELECT tid, username, symbol, trail_amount, trail_bps, high_water FROM trailing_stops WHERE $1 = '' OR username = $1 ORDER BY tid"
+	rows, err := tdb.DB.QueryEx(ctx, query, nil, username)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		ts := TrailingStop{}
+		if err = rows.Scan(&ts.TID, &ts.Username, &ts.Symbol, &ts.TrailAmount, &ts.TrailBasisPoints, &ts.HighWater); err != nil {
+			return
+		}
+		stops = append(stops, ts)
+	}
+	err = rows.Err()
+	return
+}
+
+func (tdb *TransactionDB) QueryReservation(ctx context.Context, rid int64) (res models.Reservation, err error) {
+	ctx, span := startSpan(ctx, "QueryReservation")
+	defer endSpan(span, &err)
+
 	query := "SELECT rid, username, symbol, shares, amount, type, time FROM reservations WHERE rid=$1"
-	err = tdb.DB.QueryRow(query, rid).Scan(&res.ID, &res.Username, &res.Symbol, &res.Shares, &res.Amount, &res.Order, &res.Time)
+	err = tdb.DB.QueryRowEx(ctx, query, nil, rid).Scan(&res.ID, &res.Username, &res.Symbol, &res.Shares, &res.Amount, &res.Order, &res.Time)
 	return
 }
 
-func (tdb *TransactionDB) QueryLastReservation(username string, resType models.OrderType) (res models.Reservation, err error) {
+// QueryReservationRate returns the currency and rate recorded for the
+// reservation by SetReservationRate, or ErrNoRows if none was.
+func (tdb *TransactionDB) QueryReservationRate(ctx context.Context, tx Tx, rid int64) (currency string, rate dbutils.Rate, err error) {
+	ctx, span := startSpan(ctx, "QueryReservationRate")
+	defer endSpan(span, &err)
+
+	query := "SELECT currency, fx_rate FROM reservations WHERE rid=$1 AND fx_rate IS NOT NULL"
+	err = tdb.q(tx).QueryRowEx(ctx, query, nil, rid).Scan(&currency, &rate)
+	return
+}
+
+func (tdb *TransactionDB) QueryLastReservation(ctx context.Context, username string, resType models.OrderType) (res models.Reservation, err error) {
+	ctx, span := startSpan(ctx, "QueryLastReservation")
+	defer endSpan(span, &err)
+
 	query := "SELECT rid, username, symbol, shares, amount, type, time FROM reservations WHERE username=$1 and type=$2 ORDER BY (time) DESC, rid DESC LIMIT 1"
-	err = tdb.DB.QueryRow(query, username, resType).Scan(&res.ID, &res.Username, &res.Symbol, &res.Shares, &res.Amount, &res.Order, &res.Time)
+	err = tdb.DB.QueryRowEx(ctx, query, nil, username, resType).Scan(&res.ID, &res.Username, &res.Symbol, &res.Shares, &res.Amount, &res.Order, &res.Time)
 	return
 }
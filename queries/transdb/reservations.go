@@ -0,0 +1,98 @@
+package transdb
+
+import (
+	"context"
+	"errors"
+
+	"common/models"
+)
+
+// Quantity is how much a buy or sell reservation is for: Amount cents'
+// worth of shares, a number of share units, or with All every share the
+// user has available to sell.
+type Quantity struct {
+	Amount int
+	Shares int
+	All    bool
+}
+
+var (
+	ErrNoShares = errors.New("order is for no shares")
+	ErrBuyAll   = errors.New("only sells can be for all shares")
+)
+
+// reserveOrder prices q at quote and holds it as a buy or sell reservation,
+// checking the user has the money or shares to cover it. The reservation's
+// Shares and Amount are what a commit will trade; a buy of an amount leaves
+// room in it for the commission, which is charged on top of Amount.
+func reserveOrder(ctx context.Context, s TransactionDataStore, now int64, username string, symbol string, side models.OrderType, q Quantity, quote int) (res models.Reservation, err error) {
+	scale := s.ShareScale()
+	res = models.Reservation{Username: username, Symbol: symbol, Order: side, Time: now}
+
+	switch {
+	case q.All && side == models.BUY:
+		return res, ErrBuyAll
+	case q.All:
+		if res.Shares, err = s.QueryUserAvailableShares(ctx, username, symbol); err != nil {
+			return
+		}
+	case q.Shares > 0:
+		res.Shares = q.Shares
+	case side == models.BUY:
+		res.Shares = s.Fees().Afford(scale, symbol, q.Amount, quote)
+	default:
+		res.Shares = scale.Buy(q.Amount, quote)
+	}
+	if res.Shares <= 0 {
+		return res, ErrNoShares
+	}
+
+	if side == models.BUY {
+		res.Amount = scale.Cost(res.Shares, quote)
+		var balance int
+		if balance, err = s.QueryUserAvailableBalance(ctx, username); err != nil {
+			return
+		}
+		if balance < res.Amount+s.Fees().Fee(symbol, side, res.Amount) {
+			return res, ErrInsufficientFunds
+		}
+	} else {
+		res.Amount = scale.Value(res.Shares, quote)
+		var shares int
+		if shares, err = s.QueryUserAvailableShares(ctx, username, symbol); err != nil {
+			return
+		}
+		if shares < res.Shares {
+			return res, ErrInsufficientShares
+		}
+	}
+
+	// the commit records the execution at the rate the quote was priced at
+	currency, rate, err := symbolRate(ctx, s, nil, symbol)
+	if err != nil {
+		return
+	}
+
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		return
+	}
+
+	res.ID, err = s.AddReservation(ctx, tx, res)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = s.SetReservationRate(ctx, tx, res.ID, currency, rate)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		tx.Rollback(ctx)
+	}
+	return
+}
@@ -0,0 +1,232 @@
+package transdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"common/models"
+	"transaction_service/applog"
+	"transaction_service/queries/utils"
+)
+
+// SourceSchedule marks executions of recurring buys.
+const SourceSchedule = "schedule"
+
+// Schedule run outcomes.
+const (
+	RunBought  = "bought"
+	RunSkipped = "skipped"
+)
+
+// Reasons a schedule run bought nothing.
+const (
+	SkipNoQuote      = "quote unavailable"
+	SkipBelowOne     = "amount buys no shares"
+	SkipInsufficient = "not enough money"
+	SkipInactive     = "account not active"
+)
+
+var ErrScheduleNotDue = errors.New("schedule is not due")
+
+// Schedule buys Amount cents of Symbol every time its cadence comes round,
+// until Ends.
+type Schedule struct {
+	ID       int64  `json:"sid"`
+	Username string `json:"username"`
+	Symbol   string `json:"symbol"`
+	Amount   int    `json:"amount"`
+	Cadence  string `json:"cadence"`
+	// Next is when the schedule runs next.
+	Next int64 `json:"next"`
+	// Ends is the last time the schedule may run, 0 for never.
+	Ends   int64  `json:"ends"`
+	Paused bool   `json:"paused"`
+	Time   int64  `json:"time"`
+	Trans  string `json:"trans"`
+}
+
+// Ended reports whether the schedule will never run again.
+func (sch Schedule) Ended() bool {
+	return sch.Next == 0 || (sch.Ends != 0 && sch.Next > sch.Ends)
+}
+
+// State returns active, paused or ended.
+func (sch Schedule) State() string {
+	switch {
+	case sch.Ended():
+		return "ended"
+	case sch.Paused:
+		return "paused"
+	}
+	return "active"
+}
+
+// ScheduleRun is one run of a schedule, which either bought shares or was
+// skipped for Reason.
+type ScheduleRun struct {
+	ID       int64  `json:"id"`
+	SID      int64  `json:"sid"`
+	Username string `json:"username"`
+	Symbol   string `json:"symbol"`
+	Status   string `json:"status"`
+	Reason   string `json:"reason,omitempty"`
+	Shares   int    `json:"shares"`
+	Price    int    `json:"price"`
+	Amount   int    `json:"amount"`
+	Time     int64  `json:"time"`
+	Trans    string `json:"trans"`
+}
+
+// NewSchedule checks a new schedule and sets its first run after now.
+func NewSchedule(username string, symbol string, amount int, cadence string, ends int64, now int64, trans string) (sch Schedule, err error) {
+	if amount <= 0 {
+		return sch, fmt.Errorf("invalid amount %d", amount)
+	}
+	c, err := ParseCadence(cadence)
+	if err != nil {
+		return
+	}
+	sch = Schedule{Username: username, Symbol: symbol, Amount: amount, Cadence: cadence, Ends: ends, Time: now, Trans: trans}
+	sch.Next = nextRun(c, now)
+	if sch.Ended() {
+		return sch, fmt.Errorf("schedule %q never runs before it ends", cadence)
+	}
+	return sch, nil
+}
+
+// nextRun returns the unix time of the cadence's first run after now, or 0
+// if there is none.
+func nextRun(c Cadence, now int64) int64 {
+	next := c.Next(time.Unix(now, 0))
+	if next.IsZero() {
+		return 0
+	}
+	return next.Unix()
+}
+
+// Resume unpauses sch, skipping any runs missed while it was paused.
+func (sch *Schedule) Resume(now int64) error {
+	c, err := ParseCadence(sch.Cadence)
+	if err != nil {
+		return err
+	}
+	sch.Paused = false
+	if sch.Next <= now {
+		sch.Next = nextRun(c, now)
+	}
+	return nil
+}
+
+// runSchedule buys the schedule's amount at the current quote, reserving
+// and committing in one transaction, or records why it couldn't. Either way
+// the schedule moves on to its next run after now, so runs missed while the
+// service was down are not made up.
+func runSchedule(ctx context.Context, s TransactionDataStore, method CostBasis, now int64, sch Schedule, quotes dbutils.QuoteProvider, trans string) (run ScheduleRun, err error) {
+	c, err := ParseCadence(sch.Cadence)
+	if err != nil {
+		return
+	}
+	run = ScheduleRun{SID: sch.ID, Username: sch.Username, Symbol: sch.Symbol, Status: RunSkipped, Time: now, Trans: trans}
+
+	var quote int
+	if err = canTrade(ctx, s, nil, sch.Username); inactive(err) {
+		run.Reason = SkipInactive
+	} else if err != nil {
+		return
+	} else if quote, err = quotes.QueryQuotePrice(ctx, sch.Username, sch.Symbol, trans); err != nil {
+		applog.FromContext(ctx).Warn("Failed to get quote for schedule", "sid", sch.ID, "symbol", sch.Symbol, "error", err)
+		run.Reason = SkipNoQuote
+	} else {
+		run.Price = quote
+		run.Shares = s.Fees().Afford(s.ShareScale(), sch.Symbol, sch.Amount, quote)
+		run.Amount = s.ShareScale().Cost(run.Shares, quote)
+		if run.Shares == 0 {
+			run.Reason = SkipBelowOne
+		}
+	}
+
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		return
+	}
+
+	// another replica may have run it since it was read
+	sch, err = s.QuerySchedule(ctx, tx, sch.ID)
+	if err == nil && (sch.Paused || sch.Ended() || sch.Next > now) {
+		err = ErrScheduleNotDue
+	}
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	// the balance is checked under the user's row lock, so a buy it no
+	// longer covers is skipped rather than failing the whole run
+	if run.Reason == "" {
+		var acct Account
+		if acct, err = s.LockUser(ctx, tx, sch.Username); err != nil {
+			tx.Rollback(ctx)
+			return
+		}
+		if acct.Money < run.Amount+s.Fees().Fee(sch.Symbol, models.BUY, run.Amount) {
+			run.Reason = SkipInsufficient
+		}
+	}
+	if run.Reason != "" {
+		run.Shares = 0
+		run.Amount = 0
+	}
+
+	if run.Reason == "" {
+		run.Status = RunBought
+		res := models.Reservation{Username: sch.Username, Symbol: sch.Symbol, Order: models.BUY, Shares: run.Shares, Amount: run.Amount, Time: now}
+		if res.ID, err = s.AddReservation(ctx, tx, res); err != nil {
+			tx.Rollback(ctx)
+			return
+		}
+		if err = commitReservation(ctx, s, tx, method, now, res, SourceSchedule, trans); err != nil {
+			tx.Rollback(ctx)
+			return
+		}
+	}
+
+	run.ID, err = s.AddScheduleRun(ctx, tx, run)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	sch.Next = nextRun(c, now)
+	err = s.UpdateSchedule(ctx, tx, sch)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+	return run, nil
+}
+
+// runSchedules runs every due schedule in schedules, returning the runs
+// made.
+func runSchedules(ctx context.Context, s TransactionDataStore, method CostBasis, now int64, schedules []Schedule, quotes dbutils.QuoteProvider, trans string) (runs []ScheduleRun) {
+	quotes = BaseQuotes(s, quotes)
+	for _, sch := range schedules {
+		run, err := runSchedule(ctx, s, method, now, sch, quotes, trans)
+		if err == ErrScheduleNotDue {
+			continue
+		}
+		if err != nil {
+			applog.FromContext(ctx).Warn("Failed to run schedule", "sid", sch.ID, "error", err)
+			continue
+		}
+		runs = append(runs, run)
+	}
+	return
+}
@@ -0,0 +1,254 @@
+package transdb
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"transaction_service/queries/utils"
+)
+
+// schema creates the tables added after the original users, stocks,
+// reservations and triggers tables. Every statement must be safe to run
+// again.
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS lots (
+		lid SERIAL PRIMARY KEY,
+		username VARCHAR(64) NOT NULL,
+		symbol VARCHAR(8) NOT NULL,
+		shares INTEGER NOT NULL,
+		cost BIGINT NOT NULL,
+		time BIGINT NOT NULL,
+		trans VARCHAR(32) NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS lots_username_symbol ON lots (username, symbol, lid)`,
+	`CREATE TABLE IF NOT EXISTS realizations (
+		id SERIAL PRIMARY KEY,
+		username VARCHAR(64) NOT NULL,
+		symbol VARCHAR(8) NOT NULL,
+		shares INTEGER NOT NULL,
+		proceeds BIGINT NOT NULL,
+		cost BIGINT NOT NULL,
+		time BIGINT NOT NULL,
+		trans VARCHAR(32) NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS realizations_username ON realizations (username, id)`,
+	`CREATE TABLE IF NOT EXISTS executions (
+		eid SERIAL PRIMARY KEY,
+		username VARCHAR(64) NOT NULL,
+		symbol VARCHAR(8) NOT NULL,
+		side VARCHAR(8) NOT NULL,
+		shares INTEGER NOT NULL,
+		price BIGINT NOT NULL,
+		amount BIGINT NOT NULL,
+		fees BIGINT NOT NULL DEFAULT 0,
+		source VARCHAR(16) NOT NULL,
+		trans VARCHAR(32) NOT NULL,
+		time BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS executions_username_time ON executions (username, time DESC, eid DESC)`,
+	`CREATE TABLE IF NOT EXISTS orders (
+		oid SERIAL PRIMARY KEY,
+		username VARCHAR(64) NOT NULL,
+		symbol VARCHAR(8) NOT NULL,
+		kind VARCHAR(16) NOT NULL,
+		shares INTEGER NOT NULL,
+		limit_price BIGINT NOT NULL,
+		stop_price BIGINT NOT NULL,
+		tif VARCHAR(8) NOT NULL,
+		held BIGINT NOT NULL,
+		stopped BOOLEAN NOT NULL DEFAULT FALSE,
+		status VARCHAR(16) NOT NULL,
+		fill_price BIGINT NOT NULL DEFAULT 0,
+		time BIGINT NOT NULL,
+		expires BIGINT NOT NULL DEFAULT 0,
+		trans VARCHAR(32) NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS orders_username ON orders (username, oid)`,
+	`CREATE INDEX IF NOT EXISTS orders_open ON orders (oid) WHERE status = 'open'`,
+	`ALTER TABLE orders ADD COLUMN IF NOT EXISTS gid BIGINT NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS orders_gid ON orders (gid, oid) WHERE gid != 0`,
+	`CREATE TABLE IF NOT EXISTS order_groups (
+		gid SERIAL PRIMARY KEY,
+		username VARCHAR(64) NOT NULL,
+		kind VARCHAR(16) NOT NULL,
+		time BIGINT NOT NULL,
+		trans VARCHAR(32) NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS order_groups_username ON order_groups (username, gid)`,
+	`CREATE TABLE IF NOT EXISTS schedules (
+		sid SERIAL PRIMARY KEY,
+		username VARCHAR(64) NOT NULL,
+		symbol VARCHAR(8) NOT NULL,
+		amount BIGINT NOT NULL,
+		cadence VARCHAR(64) NOT NULL,
+		next BIGINT NOT NULL,
+		ends BIGINT NOT NULL DEFAULT 0,
+		paused BOOLEAN NOT NULL DEFAULT FALSE,
+		time BIGINT NOT NULL,
+		trans VARCHAR(32) NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS schedules_username ON schedules (username, sid)`,
+	`CREATE INDEX IF NOT EXISTS schedules_next ON schedules (next) WHERE NOT paused`,
+	`CREATE TABLE IF NOT EXISTS schedule_runs (
+		id SERIAL PRIMARY KEY,
+		sid BIGINT NOT NULL,
+		username VARCHAR(64) NOT NULL,
+		symbol VARCHAR(8) NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		reason VARCHAR(64) NOT NULL DEFAULT '',
+		shares INTEGER NOT NULL,
+		price BIGINT NOT NULL,
+		amount BIGINT NOT NULL,
+		time BIGINT NOT NULL,
+		trans VARCHAR(32) NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS schedule_runs_username ON schedule_runs (username, sid, id)`,
+	`CREATE TABLE IF NOT EXISTS transfers (
+		id SERIAL PRIMARY KEY,
+		username VARCHAR(64) NOT NULL,
+		kind VARCHAR(16) NOT NULL,
+		counterparty VARCHAR(64) NOT NULL DEFAULT '',
+		amount BIGINT NOT NULL,
+		state VARCHAR(16) NOT NULL,
+		ref VARCHAR(32) NOT NULL,
+		time BIGINT NOT NULL,
+		trans VARCHAR(32) NOT NULL
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS transfers_ref ON transfers (ref, kind)`,
+	`CREATE INDEX IF NOT EXISTS transfers_username ON transfers (username, id)`,
+	`CREATE INDEX IF NOT EXISTS transfers_pending ON transfers (time) WHERE state = 'pending'`,
+	`CREATE TABLE IF NOT EXISTS trailing_stops (
+		tid BIGINT PRIMARY KEY,
+		username VARCHAR(64) NOT NULL,
+		symbol VARCHAR(8) NOT NULL,
+		trail_amount BIGINT NOT NULL DEFAULT 0,
+		trail_bps INTEGER NOT NULL DEFAULT 0,
+		high_water BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS trailing_stops_username ON trailing_stops (username)`,
+	`CREATE TABLE IF NOT EXISTS settings (
+		name VARCHAR(32) PRIMARY KEY,
+		value VARCHAR(64) NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS symbols (
+		symbol VARCHAR(8) PRIMARY KEY,
+		currency VARCHAR(8) NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS balances (
+		username VARCHAR(64) NOT NULL,
+		currency VARCHAR(8) NOT NULL,
+		amount BIGINT NOT NULL,
+		PRIMARY KEY (username, currency)
+	)`,
+	`ALTER TABLE executions ADD COLUMN IF NOT EXISTS currency VARCHAR(8) NOT NULL DEFAULT 'USD'`,
+	`ALTER TABLE executions ADD COLUMN IF NOT EXISTS fx_rate BIGINT NOT NULL DEFAULT 1000000`,
+	`ALTER TABLE executions ADD COLUMN IF NOT EXISTS local_price BIGINT`,
+	`UPDATE executions SET local_price = price WHERE local_price IS NULL`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'active'`,
+	`ALTER TABLE reservations ADD COLUMN IF NOT EXISTS currency VARCHAR(8)`,
+	`ALTER TABLE reservations ADD COLUMN IF NOT EXISTS fx_rate BIGINT`,
+}
+
+// Migrate creates any missing tables.
+func (tdb *TransactionDB) Migrate(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "Migrate")
+	defer endSpan(span, &err)
+
+	for _, stmt := range schema {
+		if _, err = tdb.DB.ExecEx(ctx, stmt, nil); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// shareConversions widen every column counting shares and multiply it by
+// $1. Sell triggers hold shares in their amount and sell orders in held.
+var shareConversions = []string{
+	`ALTER TABLE stocks ALTER COLUMN shares TYPE BIGINT`,
+	`ALTER TABLE reservations ALTER COLUMN shares TYPE BIGINT`,
+	`ALTER TABLE triggers ALTER COLUMN amount TYPE BIGINT`,
+	`ALTER TABLE lots ALTER COLUMN shares TYPE BIGINT`,
+	`ALTER TABLE realizations ALTER COLUMN shares TYPE BIGINT`,
+	`ALTER TABLE executions ALTER COLUMN shares TYPE BIGINT`,
+	`ALTER TABLE orders ALTER COLUMN shares TYPE BIGINT`,
+	`ALTER TABLE schedule_runs ALTER COLUMN shares TYPE BIGINT`,
+	`UPDATE stocks SET shares = shares * $1`,
+	`UPDATE reservations SET shares = shares * $1`,
+	`UPDATE triggers SET amount = amount * $1 WHERE type = 'sell'`,
+	`UPDATE lots SET shares = shares * $1`,
+	`UPDATE realizations SET shares = shares * $1`,
+	`UPDATE executions SET shares = shares * $1`,
+	`UPDATE orders SET shares = shares * $1, held = CASE WHEN kind = 'limit_buy' THEN held ELSE held * $1 END`,
+	`UPDATE schedule_runs SET shares = shares * $1`,
+}
+
+func (tdb *TransactionDB) ShareScale() ShareScale {
+	return tdb.Scale
+}
+
+func (tdb *TransactionDB) Fees() FeeSchedule {
+	return tdb.FeeSchedule
+}
+
+func (tdb *TransactionDB) FXRates() dbutils.RateProvider {
+	return tdb.Rates
+}
+
+// SetShareScale stores shares at scale from now on. The first time a
+// database is switched to a finer scale its rows are converted, in one
+// transaction so other replicas wait for it. A database can't go back to
+// a coarser scale, as that would drop fractions of shares.
+func (tdb *TransactionDB) SetShareScale(ctx context.Context, scale ShareScale) (err error) {
+	ctx, span := startSpan(ctx, "SetShareScale")
+	defer endSpan(span, &err)
+
+	tx, err := tdb.DB.BeginEx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecEx(ctx, "INSERT INTO settings(name, value) VALUES('share_units', '1') ON CONFLICT DO NOTHING", nil)
+	if err != nil {
+		return
+	}
+	var value string
+	err = tx.QueryRowEx(ctx, "SELECT value FROM settings WHERE name = 'share_units' FOR UPDATE", nil).Scan(&value)
+	if err != nil {
+		return
+	}
+	stored, err := strconv.Atoi(value)
+	if err != nil || stored <= 0 {
+		return fmt.Errorf("invalid share_units setting %q", value)
+	}
+
+	switch {
+	case stored == scale.Units():
+	case stored > scale.Units() || scale.Units()%stored != 0:
+		return fmt.Errorf("database stores 1/%d shares, which can't be converted to 1/%d", stored, scale.Units())
+	default:
+		factor := scale.Units() / stored
+		for _, stmt := range shareConversions {
+			var args []interface{}
+			if strings.Contains(stmt, "$1") {
+				args = append(args, factor)
+			}
+			if _, err = tx.ExecEx(ctx, stmt, nil, args...); err != nil {
+				return
+			}
+		}
+		_, err = tx.ExecEx(ctx, "UPDATE settings SET value = $1 WHERE name = 'share_units'", nil, strconv.Itoa(scale.Units()))
+		if err != nil {
+			return
+		}
+	}
+
+	if err = tx.CommitEx(ctx); err != nil {
+		return
+	}
+	tdb.Scale = scale
+	return
+}
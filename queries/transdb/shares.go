@@ -0,0 +1,107 @@
+package transdb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ShareScale is how many stored units make up one share. Every share
+// quantity in the store, from stocks and reservations to sell trigger
+// amounts, lots and executions, is counted in these units, so share
+// arithmetic stays exact integer arithmetic.
+type ShareScale int
+
+const (
+	// WholeShares stores whole shares, as the original tables did.
+	WholeShares ShareScale = 1
+	// MicroShares stores millionths of a share.
+	MicroShares ShareScale = 1000000
+)
+
+// Units returns how many units make up one share.
+func (sc ShareScale) Units() int {
+	if sc <= 0 {
+		return int(WholeShares)
+	}
+	return int(sc)
+}
+
+// Fractional reports whether shares can be split.
+func (sc ShareScale) Fractional() bool {
+	return sc.Units() > 1
+}
+
+// Value returns what units shares cost at price cents a share, rounded
+// down to the cent.
+func (sc ShareScale) Value(units int, price int) int {
+	return units * price / sc.Units()
+}
+
+// Cost returns what buying units shares at price cents a share costs,
+// rounded up to the cent. It is never more than the amount Buy was given.
+func (sc ShareScale) Cost(units int, price int) int {
+	return (units*price + sc.Units() - 1) / sc.Units()
+}
+
+// Buy returns the most units amount cents buys at price cents a share.
+func (sc ShareScale) Buy(amount int, price int) int {
+	if price <= 0 {
+		return 0
+	}
+	return amount * sc.Units() / price
+}
+
+// Price returns the price per share of units bought for amount cents.
+func (sc ShareScale) Price(amount int, units int) int {
+	if units == 0 {
+		return 0
+	}
+	return amount * sc.Units() / units
+}
+
+// Format returns units as a decimal number of shares.
+func (sc ShareScale) Format(units int) string {
+	if !sc.Fractional() {
+		return strconv.Itoa(units)
+	}
+	sign := ""
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+	digits := len(strconv.Itoa(sc.Units())) - 1
+	whole, frac := units/sc.Units(), units%sc.Units()
+	if frac == 0 {
+		return sign + strconv.Itoa(whole)
+	}
+	return sign + strconv.Itoa(whole) + "." + strings.TrimRight(fmt.Sprintf("%0*d", digits, frac), "0")
+}
+
+// Parse reads a decimal number of shares as units. It rejects fractions
+// finer than one unit rather than rounding them.
+func (sc ShareScale) Parse(str string) (units int, err error) {
+	whole, frac := str, ""
+	if i := strings.IndexByte(str, '.'); i >= 0 {
+		whole, frac = str[:i], str[i+1:]
+	}
+	digits := len(strconv.Itoa(sc.Units())) - 1
+	if len(frac) > digits || strings.ContainsAny(whole+frac, "+-") || (whole == "" && frac == "") {
+		return 0, fmt.Errorf("invalid number of shares %s", str)
+	}
+
+	n := 0
+	if whole != "" {
+		if n, err = strconv.Atoi(whole); err != nil {
+			return 0, fmt.Errorf("invalid number of shares %s", str)
+		}
+	}
+	units = n * sc.Units()
+	if frac != "" {
+		if n, err = strconv.Atoi(frac + strings.Repeat("0", digits-len(frac))); err != nil {
+			return 0, fmt.Errorf("invalid number of shares %s", str)
+		}
+		units += n
+	}
+	return units, nil
+}
@@ -0,0 +1,64 @@
+package transdb
+
+import "testing"
+
+func TestShareScaleParse(t *testing.T) {
+	tests := []struct {
+		scale ShareScale
+		str   string
+		units int
+		valid bool
+	}{
+		{WholeShares, "3", 3, true},
+		{WholeShares, "1.5", 0, false},
+		{MicroShares, "3", 3000000, true},
+		{MicroShares, "0.5", 500000, true},
+		{MicroShares, ".000001", 1, true},
+		{MicroShares, "1.0000001", 0, false},
+		{MicroShares, "-1", 0, false},
+		{MicroShares, ".", 0, false},
+		{MicroShares, "1e3", 0, false},
+	}
+	for _, tt := range tests {
+		units, err := tt.scale.Parse(tt.str)
+		if (err == nil) != tt.valid || units != tt.units {
+			t.Errorf("%d.Parse(%q) = %d, %v", tt.scale, tt.str, units, err)
+		}
+	}
+}
+
+func TestShareScaleFormat(t *testing.T) {
+	tests := []struct {
+		scale ShareScale
+		units int
+		want  string
+	}{
+		{WholeShares, 3, "3"},
+		{MicroShares, 3000000, "3"},
+		{MicroShares, 1500000, "1.5"},
+		{MicroShares, 1, "0.000001"},
+		{MicroShares, -250000, "-0.25"},
+	}
+	for _, tt := range tests {
+		if got := tt.scale.Format(tt.units); got != tt.want {
+			t.Errorf("%d.Format(%d) = %q, want %q", tt.scale, tt.units, got, tt.want)
+		}
+	}
+}
+
+func TestShareScaleValue(t *testing.T) {
+	// $10 buys a third of a $30 share, worth 999 cents after rounding down
+	units := MicroShares.Buy(1000, 3000)
+	if units != 333333 {
+		t.Errorf("Buy = %d", units)
+	}
+	if v := MicroShares.Value(units, 3000); v != 999 {
+		t.Errorf("Value = %d", v)
+	}
+	if p := MicroShares.Price(999, units); p != 2997 {
+		t.Errorf("Price = %d", p)
+	}
+	if WholeShares.Buy(1000, 3000) != 0 || WholeShares.Value(2, 3000) != 6000 {
+		t.Error("whole shares don't split")
+	}
+}
@@ -0,0 +1,1188 @@
+package transdb
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"common/logging"
+	"common/models"
+	"transaction_service/clock"
+	"transaction_service/queries/utils"
+
+	"github.com/jackc/pgx"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) LogCommand(command logging.Command, vars map[string]string)                   {}
+func (nopLogger) LogErrorEvent(command logging.Command, vars map[string]string, msg string)    {}
+func (nopLogger) LogTransaction(action string, username string, money int, trans string)       {}
+func (nopLogger) LogQuoteServ(quote *models.StockQuote, trans string)                          {}
+func (nopLogger) LogSystemEvent(command logging.Command, username, stock, funds, trans string) {}
+func (nopLogger) SendDumpLog(filename string, username string)                                 {}
+
+type fixedQuotes map[string]int
+
+func (q fixedQuotes) QueryQuotePrice(ctx context.Context, username string, symbol string, trans string) (int, error) {
+	quote, ok := q[symbol]
+	if !ok {
+		return 0, fmt.Errorf("no quote for %s", symbol)
+	}
+	return quote, nil
+}
+
+// hookStore calls hook before beginning each transaction.
+type hookStore struct {
+	TransactionDataStore
+	hook func()
+}
+
+func (s hookStore) Begin(ctx context.Context) (Tx, error) {
+	s.hook()
+	return s.TransactionDataStore.Begin(ctx)
+}
+
+func TestMemoryDB(t *testing.T) {
+	testStore(t, func(t *testing.T) TransactionDataStore {
+		return NewMemoryDB(nopLogger{}, clock.Real)
+	})
+}
+
+// testTransactionDB connects to the Postgres database named by
+// TRANSDB_TEST_HOST, TRANSDB_TEST_PORT and the usual PG* variables, skipping
+// the test when it isn't set.
+func testTransactionDB(tb testing.TB) *TransactionDB {
+	host := os.Getenv("TRANSDB_TEST_HOST")
+	if host == "" {
+		tb.Skip("TRANSDB_TEST_HOST not set")
+	}
+	port, _ := strconv.ParseUint(os.Getenv("TRANSDB_TEST_PORT"), 10, 16)
+	if port == 0 {
+		port = 5432
+	}
+
+	pool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
+		ConnConfig: pgx.ConnConfig{
+			Host:     host,
+			Port:     uint16(port),
+			Database: os.Getenv("TRANS_DB"),
+			User:     os.Getenv("PGUSER"),
+			Password: os.Getenv("PGPASSWORD"),
+		},
+		MaxConnections: 10,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(pool.Close)
+
+	tdb := &TransactionDB{DB: pool, CostBasis: FIFO, Scale: WholeShares, logger: nopLogger{}, log: slog.Default(), clock: clock.Real}
+	if err := tdb.Migrate(context.Background()); err != nil {
+		tb.Fatal(err)
+	}
+	return tdb
+}
+
+func TestTransactionDB(t *testing.T) {
+	tdb := testTransactionDB(t)
+	testStore(t, func(t *testing.T) TransactionDataStore {
+		return tdb
+	})
+}
+
+// setFees charges fs on s for the rest of the test.
+func setFees(t *testing.T, s TransactionDataStore, fs FeeSchedule) {
+	switch db := s.(type) {
+	case *MemoryDB:
+		old := db.FeeSchedule
+		db.FeeSchedule = fs
+		t.Cleanup(func() { db.FeeSchedule = old })
+	case *TransactionDB:
+		old := db.FeeSchedule
+		db.FeeSchedule = fs
+		t.Cleanup(func() { db.FeeSchedule = old })
+	}
+}
+
+func setRates(t *testing.T, s TransactionDataStore, rates dbutils.RateProvider) {
+	switch db := s.(type) {
+	case *MemoryDB:
+		old := db.Rates
+		db.Rates = rates
+		t.Cleanup(func() { db.Rates = old })
+	case *TransactionDB:
+		old := db.Rates
+		db.Rates = rates
+		t.Cleanup(func() { db.Rates = old })
+	}
+}
+
+// uniqueUser returns a username no earlier run of the suite has used, so the
+// Postgres backend doesn't need to be emptied between tests.
+func uniqueUser(tb testing.TB) string {
+	return fmt.Sprintf("u%d", rand.Int63())
+}
+
+func addUser(tb testing.TB, ctx context.Context, s TransactionDataStore, money int) string {
+	username := uniqueUser(tb)
+	if err := s.InsertUser(ctx, models.User{Username: username, Money: money}); err != nil {
+		tb.Fatalf("InsertUser: %s", err)
+	}
+	return username
+}
+
+func assertBalance(t *testing.T, ctx context.Context, s TransactionDataStore, username string, want int) {
+	t.Helper()
+	balance, err := s.QueryUserAvailableBalance(ctx, username)
+	if err != nil {
+		t.Fatalf("QueryUserAvailableBalance: %s", err)
+	}
+	if balance != want {
+		t.Errorf("balance = %d, want %d", balance, want)
+	}
+}
+
+func assertShares(t *testing.T, ctx context.Context, s TransactionDataStore, username string, symbol string, want int) {
+	t.Helper()
+	shares, err := s.QueryUserAvailableShares(ctx, username, symbol)
+	if err != nil {
+		t.Fatalf("QueryUserAvailableShares: %s", err)
+	}
+	if shares != want {
+		t.Errorf("shares = %d, want %d", shares, want)
+	}
+}
+
+// testStore is the conformance suite every TransactionDataStore must pass.
+func testStore(t *testing.T, newStore func(t *testing.T) TransactionDataStore) {
+	ctx := context.Background()
+
+	t.Run("Users", func(t *testing.T) {
+		s := newStore(t)
+		username := addUser(t, ctx, s, 1000)
+
+		user, err := s.QueryUser(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Username != username || user.Money != 1000 {
+			t.Errorf("QueryUser = %+v", user)
+		}
+
+		user.Money = 2500
+		if err := s.UpdateUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		assertBalance(t, ctx, s, username, 2500)
+
+		if _, err := s.QueryUser(ctx, uniqueUser(t)); err != ErrNoRows {
+			t.Errorf("QueryUser of missing user err = %v, want ErrNoRows", err)
+		}
+		if _, err := s.QueryUserAvailableBalance(ctx, uniqueUser(t)); err != ErrNoRows {
+			t.Errorf("QueryUserAvailableBalance of missing user err = %v, want ErrNoRows", err)
+		}
+	})
+
+	t.Run("Reservations", func(t *testing.T) {
+		s := newStore(t)
+		username := addUser(t, ctx, s, 1000)
+
+		first, err := s.AddReservation(ctx, nil, models.Reservation{Username: username, Symbol: "ABC", Order: models.BUY, Shares: 1, Amount: 100, Time: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := s.AddReservation(ctx, nil, models.Reservation{Username: username, Symbol: "DEF", Order: models.BUY, Shares: 2, Amount: 200, Time: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		all, err := s.QueryAllUserReservations(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 2 || all[0].ID != first || all[1].ID != second {
+			t.Errorf("QueryAllUserReservations = %+v, want %d and %d", all, first, second)
+		}
+
+		res, err := s.QueryReservation(ctx, first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Symbol != "ABC" || res.Shares != 1 || res.Amount != 100 {
+			t.Errorf("QueryReservation = %+v", res)
+		}
+
+		last, err := s.QueryLastReservation(ctx, username, models.BUY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last.ID != second {
+			t.Errorf("QueryLastReservation = %d, want %d", last.ID, second)
+		}
+
+		removed, err := s.RemoveLastOrderTypeReservation(ctx, username, models.BUY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed.ID != second {
+			t.Errorf("RemoveLastOrderTypeReservation = %d, want %d", removed.ID, second)
+		}
+
+		if err := s.RemoveReservation(ctx, nil, first); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.QueryLastReservation(ctx, username, models.BUY); err != ErrNoRows {
+			t.Errorf("QueryLastReservation after removal err = %v, want ErrNoRows", err)
+		}
+		if _, err := s.RemoveLastOrderTypeReservation(ctx, username, models.SELL); err != ErrNoRows {
+			t.Errorf("RemoveLastOrderTypeReservation with none err = %v, want ErrNoRows", err)
+		}
+	})
+
+	t.Run("CommitBuySell", func(t *testing.T) {
+		s := newStore(t)
+		username := addUser(t, ctx, s, 1000)
+
+		buy := models.Reservation{Username: username, Symbol: "ABC", Order: models.BUY, Shares: 3, Amount: 300, Time: 1}
+		buy.ID, _ = s.AddReservation(ctx, nil, buy)
+		if err := s.CommitBuySellTransaction(ctx, buy, "1"); err != nil {
+			t.Fatal(err)
+		}
+		assertBalance(t, ctx, s, username, 700)
+		assertShares(t, ctx, s, username, "ABC", 3)
+		if _, err := s.QueryReservation(ctx, buy.ID); err != ErrNoRows {
+			t.Errorf("reservation still exists after commit, err = %v", err)
+		}
+
+		sell := models.Reservation{Username: username, Symbol: "ABC", Order: models.SELL, Shares: 2, Amount: 240, Time: 2}
+		sell.ID, _ = s.AddReservation(ctx, nil, sell)
+		if err := s.CommitBuySellTransaction(ctx, sell, "2"); err != nil {
+			t.Fatal(err)
+		}
+		assertBalance(t, ctx, s, username, 940)
+		assertShares(t, ctx, s, username, "ABC", 1)
+
+		lots, err := s.QueryUserLots(ctx, nil, username, "ABC")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lots) != 1 || lots[0].Shares != 1 || lots[0].Cost != 100 || lots[0].Trans != "1" {
+			t.Errorf("lots after sale = %+v, want 1 share costing 100", lots)
+		}
+		realizations, err := s.QueryUserRealizations(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(realizations) != 1 || realizations[0].Shares != 2 || realizations[0].Cost != 200 || realizations[0].Gain() != 40 {
+			t.Errorf("realizations = %+v, want 2 shares gaining 40", realizations)
+		}
+
+		executions, _, err := s.QueryUserExecutions(ctx, username, ExecutionFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(executions) != 2 || executions[0].Side != models.SELL || executions[0].Price != 120 || executions[0].Source != SourceManual || executions[1].Amount != 300 {
+			t.Errorf("executions = %+v", executions)
+		}
+	})
+
+	t.Run("ReserveOrder", func(t *testing.T) {
+		s := newStore(t)
+		username := addUser(t, ctx, s, 1000)
+
+		buy, err := s.ReserveOrder(ctx, username, "ABC", models.BUY, Quantity{Amount: 250}, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buy.ID == 0 || buy.Shares != 2 || buy.Amount != 200 {
+			t.Errorf("buying 250 cents at 100 = %+v, want 2 shares for 200", buy)
+		}
+		byShares, err := s.ReserveOrder(ctx, username, "ABC", models.BUY, Quantity{Shares: 4}, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if byShares.Shares != 4 || byShares.Amount != 400 {
+			t.Errorf("buying 4 shares at 100 = %+v", byShares)
+		}
+		if _, err := s.ReserveOrder(ctx, username, "ABC", models.BUY, Quantity{Shares: 11}, 100); err != ErrInsufficientFunds {
+			t.Errorf("buying 11 shares with 1000 err = %v, want ErrInsufficientFunds", err)
+		}
+		if _, err := s.ReserveOrder(ctx, username, "ABC", models.BUY, Quantity{Amount: 50}, 100); err != ErrNoShares {
+			t.Errorf("buying 50 cents at 100 err = %v, want ErrNoShares", err)
+		}
+		if _, err := s.ReserveOrder(ctx, username, "ABC", models.BUY, Quantity{All: true}, 100); err != ErrBuyAll {
+			t.Errorf("buying all err = %v, want ErrBuyAll", err)
+		}
+
+		if err := s.UpdateUserStock(ctx, nil, username, "ABC", 5, models.BUY); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.ReserveOrder(ctx, username, "ABC", models.SELL, Quantity{Shares: 6}, 120); err != ErrInsufficientShares {
+			t.Errorf("selling 6 of 5 shares err = %v, want ErrInsufficientShares", err)
+		}
+		all, err := s.ReserveOrder(ctx, username, "ABC", models.SELL, Quantity{All: true}, 120)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if all.Shares != 5 || all.Amount != 600 || all.Order != models.SELL {
+			t.Errorf("selling all at 120 = %+v, want 5 shares for 600", all)
+		}
+		if _, err := s.ReserveOrder(ctx, username, "DEF", models.SELL, Quantity{All: true}, 40); err != ErrNoShares {
+			t.Errorf("selling all of none err = %v, want ErrNoShares", err)
+		}
+	})
+
+	t.Run("Fees", func(t *testing.T) {
+		s := newStore(t)
+		setFees(t, s, FeeSchedule{Default: FeeRule{Flat: 5}, Symbols: map[string]FeeRule{"DEF": {Rate: 100, Min: 2}}})
+		username := addUser(t, ctx, s, 1000)
+
+		// the fee comes out of the amount
+		buy, err := s.ReserveOrder(ctx, username, "ABC", models.BUY, Quantity{Amount: 305}, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buy.Shares != 3 || buy.Amount != 300 {
+			t.Errorf("buying 305 cents at 100 = %+v, want 3 shares for 300", buy)
+		}
+		if err := s.CommitBuySellTransaction(ctx, buy, "1"); err != nil {
+			t.Fatal(err)
+		}
+		assertBalance(t, ctx, s, username, 695)
+
+		sell, err := s.ReserveOrder(ctx, username, "ABC", models.SELL, Quantity{Shares: 1}, 120)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CommitBuySellTransaction(ctx, sell, "2"); err != nil {
+			t.Fatal(err)
+		}
+		assertBalance(t, ctx, s, username, 810)
+
+		lots, err := s.QueryUserLots(ctx, nil, username, "ABC")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lots) != 1 || lots[0].Shares != 2 || lots[0].Cost != 204 {
+			t.Errorf("lots = %+v, want 2 shares costing 204 with the fee", lots)
+		}
+
+		// 2 DEF for 80 and the minimum fee of 2, with 18 of the 100 returned
+		tid, err := s.CommitSetOrderTransaction(ctx, username, "DEF", models.BUY, 100, "3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		trig, err := s.QueryStockTrigger(ctx, tid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trig.TriggerPrice = 50
+		trig.Executable = true
+		if err := s.UpdateTrigger(ctx, nil, trig); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.QueryAndExecuteCurrentTriggers(ctx, fixedQuotes{"DEF": 40}, "4"); err != nil {
+			t.Fatal(err)
+		}
+		assertBalance(t, ctx, s, username, 728)
+		assertShares(t, ctx, s, username, "DEF", 2)
+
+		if _, err := s.ReserveOrder(ctx, username, "ABC", models.BUY, Quantity{Shares: 7}, 104); err != ErrInsufficientFunds {
+			t.Errorf("buying 728 worth with 728 and a fee err = %v, want ErrInsufficientFunds", err)
+		}
+
+		fees, err := s.QueryUserFees(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fees != 12 {
+			t.Errorf("QueryUserFees = %d, want 12", fees)
+		}
+		executions, _, err := s.QueryUserExecutions(ctx, username, ExecutionFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(executions) != 3 || executions[0].Fees != 2 || executions[0].Amount != 80 || executions[2].Fees != 5 || executions[2].Amount != 300 {
+			t.Errorf("executions = %+v", executions)
+		}
+	})
+
+	t.Run("Currencies", func(t *testing.T) {
+		s := newStore(t)
+		username := addUser(t, ctx, s, 1000)
+
+		if currency, err := s.QuerySymbolCurrency(ctx, nil, "EUA"); err != nil || currency != BaseCurrency {
+			t.Errorf("QuerySymbolCurrency of an unset symbol = %q, %v, want %s", currency, err, BaseCurrency)
+		}
+		if err := s.SetSymbolCurrency(ctx, "EUA", "EUR"); err != nil {
+			t.Fatal(err)
+		}
+		if currency, err := s.QuerySymbolCurrency(ctx, nil, "EUA"); err != nil || currency != "EUR" {
+			t.Errorf("QuerySymbolCurrency = %q, %v, want EUR", currency, err)
+		}
+		if _, err := s.ExchangeTransaction(ctx, username, BaseCurrency, "EUR", 100, "1"); err != ErrNoRates {
+			t.Errorf("exchanging without rates err = %v, want ErrNoRates", err)
+		}
+		setRates(t, s, dbutils.StaticRates{"USD": dbutils.RateOne, "EUR": 1080000})
+
+		// quoted at 50 EUR, 54 USD: 3 shares for 162 with 38 of the 200 returned
+		tid, err := s.CommitSetOrderTransaction(ctx, username, "EUA", models.BUY, 200, "2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		trig, err := s.QueryStockTrigger(ctx, tid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trig.TriggerPrice = 60
+		trig.Executable = true
+		if err := s.UpdateTrigger(ctx, nil, trig); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.QueryAndExecuteCurrentTriggers(ctx, fixedQuotes{"EUA": 50}, "3"); err != nil {
+			t.Fatal(err)
+		}
+		assertBalance(t, ctx, s, username, 838)
+		assertShares(t, ctx, s, username, "EUA", 3)
+
+		executions, _, err := s.QueryUserExecutions(ctx, username, ExecutionFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(executions) != 1 || executions[0].Price != 54 || executions[0].Currency != "EUR" || executions[0].FXRate != 1080000 || executions[0].LocalPrice != 50 {
+			t.Errorf("executions = %+v, want 3 at 54 USD, 50 EUR", executions)
+		}
+
+		ex, err := s.ExchangeTransaction(ctx, username, BaseCurrency, "EUR", 108, "4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ex.Received != 99 || ex.Rate != 925925 {
+			t.Errorf("exchanging 108 USD = %+v, want 99 EUR", ex)
+		}
+		assertBalance(t, ctx, s, username, 730)
+		if _, err := s.ExchangeTransaction(ctx, username, "EUR", BaseCurrency, 100, "5"); err != ErrInsufficientFunds {
+			t.Errorf("exchanging 100 of 99 EUR err = %v, want ErrInsufficientFunds", err)
+		}
+		if _, err := s.ExchangeTransaction(ctx, username, "EUR", BaseCurrency, 99, "6"); err != nil {
+			t.Fatal(err)
+		}
+		assertBalance(t, ctx, s, username, 836)
+
+		if err := s.UpdateUserBalance(ctx, nil, username, "GBP", 50, models.SELL); err != nil {
+			t.Fatal(err)
+		}
+		balances, err := s.QueryUserBalances(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balances["EUR"] != 0 || balances["GBP"] != 50 {
+			t.Errorf("QueryUserBalances = %v, want 50 GBP", balances)
+		}
+		if err := s.UpdateUserBalance(ctx, nil, username, "GBP", 51, models.BUY); err != ErrInsufficientFunds {
+			t.Errorf("taking 51 of 50 GBP err = %v, want ErrInsufficientFunds", err)
+		}
+		if err := s.UpdateUserBalance(ctx, nil, username, "CHF", 1, models.BUY); err != ErrInsufficientFunds {
+			t.Errorf("taking 1 of no CHF err = %v, want ErrInsufficientFunds", err)
+		}
+		if balances, _ := s.QueryUserBalances(ctx, username); balances["GBP"] != 50 || balances["CHF"] != 0 {
+			t.Errorf("QueryUserBalances after overdrawing = %v, want 50 GBP", balances)
+		}
+
+		// a sale reserved at 54 USD, 50 EUR, is recorded at that rate
+		// however it has moved by the commit
+		res, err := s.ReserveOrder(ctx, username, "EUA", models.SELL, Quantity{Shares: 1}, 54)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setRates(t, s, dbutils.StaticRates{"USD": dbutils.RateOne, "EUR": 1200000})
+		if err := s.CommitBuySellTransaction(ctx, res, "7"); err != nil {
+			t.Fatal(err)
+		}
+		executions, _, err = s.QueryUserExecutions(ctx, username, ExecutionFilter{Side: models.SELL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(executions) != 1 || executions[0].Price != 54 || executions[0].FXRate != 1080000 || executions[0].LocalPrice != 50 {
+			t.Errorf("executions = %+v, want 1 at 54 USD, 50 EUR", executions)
+		}
+	})
+
+	t.Run("Transfers", func(t *testing.T) {
+		s := newStore(t)
+		username := addUser(t, ctx, s, 1000)
+		other := addUser(t, ctx, s, 100)
+
+		// 300 held by a buy trigger isn't available
+		if _, err := s.CommitSetOrderTransaction(ctx, username, "ABC", models.BUY, 300, "1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.WithdrawTransaction(ctx, username, 701, "2"); err != ErrInsufficientFunds {
+			t.Errorf("withdrawing 701 of 700 err = %v, want ErrInsufficientFunds", err)
+		}
+		w, err := s.WithdrawTransaction(ctx, username, 200, "3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Kind != TransferWithdrawal || w.State != TransferCompleted || w.Amount != 200 {
+			t.Errorf("withdrawal = %+v", w)
+		}
+		assertBalance(t, ctx, s, username, 500)
+
+		now := time.Now().Unix()
+		if _, err := TransferMoney(ctx, s, s, now, username, username, 10, "4"); err != ErrSelfTransfer {
+			t.Errorf("transfer to self err = %v, want ErrSelfTransfer", err)
+		}
+		if _, err := TransferMoney(ctx, s, s, now, username, "nobody-"+username, 10, "5"); err != ErrNoRecipient {
+			t.Errorf("transfer to nobody err = %v, want ErrNoRecipient", err)
+		}
+		sent, err := TransferMoney(ctx, s, s, now, username, other, 150, "6")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sent.State != TransferCompleted || sent.Counterparty != other {
+			t.Errorf("transfer = %+v", sent)
+		}
+		assertBalance(t, ctx, s, username, 350)
+		assertBalance(t, ctx, s, other, 250)
+
+		transfers, err := s.QueryUserTransfers(ctx, username, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(transfers) != 2 || transfers[0].Kind != TransferSent || transfers[1].Kind != TransferWithdrawal {
+			t.Errorf("sender's transfers = %+v", transfers)
+		}
+		transfers, err = s.QueryUserTransfers(ctx, other, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(transfers) != 1 || transfers[0].Kind != TransferReceived || transfers[0].Ref != sent.Ref || transfers[0].Counterparty != username {
+			t.Errorf("recipient's transfers = %+v", transfers)
+		}
+	})
+
+	t.Run("UserLifecycle", func(t *testing.T) {
+		s := newStore(t)
+		username := addUser(t, ctx, s, 1000)
+
+		if st, err := s.QueryUserStatus(ctx, nil, username); err != nil || st != UserActive {
+			t.Errorf("QueryUserStatus of a new user = %q, %v, want active", st, err)
+		}
+		if err := s.SetUserStatus(ctx, nil, "nobody-"+username, UserSuspended); err != ErrNoRows {
+			t.Errorf("SetUserStatus of nobody err = %v, want ErrNoRows", err)
+		}
+
+		res, err := s.ReserveOrder(ctx, username, "ABC", models.BUY, Quantity{Shares: 2}, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CommitBuySellTransaction(ctx, res, "1"); err != nil {
+			t.Fatal(err)
+		}
+		tid, err := s.CommitSetOrderTransaction(ctx, username, "ABC", models.BUY, 200, "2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		trig, err := s.QueryStockTrigger(ctx, tid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trig.TriggerPrice = 150
+		trig.Executable = true
+		if err := s.UpdateTrigger(ctx, nil, trig); err != nil {
+			t.Fatal(err)
+		}
+
+		// a suspended user's triggers don't execute
+		if err := s.SetUserStatus(ctx, nil, username, UserSuspended); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.QueryAndExecuteCurrentTriggers(ctx, fixedQuotes{"ABC": 100}, "3"); err != nil {
+			t.Fatal(err)
+		}
+		assertShares(t, ctx, s, username, "ABC", 2)
+		assertBalance(t, ctx, s, username, 600)
+
+		if err := CloseAccount(ctx, s, username, false, fixedQuotes{"ABC": 110}, "4"); err != ErrOpenPositions {
+			t.Errorf("closing with shares err = %v, want ErrOpenPositions", err)
+		}
+		if st, err := s.QueryUserStatus(ctx, nil, username); err != nil || st != UserSuspended {
+			t.Errorf("QueryUserStatus after a refused close = %q, %v, want suspended", st, err)
+		}
+
+		// without a quote the trigger is cancelled but the shares can't be
+		// sold, and the account is left closing
+		if err := CloseAccount(ctx, s, username, true, fixedQuotes{}, "5"); err == nil {
+			t.Fatal("closing without a quote succeeded")
+		}
+		if st, err := s.QueryUserStatus(ctx, nil, username); err != nil || st != UserClosing {
+			t.Errorf("QueryUserStatus after a failed close = %q, %v, want closing", st, err)
+		}
+		assertShares(t, ctx, s, username, "ABC", 2)
+		assertBalance(t, ctx, s, username, 800)
+
+		// the trigger's 200 came back and finishing sells 2 shares for 220
+		if err := CloseAccount(ctx, s, username, true, fixedQuotes{"ABC": 110}, "5"); err != nil {
+			t.Fatal(err)
+		}
+		assertShares(t, ctx, s, username, "ABC", 0)
+		assertBalance(t, ctx, s, username, 1020)
+		if trigs, err := s.QueryAllUserTriggers(ctx, username); err != nil || len(trigs) != 0 {
+			t.Errorf("triggers after closing = %+v, %v", trigs, err)
+		}
+		if st, err := s.QueryUserStatus(ctx, nil, username); err != nil || st != UserClosed {
+			t.Errorf("QueryUserStatus after closing = %q, %v, want closed", st, err)
+		}
+		if err := CloseAccount(ctx, s, username, true, fixedQuotes{"ABC": 110}, "6"); err != ErrUserClosed {
+			t.Errorf("closing twice err = %v, want ErrUserClosed", err)
+		}
+
+		if err := s.DeleteUser(ctx, username); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.QueryUser(ctx, username); err != ErrNoRows {
+			t.Errorf("QueryUser after deleting err = %v, want ErrNoRows", err)
+		}
+		if executions, _, err := s.QueryUserExecutions(ctx, username, ExecutionFilter{}); err != nil || len(executions) != 0 {
+			t.Errorf("executions after deleting = %+v, %v", executions, err)
+		}
+		if stocks, err := s.QueryAllUserStocks(ctx, username); err != nil || len(stocks) != 0 {
+			t.Errorf("stocks after deleting = %+v, %v", stocks, err)
+		}
+	})
+
+	t.Run("AllUserStocks", func(t *testing.T) {
+		s := newStore(t)
+		username := addUser(t, ctx, s, 1000)
+		other := addUser(t, ctx, s, 1000)
+		for _, stock := range []models.Stock{{Username: username, Symbol: "DEF", Shares: 2}, {Username: username, Symbol: "ABC", Shares: 1}, {Username: other, Symbol: "ABC", Shares: 5}} {
+			if err := s.UpdateUserStock(ctx, nil, stock.Username, stock.Symbol, stock.Shares, models.BUY); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		stocks, err := s.QueryAllUserStocks(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stocks) != 2 || stocks[0].Symbol != "ABC" || stocks[0].Shares != 1 || stocks[1].Symbol != "DEF" || stocks[1].Shares != 2 {
+			t.Errorf("QueryAllUserStocks = %+v", stocks)
+		}
+	})
+
+	t.Run("Executions", func(t *testing.T) {
+		s := newStore(t)
+		username := addUser(t, ctx, s, 1000)
+		for i, e := range []Execution{
+			{Symbol: "ABC", Side: models.BUY, Shares: 2, Price: 100, Time: 10},
+			{Symbol: "DEF", Side: models.BUY, Shares: 1, Price: 40, Time: 20},
+			{Symbol: "ABC", Side: models.SELL, Shares: 1, Price: 120, Time: 30},
+		} {
+			e.Username = username
+			e.Amount = e.Shares * e.Price
+			e.Source = SourceManual
+			e.Trans = strconv.Itoa(i + 1)
+			if _, err := s.AddExecution(ctx, nil, e); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := []struct {
+			f     ExecutionFilter
+			trans []string
+			total int
+		}{
+			{ExecutionFilter{}, []string{"3", "2", "1"}, 3},
+			{ExecutionFilter{Symbol: "ABC"}, []string{"3", "1"}, 2},
+			{ExecutionFilter{Side: models.BUY}, []string{"2", "1"}, 2},
+			{ExecutionFilter{From: 15, To: 30}, []string{"3", "2"}, 2},
+			{ExecutionFilter{Offset: 1, Limit: 1}, []string{"2"}, 3},
+			{ExecutionFilter{Offset: 5}, nil, 3},
+		}
+		for _, tt := range tests {
+			executions, total, err := s.QueryUserExecutions(ctx, username, tt.f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var trans []string
+			for _, e := range executions {
+				trans = append(trans, e.Trans)
+			}
+			if fmt.Sprint(trans) != fmt.Sprint(tt.trans) || total != tt.total {
+				t.Errorf("QueryUserExecutions(%+v) = %v of %d, want %v of %d", tt.f, trans, total, tt.trans, tt.total)
+			}
+		}
+	})
+
+	t.Run("Orders", func(t *testing.T) {
+		s := newStore(t)
+		username := addUser(t, ctx, s, 1000)
+
+		buy, err := s.PlaceOrderTransaction(ctx, Order{Username: username, Symbol: "ABC", Kind: LimitBuy, Shares: 4, LimitPrice: 100, TimeInForce: GTC}, 120, "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buy.Status != OrderOpen || buy.Held != 400 {
+			t.Errorf("placed order = %+v", buy)
+		}
+		assertBalance(t, ctx, s, username, 600)
+
+		buy, err = s.ExecuteOrder(ctx, buy, 90, "2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buy.Status != OrderFilled || buy.FillPrice != 90 {
+			t.Errorf("executed order = %+v", buy)
+		}
+		assertBalance(t, ctx, s, username, 640)
+		assertShares(t, ctx, s, username, "ABC", 4)
+
+		sell, err := s.PlaceOrderTransaction(ctx, Order{Username: username, Symbol: "ABC", Kind: LimitSell, Shares: 3, LimitPrice: 150, TimeInForce: GTC}, 90, "3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertShares(t, ctx, s, username, "ABC", 1)
+		if _, err := s.CloseOrderTransaction(ctx, sell, OrderCancelled, "4"); err != nil {
+			t.Fatal(err)
+		}
+		assertShares(t, ctx, s, username, "ABC", 4)
+		if _, err := s.CloseOrderTransaction(ctx, sell, OrderCancelled, "5"); err != ErrOrderClosed {
+			t.Errorf("closing a cancelled order err = %v, want ErrOrderClosed", err)
+		}
+		if _, err := s.PlaceOrderTransaction(ctx, Order{Username: username, Symbol: "ABC", Kind: StopLoss, Shares: 5, StopPrice: 80, TimeInForce: GTC}, 90, "6"); err != ErrInsufficientShares {
+			t.Errorf("selling 5 of 4 shares err = %v, want ErrInsufficientShares", err)
+		}
+
+		orders, err := s.QueryUserOrders(ctx, username, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(orders) != 2 || orders[0].ID != buy.ID || orders[1].Status != OrderCancelled {
+			t.Errorf("QueryUserOrders = %+v", orders)
+		}
+	})
+
+	t.Run("OrderGroups", func(t *testing.T) {
+		s := newStore(t)
+		username := addUser(t, ctx, s, 1000)
+
+		bracket := OrderGroup{Username: username, Kind: Bracket, Orders: []Order{
+			{Symbol: "ABC", Kind: LimitBuy, Shares: 4, LimitPrice: 100, TimeInForce: GTC},
+			{Symbol: "ABC", Kind: LimitSell, Shares: 4, LimitPrice: 150, TimeInForce: GTC},
+			{Symbol: "ABC", Kind: StopLoss, Shares: 4, StopPrice: 80, TimeInForce: GTC},
+		}}
+		g, err := s.PlaceOrderGroupTransaction(ctx, bracket, 120, "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g.Status != OrderOpen || len(g.Orders) != 3 || g.Orders[1].Status != OrderPending || g.Orders[2].Status != OrderPending {
+			t.Errorf("placed bracket = %+v", g)
+		}
+		assertBalance(t, ctx, s, username, 600)
+
+		if _, err := s.QueryAndExecuteCurrentTriggers(ctx, fixedQuotes{"ABC": 95}, "2"); err != nil {
+			t.Fatal(err)
+		}
+		assertBalance(t, ctx, s, username, 620)
+		assertShares(t, ctx, s, username, "ABC", 0)
+		if g, _ = s.QueryOrderGroup(ctx, nil, g.ID); g.Orders[1].Status != OrderOpen || g.Orders[1].Held != 4 || g.Orders[2].Status != OrderOpen {
+			t.Errorf("bracket after entry filled = %+v", g)
+		}
+
+		if _, err := s.QueryAndExecuteCurrentTriggers(ctx, fixedQuotes{"ABC": 150}, "3"); err != nil {
+			t.Fatal(err)
+		}
+		assertBalance(t, ctx, s, username, 1220)
+		assertShares(t, ctx, s, username, "ABC", 0)
+		g, err = s.QueryOrderGroup(ctx, nil, g.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g.Status != OrderFilled || g.Orders[1].Status != OrderFilled || g.Orders[2].Status != OrderCancelled {
+			t.Errorf("bracket after take profit = %+v", g)
+		}
+
+		// the larger stop holds for both, the rest comes back when the
+		// smaller take profit fills
+		if err := s.UpdateUserStock(ctx, nil, username, "ABC", 10, models.BUY); err != nil {
+			t.Fatal(err)
+		}
+		oco := OrderGroup{Username: username, Kind: OCO, Orders: []Order{
+			{Symbol: "ABC", Kind: LimitSell, Shares: 3, LimitPrice: 200, TimeInForce: GTC},
+			{Symbol: "ABC", Kind: StopLoss, Shares: 5, StopPrice: 50, TimeInForce: GTC},
+		}}
+		if g, err = s.PlaceOrderGroupTransaction(ctx, oco, 100, "4"); err != nil {
+			t.Fatal(err)
+		}
+		assertShares(t, ctx, s, username, "ABC", 5)
+		if _, err := s.QueryAndExecuteCurrentTriggers(ctx, fixedQuotes{"ABC": 200}, "5"); err != nil {
+			t.Fatal(err)
+		}
+		assertShares(t, ctx, s, username, "ABC", 7)
+		assertBalance(t, ctx, s, username, 1820)
+
+		if g, err = s.PlaceOrderGroupTransaction(ctx, oco, 100, "6"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.CloseOrderTransaction(ctx, g.Orders[0], OrderCancelled, "7"); err != nil {
+			t.Fatal(err)
+		}
+		assertShares(t, ctx, s, username, "ABC", 7)
+
+		groups, err := s.QueryUserOrderGroups(ctx, username, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(groups) != 3 || groups[1].Status != OrderFilled || groups[2].Status != OrderCancelled || len(groups[2].Orders) != 2 {
+			t.Errorf("QueryUserOrderGroups = %+v", groups)
+		}
+		if open, _ := s.QueryUserOrderGroups(ctx, username, true); len(open) != 0 {
+			t.Errorf("open groups = %+v", open)
+		}
+	})
+
+	t.Run("Schedules", func(t *testing.T) {
+		s := newStore(t)
+		username := addUser(t, ctx, s, 1000)
+		now := time.Now().Unix()
+
+		due := Schedule{Username: username, Symbol: "ABC", Cadence: "@daily", Next: now - 10, Time: now - 100, Trans: "1"}
+		var sids []int64
+		for _, amount := range []int{250, 50, 5000} {
+			due.Amount = amount
+			sid, err := s.AddSchedule(ctx, nil, due)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sids = append(sids, sid)
+		}
+		paused := due
+		paused.Amount = 100
+		paused.Paused = true
+		if _, err := s.AddSchedule(ctx, nil, paused); err != nil {
+			t.Fatal(err)
+		}
+
+		runs, err := s.QueryAndRunDueSchedules(ctx, fixedQuotes{"ABC": 100}, "2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		reasons := map[int64]string{}
+		for _, run := range runs {
+			if run.Username == username {
+				reasons[run.SID] = run.Status + " " + run.Reason
+			}
+		}
+		want := map[int64]string{sids[0]: RunBought + " ", sids[1]: RunSkipped + " " + SkipBelowOne, sids[2]: RunSkipped + " " + SkipInsufficient}
+		if !reflect.DeepEqual(reasons, want) {
+			t.Errorf("runs = %v, want %v", reasons, want)
+		}
+		assertBalance(t, ctx, s, username, 800)
+		assertShares(t, ctx, s, username, "ABC", 2)
+
+		executions, _, err := s.QueryUserExecutions(ctx, username, ExecutionFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(executions) != 1 || executions[0].Source != SourceSchedule || executions[0].Amount != 200 {
+			t.Errorf("executions = %+v", executions)
+		}
+
+		sch, err := s.QuerySchedule(ctx, nil, sids[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sch.Next <= now {
+			t.Errorf("next run %d is not after %d", sch.Next, now)
+		}
+		// a stale copy of a schedule that has run isn't run again
+		stale := due
+		stale.ID = sids[0]
+		if _, err := runSchedule(ctx, s, FIFO, now, stale, fixedQuotes{"ABC": 100}, "3"); err != ErrScheduleNotDue {
+			t.Errorf("running a stale schedule err = %v, want ErrScheduleNotDue", err)
+		}
+
+		history, err := s.QueryScheduleRuns(ctx, username, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 3 || history[0].SID != sids[2] {
+			t.Errorf("QueryScheduleRuns = %+v", history)
+		}
+		if err := s.RemoveSchedule(ctx, nil, sids[0]); err != nil {
+			t.Fatal(err)
+		}
+		schedules, err := s.QueryUserSchedules(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(schedules) != 3 || !schedules[2].Paused {
+			t.Errorf("QueryUserSchedules = %+v", schedules)
+		}
+
+		// money taken out after the schedule is priced, before its
+		// transaction, is a recorded skip
+		due.Amount = 300
+		due.Trans = "4"
+		if due.ID, err = s.AddSchedule(ctx, nil, due); err != nil {
+			t.Fatal(err)
+		}
+		drain := hookStore{s, func() {
+			if err := s.UpdateUserMoney(ctx, nil, username, 700, models.BUY, "5"); err != nil {
+				t.Fatal(err)
+			}
+		}}
+		run, err := runSchedule(ctx, drain, FIFO, now, due, fixedQuotes{"ABC": 100}, "6")
+		if err != nil || run.Status != RunSkipped || run.Reason != SkipInsufficient || run.ID == 0 {
+			t.Errorf("running a schedule the balance no longer covers = %+v, %v", run, err)
+		}
+		assertBalance(t, ctx, s, username, 100)
+		if sch, err = s.QuerySchedule(ctx, nil, due.ID); err != nil || sch.Next <= now {
+			t.Errorf("schedule after a skip = %+v, %v", sch, err)
+		}
+	})
+
+	t.Run("TrailingStops", func(t *testing.T) {
+		s := newStore(t)
+		username := addUser(t, ctx, s, 1000)
+		if err := s.UpdateUserStock(ctx, nil, username, "ABC", 5, models.BUY); err != nil {
+			t.Fatal(err)
+		}
+		tid, err := s.CommitSetOrderTransaction(ctx, username, "ABC", models.SELL, 2, "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ts := TrailingStop{TID: tid, Username: username, Symbol: "ABC", TrailAmount: 10, HighWater: 100}
+		if err := s.SetTrailingStop(ctx, nil, ts); err != nil {
+			t.Fatal(err)
+		}
+		for _, quote := range []int{120, 115} {
+			if _, err := s.QueryAndExecuteCurrentTriggers(ctx, fixedQuotes{"ABC": quote}, "2"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		trig, err := s.QueryStockTrigger(ctx, tid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if trig.TriggerPrice != 110 || !trig.Executable {
+			t.Errorf("trigger after rising to 120 = %+v, want a stop of 110", trig)
+		}
+		stops, err := s.QueryTrailingStops(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stops) != 1 || stops[0].HighWater != 120 {
+			t.Errorf("QueryTrailingStops = %+v", stops)
+		}
+
+		if _, err := s.QueryAndExecuteCurrentTriggers(ctx, fixedQuotes{"ABC": 110}, "3"); err != nil {
+			t.Fatal(err)
+		}
+		assertBalance(t, ctx, s, username, 1220)
+		if stops, _ := s.QueryTrailingStops(ctx, username); len(stops) != 0 {
+			t.Errorf("trailing stops after execution = %+v", stops)
+		}
+	})
+
+	t.Run("Rollback", func(t *testing.T) {
+		s := newStore(t)
+		username := addUser(t, ctx, s, 1000)
+
+		tx, err := s.Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UpdateUserMoney(ctx, tx, username, 400, models.BUY, "1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UpdateUserStock(ctx, tx, username, "ABC", 4, models.BUY); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Rollback(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		assertBalance(t, ctx, s, username, 1000)
+		assertShares(t, ctx, s, username, "ABC", 0)
+	})
+
+	t.Run("Overdraw", func(t *testing.T) {
+		s := newStore(t)
+		username := addUser(t, ctx, s, 1000)
+		if err := s.UpdateUserStock(ctx, nil, username, "ABC", 4, models.BUY); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.UpdateUserMoney(ctx, nil, username, 1001, models.BUY, "1"); err != ErrInsufficientFunds {
+			t.Errorf("taking 1001 of 1000 err = %v, want ErrInsufficientFunds", err)
+		}
+		if err := s.UpdateUserStock(ctx, nil, username, "ABC", 5, models.SELL); err != ErrInsufficientShares {
+			t.Errorf("taking 5 of 4 shares err = %v, want ErrInsufficientShares", err)
+		}
+		if err := s.UpdateUserStock(ctx, nil, username, "DEF", 1, models.SELL); err != ErrInsufficientShares {
+			t.Errorf("taking shares never held err = %v, want ErrInsufficientShares", err)
+		}
+		assertBalance(t, ctx, s, username, 1000)
+		assertShares(t, ctx, s, username, "ABC", 4)
+		assertShares(t, ctx, s, username, "DEF", 0)
+
+		// only two of these orders fit in the balance however they interleave
+		var wg sync.WaitGroup
+		errs := make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := s.PlaceOrderTransaction(ctx, Order{Username: username, Symbol: "ABC", Kind: LimitBuy, Shares: 4, LimitPrice: 100, TimeInForce: GTC}, 120, strconv.Itoa(i))
+				errs <- err
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		placed := 0
+		for err := range errs {
+			if err == nil {
+				placed++
+			} else if err != ErrInsufficientFunds {
+				t.Error(err)
+			}
+		}
+		if placed != 2 {
+			t.Errorf("placed %d orders holding 400 of 1000, want 2", placed)
+		}
+		assertBalance(t, ctx, s, username, 200)
+
+		// nor can withdrawals and transfers racing each other overdraw it
+		other := addUser(t, ctx, s, 0)
+		errs = make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var err error
+				if i%2 == 0 {
+					_, err = s.WithdrawTransaction(ctx, username, 60, strconv.Itoa(10+i))
+				} else {
+					_, err = TransferMoney(ctx, s, s, 1, username, other, 60, strconv.Itoa(10+i))
+				}
+				errs <- err
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		moved := 0
+		for err := range errs {
+			if err == nil {
+				moved++
+			} else if err != ErrInsufficientFunds {
+				t.Error(err)
+			}
+		}
+		if moved != 3 {
+			t.Errorf("moved 60 of 200 %d times, want 3", moved)
+		}
+		assertBalance(t, ctx, s, username, 20)
+	})
+
+	t.Run("SetAndCancelOrders", func(t *testing.T) {
+		s := newStore(t)
+		username := addUser(t, ctx, s, 1000)
+
+		tid, err := s.CommitSetOrderTransaction(ctx, username, "ABC", models.BUY, 600, "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertBalance(t, ctx, s, username, 400)
+
+		trig, err := s.QueryUserTrigger(ctx, username, "ABC", models.BUY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if trig.ID != tid || trig.Amount != 600 || trig.Executable {
+			t.Errorf("QueryUserTrigger = %+v", trig)
+		}
+
+		if _, err := s.CancelOrderTransaction(ctx, trig, "2"); err != nil {
+			t.Fatal(err)
+		}
+		assertBalance(t, ctx, s, username, 1000)
+		if _, err := s.QueryStockTrigger(ctx, tid); err != ErrNoRows {
+			t.Errorf("trigger still exists after cancel, err = %v", err)
+		}
+	})
+
+	t.Run("ExecuteTriggers", func(t *testing.T) {
+		s := newStore(t)
+		username := addUser(t, ctx, s, 1000)
+		seed := models.Reservation{Username: username, Symbol: "DEF", Order: models.BUY, Shares: 5, Amount: 500}
+		seed.ID, _ = s.AddReservation(ctx, nil, seed)
+		if err := s.CommitBuySellTransaction(ctx, seed, "1"); err != nil {
+			t.Fatal(err)
+		}
+
+		buyTid, err := s.CommitSetOrderTransaction(ctx, username, "ABC", models.BUY, 250, "2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sellTid, err := s.CommitSetOrderTransaction(ctx, username, "DEF", models.SELL, 2, "3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertBalance(t, ctx, s, username, 250)
+		assertShares(t, ctx, s, username, "DEF", 3)
+
+		for tid, price := range map[int64]int{buyTid: 100, sellTid: 150} {
+			trig, err := s.QueryStockTrigger(ctx, tid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			trig.TriggerPrice = price
+			trig.Executable = true
+			if err := s.UpdateTrigger(ctx, nil, trig); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// neither price reached yet
+		if _, err := s.QueryAndExecuteCurrentTriggers(ctx, fixedQuotes{"ABC": 120, "DEF": 140}, "4"); err != nil {
+			t.Fatal(err)
+		}
+		assertShares(t, ctx, s, username, "ABC", 0)
+		assertBalance(t, ctx, s, username, 250)
+
+		if _, err := s.QueryAndExecuteCurrentTriggers(ctx, fixedQuotes{"ABC": 80, "DEF": 160}, "5"); err != nil {
+			t.Fatal(err)
+		}
+		// 250 buys 3 ABC at 80 with 10 back, the 2 DEF sell for 320
+		assertShares(t, ctx, s, username, "ABC", 3)
+		assertShares(t, ctx, s, username, "DEF", 3)
+		assertBalance(t, ctx, s, username, 250+10+320)
+
+		trigs, err := s.QueryAllUserTriggers(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trigs) != 0 {
+			t.Errorf("%d triggers left after execution", len(trigs))
+		}
+
+		executions, _, err := s.QueryUserExecutions(ctx, username, ExecutionFilter{Symbol: "DEF", Side: models.SELL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(executions) != 1 || executions[0].Side != models.SELL || executions[0].Shares != 2 || executions[0].Price != 160 || executions[0].Source != SourceTrigger {
+			t.Errorf("DEF executions = %+v", executions)
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package transdb
+
+import (
+	"context"
+
+	"common/models"
+)
+
+// TrailingStop makes a sell trigger a trailing stop. The trigger's price is
+// kept TrailAmount cents, or TrailBasisPoints hundredths of a percent, below
+// the highest quote seen since it was set, and the trigger sells when the
+// quote falls to it.
+type TrailingStop struct {
+	TID              int64  `json:"tid"`
+	Username         string `json:"username"`
+	Symbol           string `json:"symbol"`
+	TrailAmount      int    `json:"trailAmount"`
+	TrailBasisPoints int    `json:"trailBasisPoints"`
+	HighWater        int    `json:"highWater"`
+}
+
+// Stop returns the effective stop price for the high-water mark.
+func (ts TrailingStop) Stop() int {
+	if ts.TrailBasisPoints > 0 {
+		return ts.HighWater - ts.HighWater*ts.TrailBasisPoints/10000
+	}
+	return ts.HighWater - ts.TrailAmount
+}
+
+// trailingStops indexes stops by trigger.
+func trailingStops(stops []TrailingStop) map[int64]TrailingStop {
+	m := make(map[int64]TrailingStop, len(stops))
+	for _, ts := range stops {
+		m[ts.TID] = ts
+	}
+	return m
+}
+
+// trail raises the trailing stop for trig to quote if that is a new high,
+// returning the trigger with its effective stop.
+func trail(ctx context.Context, s TransactionDataStore, trig models.Trigger, ts TrailingStop, quote int) (models.Trigger, error) {
+	if quote <= ts.HighWater {
+		return trig, nil
+	}
+	ts.HighWater = quote
+	if err := s.SetTrailingStop(ctx, nil, ts); err != nil {
+		return trig, err
+	}
+	trig.TriggerPrice = ts.Stop()
+	return trig, nil
+}
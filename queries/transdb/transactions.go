@@ -0,0 +1,302 @@
+package transdb
+
+import (
+	"context"
+
+	"common/models"
+	"transaction_service/applog"
+	"transaction_service/queries/utils"
+)
+
+// The multi-step operations below are shared by every TransactionDataStore
+// so each backend only implements the single-step primitives, and both
+// behave identically.
+
+func commitSetOrderTransaction(ctx context.Context, s TransactionDataStore, username string, symbol string, orderType models.OrderType, amount int, trans string) (tid int64, err error) {
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		return
+	}
+
+	if orderType == models.BUY {
+		err = s.UpdateUserMoney(ctx, tx, username, amount, orderType, trans)
+	} else {
+		//TODO: check for sell
+		err = s.UpdateUserStock(ctx, tx, username, symbol, amount, orderType)
+	}
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	//TODO: check for sell
+	tid, err = s.SetUserOrderTypeAmount(ctx, tx, username, symbol, orderType, amount)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	return
+}
+
+func cancelOrderTransaction(ctx context.Context, s TransactionDataStore, trig models.Trigger, trans string) (rtrig models.Trigger, err error) {
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		return
+	}
+
+	if trig.Order == models.BUY {
+		err = s.UpdateUserMoney(ctx, tx, trig.Username, trig.Amount, models.SELL, trans)
+	} else {
+		err = s.UpdateUserStock(ctx, tx, trig.Username, trig.Symbol, trig.Amount, models.BUY)
+	}
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	rtrig, err = s.RemoveUserStockTrigger(ctx, tx, trig.ID)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = s.RemoveTrailingStop(ctx, tx, trig.ID)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	return
+}
+
+// SetTrigger saves trig, making it executable at its price. Any trailing
+// stop on the trigger is removed in the same transaction, so the price set
+// here isn't moved by later quotes.
+func SetTrigger(ctx context.Context, s TransactionDataStore, trig models.Trigger) (err error) {
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		return
+	}
+
+	err = s.UpdateTrigger(ctx, tx, trig)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = s.RemoveTrailingStop(ctx, tx, trig.ID)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		tx.Rollback(ctx)
+	}
+	return
+}
+
+func commitBuySellTransaction(ctx context.Context, s TransactionDataStore, method CostBasis, now int64, res models.Reservation, trans string) (err error) {
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		return
+	}
+
+	err = commitReservation(ctx, s, tx, method, now, res, SourceManual, trans)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+	return
+}
+
+// commitReservation buys or sells res within tx and removes it, recording
+// the execution with source. The commission is paid on top of a buy's
+// amount and out of a sale's.
+func commitReservation(ctx context.Context, s TransactionDataStore, tx Tx, method CostBasis, now int64, res models.Reservation, source string, trans string) (err error) {
+	fee := s.Fees().Fee(res.Symbol, res.Order, res.Amount)
+	net := res.Amount - fee
+	if res.Order == models.BUY {
+		net = res.Amount + fee
+		err = addLot(ctx, s, tx, res.Username, res.Symbol, res.Shares, net, now, trans)
+	} else {
+		err = realizeSale(ctx, s, tx, method, res.Username, res.Symbol, res.Shares, net, now, trans)
+	}
+	if err != nil {
+		return
+	}
+
+	// the reservation was priced at the rate when it was quoted, which
+	// schedules' reservations, made and committed at once, don't record
+	currency, rate, err := s.QueryReservationRate(ctx, tx, res.ID)
+	if err == ErrNoRows {
+		currency, rate, err = symbolRate(ctx, s, tx, res.Symbol)
+	}
+	if err != nil {
+		return
+	}
+
+	err = recordExecutionAt(ctx, s, tx, currency, rate, res.Username, res.Symbol, res.Order, res.Shares, s.ShareScale().Price(res.Amount, res.Shares), fee, source, now, trans)
+	if err != nil {
+		return
+	}
+
+	err = s.UpdateUserStock(ctx, tx, res.Username, res.Symbol, res.Shares, res.Order)
+	if err != nil {
+		return
+	}
+
+	err = s.UpdateUserMoney(ctx, tx, res.Username, net, res.Order, trans)
+	if err != nil {
+		return
+	}
+
+	return s.RemoveReservation(ctx, tx, res.ID)
+}
+
+// executeTriggers runs every trigger in trigs whose price has been reached,
+// returning the triggers it examined without error. Trailing stops are
+// raised with the quote first, and sell once it falls to their stop.
+func executeTriggers(ctx context.Context, s TransactionDataStore, trigs []models.Trigger, trailing map[int64]TrailingStop, quotes dbutils.QuoteProvider, trans string) (rTrigs []models.Trigger) {
+	quotes = BaseQuotes(s, quotes)
+	for _, trig := range trigs {
+		if err := canTrade(ctx, s, nil, trig.Username); err != nil {
+			if !inactive(err) {
+				applog.FromContext(ctx).Warn("Failed to get user status for trigger", "tid", trig.ID, "error", err)
+			}
+			continue
+		}
+
+		quote, err := quotes.QueryQuotePrice(ctx, trig.Username, trig.Symbol, trans)
+		if err != nil {
+			applog.FromContext(ctx).Warn("Failed to get quote for trigger", "tid", trig.ID, "symbol", trig.Symbol, "error", err)
+			continue
+		}
+
+		executed := trig
+		if ts, ok := trailing[trig.ID]; ok {
+			executed, err = trail(ctx, s, trig, ts, quote)
+			if err == nil && quote <= executed.TriggerPrice {
+				executed, err = s.ExecuteTrigger(ctx, executed, quote, trans)
+			}
+
+		} else if trig.Order == models.BUY {
+			if quote <= trig.TriggerPrice {
+				executed, err = s.ExecuteTrigger(ctx, trig, quote, trans)
+			}
+
+		} else {
+			if quote >= trig.TriggerPrice {
+				executed, err = s.ExecuteTrigger(ctx, trig, quote, trans)
+			}
+		}
+		if err != nil {
+			applog.FromContext(ctx).Warn("Failed to execute trigger", "tid", trig.ID, "error", err)
+			continue
+		}
+		rTrigs = append(rTrigs, executed)
+	}
+	return
+}
+
+func executeTrigger(ctx context.Context, s TransactionDataStore, method CostBasis, now int64, trig models.Trigger, quote int, trans string) (rtrig models.Trigger, err error) {
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		return
+	}
+
+	if trig.Order == models.BUY {
+		// the commission comes out of the cash the trigger holds
+		shares := s.Fees().Afford(s.ShareScale(), trig.Symbol, trig.Amount, quote)
+		cost := s.ShareScale().Cost(shares, quote)
+		fee := s.Fees().Fee(trig.Symbol, trig.Order, cost)
+		remainder := trig.Amount - cost - fee
+
+		// add stock
+		err = s.UpdateUserStock(ctx, tx, trig.Username, trig.Symbol, shares, trig.Order)
+		if err != nil {
+			tx.Rollback(ctx)
+			return
+		}
+
+		//add remainder back
+		err = s.UpdateUserMoney(ctx, tx, trig.Username, remainder, models.SELL, trans)
+		if err != nil {
+			tx.Rollback(ctx)
+			return
+		}
+
+		err = addLot(ctx, s, tx, trig.Username, trig.Symbol, shares, cost+fee, now, trans)
+		if err != nil {
+			tx.Rollback(ctx)
+			return
+		}
+
+		err = recordExecution(ctx, s, tx, trig.Username, trig.Symbol, trig.Order, shares, quote, fee, SourceTrigger, now, trans)
+		if err != nil {
+			tx.Rollback(ctx)
+			return
+		}
+
+	} else {
+		// sell triggers hold shares, credit their value at the quote less
+		// the commission
+		fee := s.Fees().Fee(trig.Symbol, trig.Order, s.ShareScale().Value(trig.Amount, quote))
+		proceeds := s.ShareScale().Value(trig.Amount, quote) - fee
+		err = s.UpdateUserMoney(ctx, tx, trig.Username, proceeds, trig.Order, trans)
+		if err != nil {
+			tx.Rollback(ctx)
+			return
+		}
+
+		err = realizeSale(ctx, s, tx, method, trig.Username, trig.Symbol, trig.Amount, proceeds, now, trans)
+		if err != nil {
+			tx.Rollback(ctx)
+			return
+		}
+
+		err = recordExecution(ctx, s, tx, trig.Username, trig.Symbol, trig.Order, trig.Amount, quote, fee, SourceTrigger, now, trans)
+		if err != nil {
+			tx.Rollback(ctx)
+			return
+		}
+	}
+	rtrig, err = s.RemoveUserStockTrigger(ctx, tx, trig.ID)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = s.RemoveTrailingStop(ctx, tx, trig.ID)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+	return
+}
@@ -0,0 +1,323 @@
+package transdb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"common/models"
+	"transaction_service/applog"
+)
+
+// Transfer kinds.
+const (
+	TransferWithdrawal = "withdrawal"
+	TransferSent       = "sent"
+	TransferReceived   = "received"
+)
+
+// Transfer states. A transfer between users on different databases is
+// pending from when the sender is debited until the recipient is credited,
+// or the sender is refunded because the recipient doesn't exist.
+const (
+	TransferPending   = "pending"
+	TransferCompleted = "completed"
+	TransferReversed  = "reversed"
+)
+
+var (
+	ErrNoRecipient  = errors.New("recipient does not exist or is closed")
+	ErrSelfTransfer = errors.New("cannot transfer to yourself")
+)
+
+// Transfer is cash withdrawn by a user or moved between two users. Both
+// sides of a transfer between users are recorded, with the same Ref.
+type Transfer struct {
+	ID           int64  `json:"id"`
+	Username     string `json:"username"`
+	Kind         string `json:"kind"`
+	Counterparty string `json:"counterparty,omitempty"`
+	Amount       int    `json:"amount"`
+	State        string `json:"state"`
+	Ref          string `json:"ref"`
+	Time         int64  `json:"time"`
+	Trans        string `json:"trans"`
+}
+
+func newTransferRef() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// withdrawTransaction takes amount out of the user's available balance,
+// which excludes the cash held by triggers and orders. The debit checks it
+// under the user's row lock, so withdrawals racing other debits fail with
+// ErrInsufficientFunds rather than overdraw it.
+func withdrawTransaction(ctx context.Context, s TransactionDataStore, now int64, username string, amount int, trans string) (t Transfer, err error) {
+	t = Transfer{Username: username, Kind: TransferWithdrawal, Amount: amount, State: TransferCompleted, Time: now, Trans: trans}
+	if amount <= 0 {
+		return t, fmt.Errorf("invalid withdrawal of %d", amount)
+	}
+	if t.Ref, err = newTransferRef(); err != nil {
+		return
+	}
+
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		return
+	}
+
+	err = s.UpdateUserMoney(ctx, tx, username, amount, models.BUY, trans)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	t.ID, err = s.AddTransfer(ctx, tx, t)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+	return t, nil
+}
+
+// TransferMoney moves amount from the sender, whose database is from, to
+// the recipient, whose database is to. When they differ the sender is
+// debited first and the transfer stays pending until the recipient is
+// credited; if that fails for any reason but the recipient not existing,
+// the pending transfer is returned and ResumeTransfers finishes it later.
+// Like a withdrawal, the sender's debit fails with ErrInsufficientFunds
+// unless their available balance covers it.
+func TransferMoney(ctx context.Context, from TransactionDataStore, to TransactionDataStore, now int64, sender string, recipient string, amount int, trans string) (t Transfer, err error) {
+	t = Transfer{Username: sender, Kind: TransferSent, Counterparty: recipient, Amount: amount, State: TransferPending, Time: now, Trans: trans}
+	if amount <= 0 {
+		return t, fmt.Errorf("invalid transfer of %d", amount)
+	}
+	if sender == recipient {
+		return t, ErrSelfTransfer
+	}
+	// closing and closed accounts can't take money in
+	if st, err := to.QueryUserStatus(ctx, nil, recipient); err == ErrNoRows || st == UserClosing || st == UserClosed {
+		return t, ErrNoRecipient
+	} else if err != nil {
+		return t, err
+	}
+	if t.Ref, err = newTransferRef(); err != nil {
+		return
+	}
+
+	if from == to {
+		t.State = TransferCompleted
+		return t, transferLocal(ctx, from, &t)
+	}
+
+	tx, err := from.Begin(ctx)
+	if err != nil {
+		return
+	}
+
+	err = from.UpdateUserMoney(ctx, tx, sender, amount, models.BUY, trans)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	t.ID, err = from.AddTransfer(ctx, tx, t)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	return finishTransfer(ctx, from, to, t)
+}
+
+// transferLocal moves t between two users of the same database in one
+// transaction.
+func transferLocal(ctx context.Context, s TransactionDataStore, t *Transfer) (err error) {
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		return
+	}
+
+	err = lockRecipient(ctx, s, tx, t.Counterparty)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = s.UpdateUserMoney(ctx, tx, t.Username, t.Amount, models.BUY, t.Trans)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = s.UpdateUserMoney(ctx, tx, t.Counterparty, t.Amount, models.SELL, t.Trans)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	t.ID, err = s.AddTransfer(ctx, tx, *t)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	_, err = s.AddTransfer(ctx, tx, received(*t))
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		tx.Rollback(ctx)
+	}
+	return
+}
+
+// received returns the recipient's side of the sent transfer t.
+func received(t Transfer) Transfer {
+	return Transfer{Username: t.Counterparty, Kind: TransferReceived, Counterparty: t.Username, Amount: t.Amount, State: TransferCompleted, Ref: t.Ref, Time: t.Time, Trans: t.Trans}
+}
+
+// finishTransfer credits the recipient of the pending transfer t and
+// completes it, or refunds the sender when the recipient doesn't exist or
+// has started closing since it was sent.
+func finishTransfer(ctx context.Context, from TransactionDataStore, to TransactionDataStore, t Transfer) (Transfer, error) {
+	err := creditTransfer(ctx, to, t)
+	if err == ErrNoRecipient {
+		if err = reverseTransfer(ctx, from, t); err != nil {
+			return t, err
+		}
+		t.State = TransferReversed
+		return t, ErrNoRecipient
+	}
+	if err != nil {
+		applog.FromContext(ctx).Warn("Failed to credit transfer, leaving it pending", "id", t.ID, "recipient", t.Counterparty, "error", err)
+		return t, nil
+	}
+
+	// the recipient has the money, so a transfer left pending here is only
+	// completed again by ResumeTransfers
+	if err = from.SettleTransfer(ctx, nil, t.ID, TransferCompleted); err != nil && err != ErrNoRows {
+		applog.FromContext(ctx).Warn("Failed to complete transfer", "id", t.ID, "error", err)
+		return t, nil
+	}
+	t.State = TransferCompleted
+	return t, nil
+}
+
+// lockRecipient locks the recipient's row within tx, returning
+// ErrNoRecipient unless they exist and can take money in.
+func lockRecipient(ctx context.Context, s TransactionDataStore, tx Tx, recipient string) error {
+	acct, err := s.LockUser(ctx, tx, recipient)
+	if err == ErrNoRows || err == nil && (acct.Status == UserClosing || acct.Status == UserClosed) {
+		return ErrNoRecipient
+	}
+	return err
+}
+
+// creditTransfer gives the recipient of t its amount, unless they already
+// have it.
+func creditTransfer(ctx context.Context, s TransactionDataStore, t Transfer) (err error) {
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		return
+	}
+
+	if _, err = s.QueryTransfer(ctx, tx, t.Ref, TransferReceived); err == nil {
+		return tx.Rollback(ctx)
+	} else if err != ErrNoRows {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = lockRecipient(ctx, s, tx, t.Counterparty)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = s.UpdateUserMoney(ctx, tx, t.Counterparty, t.Amount, models.SELL, t.Trans)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	_, err = s.AddTransfer(ctx, tx, received(t))
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		tx.Rollback(ctx)
+	}
+	return
+}
+
+// reverseTransfer refunds the sender of the pending transfer t.
+func reverseTransfer(ctx context.Context, s TransactionDataStore, t Transfer) (err error) {
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		return
+	}
+
+	err = s.SettleTransfer(ctx, tx, t.ID, TransferReversed)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = s.UpdateUserMoney(ctx, tx, t.Username, t.Amount, models.SELL, t.Trans)
+	if err != nil {
+		tx.Rollback(ctx)
+		return
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		tx.Rollback(ctx)
+	}
+	return
+}
+
+// ResumeTransfers finishes the transfers sent from s that have been
+// pending since before, looking up each recipient's database with stores.
+// It returns the transfers it finished, skipping those that failed again.
+func ResumeTransfers(ctx context.Context, s TransactionDataStore, stores func(username string) TransactionDataStore, before int64) (finished []Transfer, err error) {
+	pending, err := s.QueryPendingTransfers(ctx, before)
+	if err != nil {
+		return
+	}
+	for _, t := range pending {
+		t, err := finishTransfer(ctx, s, stores(t.Counterparty), t)
+		if err != nil && err != ErrNoRecipient {
+			applog.FromContext(ctx).Warn("Failed to resume transfer", "id", t.ID, "error", err)
+			continue
+		}
+		if t.State != TransferPending {
+			finished = append(finished, t)
+		}
+	}
+	return finished, nil
+}
@@ -0,0 +1,118 @@
+package transdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"common/models"
+	"transaction_service/clock"
+)
+
+// flakyDB fails to begin transactions while down.
+type flakyDB struct {
+	*MemoryDB
+	down bool
+}
+
+func (db *flakyDB) Begin(ctx context.Context) (Tx, error) {
+	if db.down {
+		return nil, errors.New("database unavailable")
+	}
+	return db.MemoryDB.Begin(ctx)
+}
+
+func TestTransferAcrossDatabases(t *testing.T) {
+	ctx := context.Background()
+	from := NewMemoryDB(nopLogger{}, clock.Real)
+	to := &flakyDB{MemoryDB: NewMemoryDB(nopLogger{}, clock.Real)}
+	alice := addUser(t, ctx, from, 1000)
+	bob := addUser(t, ctx, to, 0)
+	stores := func(username string) TransactionDataStore {
+		if username == bob {
+			return to
+		}
+		return from
+	}
+
+	sent, err := TransferMoney(ctx, from, to, 100, alice, bob, 300, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.State != TransferCompleted {
+		t.Errorf("transfer = %+v, want completed", sent)
+	}
+	assertBalance(t, ctx, from, alice, 700)
+	assertBalance(t, ctx, to, bob, 300)
+
+	// the recipient's database fails after the sender is debited
+	to.down = true
+	pending, err := TransferMoney(ctx, from, to, 200, alice, bob, 200, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.State != TransferPending {
+		t.Errorf("transfer = %+v, want pending", pending)
+	}
+	assertBalance(t, ctx, from, alice, 500)
+	assertBalance(t, ctx, to, bob, 300)
+
+	if finished, err := ResumeTransfers(ctx, from, stores, 200); err != nil || len(finished) != 0 {
+		t.Errorf("ResumeTransfers while down = %+v, %v", finished, err)
+	}
+	to.down = false
+	if finished, err := ResumeTransfers(ctx, from, stores, 100); err != nil || len(finished) != 0 {
+		t.Errorf("ResumeTransfers before it is due = %+v, %v", finished, err)
+	}
+	finished, err := ResumeTransfers(ctx, from, stores, 200)
+	if err != nil || len(finished) != 1 || finished[0].State != TransferCompleted {
+		t.Errorf("ResumeTransfers = %+v, %v", finished, err)
+	}
+	assertBalance(t, ctx, to, bob, 500)
+
+	// crediting twice gives the recipient the money once
+	if _, err := finishTransfer(ctx, from, to, pending); err != nil {
+		t.Fatal(err)
+	}
+	assertBalance(t, ctx, to, bob, 500)
+
+	// a recipient removed before they are credited is refunded
+	transfers, err := from.QueryUserTransfers(ctx, alice, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transfers[0].State != TransferCompleted {
+		t.Errorf("sender's transfer = %+v, want completed", transfers[0])
+	}
+	gone := pending
+	gone.ID, gone.Ref, gone.Counterparty, gone.State = 0, "gone", "nobody", TransferPending
+	if gone.ID, err = from.AddTransfer(ctx, nil, gone); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.UpdateUserMoney(ctx, nil, alice, gone.Amount, models.BUY, "3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := finishTransfer(ctx, from, to, gone); err != ErrNoRecipient {
+		t.Errorf("transfer to a removed user err = %v, want ErrNoRecipient", err)
+	}
+	assertBalance(t, ctx, from, alice, 500)
+	if pending, err := from.QueryPendingTransfers(ctx, 1000); err != nil || len(pending) != 0 {
+		t.Errorf("pending transfers = %+v, %v", pending, err)
+	}
+
+	// as is one whose account starts closing before they are credited
+	to.down = true
+	if pending, err = TransferMoney(ctx, from, to, 300, alice, bob, 100, "4"); err != nil || pending.State != TransferPending {
+		t.Fatalf("transfer = %+v, %v, want pending", pending, err)
+	}
+	to.down = false
+	if err := to.SetUserStatus(ctx, nil, bob, UserClosing); err != nil {
+		t.Fatal(err)
+	}
+	finished, err = ResumeTransfers(ctx, from, stores, 300)
+	if err != nil || len(finished) != 1 || finished[0].State != TransferReversed {
+		t.Errorf("ResumeTransfers to a closing account = %+v, %v", finished, err)
+	}
+	assertBalance(t, ctx, from, alice, 500)
+	assertBalance(t, ctx, to, bob, 500)
+}
@@ -0,0 +1,54 @@
+package transdb
+
+import (
+	"context"
+
+	"github.com/jackc/pgx"
+)
+
+// ErrNoRows is returned when a query expected a row but found none.
+var ErrNoRows = pgx.ErrNoRows
+
+// Tx is a transaction started with Begin. Methods taking a Tx run inside it
+// when it is non-nil, and on their own otherwise.
+type Tx interface {
+	Commit(ctx context.Context) error
+	Rollback(ctx context.Context) error
+}
+
+type pgTx struct {
+	tx *pgx.Tx
+}
+
+func (t *pgTx) Commit(ctx context.Context) error {
+	return t.tx.CommitEx(ctx)
+}
+
+// Rollback ignores ctx, a transaction must still be rolled back after the
+// request deadline has passed.
+func (t *pgTx) Rollback(ctx context.Context) error {
+	return t.tx.Rollback()
+}
+
+// querier is implemented by both *pgx.ConnPool and *pgx.Tx.
+type querier interface {
+	ExecEx(ctx context.Context, sql string, options *pgx.QueryExOptions, arguments ...interface{}) (pgx.CommandTag, error)
+	QueryEx(ctx context.Context, sql string, options *pgx.QueryExOptions, args ...interface{}) (*pgx.Rows, error)
+	QueryRowEx(ctx context.Context, sql string, options *pgx.QueryExOptions, args ...interface{}) *pgx.Row
+}
+
+// q returns the querier for tx, or the pool when tx is nil.
+func (tdb *TransactionDB) q(tx Tx) querier {
+	if tx == nil {
+		return tdb.DB
+	}
+	return tx.(*pgTx).tx
+}
+
+func (tdb *TransactionDB) Begin(ctx context.Context) (Tx, error) {
+	tx, err := tdb.DB.BeginEx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &pgTx{tx: tx}, nil
+}
@@ -0,0 +1,224 @@
+package transdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"common/models"
+	"transaction_service/queries/utils"
+)
+
+// UserStatus is where a user's account is in its lifecycle. Only active
+// users can trade; suspended users can't move money either, while closed
+// users can still withdraw what is left in their account. An account is
+// closing while CloseAccount cancels and sells what it holds.
+type UserStatus string
+
+const (
+	UserActive    UserStatus = "active"
+	UserSuspended UserStatus = "suspended"
+	UserClosing   UserStatus = "closing"
+	UserClosed    UserStatus = "closed"
+)
+
+var (
+	ErrUserSuspended = errors.New("account is suspended")
+	ErrUserClosing   = errors.New("account is closing")
+	ErrUserClosed    = errors.New("account is closed")
+	ErrOpenPositions = errors.New("account still holds shares, triggers or orders")
+	ErrFundsLeft     = errors.New("account still holds money or pending transfers")
+)
+
+// ParseUserStatus parses the name of a status.
+func ParseUserStatus(str string) (UserStatus, error) {
+	switch st := UserStatus(str); st {
+	case UserActive, UserSuspended, UserClosing, UserClosed:
+		return st, nil
+	}
+	return "", fmt.Errorf("invalid user status %q", str)
+}
+
+// Err returns why a user with the status can't trade, or nil.
+func (st UserStatus) Err() error {
+	switch st {
+	case UserSuspended:
+		return ErrUserSuspended
+	case UserClosing:
+		return ErrUserClosing
+	case UserClosed:
+		return ErrUserClosed
+	}
+	return nil
+}
+
+// Account is a user with the status of their account.
+type Account struct {
+	models.User
+	Status UserStatus `json:"status"`
+}
+
+// canTrade returns the user's status error, or nil when they are active.
+func canTrade(ctx context.Context, s TransactionDataStore, tx Tx, username string) error {
+	st, err := s.QueryUserStatus(ctx, tx, username)
+	if err != nil {
+		return err
+	}
+	return st.Err()
+}
+
+// inactive reports whether err is the status error of a user who can't
+// trade, rather than a failure to look them up.
+func inactive(err error) bool {
+	return err == ErrUserSuspended || err == ErrUserClosing || err == ErrUserClosed
+}
+
+// CheckEmpty returns ErrFundsLeft if the user has money in any currency,
+// or a transfer still pending, which deleting them would lose.
+func CheckEmpty(ctx context.Context, s TransactionDataStore, username string) error {
+	user, err := s.QueryUser(ctx, username)
+	if err != nil {
+		return err
+	}
+	if user.Money != 0 {
+		return ErrFundsLeft
+	}
+	balances, err := s.QueryUserBalances(ctx, username)
+	if err != nil {
+		return err
+	}
+	for _, amount := range balances {
+		if amount != 0 {
+			return ErrFundsLeft
+		}
+	}
+	transfers, err := s.QueryUserTransfers(ctx, username, 0)
+	if err != nil {
+		return err
+	}
+	for _, t := range transfers {
+		if t.State == TransferPending {
+			return ErrFundsLeft
+		}
+	}
+	return nil
+}
+
+// CloseAccount closes the user's account. Unless liquidate is set the user
+// must hold no shares and have no open triggers or orders; with it they are
+// cancelled and every share is sold at the current quote. Reservations and
+// schedules are removed either way, and the cash stays to be withdrawn.
+//
+// The account is marked closing first, so the user can't trade and their
+// triggers, orders and schedules don't run while it is emptied. Each step
+// only acts on what is left, so a close that fails part way stays closing
+// and is finished by calling CloseAccount again.
+func CloseAccount(ctx context.Context, s TransactionDataStore, username string, liquidate bool, quotes dbutils.QuoteProvider, trans string) (err error) {
+	st, err := s.QueryUserStatus(ctx, nil, username)
+	if err != nil {
+		return
+	}
+	if st == UserClosed {
+		return ErrUserClosed
+	}
+
+	if st != UserClosing {
+		if err = s.SetUserStatus(ctx, nil, username, UserClosing); err != nil {
+			return
+		}
+	}
+	err = emptyAccount(ctx, s, username, liquidate, quotes, trans)
+	if err == ErrOpenPositions && st != UserClosing {
+		// nothing was changed, so the account goes back to how it was
+		if rerr := s.SetUserStatus(ctx, nil, username, st); rerr != nil {
+			return rerr
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	return s.SetUserStatus(ctx, nil, username, UserClosed)
+}
+
+// emptyAccount cancels the user's triggers and orders, removes their
+// reservations and schedules and, with liquidate, sells their shares.
+// Without liquidate it fails with ErrOpenPositions before changing anything
+// unless they have no shares, triggers or orders.
+func emptyAccount(ctx context.Context, s TransactionDataStore, username string, liquidate bool, quotes dbutils.QuoteProvider, trans string) (err error) {
+	triggers, err := s.QueryAllUserTriggers(ctx, username)
+	if err != nil {
+		return
+	}
+	orders, err := s.QueryUserOrders(ctx, username, true)
+	if err != nil {
+		return
+	}
+	stocks, err := s.QueryAllUserStocks(ctx, username)
+	if err != nil {
+		return
+	}
+	if !liquidate {
+		if len(triggers) > 0 || len(orders) > 0 {
+			return ErrOpenPositions
+		}
+		for _, stock := range stocks {
+			if stock.Shares > 0 {
+				return ErrOpenPositions
+			}
+		}
+	}
+
+	for _, trig := range triggers {
+		if _, err = s.CancelOrderTransaction(ctx, trig, trans); err != nil {
+			return
+		}
+	}
+	for _, o := range orders {
+		if _, err = s.CloseOrderTransaction(ctx, o, OrderCancelled, trans); err != nil && err != ErrOrderClosed {
+			return
+		}
+	}
+
+	reservations, err := s.QueryAllUserReservations(ctx, username)
+	if err != nil {
+		return
+	}
+	for _, res := range reservations {
+		if err = s.RemoveReservation(ctx, nil, res.ID); err != nil {
+			return
+		}
+	}
+	schedules, err := s.QueryUserSchedules(ctx, username)
+	if err != nil {
+		return
+	}
+	for _, sch := range schedules {
+		if err = s.RemoveSchedule(ctx, nil, sch.ID); err != nil {
+			return
+		}
+	}
+
+	// shares held by the cancelled triggers and orders are back in stocks
+	if stocks, err = s.QueryAllUserStocks(ctx, username); err != nil {
+		return
+	}
+	quotes = BaseQuotes(s, quotes)
+	for _, stock := range stocks {
+		if stock.Shares <= 0 {
+			continue
+		}
+		var quote int
+		if quote, err = quotes.QueryQuotePrice(ctx, username, stock.Symbol, trans); err != nil {
+			return
+		}
+		var res models.Reservation
+		if res, err = s.ReserveOrder(ctx, username, stock.Symbol, models.SELL, Quantity{All: true}, quote); err != nil {
+			return
+		}
+		if err = s.CommitBuySellTransaction(ctx, res, trans); err != nil {
+			return
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package dbutils
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"transaction_service/clock"
+
+	"github.com/go-redis/redis"
+)
+
+// BenchmarkQueryQuotePriceCacheHit measures serving a cached quote, from
+// memory and, when REDIS_TEST_ADDR is set, from Redis.
+func BenchmarkQueryQuotePriceCacheHit(b *testing.B) {
+	caches := map[string]func(b *testing.B) QuoteCache{
+		"memory": func(b *testing.B) QuoteCache {
+			return NewMemoryQuoteCache(clock.Real, QuoteTTL)
+		},
+		"redis": func(b *testing.B) QuoteCache {
+			addr := os.Getenv("REDIS_TEST_ADDR")
+			if addr == "" {
+				b.Skip("REDIS_TEST_ADDR not set")
+			}
+			client := redis.NewClient(&redis.Options{Addr: addr})
+			b.Cleanup(func() { client.Close() })
+			return &RedisQuoteCache{Client: client}
+		},
+	}
+
+	for _, name := range []string{"memory", "redis"} {
+		b.Run(name, func(b *testing.B) {
+			ctx := context.Background()
+			cache := caches[name](b)
+			if err := cache.Set(ctx, "ABC", "1234"); err != nil {
+				b.Fatal(err)
+			}
+			p := &CachedQuoteProvider{Cache: cache, Logger: nopLogger{}}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := p.QueryQuotePrice(ctx, "alice", "ABC", "1"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
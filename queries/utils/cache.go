@@ -0,0 +1,102 @@
+package dbutils
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"transaction_service/clock"
+	"transaction_service/tracing"
+
+	"github.com/go-redis/redis"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// QuoteTTL is how long a quote is served from the cache before the quote
+// server is asked again.
+const QuoteTTL = 50 * time.Second
+
+// QuoteCache holds recently fetched quotes, keyed by symbol.
+type QuoteCache interface {
+	// Get returns the cached price of symbol, and false if there is none
+	// or it has expired.
+	Get(ctx context.Context, symbol string) (value string, ok bool, err error)
+	Set(ctx context.Context, symbol string, value string) error
+}
+
+// RedisQuoteCache shares quotes between replicas through Redis, which
+// expires them itself.
+type RedisQuoteCache struct {
+	Client *redis.Client
+}
+
+func redisSpan(ctx context.Context, op string, key string) (context.Context, trace.Span) {
+	return tracing.StartKind(ctx, op, trace.SpanKindClient,
+		attribute.String("db.system", "redis"), attribute.String("db.redis.key", key))
+}
+
+func (c *RedisQuoteCache) Get(ctx context.Context, symbol string) (value string, ok bool, err error) {
+	ctx, span := redisSpan(ctx, "redis.GET", symbol)
+	defer tracing.End(span, &err)
+
+	value, err = c.Client.WithContext(ctx).Get(symbol).Result()
+	if err == redis.Nil {
+		// a miss is expected, don't mark the span as failed
+		span.SetAttributes(attribute.Bool("cache.hit", false))
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	span.SetAttributes(attribute.Bool("cache.hit", true))
+	return value, true, nil
+}
+
+func (c *RedisQuoteCache) Set(ctx context.Context, symbol string, value string) (err error) {
+	ctx, span := redisSpan(ctx, "redis.SET", symbol)
+	defer tracing.End(span, &err)
+
+	_, err = c.Client.WithContext(ctx).Set(symbol, value, QuoteTTL).Result()
+	return
+}
+
+type cachedQuote struct {
+	value   string
+	expires time.Time
+}
+
+// MemoryQuoteCache keeps quotes in process and expires them by its clock,
+// for tests and single-process runs.
+type MemoryQuoteCache struct {
+	mu     sync.Mutex
+	clock  clock.Clock
+	ttl    time.Duration
+	quotes map[string]cachedQuote
+}
+
+func NewMemoryQuoteCache(clk clock.Clock, ttl time.Duration) *MemoryQuoteCache {
+	return &MemoryQuoteCache{clock: clk, ttl: ttl, quotes: make(map[string]cachedQuote)}
+}
+
+func (c *MemoryQuoteCache) Get(ctx context.Context, symbol string) (string, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	q, ok := c.quotes[symbol]
+	if !ok {
+		return "", false, nil
+	}
+	if !c.clock.Now().Before(q.expires) {
+		delete(c.quotes, symbol)
+		return "", false, nil
+	}
+	return q.value, true, nil
+}
+
+func (c *MemoryQuoteCache) Set(ctx context.Context, symbol string, value string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.quotes[symbol] = cachedQuote{value: value, expires: c.clock.Now().Add(c.ttl)}
+	return nil
+}
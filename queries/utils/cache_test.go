@@ -0,0 +1,70 @@
+package dbutils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"common/logging"
+	"common/models"
+	"transaction_service/clock"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) LogCommand(command logging.Command, vars map[string]string)                   {}
+func (nopLogger) LogErrorEvent(command logging.Command, vars map[string]string, msg string)    {}
+func (nopLogger) LogTransaction(action string, username string, money int, trans string)       {}
+func (nopLogger) LogQuoteServ(quote *models.StockQuote, trans string)                          {}
+func (nopLogger) LogSystemEvent(command logging.Command, username, stock, funds, trans string) {}
+func (nopLogger) SendDumpLog(filename string, username string)                                 {}
+
+func TestMemoryQuoteCacheTTL(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewFake(time.Unix(1500000000, 0))
+	cache := NewMemoryQuoteCache(clk, QuoteTTL)
+
+	if _, ok, _ := cache.Get(ctx, "ABC"); ok {
+		t.Fatal("hit on an empty cache")
+	}
+	cache.Set(ctx, "ABC", "1234")
+
+	clk.Advance(QuoteTTL - time.Second)
+	if value, ok, _ := cache.Get(ctx, "ABC"); !ok || value != "1234" {
+		t.Errorf("Get before expiry = %q, %t", value, ok)
+	}
+
+	clk.Advance(time.Second)
+	if _, ok, _ := cache.Get(ctx, "ABC"); ok {
+		t.Error("quote still cached after its TTL")
+	}
+}
+
+func TestQueryQuotePriceCacheHit(t *testing.T) {
+	ctx := context.Background()
+	cache := NewMemoryQuoteCache(clock.NewFake(time.Unix(0, 0)), QuoteTTL)
+	cache.Set(ctx, "ABC", "1234")
+
+	p := &CachedQuoteProvider{Cache: cache, Logger: nopLogger{}}
+	quote, err := p.QueryQuotePrice(ctx, "alice", "ABC", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quote != 1234 {
+		t.Errorf("quote = %d, want 1234", quote)
+	}
+}
+
+func TestCachedQuote(t *testing.T) {
+	ctx := context.Background()
+	cache := NewMemoryQuoteCache(clock.NewFake(time.Unix(0, 0)), QuoteTTL)
+	cache.Set(ctx, "ABC", "1234")
+
+	p := &CachedQuoteProvider{Cache: cache, Logger: nopLogger{}}
+	if quote, ok, err := p.CachedQuote(ctx, "ABC"); err != nil || !ok || quote != 1234 {
+		t.Errorf("CachedQuote(ABC) = %d, %t, %v, want 1234, true, nil", quote, ok, err)
+	}
+	if _, ok, err := p.CachedQuote(ctx, "DEF"); err != nil || ok {
+		t.Errorf("CachedQuote(DEF) = %t, %v, want a miss", ok, err)
+	}
+}
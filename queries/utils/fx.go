@@ -0,0 +1,83 @@
+package dbutils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Rate is an exchange rate in millionths: how many millionths of a unit of
+// one currency a unit of another buys.
+type Rate int64
+
+// RateOne converts a currency to itself.
+const RateOne Rate = 1000000
+
+// Convert returns amount converted at the rate, rounded down.
+func (r Rate) Convert(amount int) int {
+	return int(int64(amount) * int64(r) / int64(RateOne))
+}
+
+// String returns the rate as a decimal.
+func (r Rate) String() string {
+	str := strconv.FormatInt(int64(r/RateOne), 10)
+	if frac := int64(r % RateOne); frac != 0 {
+		str += "." + strings.TrimRight(fmt.Sprintf("%06d", frac), "0")
+	}
+	return str
+}
+
+// RateProvider looks up the current rate from one currency to another.
+type RateProvider interface {
+	QueryRate(ctx context.Context, from string, to string) (Rate, error)
+}
+
+// StaticRates serves rates from a fixed table of what each currency is
+// worth in a common unit, such as a file loaded for offline use.
+type StaticRates map[string]Rate
+
+// LoadStaticRates reads a JSON object of currencies and their values in a
+// common unit, e.g. {"USD": 1, "EUR": 1.08, "JPY": 0.0067}.
+func LoadStaticRates(path string) (StaticRates, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]float64
+	if err = json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("reading rates from %s: %s", path, err)
+	}
+	rates := make(StaticRates, len(values))
+	for currency, value := range values {
+		// a value too small for a millionth would convert everything to 0
+		r := Rate(math.Round(value * float64(RateOne)))
+		if r <= 0 {
+			return nil, fmt.Errorf("invalid rate for %s in %s", currency, path)
+		}
+		rates[currency] = r
+	}
+	return rates, nil
+}
+
+func (sr StaticRates) QueryRate(ctx context.Context, from string, to string) (Rate, error) {
+	if from == to {
+		return RateOne, nil
+	}
+	vf, ok := sr[from]
+	if !ok {
+		return 0, fmt.Errorf("no exchange rate for %s", from)
+	}
+	vt, ok := sr[to]
+	if !ok {
+		return 0, fmt.Errorf("no exchange rate for %s", to)
+	}
+	r := vf * RateOne / vt
+	if r <= 0 {
+		return 0, fmt.Errorf("exchange rate from %s to %s is below a millionth", from, to)
+	}
+	return r, nil
+}
@@ -0,0 +1,83 @@
+package dbutils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRate(t *testing.T) {
+	tests := []struct {
+		rate   Rate
+		amount int
+		want   int
+		str    string
+	}{
+		{RateOne, 100, 100, "1"},
+		{1080000, 100, 108, "1.08"},
+		{925926, 100, 92, "0.925926"},
+		{150000000, 3, 450, "150"},
+	}
+	for _, tt := range tests {
+		if got := tt.rate.Convert(tt.amount); got != tt.want {
+			t.Errorf("Rate(%d).Convert(%d) = %d, want %d", tt.rate, tt.amount, got, tt.want)
+		}
+		if got := tt.rate.String(); got != tt.str {
+			t.Errorf("Rate(%d).String() = %q, want %q", tt.rate, got, tt.str)
+		}
+	}
+}
+
+func TestStaticRates(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "rates.json")
+	if err := os.WriteFile(path, []byte(`{"USD": 1, "EUR": 1.08, "GBP": 1.25}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rates, err := LoadStaticRates(path)
+	if err != nil {
+		t.Fatalf("LoadStaticRates: %s", err)
+	}
+
+	tests := []struct {
+		from, to string
+		want     Rate
+	}{
+		{"EUR", "USD", 1080000},
+		{"USD", "EUR", 925925},
+		{"GBP", "EUR", 1157407},
+		{"JPY", "JPY", RateOne},
+	}
+	for _, tt := range tests {
+		if got, err := rates.QueryRate(ctx, tt.from, tt.to); err != nil || got != tt.want {
+			t.Errorf("QueryRate(%s, %s) = %d, %v, want %d", tt.from, tt.to, got, err, tt.want)
+		}
+	}
+	if _, err := rates.QueryRate(ctx, "JPY", "USD"); err == nil {
+		t.Error("QueryRate of an unknown currency succeeded")
+	}
+
+	for _, data := range []string{`{"USD": 0}`, `{"USD": 1e-7}`, `["USD"]`} {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadStaticRates(path); err == nil {
+			t.Errorf("LoadStaticRates(%s) succeeded", data)
+		}
+	}
+}
+
+func TestStaticRatesTooSmall(t *testing.T) {
+	rates := StaticRates{"USD": RateOne, "XTS": 1}
+	if r, err := rates.QueryRate(context.Background(), "XTS", "USD"); err != nil || r != 1 {
+		t.Errorf("QueryRate(XTS, USD) = %d, %v, want 1", r, err)
+	}
+	if r, err := rates.QueryRate(context.Background(), "USD", "XTS"); err != nil || r != RateOne*RateOne {
+		t.Errorf("QueryRate(USD, XTS) = %d, %v", r, err)
+	}
+	rates["XTS"] = 2 * RateOne * RateOne
+	if r, err := rates.QueryRate(context.Background(), "USD", "XTS"); err == nil {
+		t.Errorf("QueryRate rounding to 0 = %d, want an error", r)
+	}
+}
@@ -2,10 +2,11 @@
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
@@ -15,52 +16,102 @@ import (
 
 	"common/logging"
 	"common/models"
+	"transaction_service/applog"
+	"transaction_service/clock"
+	"transaction_service/tracing"
 
-	"github.com/go-redis/redis"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func getUnixTimestamp() int64 {
-	return time.Now().UnixNano() / int64(time.Millisecond)
-}
-
-func queryRedisKey(cache *redis.Client, queryStruct *models.StockQuote) error {
-	key := fmt.Sprintf("%s", queryStruct.Symbol)
-	var err error
+// ErrTimeout is returned in place of the underlying error when a request's
+// deadline passes before a query or quote server call completes.
+var ErrTimeout = errors.New("Request timed out")
 
-	if queryStruct.Qtype == models.CacheGet {
-		val, err := cache.Get(key).Result()
-		if err == redis.Nil {
-			err = errors.New("Key does not exist")
-			return err
-		} else if err == nil {
-			queryStruct.Value = val
-		}
-	} else {
-		_, err = cache.Set(key, queryStruct.Value, time.Second*50).Result()
+// IsTimeout reports whether err was caused by an expired request deadline.
+func IsTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == ErrTimeout || err == context.DeadlineExceeded {
+		return true
 	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
 
+// checkTimeout swaps err for ErrTimeout if ctx has already expired.
+func checkTimeout(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return ErrTimeout
+	}
 	return err
 }
 
-func QueryQuoteHTTP(cache *redis.Client, username string, stock string) (queryString string, err error) {
+func getUnixTimestamp(clk clock.Clock) int64 {
+	return clk.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func QueryQuoteHTTP(ctx context.Context, username string, stock string) (queryString string, err error) {
 	port := os.Getenv("QUOTE_SERVER_PORT")
 	host := os.Getenv("QUOTE_SERVER_HOST")
 	url := fmt.Sprintf("http://%s:%s", host, port)
-	res, err := http.Get(url + "/api/getQuote/" + username + "/" + stock)
+
+	ctx, span := tracing.StartKind(ctx, "dbutils.QueryQuoteHTTP", trace.SpanKindClient,
+		attribute.String("http.url", url), attribute.String("quoteserver.symbol", stock))
+	defer tracing.End(span, &err)
+
+	req, err := http.NewRequest(http.MethodGet, url+"/api/getQuote/"+username+"/"+stock, nil)
 	if err != nil {
 		return
 	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		err = checkTimeout(ctx, err)
+		return
+	}
+	defer res.Body.Close()
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
+		err = checkTimeout(ctx, err)
 		return
 	}
 
 	queryString = string(body)
-	log.Println(queryString)
+	applog.FromContext(ctx).Debug("Quote server response", "body", queryString)
 	return
 }
 
-func QueryQuoteTCP(cache *redis.Client, username string, stock string) (string, error) {
+// deadline returns the earlier of now+timeout and the deadline on ctx.
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	d := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(d) {
+		return ctxDeadline
+	}
+	return d
+}
+
+// queryQuoteServerOnce makes a single request to the quote server, reading
+// the response into respBuf.
+func queryQuoteServerOnce(ctx context.Context, dialer *net.Dialer, addr string, msg string, respBuf []byte, timeout time.Duration) error {
+	quoteServerConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer quoteServerConn.Close()
+
+	quoteServerConn.SetWriteDeadline(deadline(ctx, dialer.Timeout))
+	quoteServerConn.Write([]byte(msg))
+
+	quoteServerConn.SetReadDeadline(deadline(ctx, timeout))
+	_, err = quoteServerConn.Read(respBuf)
+	return err
+}
+
+func QueryQuoteTCP(ctx context.Context, username string, stock string) (string, error) {
 
 	port := os.Getenv("QUOTE_SERVER_PORT")
 	host := os.Getenv("QUOTE_SERVER_HOST")
@@ -74,35 +125,48 @@ func QueryQuoteTCP(cache *redis.Client, username string, stock string) (string,
 	respBuf := make([]byte, 2048)
 	attempts := 1
 
-	for {
-		quoteServerConn, err := net.DialTimeout("tcp", addr, readTimeoutBase)
-		if err != nil {
-			return "", err
-		}
+	ctx, span := tracing.StartKind(ctx, "dbutils.QueryQuoteTCP", trace.SpanKindClient,
+		attribute.String("quoteserver.addr", addr), attribute.String("quoteserver.symbol", stock))
+	defer func() {
+		span.SetAttributes(attribute.Int("quoteserver.attempts", attempts))
+		tracing.End(span, &err)
+	}()
 
-		quoteServerConn.SetWriteDeadline(time.Now().Add(readTimeoutBase))
-		quoteServerConn.Write([]byte(msg))
+	dialer := net.Dialer{Timeout: readTimeoutBase}
 
+	for {
 		timeout := readTimeoutBase + backoff
-		quoteServerConn.SetReadDeadline(time.Now().Add(timeout))
 
-		_, err = quoteServerConn.Read(respBuf)
-		quoteServerConn.Close()
+		attemptCtx, attemptSpan := tracing.StartKind(ctx, "quoteserver.attempt", trace.SpanKindClient,
+			attribute.Int("quoteserver.attempt", attempts),
+			attribute.Int64("quoteserver.backoff_ms", backoff.Milliseconds()),
+			attribute.Int64("quoteserver.timeout_ms", timeout.Milliseconds()))
+		err = queryQuoteServerOnce(attemptCtx, &dialer, addr, msg, respBuf, timeout)
+		tracing.End(attemptSpan, &err)
 
 		if err == nil {
 			break
 		}
 
+		// the request deadline passed, retrying won't help
+		if ctx.Err() != nil {
+			err = checkTimeout(ctx, ctx.Err())
+			return "", err
+		}
+
 		if attempts > maxAttempts {
-			return "Quoteserver max attempts reached.", errors.New("Quoteserver max attempts for response")
+			err = errors.New("Quoteserver max attempts for response")
+			return "Quoteserver max attempts reached.", err
 		}
 
 		// check for a timeout
 		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 			// backoff linearly and try again for a quote
-			log.Println("Attempt %d timeout. Waiting for %d ms", attempts, timeout)
+			applog.FromContext(ctx).Warn("Quote server attempt timed out",
+				"attempt", attempts, "timeout_ms", timeout.Milliseconds())
 		} else {
-			return "Failed to read from quoteserver", errors.New("Failed to read from quoteserve")
+			err = errors.New("Failed to read from quoteserve")
+			return "Failed to read from quoteserver", err
 		}
 		attempts++
 	}
@@ -114,26 +178,63 @@ func QueryQuoteTCP(cache *redis.Client, username string, stock string) (string,
 	return queryString, err
 }
 
-func QueryQuotePrice(cache *redis.Client, logger logging.Logger, username string, symbol string, trans string) (quote int, err error) {
+// QuoteProvider looks up the current price of a symbol in cents.
+type QuoteProvider interface {
+	QueryQuotePrice(ctx context.Context, username string, symbol string, trans string) (int, error)
+}
+
+// CachedQuoteProvider serves quotes from Cache, falling back to the quote
+// server on a miss.
+type CachedQuoteProvider struct {
+	Cache  QuoteCache
+	Logger logging.Logger
+}
+
+func (p *CachedQuoteProvider) QueryQuotePrice(ctx context.Context, username string, symbol string, trans string) (int, error) {
+	return QueryQuotePrice(ctx, p.Cache, p.Logger, username, symbol, trans)
+}
+
+// CachedQuoter is implemented by quote providers that can report a cached
+// quote without querying the quote server.
+type CachedQuoter interface {
+	CachedQuote(ctx context.Context, symbol string) (quote int, ok bool, err error)
+}
+
+// CachedQuote returns the cached quote for symbol, if there is one.
+func (p *CachedQuoteProvider) CachedQuote(ctx context.Context, symbol string) (quote int, ok bool, err error) {
+	value, ok, err := p.Cache.Get(ctx, symbol)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	quote, err = strconv.Atoi(value)
+	return quote, err == nil, err
+}
+
+func QueryQuotePrice(ctx context.Context, cache QuoteCache, logger logging.Logger, username string, symbol string, trans string) (quote int, err error) {
 	var body string
 
+	ctx, span := tracing.Start(ctx, "dbutils.QueryQuotePrice", attribute.String("quoteserver.symbol", symbol))
+	defer tracing.End(span, &err)
+
 	queryStruct := &models.StockQuote{Username: username, Symbol: symbol, Qtype: models.CacheGet, CrytpoKey: "", QuoteTimestamp: ""}
-	err = queryRedisKey(cache, queryStruct)
+	value, hit, err := cache.Get(ctx, symbol)
+	if err != nil {
+		applog.FromContext(ctx).Warn("Failed to read quote cache", "symbol", symbol, "error", err)
+	}
 
-	if err == nil {
-		// cache hit
-		quote, err = strconv.Atoi(queryStruct.Value)
-		fmt.Println("Cache hit!")
+	if hit {
+		span.SetAttributes(attribute.Bool("cache.hit", true))
+		quote, err = strconv.Atoi(value)
+		applog.FromContext(ctx).Debug("Quote cache hit", "symbol", symbol, "value", value)
 		return
 	}
 
+	span.SetAttributes(attribute.Bool("cache.hit", false))
 	prod, _ := os.LookupEnv("PROD")
 	if prod == "true" {
-		body, err = QueryQuoteTCP(cache, username, symbol)
+		body, err = QueryQuoteTCP(ctx, username, symbol)
 	} else {
-		body, err = QueryQuoteHTTP(cache, username, symbol)
-		fmt.Println("Printing body")
-		fmt.Printf(body)
+		body, err = QueryQuoteHTTP(ctx, username, symbol)
 	}
 	if err != nil {
 		return
@@ -149,15 +250,16 @@ func QueryQuotePrice(cache *redis.Client, logger logging.Logger, username string
 	// set cache
 	queryStruct.Qtype = models.CacheSet
 	queryStruct.Value = priceStr
-	err = queryRedisKey(cache, queryStruct)
-	if err != nil {
-		log.Println(err.Error())
+	if cacheErr := cache.Set(ctx, symbol, priceStr); cacheErr != nil {
+		applog.FromContext(ctx).Warn("Failed to cache quote", "symbol", symbol, "error", cacheErr)
 	}
 
 	queryStruct.QuoteTimestamp = split[3]
 	queryStruct.CrytpoKey = split[4]
 
 	logger.LogQuoteServ(queryStruct, trans)
-	fmt.Println(queryStruct)
+	applog.FromContext(ctx).Debug("Quote server hit",
+		slog.String("symbol", symbol), slog.String("price", priceStr),
+		slog.String("quote_timestamp", queryStruct.QuoteTimestamp), slog.String("cryptokey", queryStruct.CrytpoKey))
 	return
 }
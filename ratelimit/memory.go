@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"transaction_service/clock"
+)
+
+// sweepInterval is how often idle buckets are dropped.
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// full is when the bucket will have refilled to its burst
+	full time.Time
+}
+
+// MemoryLimiter keeps buckets in process. Limits are per replica. Buckets
+// which have refilled are dropped once every sweepInterval, since a new
+// bucket starts full anyway, so idle users and IPs don't accumulate.
+type MemoryLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	clock     clock.Clock
+	lastSweep time.Time
+}
+
+func NewMemoryLimiter(clk clock.Clock) *MemoryLimiter {
+	return &MemoryLimiter{buckets: make(map[string]*bucket), clock: clk, lastSweep: clk.Now()}
+}
+
+func (ml *MemoryLimiter) Allow(ctx context.Context, key string, l Limit) (ok bool, wait time.Duration, err error) {
+	if l.Unlimited() {
+		return true, 0, nil
+	}
+
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	now := ml.clock.Now()
+	if now.Sub(ml.lastSweep) >= sweepInterval {
+		ml.sweep(now)
+	}
+
+	b, exists := ml.buckets[key]
+	if !exists {
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		ml.buckets[key] = b
+	}
+
+	elapsed := now.Sub(b.last).Seconds()
+	b.tokens = math.Min(float64(l.Burst), b.tokens+elapsed*l.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		b.full = now.Add(refillTime(float64(l.Burst)-b.tokens, l))
+		return false, retryAfter(b.tokens, l), nil
+	}
+	b.tokens--
+	b.full = now.Add(refillTime(float64(l.Burst)-b.tokens, l))
+	return true, 0, nil
+}
+
+// sweep drops the buckets which are full by now. ml.mu must be held.
+func (ml *MemoryLimiter) sweep(now time.Time) {
+	for key, b := range ml.buckets {
+		if !now.Before(b.full) {
+			delete(ml.buckets, key)
+		}
+	}
+	ml.lastSweep = now
+}
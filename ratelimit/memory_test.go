@@ -0,0 +1,115 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"transaction_service/clock"
+)
+
+func TestMemoryLimiter(t *testing.T) {
+	ctx := context.Background()
+	limit := Limit{Rate: 2, Burst: 3}
+
+	type call struct {
+		advance time.Duration
+		key     string
+		ok      bool
+		wait    time.Duration
+	}
+	tests := []struct {
+		name  string
+		calls []call
+	}{
+		{"burst", []call{
+			{0, "alice", true, 0},
+			{0, "alice", true, 0},
+			{0, "alice", true, 0},
+			{0, "alice", false, 500 * time.Millisecond},
+		}},
+		{"refill", []call{
+			{0, "alice", true, 0},
+			{0, "alice", true, 0},
+			{0, "alice", true, 0},
+			{250 * time.Millisecond, "alice", false, 250 * time.Millisecond},
+			{250 * time.Millisecond, "alice", true, 0},
+			{0, "alice", false, 500 * time.Millisecond},
+			// refills only up to the burst
+			{time.Hour, "alice", true, 0},
+			{0, "alice", true, 0},
+			{0, "alice", true, 0},
+			{0, "alice", false, 500 * time.Millisecond},
+		}},
+		{"per key", []call{
+			{0, "alice", true, 0},
+			{0, "alice", true, 0},
+			{0, "alice", true, 0},
+			{0, "alice", false, 500 * time.Millisecond},
+			{0, "bob", true, 0},
+			{0, "bob", true, 0},
+			{0, "bob", true, 0},
+			{0, "bob", false, 500 * time.Millisecond},
+		}},
+	}
+	for _, tt := range tests {
+		clk := clock.NewFake(time.Unix(1500000000, 0))
+		ml := NewMemoryLimiter(clk)
+		for i, c := range tt.calls {
+			clk.Advance(c.advance)
+			ok, wait, err := ml.Allow(ctx, c.key, limit)
+			if err != nil || ok != c.ok || wait != c.wait {
+				t.Errorf("%s: call %d for %s = %t, %s, %v, want %t, %s", tt.name, i, c.key, ok, wait, err, c.ok, c.wait)
+			}
+		}
+	}
+}
+
+func TestMemoryLimiterUnlimited(t *testing.T) {
+	ml := NewMemoryLimiter(clock.NewFake(time.Unix(1500000000, 0)))
+	for i := 0; i < 100; i++ {
+		if ok, _, err := ml.Allow(context.Background(), "alice", Limit{}); !ok || err != nil {
+			t.Fatalf("Allow with no limit = %t, %v", ok, err)
+		}
+	}
+	if len(ml.buckets) != 0 {
+		t.Errorf("%d buckets kept for no limit", len(ml.buckets))
+	}
+}
+
+func TestMemoryLimiterSweep(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewFake(time.Unix(1500000000, 0))
+	ml := NewMemoryLimiter(clk)
+	slow := Limit{Rate: 0.01, Burst: 2}
+	fast := Limit{Rate: 10, Burst: 2}
+
+	ml.Allow(ctx, "idle", fast)
+	ml.Allow(ctx, "slow", slow)
+	ml.Allow(ctx, "slow", slow)
+	if len(ml.buckets) != 2 {
+		t.Fatalf("%d buckets, want 2", len(ml.buckets))
+	}
+
+	// idle has refilled but slow needs 200s to, and the bucket being used
+	// is kept
+	clk.Advance(sweepInterval)
+	ml.Allow(ctx, "busy", fast)
+	if _, ok := ml.buckets["idle"]; ok {
+		t.Error("full bucket kept after a sweep")
+	}
+	if len(ml.buckets) != 2 {
+		t.Errorf("%d buckets after a sweep, want slow and busy", len(ml.buckets))
+	}
+
+	// slow is still empty after it's recreated
+	if ok, _, _ := ml.Allow(ctx, "slow", slow); ok {
+		t.Error("swept a bucket which hadn't refilled")
+	}
+
+	clk.Advance(200 * time.Second)
+	ml.Allow(ctx, "busy", fast)
+	if _, ok := ml.buckets["slow"]; ok {
+		t.Error("refilled bucket kept after a sweep")
+	}
+}
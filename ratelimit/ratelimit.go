@@ -0,0 +1,102 @@
+// Package ratelimit implements token bucket rate limiting for API commands,
+// either in process or shared between replicas through Redis.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Class groups commands which share a limit.
+type Class string
+
+const (
+	Quote Class = "quote"
+	Order Class = "order"
+	Admin Class = "admin"
+)
+
+var Classes = []Class{Quote, Order, Admin}
+
+// Limit is a token bucket refilling at Rate tokens per second up to Burst.
+// The zero Limit is unlimited.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0 || l.Burst <= 0
+}
+
+// ClassLimits are the per user and global limits for a Class.
+type ClassLimits struct {
+	PerUser Limit
+	Global  Limit
+}
+
+// Limiter takes a token from the bucket named key, reporting how long the
+// caller should wait before retrying when the bucket is empty.
+type Limiter interface {
+	Allow(ctx context.Context, key string, l Limit) (ok bool, retryAfter time.Duration, err error)
+}
+
+// ParseLimit parses "rate:burst", e.g. "5:10" for five requests per second
+// with bursts of up to ten.
+func ParseLimit(s string) (l Limit, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return l, fmt.Errorf("invalid limit %s, expected rate:burst", s)
+	}
+	l.Rate, err = strconv.ParseFloat(parts[0], 64)
+	if err != nil || l.Rate < 0 {
+		return l, fmt.Errorf("invalid rate in limit %s", s)
+	}
+	l.Burst, err = strconv.Atoi(parts[1])
+	if err != nil || l.Burst < 0 {
+		return l, fmt.Errorf("invalid burst in limit %s", s)
+	}
+	return l, nil
+}
+
+// LimitsFromEnv reads RATE_LIMIT_<CLASS>_USER and RATE_LIMIT_<CLASS>_GLOBAL
+// for every class. Unset limits are unlimited.
+func LimitsFromEnv() (map[Class]ClassLimits, error) {
+	limits := make(map[Class]ClassLimits)
+	for _, class := range Classes {
+		var cl ClassLimits
+		prefix := "RATE_LIMIT_" + strings.ToUpper(string(class))
+		if v, ok := os.LookupEnv(prefix + "_USER"); ok {
+			l, err := ParseLimit(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s_USER: %s", prefix, err)
+			}
+			cl.PerUser = l
+		}
+		if v, ok := os.LookupEnv(prefix + "_GLOBAL"); ok {
+			l, err := ParseLimit(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s_GLOBAL: %s", prefix, err)
+			}
+			cl.Global = l
+		}
+		limits[class] = cl
+	}
+	return limits, nil
+}
+
+// retryAfter returns how long until a bucket with tokens available refills
+// to one whole token.
+func retryAfter(tokens float64, l Limit) time.Duration {
+	return refillTime(1-tokens, l)
+}
+
+// refillTime returns how long a bucket takes to gain tokens.
+func refillTime(tokens float64, l Limit) time.Duration {
+	return time.Duration(math.Ceil(tokens / l.Rate * float64(time.Second)))
+}
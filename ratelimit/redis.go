@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// tokenBucketScript refills and takes from the bucket at KEYS[1] atomically.
+// ARGV is rate, burst and the current time in milliseconds. It returns
+// {allowed, retry after in milliseconds}.
+const tokenBucketScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens = tonumber(state[1]) or burst
+local last = tonumber(state[2]) or now
+
+tokens = math.min(burst, tokens + math.max(0, now - last) / 1000 * rate)
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "last", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, wait}
+`
+
+// RedisLimiter keeps buckets in Redis so limits hold across replicas.
+type RedisLimiter struct {
+	client *redis.Client
+	prefix string
+}
+
+func NewRedisLimiter(client *redis.Client) *RedisLimiter {
+	return &RedisLimiter{client: client, prefix: "ratelimit:"}
+}
+
+func (rl *RedisLimiter) Allow(ctx context.Context, key string, l Limit) (ok bool, wait time.Duration, err error) {
+	if l.Unlimited() {
+		return true, 0, nil
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	res, err := rl.client.WithContext(ctx).Eval(tokenBucketScript, []string{rl.prefix + key},
+		strconv.FormatFloat(l.Rate, 'f', -1, 64), l.Burst, now).Result()
+	if err != nil {
+		return false, 0, err
+	}
+
+	vals, isSlice := res.([]interface{})
+	if !isSlice || len(vals) != 2 {
+		return false, 0, errors.New("Unexpected rate limit script result")
+	}
+	allowed, _ := vals[0].(int64)
+	waitMs, _ := vals[1].(int64)
+	return allowed == 1, time.Duration(waitMs) * time.Millisecond, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+	"transaction_service/workload"
+)
+
+// runReplay implements the replay subcommand, returning the exit code:
+//
+//	transaction_service replay [-url URL] [-workers N] [-api-key KEY] [-json] FILE
+//
+// Without -url the commands run in process against the databases configured
+// for the server, with authentication and rate limiting off.
+func runReplay(log *slog.Logger, args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	baseURL := fs.String("url", "", "base URL of a running service, e.g. http://localhost:8888 (default: run in process)")
+	workers := fs.Int("workers", 50, "maximum number of commands in flight")
+	apiKey := fs.String("api-key", os.Getenv("REPLAY_API_KEY"), "API key sent as X-API-Key with -url")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: transaction_service replay [flags] FILE")
+		fs.PrintDefaults()
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Error("Failed to open workload file", "error", err)
+		return 1
+	}
+	cmds, err := workload.Parse(f)
+	f.Close()
+	if err != nil {
+		log.Error("Failed to parse workload file", "file", fs.Arg(0), "error", err)
+		return 1
+	}
+
+	var d workload.Dispatcher
+	if *baseURL != "" {
+		d = newHTTPDispatcher(*baseURL, *apiKey, *workers)
+	} else {
+		env, err := newEnv(log)
+		if err != nil {
+			log.Error("Failed to configure service", "error", err)
+			return 1
+		}
+		d = &workload.HandlerDispatcher{Handler: env.newRouter()}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	log.Info("Replaying workload", "file", fs.Arg(0), "commands", len(cmds), "workers", *workers, "url", *baseURL)
+	report := workload.Replay(ctx, cmds, d, *workers)
+	printReport(report, *asJSON)
+
+	if ctx.Err() != nil {
+		log.Warn("Replay interrupted", "completed", report.Commands, "total", len(cmds))
+		return 1
+	}
+	return 0
+}
+
+func newHTTPDispatcher(baseURL string, apiKey string, workers int) *workload.HTTPDispatcher {
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{MaxIdleConnsPerHost: workers},
+	}
+	return &workload.HTTPDispatcher{Client: client, BaseURL: baseURL, APIKey: apiKey}
+}
+
+// printReport writes report to stdout, as JSON for comparing runs
+// mechanically or as a table otherwise.
+func printReport(report *workload.Report, asJSON bool) {
+	if !asJSON {
+		report.Print(os.Stdout)
+		return
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report.Summary())
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const defaultScheduleInterval = time.Minute
+
+// runDueSchedules runs the schedules due on every database.
+func (env *Env) runDueSchedules(ctx context.Context) {
+	for _, tdb := range env.databases {
+		runs, err := tdb.QueryAndRunDueSchedules(ctx, env.quotes, scheduleTrans)
+		if err != nil {
+			env.log.Error("Failed to run schedules", "error", err)
+			continue
+		}
+		for _, run := range runs {
+			env.log.Info("Ran schedule", "sid", run.SID, "username", run.Username, "symbol", run.Symbol, "status", run.Status, "reason", run.Reason, "shares", run.Shares)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+// Package sequencer runs commands for the same user one at a time, in
+// transaction number order, while commands for different users run in
+// parallel.
+//
+// Users are spread over a fixed number of shards by a hash of their name.
+// Each shard has one worker and a bounded queue ordered by transaction
+// number. A command waits in the queue for a short hold period so an
+// earlier command for the same user that arrives slightly later still runs
+// first.
+package sequencer
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"transaction_service/clock"
+)
+
+var (
+	// ErrClosed is returned by Submit after Close.
+	ErrClosed = errors.New("sequencer closed")
+	// ErrPanicked is returned by Submit when the command panicked.
+	ErrPanicked = errors.New("command panicked")
+)
+
+// Options configures a Sequencer.
+type Options struct {
+	// Shards is the number of workers, and so the number of users whose
+	// commands can run at once.
+	Shards int
+	// QueueSize bounds the commands queued or running on one shard. Submit
+	// blocks while the shard is full.
+	QueueSize int
+	// Hold is how long a command waits for earlier commands to arrive.
+	Hold time.Duration
+}
+
+type job struct {
+	trans int
+	seq   uint64
+	ready time.Time
+	fn    func()
+	done  chan struct{}
+
+	// guarded by the shard's mu
+	started   bool
+	cancelled bool
+
+	// set before done is closed
+	panicked bool
+}
+
+// jobHeap orders jobs by transaction number, then arrival.
+type jobHeap []*job
+
+func (h jobHeap) Len() int { return len(h) }
+func (h jobHeap) Less(i, j int) bool {
+	if h[i].trans != h[j].trans {
+		return h[i].trans < h[j].trans
+	}
+	return h[i].seq < h[j].seq
+}
+func (h jobHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *jobHeap) Push(x interface{}) { *h = append(*h, x.(*job)) }
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	j := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return j
+}
+
+type shard struct {
+	mu     sync.Mutex
+	jobs   jobHeap
+	seq    uint64
+	closed bool
+	// slots holds a token for every queued or running job
+	slots chan struct{}
+	wake  chan struct{}
+}
+
+type Sequencer struct {
+	opts   Options
+	clock  clock.Clock
+	shards []*shard
+	wg     sync.WaitGroup
+}
+
+// New starts the shard workers. Call Close to stop them.
+func New(opts Options, clk clock.Clock) *Sequencer {
+	if opts.Shards < 1 {
+		opts.Shards = 1
+	}
+	if opts.QueueSize < 1 {
+		opts.QueueSize = 1
+	}
+
+	s := &Sequencer{opts: opts, clock: clk}
+	for i := 0; i < opts.Shards; i++ {
+		sh := &shard{slots: make(chan struct{}, opts.QueueSize), wake: make(chan struct{}, 1)}
+		s.shards = append(s.shards, sh)
+		s.wg.Add(1)
+		go s.work(sh)
+	}
+	return s
+}
+
+func (s *Sequencer) shardFor(key string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return s.shards[int(h.Sum32()%uint32(len(s.shards)))]
+}
+
+func (sh *shard) signal() {
+	select {
+	case sh.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Submit queues fn behind the other commands for key and waits for it to
+// run. If ctx ends before fn starts, fn is dropped and ctx's error is
+// returned; once fn has started Submit always waits for it to finish, and
+// returns ErrPanicked if it panics.
+func (s *Sequencer) Submit(ctx context.Context, key string, trans int, fn func()) error {
+	sh := s.shardFor(key)
+
+	select {
+	case sh.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	j := &job{trans: trans, ready: s.clock.Now().Add(s.opts.Hold), fn: fn, done: make(chan struct{})}
+	sh.mu.Lock()
+	if sh.closed {
+		sh.mu.Unlock()
+		<-sh.slots
+		return ErrClosed
+	}
+	sh.seq++
+	j.seq = sh.seq
+	heap.Push(&sh.jobs, j)
+	sh.mu.Unlock()
+	sh.signal()
+
+	select {
+	case <-j.done:
+		return j.err()
+	case <-ctx.Done():
+	}
+
+	sh.mu.Lock()
+	if !j.started {
+		j.cancelled = true
+		sh.mu.Unlock()
+		return ctx.Err()
+	}
+	sh.mu.Unlock()
+	<-j.done
+	return j.err()
+}
+
+func (j *job) err() error {
+	if j.panicked {
+		return ErrPanicked
+	}
+	return nil
+}
+
+func (s *Sequencer) work(sh *shard) {
+	defer s.wg.Done()
+	for {
+		var next *job
+		var wait <-chan time.Time
+
+		sh.mu.Lock()
+		if len(sh.jobs) == 0 && sh.closed {
+			sh.mu.Unlock()
+			return
+		}
+		if len(sh.jobs) > 0 {
+			head := sh.jobs[0]
+			if d := head.ready.Sub(s.clock.Now()); d <= 0 || sh.closed {
+				next = heap.Pop(&sh.jobs).(*job)
+				if next.cancelled {
+					sh.mu.Unlock()
+					<-sh.slots
+					continue
+				}
+				next.started = true
+			} else {
+				wait = s.clock.After(d)
+			}
+		}
+		sh.mu.Unlock()
+
+		if next == nil {
+			select {
+			case <-sh.wake:
+			case <-wait:
+			}
+			continue
+		}
+
+		sh.run(next)
+	}
+}
+
+// run runs j and frees its slot. A panic in j is logged rather than
+// taking down the worker, and the Submit waiting for j returns ErrPanicked.
+func (sh *shard) run(j *job) {
+	defer func() {
+		if p := recover(); p != nil {
+			slog.Error("Command panicked", "panic", p, "stack", string(debug.Stack()))
+			j.panicked = true
+		}
+		close(j.done)
+		<-sh.slots
+	}()
+	j.fn()
+}
+
+// Queued returns the number of commands waiting to start.
+func (s *Sequencer) Queued() (n int) {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		n += len(sh.jobs)
+		sh.mu.Unlock()
+	}
+	return
+}
+
+// Close runs the commands already queued, without waiting for their hold
+// period, then stops the workers. Later Submits fail with ErrClosed.
+func (s *Sequencer) Close() {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		sh.closed = true
+		sh.mu.Unlock()
+		sh.signal()
+	}
+	s.wg.Wait()
+}
@@ -0,0 +1,154 @@
+package sequencer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"transaction_service/clock"
+)
+
+// waitQueued waits until n commands are queued on s.
+func waitQueued(t *testing.T, s *Sequencer, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for s.Queued() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d commands queued, want %d", s.Queued(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTransOrder(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	s := New(Options{Shards: 4, QueueSize: 10, Hold: 10 * time.Millisecond}, clk)
+	defer s.Close()
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	submit := func(trans int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.Submit(context.Background(), "alice", trans, func() {
+				mu.Lock()
+				order = append(order, trans)
+				mu.Unlock()
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	// the commit arrives before the buy it depends on
+	submit(3)
+	waitQueued(t, s, 1)
+	submit(2)
+	waitQueued(t, s, 2)
+
+	clk.Advance(10 * time.Millisecond)
+	wg.Wait()
+	if len(order) != 2 || order[0] != 2 || order[1] != 3 {
+		t.Errorf("ran %v, want [2 3]", order)
+	}
+}
+
+func TestSerializesUser(t *testing.T) {
+	s := New(Options{Shards: 4, QueueSize: 100}, clock.Real)
+	defer s.Close()
+
+	var mu sync.Mutex
+	running := make(map[string]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		for _, user := range []string{"alice", "bob"} {
+			wg.Add(1)
+			go func(user string, trans int) {
+				defer wg.Done()
+				s.Submit(context.Background(), user, trans, func() {
+					mu.Lock()
+					running[user]++
+					if running[user] > 1 {
+						t.Errorf("%d commands for %s running at once", running[user], user)
+					}
+					mu.Unlock()
+					time.Sleep(100 * time.Microsecond)
+					mu.Lock()
+					running[user]--
+					mu.Unlock()
+				})
+			}(user, i)
+		}
+	}
+	wg.Wait()
+}
+
+func TestBackpressure(t *testing.T) {
+	s := New(Options{Shards: 1, QueueSize: 1}, clock.Real)
+	defer s.Close()
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go s.Submit(context.Background(), "alice", 1, func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	ran := false
+	err := s.Submit(ctx, "bob", 2, func() { ran = true })
+	if err != context.DeadlineExceeded {
+		t.Errorf("Submit on a full shard err = %v, want DeadlineExceeded", err)
+	}
+	close(release)
+	if ran {
+		t.Error("rejected command ran")
+	}
+}
+
+func TestCancelBeforeStart(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	s := New(Options{Shards: 1, QueueSize: 10, Hold: time.Hour}, clk)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	ran := false
+	go func() {
+		errc <- s.Submit(ctx, "alice", 1, func() { ran = true })
+	}()
+	waitQueued(t, s, 1)
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("Submit err = %v, want Canceled", err)
+	}
+
+	s.Close()
+	if ran {
+		t.Error("cancelled command ran")
+	}
+	if err := s.Submit(context.Background(), "alice", 2, func() {}); err != ErrClosed {
+		t.Errorf("Submit after Close err = %v, want ErrClosed", err)
+	}
+}
+
+func TestPanic(t *testing.T) {
+	s := New(Options{Shards: 1, QueueSize: 1}, clock.Real)
+	defer s.Close()
+
+	if err := s.Submit(context.Background(), "alice", 1, func() { panic("boom") }); err != ErrPanicked {
+		t.Errorf("Submit of a panicking command err = %v, want ErrPanicked", err)
+	}
+	// the worker and the only slot are still there for the next commands
+	for trans := 2; trans < 4; trans++ {
+		ran := false
+		if err := s.Submit(context.Background(), "alice", trans, func() { ran = true }); err != nil || !ran {
+			t.Errorf("Submit after a panic = %v, ran %t", err, ran)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"transaction_service/queries/transdb"
+)
+
+// transferRetryAfter is how long a transfer between databases may stay
+// pending before it is retried, long enough for one that is still in
+// flight to finish first.
+const transferRetryAfter = time.Minute
+
+// resumeTransfers finishes the transfers that have been pending for longer
+// than transferRetryAfter on every database.
+func (env *Env) resumeTransfers(ctx context.Context) {
+	before := env.clock.Now().Add(-transferRetryAfter).Unix()
+	for _, tdb := range env.databases {
+		transfers, err := transdb.ResumeTransfers(ctx, tdb, env.userDatabase, before)
+		if err != nil {
+			env.log.Error("Failed to resume transfers", "error", err)
+			continue
+		}
+		for _, t := range transfers {
+			env.log.Info("Resumed transfer", "id", t.ID, "username", t.Username, "recipient", t.Counterparty, "amount", t.Amount, "state", t.State)
+		}
+	}
+}
+
+// userDatabase returns the database holding username.
+func (env *Env) userDatabase(username string) transdb.TransactionDataStore {
+	return env.databases[hash(username)%len(env.databases)]
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const defaultTriggerInterval = 10 * time.Second
+
+// executeCurrentTriggers executes the triggers and open orders whose
+// prices have been reached, and expires DAY orders past their end, on every
+// database. What it executes is recorded as executions, so only failures
+// are logged.
+func (env *Env) executeCurrentTriggers(ctx context.Context) {
+	for _, tdb := range env.databases {
+		if _, err := tdb.QueryAndExecuteCurrentTriggers(ctx, env.quotes, triggerTrans); err != nil {
+			env.log.Error("Failed to execute triggers", "error", err)
+		}
+	}
+}
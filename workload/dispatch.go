@@ -0,0 +1,58 @@
+package workload
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+// Dispatcher sends a single API request, returning the HTTP status. err is
+// only set when no response was received.
+type Dispatcher interface {
+	Do(ctx context.Context, path string) (status int, err error)
+}
+
+// HTTPDispatcher sends requests to a running service.
+type HTTPDispatcher struct {
+	Client  *http.Client
+	BaseURL string
+	// APIKey, if set, is sent as X-API-Key.
+	APIKey string
+}
+
+func (d *HTTPDispatcher) Do(ctx context.Context, path string) (int, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(d.BaseURL, "/")+"/api/"+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	if d.APIKey != "" {
+		req.Header.Set("X-API-Key", d.APIKey)
+	}
+
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	return res.StatusCode, nil
+}
+
+// HandlerDispatcher calls a handler in process, skipping the network.
+type HandlerDispatcher struct {
+	Handler http.Handler
+}
+
+func (d *HandlerDispatcher) Do(ctx context.Context, path string) (int, error) {
+	req := httptest.NewRequest(http.MethodGet, "/api/"+path, nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	d.Handler.ServeHTTP(rec, req)
+	return rec.Code, nil
+}
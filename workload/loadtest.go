@@ -0,0 +1,71 @@
+package workload
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// symbols are the stocks synthetic sessions trade.
+var symbols = []string{"ABC", "DEF", "GHI", "JKL", "MNO", "PQR", "STU", "VWX"}
+
+// GenerateOptions shapes a synthetic workload.
+type GenerateOptions struct {
+	Users           int
+	SessionsPerUser int
+	// Prefix is prepended to every username so runs don't share users.
+	Prefix string
+	Seed   int64
+}
+
+// Generate synthesizes a workload of user sessions: each user is funded,
+// then repeatedly quotes, buys and commits, sells or cancels, and sets and
+// cancels a buy trigger, ending with a summary. The same options always
+// produce the same commands, so runs can be compared.
+func Generate(opts GenerateOptions) (cmds []Command) {
+	rng := rand.New(rand.NewSource(opts.Seed))
+	trans := 0
+	add := func(name string, args ...string) {
+		trans++
+		cmds = append(cmds, Command{Line: trans, Trans: trans, Name: name, Args: args})
+	}
+	dollars := func(min, max int) string {
+		return fmt.Sprintf("%d.%02d", min+rng.Intn(max-min+1), rng.Intn(100))
+	}
+
+	users := make([]string, opts.Users)
+	for i := range users {
+		users[i] = fmt.Sprintf("%s%d", opts.Prefix, i)
+		add("ADD", users[i], dollars(50000, 100000))
+	}
+
+	// interleave sessions so every user is active throughout the run
+	for s := 0; s < opts.SessionsPerUser; s++ {
+		for _, u := range users {
+			symbol := symbols[rng.Intn(len(symbols))]
+			for q := rng.Intn(3); q >= 0; q-- {
+				add("QUOTE", u, symbols[rng.Intn(len(symbols))])
+			}
+
+			add("BUY", u, symbol, dollars(100, 1000))
+			add("COMMIT_BUY", u)
+
+			add("SELL", u, symbol, dollars(10, 100))
+			if rng.Intn(2) == 0 {
+				add("COMMIT_SELL", u)
+			} else {
+				add("CANCEL_SELL", u)
+			}
+
+			add("SET_BUY_AMOUNT", u, symbol, dollars(100, 500))
+			add("SET_BUY_TRIGGER", u, symbol, dollars(1, 10))
+			if rng.Intn(4) != 0 {
+				add("CANCEL_SET_BUY", u, symbol)
+			}
+		}
+	}
+
+	for _, u := range users {
+		add("DISPLAY_SUMMARY", u)
+	}
+	return
+}
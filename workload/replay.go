@@ -0,0 +1,215 @@
+package workload
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Report summarises a replay.
+type Report struct {
+	Commands int
+	Errors   int
+	Duration time.Duration
+	// Latencies holds every command's latency in ascending order.
+	Latencies       []time.Duration
+	ErrorsByCommand map[string]int
+	Statuses        map[int]int
+}
+
+// Throughput is the number of commands completed per second.
+func (r *Report) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Commands) / r.Duration.Seconds()
+}
+
+// Percentile returns the latency below which p percent of commands finished.
+func (r *Report) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.Latencies))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(r.Latencies) {
+		i = len(r.Latencies) - 1
+	}
+	return r.Latencies[i]
+}
+
+// Summary is a report reduced to the numbers worth comparing between runs.
+type Summary struct {
+	Commands        int            `json:"commands"`
+	Errors          int            `json:"errors"`
+	DurationMs      float64        `json:"duration_ms"`
+	Throughput      float64        `json:"throughput"`
+	P50Ms           float64        `json:"p50_ms"`
+	P90Ms           float64        `json:"p90_ms"`
+	P99Ms           float64        `json:"p99_ms"`
+	MaxMs           float64        `json:"max_ms"`
+	ErrorsByCommand map[string]int `json:"errors_by_command,omitempty"`
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (r *Report) Summary() Summary {
+	return Summary{
+		Commands:        r.Commands,
+		Errors:          r.Errors,
+		DurationMs:      ms(r.Duration),
+		Throughput:      r.Throughput(),
+		P50Ms:           ms(r.Percentile(50)),
+		P90Ms:           ms(r.Percentile(90)),
+		P99Ms:           ms(r.Percentile(99)),
+		MaxMs:           ms(r.Percentile(100)),
+		ErrorsByCommand: r.ErrorsByCommand,
+	}
+}
+
+// Print writes the report in a human readable form.
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "commands    %d\n", r.Commands)
+	fmt.Fprintf(w, "errors      %d\n", r.Errors)
+	fmt.Fprintf(w, "duration    %s\n", r.Duration.Round(time.Millisecond))
+	fmt.Fprintf(w, "throughput  %.1f commands/s\n", r.Throughput())
+	fmt.Fprintf(w, "latency     p50 %s  p90 %s  p99 %s  max %s\n",
+		r.Percentile(50), r.Percentile(90), r.Percentile(99), r.Percentile(100))
+
+	if len(r.Statuses) > 0 {
+		fmt.Fprintln(w, "statuses")
+		var codes []int
+		for code := range r.Statuses {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			fmt.Fprintf(w, "  %d  %d\n", code, r.Statuses[code])
+		}
+	}
+
+	if len(r.ErrorsByCommand) > 0 {
+		fmt.Fprintln(w, "errors by command")
+		var names []string
+		for name := range r.ErrorsByCommand {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "  %-16s  %d\n", name, r.ErrorsByCommand[name])
+		}
+	}
+}
+
+// recorder collects results from concurrent workers.
+type recorder struct {
+	mu     sync.Mutex
+	report Report
+}
+
+func newRecorder() *recorder {
+	return &recorder{report: Report{ErrorsByCommand: make(map[string]int), Statuses: make(map[int]int)}}
+}
+
+// record counts a command as failed when err is set or the status isn't 2xx.
+func (rec *recorder) record(name string, status int, err error, latency time.Duration) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	r := &rec.report
+	r.Commands++
+	r.Latencies = append(r.Latencies, latency)
+	if status != 0 {
+		r.Statuses[status]++
+	}
+	if err != nil || status < 200 || status > 299 {
+		r.Errors++
+		r.ErrorsByCommand[name]++
+	}
+}
+
+func (rec *recorder) finish(duration time.Duration) *Report {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	r := rec.report
+	r.Duration = duration
+	sort.Slice(r.Latencies, func(i, j int) bool { return r.Latencies[i] < r.Latencies[j] })
+	return &r
+}
+
+func run(ctx context.Context, d Dispatcher, rec *recorder, c Command) {
+	path, err := c.Path()
+	if err != nil {
+		rec.record(c.Name, 0, err, 0)
+		return
+	}
+	start := time.Now()
+	status, err := d.Do(ctx, path)
+	rec.record(c.Name, status, err, time.Since(start))
+}
+
+// Replay sends cmds through d. Each user's commands run one at a time in
+// file order, while up to workers commands for different users run at once.
+// Commands that aren't for a single user, like the all-users DUMPLOG, wait
+// for everything before them and hold back everything after them.
+func Replay(ctx context.Context, cmds []Command, d Dispatcher, workers int) *Report {
+	if workers < 1 {
+		workers = 1
+	}
+	rec := newRecorder()
+	start := time.Now()
+
+	for len(cmds) > 0 && ctx.Err() == nil {
+		// replay up to the next command that isn't for a single user
+		n := 0
+		for n < len(cmds) && cmds[n].Username() != "" {
+			n++
+		}
+		replayUsers(ctx, cmds[:n], d, rec, workers)
+
+		if n < len(cmds) && ctx.Err() == nil {
+			run(ctx, d, rec, cmds[n])
+			n++
+		}
+		cmds = cmds[n:]
+	}
+
+	return rec.finish(time.Since(start))
+}
+
+func replayUsers(ctx context.Context, cmds []Command, d Dispatcher, rec *recorder, workers int) {
+	var users []string
+	byUser := make(map[string][]Command)
+	for _, c := range cmds {
+		u := c.Username()
+		if _, ok := byUser[u]; !ok {
+			users = append(users, u)
+		}
+		byUser[u] = append(byUser[u], c)
+	}
+
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for _, u := range users {
+		wg.Add(1)
+		go func(userCmds []Command) {
+			defer wg.Done()
+			for _, c := range userCmds {
+				if ctx.Err() != nil {
+					return
+				}
+				sem <- struct{}{}
+				run(ctx, d, rec, c)
+				<-sem
+			}
+		}(byUser[u])
+	}
+	wg.Wait()
+}
@@ -0,0 +1,173 @@
+// Package workload parses the standard workload files used to drive the
+// trading system and replays them against the transaction service.
+package workload
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Command is one line of a workload file, e.g. "[1] ADD,user,1000.00".
+type Command struct {
+	Line  int
+	Trans int
+	Name  string
+	Args  []string
+}
+
+// argCounts is the number of comma separated arguments each command takes.
+var argCounts = map[string][]int{
+	"ADD":              {2},
+	"QUOTE":            {2},
+	"BUY":              {3},
+	"COMMIT_BUY":       {1},
+	"CANCEL_BUY":       {1},
+	"SELL":             {3},
+	"COMMIT_SELL":      {1},
+	"CANCEL_SELL":      {1},
+	"SET_BUY_AMOUNT":   {3},
+	"CANCEL_SET_BUY":   {2},
+	"SET_BUY_TRIGGER":  {3},
+	"SET_SELL_AMOUNT":  {3},
+	"SET_SELL_TRIGGER": {3},
+	"CANCEL_SET_SELL":  {2},
+	"DUMPLOG":          {1, 2},
+	"DISPLAY_SUMMARY":  {1},
+}
+
+// ParseLine parses a single workload line. lineNo is only used in errors.
+func ParseLine(lineNo int, line string) (c Command, err error) {
+	c.Line = lineNo
+	line = strings.TrimSpace(line)
+
+	if !strings.HasPrefix(line, "[") {
+		return c, fmt.Errorf("line %d: missing [trans] prefix", lineNo)
+	}
+	end := strings.Index(line, "]")
+	if end < 0 {
+		return c, fmt.Errorf("line %d: unterminated [trans] prefix", lineNo)
+	}
+	c.Trans, err = strconv.Atoi(strings.TrimSpace(line[1:end]))
+	if err != nil {
+		return c, fmt.Errorf("line %d: invalid transaction number: %s", lineNo, err)
+	}
+
+	fields := strings.Split(strings.TrimSpace(line[end+1:]), ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	c.Name = strings.ToUpper(fields[0])
+	c.Args = fields[1:]
+
+	counts, ok := argCounts[c.Name]
+	if !ok {
+		return c, fmt.Errorf("line %d: unknown command %s", lineNo, c.Name)
+	}
+	for _, n := range counts {
+		if len(c.Args) == n {
+			return c, nil
+		}
+	}
+	return c, fmt.Errorf("line %d: %s takes %v arguments, got %d", lineNo, c.Name, counts, len(c.Args))
+}
+
+// Parse reads every command in a workload file, skipping blank lines.
+func Parse(r io.Reader) (cmds []Command, err error) {
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		c, err := ParseLine(lineNo, scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, c)
+	}
+	return cmds, scanner.Err()
+}
+
+// Username returns the user the command acts on, or "" for the all-users
+// DUMPLOG.
+func (c Command) Username() string {
+	if c.Name == "DUMPLOG" && len(c.Args) == 1 {
+		return ""
+	}
+	return c.Args[0]
+}
+
+// cents converts a dollar amount like "1000.5" to the integer cents the API
+// takes.
+func cents(dollars string) (string, error) {
+	f, err := strconv.ParseFloat(dollars, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid amount %s", dollars)
+	}
+	return strconv.FormatInt(int64(math.Round(f*100)), 10), nil
+}
+
+// Path returns the API path, relative to /api/, that runs the command.
+func (c Command) Path() (string, error) {
+	trans := strconv.Itoa(c.Trans)
+	a := c.Args
+
+	var segments []string
+	switch c.Name {
+	case "ADD":
+		money, err := cents(a[1])
+		if err != nil {
+			return "", err
+		}
+		segments = []string{"add", a[0], money}
+	case "QUOTE":
+		segments = []string{"getQuote", a[0], a[1]}
+	case "BUY", "SELL", "SET_BUY_AMOUNT", "SET_SELL_AMOUNT", "SET_BUY_TRIGGER", "SET_SELL_TRIGGER":
+		amount, err := cents(a[2])
+		if err != nil {
+			return "", err
+		}
+		segments = []string{routes[c.Name], a[0], a[1], amount}
+	case "COMMIT_BUY", "CANCEL_BUY", "COMMIT_SELL", "CANCEL_SELL", "DISPLAY_SUMMARY":
+		segments = []string{routes[c.Name], a[0]}
+	case "CANCEL_SET_BUY", "CANCEL_SET_SELL":
+		segments = []string{routes[c.Name], a[0], a[1]}
+	case "DUMPLOG":
+		// the route takes the file name as a single path segment
+		if len(a) == 1 {
+			segments = []string{"dumplog", path.Base(a[0])}
+		} else {
+			segments = []string{"dumplog", path.Base(a[1]), a[0]}
+		}
+	default:
+		return "", fmt.Errorf("unknown command %s", c.Name)
+	}
+
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(append(segments, trans), "/"), nil
+}
+
+var routes = map[string]string{
+	"BUY":              "buy",
+	"SELL":             "sell",
+	"COMMIT_BUY":       "commitBuy",
+	"CANCEL_BUY":       "cancelBuy",
+	"COMMIT_SELL":      "commitSell",
+	"CANCEL_SELL":      "cancelSell",
+	"SET_BUY_AMOUNT":   "setBuyAmount",
+	"SET_BUY_TRIGGER":  "setBuyTrigger",
+	"CANCEL_SET_BUY":   "cancelSetBuy",
+	"SET_SELL_AMOUNT":  "setSellAmount",
+	"SET_SELL_TRIGGER": "setSellTrigger",
+	"CANCEL_SET_SELL":  "cancelSetSell",
+	"DISPLAY_SUMMARY":  "displaySummary",
+}
@@ -0,0 +1,185 @@
+package workload
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const sample = `[1] ADD,alice,1000.50
+[2] QUOTE,alice,ABC
+[3] BUY,alice,ABC,250.00
+
+[4] COMMIT_BUY,alice
+[5] ADD,bob,20
+[6] SET_SELL_TRIGGER,alice,ABC,12.5
+[7] CANCEL_SET_SELL,alice,ABC
+[8] DUMPLOG,bob,./bob.log
+[9] DUMPLOG,./testLOG
+[10] DISPLAY_SUMMARY,bob
+`
+
+func TestParse(t *testing.T) {
+	cmds, err := Parse(strings.NewReader(sample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds) != 10 {
+		t.Fatalf("parsed %d commands, want 10", len(cmds))
+	}
+
+	want := []string{
+		"add/alice/100050/1",
+		"getQuote/alice/ABC/2",
+		"buy/alice/ABC/25000/3",
+		"commitBuy/alice/4",
+		"add/bob/2000/5",
+		"setSellTrigger/alice/ABC/1250/6",
+		"cancelSetSell/alice/ABC/7",
+		"dumplog/bob.log/bob/8",
+		"dumplog/testLOG/9",
+		"displaySummary/bob/10",
+	}
+	for i, c := range cmds {
+		path, err := c.Path()
+		if err != nil {
+			t.Errorf("%+v: %s", c, err)
+			continue
+		}
+		if path != want[i] {
+			t.Errorf("line %d path = %s, want %s", c.Line, path, want[i])
+		}
+	}
+	if cmds[8].Username() != "" || cmds[7].Username() != "bob" {
+		t.Errorf("DUMPLOG usernames = %q, %q", cmds[8].Username(), cmds[7].Username())
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, line := range []string{
+		"ADD,alice,10",
+		"[x] ADD,alice,10",
+		"[1] FROB,alice",
+		"[1] BUY,alice,ABC",
+		"[1",
+	} {
+		if _, err := ParseLine(1, line); err == nil {
+			t.Errorf("ParseLine(%q) succeeded", line)
+		}
+	}
+
+	c, _ := ParseLine(1, "[1] ADD,alice,lots")
+	if _, err := c.Path(); err == nil {
+		t.Error("Path accepted a non-numeric amount")
+	}
+}
+
+// recordingDispatcher records the order paths were dispatched in.
+type recordingDispatcher struct {
+	mu       sync.Mutex
+	paths    []string
+	inFlight int
+	maxSeen  int
+}
+
+func (d *recordingDispatcher) Do(ctx context.Context, path string) (int, error) {
+	d.mu.Lock()
+	d.paths = append(d.paths, path)
+	d.inFlight++
+	if d.inFlight > d.maxSeen {
+		d.maxSeen = d.inFlight
+	}
+	d.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	d.mu.Lock()
+	d.inFlight--
+	d.mu.Unlock()
+	if strings.HasPrefix(path, "commitBuy") {
+		return 500, nil
+	}
+	return 200, nil
+}
+
+func TestReplay(t *testing.T) {
+	var lines []string
+	trans := 1
+	for round := 0; round < 5; round++ {
+		for _, u := range []string{"a", "b", "c", "d"} {
+			lines = append(lines, fmt.Sprintf("[%d] QUOTE,%s,ABC", trans, u))
+			trans++
+		}
+	}
+	lines = append(lines, fmt.Sprintf("[%d] DUMPLOG,all.log", trans))
+	lines = append(lines, fmt.Sprintf("[%d] COMMIT_BUY,a", trans+1))
+	cmds, err := Parse(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &recordingDispatcher{}
+	report := Replay(context.Background(), cmds, d, 2)
+
+	if report.Commands != len(cmds) {
+		t.Errorf("Commands = %d, want %d", report.Commands, len(cmds))
+	}
+	if report.Errors != 1 || report.ErrorsByCommand["COMMIT_BUY"] != 1 {
+		t.Errorf("Errors = %d, by command %v", report.Errors, report.ErrorsByCommand)
+	}
+	if d.maxSeen > 2 {
+		t.Errorf("%d commands in flight, want at most 2", d.maxSeen)
+	}
+
+	// each user's commands keep their order, and the DUMPLOG is a barrier
+	last := make(map[string]int)
+	for i, path := range d.paths {
+		parts := strings.Split(path, "/")
+		if parts[0] == "dumplog" {
+			if i != len(d.paths)-2 {
+				t.Errorf("dumplog ran at %d, want %d", i, len(d.paths)-2)
+			}
+			continue
+		}
+		user := parts[1]
+		n, _ := strconv.Atoi(parts[len(parts)-1])
+		if n < last[user] {
+			t.Errorf("%s ran trans %d after %d", user, n, last[user])
+		}
+		last[user] = n
+	}
+
+	if p := report.Percentile(50); p <= 0 || p > report.Percentile(100) {
+		t.Errorf("p50 = %s, max = %s", p, report.Percentile(100))
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	opts := GenerateOptions{Users: 3, SessionsPerUser: 2, Prefix: "load_", Seed: 7}
+	cmds := Generate(opts)
+	again := Generate(opts)
+	if fmt.Sprint(cmds) != fmt.Sprint(again) {
+		t.Error("Generate isn't deterministic for a seed")
+	}
+
+	names := make(map[string]int)
+	for i, c := range cmds {
+		if c.Trans != i+1 {
+			t.Errorf("command %d has trans %d", i, c.Trans)
+		}
+		if _, err := c.Path(); err != nil {
+			t.Errorf("%+v: %s", c, err)
+		}
+		if !strings.HasPrefix(c.Username(), "load_") {
+			t.Errorf("%+v has an unprefixed username", c)
+		}
+		names[c.Name]++
+	}
+	if names["ADD"] != 3 || names["DISPLAY_SUMMARY"] != 3 || names["BUY"] != 6 {
+		t.Errorf("command counts = %v", names)
+	}
+}